@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"StarstreamAstra/internal/agent"
+	"StarstreamAstra/internal/config"
+	"StarstreamAstra/internal/firewall"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/nat"
+)
+
+func main() {
+	configPath := "configs/agent.yaml"
+	if p := os.Getenv("AGENT_CONFIG"); p != "" {
+		configPath = p
+	}
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	var zapLogger *zap.Logger
+	if cfg.Logger.UseZap {
+		zapLogger, err = config.NewZapLogger(&cfg.Logger)
+		if err != nil {
+			log.Fatalf("Failed to create zap logger: %v", err)
+		}
+		defer func() { _ = zapLogger.Sync() }()
+	}
+	logf := log.Printf
+	fatalf := log.Fatalf
+	if zapLogger != nil {
+		logf = zapLogger.Sugar().Infof
+		fatalf = zapLogger.Sugar().Fatalf
+	}
+
+	tlsConfig, err := agent.ServerTLSConfig(cfg.Agent.TLS)
+	if err != nil {
+		fatalf("Failed to load TLS config: %v", err)
+	}
+	if cfg.Agent.Token == "" && (tlsConfig == nil || tlsConfig.ClientCAs == nil) {
+		fatalf("agent.token is empty and mTLS is not configured; refusing to start unauthenticated")
+	}
+
+	hv, err := hypervisor.New(cfg.Hypervisor)
+	if err != nil {
+		fatalf("Failed to init hypervisor: %v", err)
+	}
+
+	r := gin.New()
+	r.Use(gin.Recovery())
+	if zapLogger == nil {
+		r.Use(gin.Logger())
+	}
+	agent.RegisterRoutes(r, hv, cfg.Agent.Token)
+	var fw agent.NATApplier
+	if cfg.Agent.NATBackend != "" {
+		f, err := nat.NewFirewall(cfg.Agent.NATBackend)
+		if err != nil {
+			fatalf("Failed to init NAT: %v", err)
+		}
+		fw = f
+	}
+	agent.RegisterNATRoutes(r, fw, cfg.Agent.Token)
+	var filter agent.FirewallApplier
+	if cfg.Agent.Firewall {
+		filter = firewall.NewNFTables()
+	}
+	agent.RegisterFirewallRoutes(r, filter, cfg.Agent.Token)
+
+	addr := cfg.Agent.Listen
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", agent.DefaultPort)
+	}
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+
+	go func() {
+		logf("Starting agent on %s (driver=%s, tls=%t)", srv.Addr, cfg.Hypervisor.Driver, tlsConfig != nil)
+		var err error
+		if tlsConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatalf("Listen: %v", err)
+		}
+	}()
+
+	reportCtx, stopReporting := context.WithCancel(context.Background())
+	if cfg.Agent.MasterURL != "" {
+		go newReporter(cfg, logf).Run(reportCtx)
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	stopReporting()
+	logf("Shutting down agent...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fatalf("Agent forced to shutdown: %v", err)
+	}
+	logf("Agent exiting")
+}
+
+func newReporter(cfg *config.Config, logf func(string, ...interface{})) *agent.Reporter {
+	hostname, _ := os.Hostname()
+	name := cfg.Agent.NodeName
+	if name == "" {
+		name = hostname
+	}
+	diskPath := cfg.Hypervisor.QEMU.DataDir
+	if diskPath == "" {
+		diskPath = "/"
+	}
+	return agent.NewReporter(agent.ReporterOptions{
+		MasterURL: cfg.Agent.MasterURL,
+		Token:     cfg.Agent.Token,
+		NodeName:  name,
+		Hostname:  hostname,
+		IP:        outboundIP(cfg.Agent.MasterURL),
+		AgentURL:  cfg.Agent.AdvertiseURL,
+		Region:    cfg.Agent.Region,
+		DiskPath:  diskPath,
+		Interval:  cfg.Agent.HeartbeatInterval(),
+		Logf:      logf,
+	})
+}
+
+// outboundIP returns the local address used to reach the master, which is
+// what the master should use to reach this agent when no advertise URL is set.
+func outboundIP(masterURL string) string {
+	u, err := url.Parse(masterURL)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
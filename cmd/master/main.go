@@ -15,7 +15,8 @@ import (
 
 	"StarstreamAstra/internal/config"
 	"StarstreamAstra/internal/db"
-	"Zjmf-kvm/internal/router"
+	"StarstreamAstra/internal/router"
+	"StarstreamAstra/internal/service"
 )
 
 func main() {
@@ -81,7 +82,15 @@ func main() {
 		r.Use(gin.Logger())
 	}
 
-	router.RegisterRoutes(r, dbConn, cfg)
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	router.RegisterRoutes(bgCtx, r, dbConn, cfg)
+
+	healthLogf := log.Printf
+	if zapLogger != nil {
+		healthLogf = zapLogger.Sugar().Infof
+	}
+	go service.NewNodeService(dbConn.Gorm).RunHealthMonitor(bgCtx, cfg.Agent.OfflineAfter(), healthLogf)
 
 	port := cfg.Server.Port
 	if envPort := os.Getenv("HTTP_PORT"); envPort != "" {
@@ -110,6 +119,7 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
+	stopBackground()
 	if zapLogger != nil {
 		zapLogger.Sugar().Info("Shutting down server...")
 	} else {
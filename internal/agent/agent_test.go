@@ -0,0 +1,267 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/firewall"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/nat"
+)
+
+func newTestAgent(t *testing.T) (*hypervisor.FakeHypervisor, *httptest.Server) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	hv := hypervisor.NewFakeHypervisor()
+	r := gin.New()
+	RegisterRoutes(r, hv, "s3cret")
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return hv, srv
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	hv, srv := newTestAgent(t)
+	c := NewClient(srv.URL, "s3cret", nil)
+
+	info, err := c.CreateVM(ctx, hypervisor.VMConfig{Name: "web", CPU: 2, MemoryMB: 1024, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, ok := hv.VM(info.ID); !ok {
+		t.Fatalf("guest %s not created on agent", info.ID)
+	}
+
+	if err := c.StartVM(ctx, info.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := c.RebootVM(ctx, info.ID); err != nil {
+		t.Fatalf("reboot: %v", err)
+	}
+	got, err := c.GetVM(ctx, info.ID)
+	if err != nil || got.Status != "running" {
+		t.Fatalf("unexpected vm %+v (%v)", got, err)
+	}
+	if err := c.ResizeVM(ctx, info.ID, hypervisor.VMConfig{CPU: 4, MemoryMB: 2048, DiskGB: 20}); err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	if err := c.ForceStopVM(ctx, info.ID); err != nil {
+		t.Fatalf("force stop: %v", err)
+	}
+	if err := c.CreateSnapshot(ctx, info.ID, "snap-1"); err != nil {
+		t.Fatalf("create snapshot: %v", err)
+	}
+	if err := c.RevertSnapshot(ctx, info.ID, "snap-1"); err != nil {
+		t.Fatalf("revert snapshot: %v", err)
+	}
+	if err := c.DeleteSnapshot(ctx, info.ID, "snap-1"); err != nil {
+		t.Fatalf("delete snapshot: %v", err)
+	}
+	if hv.Snapshots(info.ID) != 0 {
+		t.Fatal("snapshot not deleted on agent")
+	}
+	if err := c.ImportDisk(ctx, info.ID, strings.NewReader("disk image")); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	var disk strings.Builder
+	if err := c.ExportDisk(ctx, info.ID, "", &disk); err != nil || disk.String() != "disk image" {
+		t.Fatalf("export = %q, %v", disk.String(), err)
+	}
+	image := &hypervisor.ImageSpec{Name: "debian-12"}
+	if err := c.ReinstallVM(ctx, info.ID, hypervisor.VMConfig{DiskGB: 20, Image: image}); err != nil {
+		t.Fatalf("reinstall: %v", err)
+	}
+	list, err := c.ListVMs(ctx)
+	if err != nil || len(list) != 1 || list[0].DiskGB != 20 || list[0].Status != "stopped" || list[0].Image != "debian-12" {
+		t.Fatalf("unexpected list %+v (%v)", list, err)
+	}
+	limit := hypervisor.Bandwidth{InboundMbps: 100, OutboundMbps: 50}
+	if err := c.SetBandwidth(ctx, info.ID, limit); err != nil || hv.Bandwidth(info.ID) != limit {
+		t.Fatalf("set bandwidth = %v, agent has %+v", err, hv.Bandwidth(info.ID))
+	}
+	if err := c.StartVM(ctx, info.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	hv.AddTraffic(info.ID, 1000, 200)
+	stats, err := c.TrafficStats(ctx)
+	if err != nil || len(stats) != 1 || stats[0] != (hypervisor.TrafficCounters{ID: info.ID, RxBytes: 1000, TxBytes: 200}) {
+		t.Fatalf("traffic stats %+v (%v)", stats, err)
+	}
+	if err := c.DeleteVM(ctx, info.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if hv.Count() != 0 {
+		t.Fatal("guest not deleted on agent")
+	}
+}
+
+func TestClientErrorMapping(t *testing.T) {
+	ctx := context.Background()
+	hv, srv := newTestAgent(t)
+	c := NewClient(srv.URL, "s3cret", nil)
+
+	if err := c.StartVM(ctx, "missing"); !errors.Is(err, hypervisor.ErrVMNotFound) {
+		t.Fatalf("expected ErrVMNotFound, got %v", err)
+	}
+	info, _ := c.CreateVM(ctx, hypervisor.VMConfig{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err := c.RebootVM(ctx, info.ID); !errors.Is(err, hypervisor.ErrVMNotRunning) {
+		t.Fatalf("expected ErrVMNotRunning, got %v", err)
+	}
+	if err := c.ResizeVM(ctx, info.ID, hypervisor.VMConfig{DiskGB: 5}); !errors.Is(err, hypervisor.ErrDiskShrink) {
+		t.Fatalf("expected ErrDiskShrink, got %v", err)
+	}
+	if err := c.DeleteSnapshot(ctx, info.ID, "missing"); !errors.Is(err, hypervisor.ErrSnapshotNotFound) {
+		t.Fatalf("expected ErrSnapshotNotFound, got %v", err)
+	}
+	_ = c.StartVM(ctx, info.ID)
+	if err := c.RevertSnapshot(ctx, info.ID, "missing"); !errors.Is(err, hypervisor.ErrVMRunning) {
+		t.Fatalf("expected ErrVMRunning, got %v", err)
+	}
+	if err := c.ReinstallVM(ctx, info.ID, hypervisor.VMConfig{DiskGB: 10}); !errors.Is(err, hypervisor.ErrVMRunning) {
+		t.Fatalf("expected ErrVMRunning, got %v", err)
+	}
+	if err := c.ExportDisk(ctx, info.ID, "", io.Discard); !errors.Is(err, hypervisor.ErrVMRunning) {
+		t.Fatalf("expected ErrVMRunning, got %v", err)
+	}
+	if err := c.ExportDisk(ctx, info.ID, "missing", io.Discard); !errors.Is(err, hypervisor.ErrSnapshotNotFound) {
+		t.Fatalf("expected ErrSnapshotNotFound, got %v", err)
+	}
+	hv.Inject(hypervisor.MethodStopVM, hypervisor.Fault{Err: errors.New("qemu exploded")})
+	if err := c.StopVM(ctx, info.ID); err == nil || !strings.Contains(err.Error(), "qemu exploded") {
+		t.Fatalf("expected agent error, got %v", err)
+	}
+}
+
+func TestClientRejectsBadToken(t *testing.T) {
+	_, srv := newTestAgent(t)
+	c := NewClient(srv.URL, "wrong", nil)
+
+	_, err := c.ListVMs(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "invalid agent token") {
+		t.Fatalf("expected token error, got %v", err)
+	}
+}
+
+func TestClientConsole(t *testing.T) {
+	ctx := context.Background()
+	_, srv := newTestAgent(t)
+	c := NewClient(srv.URL, "s3cret", nil)
+
+	info, _ := c.CreateVM(ctx, hypervisor.VMConfig{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if _, err := c.OpenConsole(ctx, info.ID); !errors.Is(err, hypervisor.ErrVMNotRunning) {
+		t.Fatalf("expected ErrVMNotRunning, got %v", err)
+	}
+	_ = c.StartVM(ctx, info.ID)
+	console, err := c.OpenConsole(ctx, info.ID)
+	if err != nil {
+		t.Fatalf("open console: %v", err)
+	}
+	defer console.Close()
+
+	banner := make([]byte, len(hypervisor.FakeConsoleBanner))
+	if _, err := io.ReadFull(console, banner); err != nil || string(banner) != hypervisor.FakeConsoleBanner {
+		t.Fatalf("banner = %q, %v", banner, err)
+	}
+	if _, err := io.WriteString(console, "key"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	echo := make([]byte, 3)
+	if _, err := io.ReadFull(console, echo); err != nil || string(echo) != "key" {
+		t.Fatalf("echo = %q, %v", echo, err)
+	}
+}
+
+type recordingFirewall struct {
+	rules []nat.Ruleset
+}
+
+func (f *recordingFirewall) Apply(ctx context.Context, rules nat.Ruleset) error {
+	f.rules = append(f.rules, rules)
+	return nil
+}
+
+func TestClientNAT(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	rules := nat.Ruleset{
+		PublicIP: "203.0.113.10",
+		Forwards: []nat.Forward{{Protocol: "tcp", PublicPort: 20001, PrivateIP: "10.10.0.5", PrivatePort: 22}},
+	}
+
+	r := gin.New()
+	RegisterNATRoutes(r, nil, "s3cret")
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	if err := NewClient(srv.URL, "s3cret", nil).ApplyNAT(ctx, rules); !errors.Is(err, hypervisor.ErrNATUnsupported) {
+		t.Fatalf("expected ErrNATUnsupported, got %v", err)
+	}
+
+	fw := &recordingFirewall{}
+	r = gin.New()
+	RegisterNATRoutes(r, fw, "s3cret")
+	srv = httptest.NewServer(r)
+	defer srv.Close()
+	c := NewClient(srv.URL, "s3cret", nil)
+	if err := c.ApplyNAT(ctx, rules); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	bad := rules
+	bad.PublicIP = "203.0.113.10; flush ruleset"
+	if err := c.ApplyNAT(ctx, bad); err == nil {
+		t.Fatal("expected an invalid ruleset to be rejected")
+	}
+	if len(fw.rules) != 1 || len(fw.rules[0].Forwards) != 1 || fw.rules[0].Forwards[0].PrivatePort != 22 {
+		t.Fatalf("firewall got %+v", fw.rules)
+	}
+}
+
+type recordingFilter struct {
+	rules []firewall.Ruleset
+}
+
+func (f *recordingFilter) Apply(ctx context.Context, rules firewall.Ruleset) error {
+	f.rules = append(f.rules, rules)
+	return nil
+}
+
+func TestClientFirewall(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	rules := firewall.Ruleset{Guests: []firewall.Guest{{
+		VMID:      3,
+		Addresses: []string{"198.51.100.2"},
+		Ingress:   []firewall.Rule{{Protocol: firewall.ProtocolTCP, PortFrom: 22, PortTo: 22, CIDR: "0.0.0.0/0"}},
+	}}}
+
+	r := gin.New()
+	RegisterFirewallRoutes(r, nil, "s3cret")
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	if err := NewClient(srv.URL, "s3cret", nil).ApplyFirewall(ctx, rules); !errors.Is(err, hypervisor.ErrFirewallUnsupported) {
+		t.Fatalf("expected ErrFirewallUnsupported, got %v", err)
+	}
+
+	fw := &recordingFilter{}
+	r = gin.New()
+	RegisterFirewallRoutes(r, fw, "s3cret")
+	srv = httptest.NewServer(r)
+	defer srv.Close()
+	c := NewClient(srv.URL, "s3cret", nil)
+	if err := c.ApplyFirewall(ctx, rules); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	bad := firewall.Ruleset{Guests: []firewall.Guest{{VMID: 3, Addresses: []string{"198.51.100.2 accept"}}}}
+	if err := c.ApplyFirewall(ctx, bad); err == nil {
+		t.Fatal("expected an invalid ruleset to be rejected")
+	}
+	if len(fw.rules) != 1 || len(fw.rules[0].Guests) != 1 || fw.rules[0].Guests[0].Ingress[0].PortFrom != 22 {
+		t.Fatalf("firewall got %+v", fw.rules)
+	}
+}
@@ -0,0 +1,313 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"StarstreamAstra/internal/firewall"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+	"StarstreamAstra/internal/nat"
+)
+
+// Client is a hypervisor.Hypervisor backed by a remote node agent.
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+	// upgrade serves console requests, which need HTTP/1.1 to switch
+	// protocols.
+	upgrade *http.Client
+}
+
+var (
+	_ hypervisor.Hypervisor       = (*Client)(nil)
+	_ hypervisor.ConsoleSupport   = (*Client)(nil)
+	_ hypervisor.NATSupport       = (*Client)(nil)
+	_ hypervisor.FirewallSupport  = (*Client)(nil)
+	_ hypervisor.BandwidthSupport = (*Client)(nil)
+	_ hypervisor.TrafficSupport   = (*Client)(nil)
+)
+
+func NewClient(baseURL, token string, tlsConfig *tls.Config) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	upgrade := transport.Clone()
+	upgrade.ForceAttemptHTTP2 = false
+	upgrade.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Transport: transport},
+		upgrade: &http.Client{Transport: upgrade},
+	}
+}
+
+func (c *Client) CreateVM(ctx context.Context, cfg hypervisor.VMConfig) (*hypervisor.VMInfo, error) {
+	var info hypervisor.VMInfo
+	if err := c.do(ctx, http.MethodPost, "/vms", cfg, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) GetVM(ctx context.Context, id string) (*hypervisor.VMInfo, error) {
+	var info hypervisor.VMInfo
+	if err := c.do(ctx, http.MethodGet, "/vms/"+url.PathEscape(id), nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) ListVMs(ctx context.Context) ([]*hypervisor.VMInfo, error) {
+	var list []*hypervisor.VMInfo
+	if err := c.do(ctx, http.MethodGet, "/vms", nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *Client) StartVM(ctx context.Context, id string) error {
+	return c.action(ctx, id, "start")
+}
+
+func (c *Client) StopVM(ctx context.Context, id string) error {
+	return c.action(ctx, id, "stop")
+}
+
+func (c *Client) ForceStopVM(ctx context.Context, id string) error {
+	return c.action(ctx, id, "force-stop")
+}
+
+func (c *Client) RebootVM(ctx context.Context, id string) error {
+	return c.action(ctx, id, "reboot")
+}
+
+func (c *Client) DeleteVM(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/vms/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) ResizeVM(ctx context.Context, id string, cfg hypervisor.VMConfig) error {
+	return c.do(ctx, http.MethodPatch, "/vms/"+url.PathEscape(id), cfg, nil)
+}
+
+func (c *Client) ReinstallVM(ctx context.Context, id string, cfg hypervisor.VMConfig) error {
+	return c.do(ctx, http.MethodPost, "/vms/"+url.PathEscape(id)+"/reinstall", cfg, nil)
+}
+
+func (c *Client) CreateSnapshot(ctx context.Context, id, name string) error {
+	return c.do(ctx, http.MethodPost, "/vms/"+url.PathEscape(id)+"/snapshots", snapshotRequest{Name: name}, nil)
+}
+
+func (c *Client) DeleteSnapshot(ctx context.Context, id, name string) error {
+	return c.do(ctx, http.MethodDelete, "/vms/"+url.PathEscape(id)+"/snapshots/"+url.PathEscape(name), nil, nil)
+}
+
+func (c *Client) RevertSnapshot(ctx context.Context, id, name string) error {
+	return c.do(ctx, http.MethodPost, "/vms/"+url.PathEscape(id)+"/snapshots/"+url.PathEscape(name)+"/revert", nil, nil)
+}
+
+func (c *Client) action(ctx context.Context, id, name string) error {
+	return c.do(ctx, http.MethodPost, "/vms/"+url.PathEscape(id)+"/"+name, nil, nil)
+}
+
+func (c *Client) ExportDisk(ctx context.Context, id, snapshot string, w io.Writer) error {
+	path := "/vms/" + url.PathEscape(id) + "/disk"
+	if snapshot != "" {
+		path += "?snapshot=" + url.QueryEscape(snapshot)
+	}
+	resp, err := c.send(ctx, http.MethodGet, path, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return err
+	}
+	// Failures after the image started flowing arrive as a trailer.
+	if msg := resp.Trailer.Get(exportErrorTrailer); msg != "" {
+		return fmt.Errorf("agent %s %s: %s", http.MethodGet, path, msg)
+	}
+	return nil
+}
+
+func (c *Client) ImportDisk(ctx context.Context, id string, r io.Reader) error {
+	resp, err := c.send(ctx, http.MethodPut, "/vms/"+url.PathEscape(id)+"/disk", r, "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// OpenConsole asks the agent to switch the connection over to the guest's
+// console. Whether the node can is up to the agent's own driver.
+func (c *Client) OpenConsole(ctx context.Context, id string) (io.ReadWriteCloser, error) {
+	path := "/vms/" + url.PathEscape(id) + "/console"
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", consoleProtocol)
+	resp, err := c.upgrade.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		if err := responseError(http.MethodGet, path, resp); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("agent %s %s: unexpected %s", http.MethodGet, path, resp.Status)
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, fmt.Errorf("agent %s %s: connection cannot be upgraded", http.MethodGet, path)
+	}
+	return conn, nil
+}
+
+// SetBandwidth changes the guest's limits through the agent's driver.
+func (c *Client) SetBandwidth(ctx context.Context, id string, bw hypervisor.Bandwidth) error {
+	return c.do(ctx, http.MethodPut, "/vms/"+url.PathEscape(id)+"/bandwidth", bw, nil)
+}
+
+// TrafficStats returns the counters of the guests running on the agent's
+// host.
+func (c *Client) TrafficStats(ctx context.Context) ([]hypervisor.TrafficCounters, error) {
+	var stats []hypervisor.TrafficCounters
+	if err := c.do(ctx, http.MethodGet, "/traffic", nil, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ApplyNAT replaces the port forwards on the agent's host.
+func (c *Client) ApplyNAT(ctx context.Context, rules nat.Ruleset) error {
+	return c.do(ctx, http.MethodPut, "/nat", rules, nil)
+}
+
+// ApplyFirewall replaces the guest filtering on the agent's host.
+func (c *Client) ApplyFirewall(ctx context.Context, rules firewall.Ruleset) error {
+	return c.do(ctx, http.MethodPut, "/firewall", rules, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	contentType := ""
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+		contentType = "application/json"
+	}
+	resp, err := c.send(ctx, method, path, reader, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send issues a request and turns error responses into errors. On success
+// the caller owns the response body.
+func (c *Client) send(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, path, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(method, path, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+apiPrefix+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// responseError reads the error out of a failed response, mapping agent
+// error codes back to the hypervisor package's sentinels. It returns nil
+// for responses below 300.
+func responseError(method, path string, resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	var e errorResponse
+	_ = json.NewDecoder(resp.Body).Decode(&e)
+	if sentinel, ok := codeErrors[e.Code]; ok {
+		return sentinel
+	}
+	if e.Error == "" {
+		e.Error = resp.Status
+	}
+	return fmt.Errorf("agent %s %s: %s", method, path, e.Error)
+}
+
+// Pool hands out one Client per node, reusing connections across requests.
+type Pool struct {
+	token     string
+	scheme    string
+	tlsConfig *tls.Config
+	mu        sync.Mutex
+	clients   map[uint]*Client
+}
+
+func NewPool(token string, tlsConfig *tls.Config) *Pool {
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	return &Pool{token: token, scheme: scheme, tlsConfig: tlsConfig, clients: make(map[uint]*Client)}
+}
+
+// ForNode returns the hypervisor running on node.
+func (p *Pool) ForNode(node *model.Node) hypervisor.Hypervisor {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	base := p.nodeURL(node)
+	if c, ok := p.clients[node.ID]; ok && c.baseURL == base {
+		return c
+	}
+	c := NewClient(base, p.token, p.tlsConfig)
+	p.clients[node.ID] = c
+	return c
+}
+
+func (p *Pool) nodeURL(node *model.Node) string {
+	if node.AgentURL != "" {
+		return strings.TrimRight(node.AgentURL, "/")
+	}
+	return fmt.Sprintf("%s://%s:%d", p.scheme, node.IP, DefaultPort)
+}
@@ -0,0 +1,12 @@
+package agent
+
+// HostStats is a snapshot of the compute host's capacity and usage. Memory
+// is reported in MB and disk in GB to match model.Node.
+type HostStats struct {
+	CPUTotal        int
+	MemTotalMB      int
+	DiskTotalGB     int
+	CPUUsagePercent float64
+	MemUsageMB      int
+	DiskUsageGB     int
+}
@@ -0,0 +1,113 @@
+//go:build linux
+
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// hostSampler computes CPU usage from the delta between two /proc/stat reads.
+type hostSampler struct {
+	diskPath  string
+	lastIdle  uint64
+	lastTotal uint64
+}
+
+func newHostSampler(diskPath string) *hostSampler {
+	return &hostSampler{diskPath: diskPath}
+}
+
+func (s *hostSampler) Sample() (*HostStats, error) {
+	stats := &HostStats{CPUTotal: runtime.NumCPU()}
+
+	idle, total, err := readCPUTimes()
+	if err != nil {
+		return nil, err
+	}
+	if s.lastTotal > 0 && total > s.lastTotal {
+		busy := float64((total - s.lastTotal) - (idle - s.lastIdle))
+		stats.CPUUsagePercent = 100 * busy / float64(total-s.lastTotal)
+	}
+	s.lastIdle, s.lastTotal = idle, total
+
+	memTotal, memAvailable, err := readMemInfo()
+	if err != nil {
+		return nil, err
+	}
+	stats.MemTotalMB = int(memTotal / 1024)
+	stats.MemUsageMB = int((memTotal - memAvailable) / 1024)
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(s.diskPath, &fs); err != nil {
+		return nil, fmt.Errorf("statfs %s: %w", s.diskPath, err)
+	}
+	totalBytes := fs.Blocks * uint64(fs.Bsize)
+	freeBytes := fs.Bavail * uint64(fs.Bsize)
+	stats.DiskTotalGB = int(totalBytes >> 30)
+	stats.DiskUsageGB = int((totalBytes - freeBytes) >> 30)
+	return stats, nil
+}
+
+func readCPUTimes() (idle, total uint64, err error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return 0, 0, err
+			}
+			total += v
+			// idle and iowait columns
+			if i == 3 || i == 4 {
+				idle += v
+			}
+		}
+		return idle, total, nil
+	}
+	return 0, 0, fmt.Errorf("cpu line not found in /proc/stat")
+}
+
+// readMemInfo returns MemTotal and MemAvailable in KiB.
+func readMemInfo() (total, available uint64, err error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = v
+		case "MemAvailable:":
+			available = v
+		}
+	}
+	if total == 0 {
+		return 0, 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+	}
+	return total, available, scanner.Err()
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package agent
+
+import "errors"
+
+type hostSampler struct{}
+
+func newHostSampler(string) *hostSampler {
+	return &hostSampler{}
+}
+
+func (s *hostSampler) Sample() (*HostStats, error) {
+	return nil, errors.New("host statistics are only supported on linux")
+}
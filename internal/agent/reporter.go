@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"StarstreamAstra/internal/model"
+	"StarstreamAstra/internal/service"
+)
+
+var errNodeUnknown = errors.New("master does not know this node")
+
+type ReporterOptions struct {
+	MasterURL string
+	Token     string
+	NodeName  string
+	Hostname  string
+	IP        string
+	AgentURL  string
+	Region    string
+	DiskPath  string
+	Interval  time.Duration
+	Logf      func(string, ...interface{})
+}
+
+// Reporter registers the node with the master and sends periodic heartbeats
+// carrying host usage. It re-registers whenever the master forgets the node.
+type Reporter struct {
+	opts    ReporterOptions
+	http    *http.Client
+	sampler *hostSampler
+	nodeID  uint
+}
+
+func NewReporter(opts ReporterOptions) *Reporter {
+	if opts.Interval <= 0 {
+		opts.Interval = 15 * time.Second
+	}
+	if opts.DiskPath == "" {
+		opts.DiskPath = "/"
+	}
+	return &Reporter{
+		opts:    opts,
+		http:    &http.Client{Timeout: 10 * time.Second},
+		sampler: newHostSampler(opts.DiskPath),
+	}
+}
+
+func (r *Reporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.tick(ctx); err != nil && ctx.Err() == nil {
+			r.opts.Logf("Heartbeat to master failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reporter) tick(ctx context.Context) error {
+	stats, err := r.sampler.Sample()
+	if err != nil {
+		return err
+	}
+	if r.nodeID == 0 {
+		if err := r.register(ctx, stats); err != nil {
+			return err
+		}
+	}
+	err = r.post(ctx, "/heartbeat", service.NodeHeartbeatRequest{
+		NodeID:          r.nodeID,
+		CPUUsagePercent: stats.CPUUsagePercent,
+		MemUsageMB:      stats.MemUsageMB,
+		DiskUsageGB:     stats.DiskUsageGB,
+	}, nil)
+	if errors.Is(err, errNodeUnknown) {
+		r.nodeID = 0
+	}
+	return err
+}
+
+func (r *Reporter) register(ctx context.Context, stats *HostStats) error {
+	var resp struct {
+		Data model.Node `json:"data"`
+	}
+	err := r.post(ctx, "/register", service.NodeRegisterRequest{
+		Name:      r.opts.NodeName,
+		Hostname:  r.opts.Hostname,
+		IP:        r.opts.IP,
+		AgentURL:  r.opts.AgentURL,
+		Region:    r.opts.Region,
+		CPUTotal:  stats.CPUTotal,
+		MemTotal:  stats.MemTotalMB,
+		DiskTotal: stats.DiskTotalGB,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	r.nodeID = resp.Data.ID
+	r.opts.Logf("Registered with master as node %d (%s)", r.nodeID, r.opts.NodeName)
+	return nil
+}
+
+func (r *Reporter) post(ctx context.Context, path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimRight(r.opts.MasterURL, "/") + "/api/v1/agent" + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.opts.Token)
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNodeUnknown
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("master %s: %s", path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,395 @@
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/firewall"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/nat"
+)
+
+const (
+	apiPrefix   = "/agent/v1"
+	DefaultPort = 1271
+)
+
+// Error codes carried in agent error responses so the client can map them
+// back to the hypervisor package's sentinel errors.
+const (
+	codeNotFound   = "not_found"
+	codeNotRunning = "not_running"
+	codeRunning    = "running"
+	codeDiskShrink = "disk_shrink"
+	codeInternal   = "internal"
+
+	codeSnapshotNotFound     = "snapshot_not_found"
+	codeConsoleUnsupported   = "console_unsupported"
+	codeNATUnsupported       = "nat_unsupported"
+	codeFirewallUnsupported  = "firewall_unsupported"
+	codeBandwidthUnsupported = "bandwidth_unsupported"
+	codeTrafficUnsupported   = "traffic_unsupported"
+)
+
+var codeErrors = map[string]error{
+	codeNotFound:   hypervisor.ErrVMNotFound,
+	codeNotRunning: hypervisor.ErrVMNotRunning,
+	codeRunning:    hypervisor.ErrVMRunning,
+	codeDiskShrink: hypervisor.ErrDiskShrink,
+
+	codeSnapshotNotFound:     hypervisor.ErrSnapshotNotFound,
+	codeConsoleUnsupported:   hypervisor.ErrConsoleUnsupported,
+	codeNATUnsupported:       hypervisor.ErrNATUnsupported,
+	codeFirewallUnsupported:  hypervisor.ErrFirewallUnsupported,
+	codeBandwidthUnsupported: hypervisor.ErrBandwidthUnsupported,
+	codeTrafficUnsupported:   hypervisor.ErrTrafficUnsupported,
+}
+
+// exportErrorTrailer carries an export failure that happened after the
+// response status was sent.
+const exportErrorTrailer = "X-Export-Error"
+
+// consoleProtocol is what a console request upgrades the connection to:
+// after the 101 response it carries the guest's raw RFB stream.
+const consoleProtocol = "rfb"
+
+type snapshotRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// RegisterRoutes exposes hv under /agent/v1. Requests must carry the shared
+// token unless token is empty, in which case authentication is left to mTLS.
+func RegisterRoutes(r *gin.Engine, hv hypervisor.Hypervisor, token string) {
+	api := r.Group(apiPrefix)
+	api.Use(TokenMiddleware(token))
+
+	api.GET("/traffic", func(c *gin.Context) {
+		ts, ok := hv.(hypervisor.TrafficSupport)
+		if !ok {
+			abortWithError(c, hypervisor.ErrTrafficUnsupported)
+			return
+		}
+		stats, err := ts.TrafficStats(c.Request.Context())
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, stats)
+	})
+
+	vms := api.Group("/vms")
+	vms.GET("", func(c *gin.Context) {
+		list, err := hv.ListVMs(c.Request.Context())
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	vms.POST("", func(c *gin.Context) {
+		var cfg hypervisor.VMConfig
+		if err := c.ShouldBindJSON(&cfg); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error(), Code: codeInternal})
+			return
+		}
+		info, err := hv.CreateVM(c.Request.Context(), cfg)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, info)
+	})
+
+	vms.GET("/:id", func(c *gin.Context) {
+		info, err := hv.GetVM(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, info)
+	})
+
+	vms.PATCH("/:id", func(c *gin.Context) {
+		var cfg hypervisor.VMConfig
+		if err := c.ShouldBindJSON(&cfg); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error(), Code: codeInternal})
+			return
+		}
+		if err := hv.ResizeVM(c.Request.Context(), c.Param("id"), cfg); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	vms.POST("/:id/reinstall", func(c *gin.Context) {
+		var cfg hypervisor.VMConfig
+		if err := c.ShouldBindJSON(&cfg); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error(), Code: codeInternal})
+			return
+		}
+		if err := hv.ReinstallVM(c.Request.Context(), c.Param("id"), cfg); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	vms.POST("/:id/snapshots", func(c *gin.Context) {
+		var req snapshotRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error(), Code: codeInternal})
+			return
+		}
+		if err := hv.CreateSnapshot(c.Request.Context(), c.Param("id"), req.Name); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	vms.DELETE("/:id/snapshots/:name", func(c *gin.Context) {
+		if err := hv.DeleteSnapshot(c.Request.Context(), c.Param("id"), c.Param("name")); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	vms.POST("/:id/snapshots/:name/revert", func(c *gin.Context) {
+		if err := hv.RevertSnapshot(c.Request.Context(), c.Param("id"), c.Param("name")); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	vms.GET("/:id/disk", func(c *gin.Context) {
+		w := &exportWriter{c: c}
+		err := hv.ExportDisk(c.Request.Context(), c.Param("id"), c.Query("snapshot"), w)
+		switch {
+		case err != nil && !w.started:
+			abortWithError(c, err)
+		case err != nil:
+			c.Writer.Header().Set(exportErrorTrailer, err.Error())
+		default:
+			w.start()
+		}
+	})
+
+	vms.PUT("/:id/disk", func(c *gin.Context) {
+		if err := hv.ImportDisk(c.Request.Context(), c.Param("id"), c.Request.Body); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	vms.GET("/:id/console", func(c *gin.Context) {
+		cs, ok := hv.(hypervisor.ConsoleSupport)
+		if !ok {
+			abortWithError(c, hypervisor.ErrConsoleUnsupported)
+			return
+		}
+		if !strings.EqualFold(c.GetHeader("Upgrade"), consoleProtocol) {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: "console requires an upgrade to " + consoleProtocol, Code: codeInternal})
+			return
+		}
+		console, err := cs.OpenConsole(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		conn, buf, err := c.Writer.Hijack()
+		if err != nil {
+			_ = console.Close()
+			return
+		}
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + consoleProtocol + "\r\n\r\n")
+		if err := buf.Flush(); err != nil {
+			_ = console.Close()
+			_ = conn.Close()
+			return
+		}
+		// buf may already hold the first bytes the client sent.
+		hypervisor.Splice(struct {
+			io.Reader
+			io.Writer
+			io.Closer
+		}{buf, conn, conn}, console)
+	})
+
+	vms.PUT("/:id/bandwidth", func(c *gin.Context) {
+		bs, ok := hv.(hypervisor.BandwidthSupport)
+		if !ok {
+			abortWithError(c, hypervisor.ErrBandwidthUnsupported)
+			return
+		}
+		var bw hypervisor.Bandwidth
+		if err := c.ShouldBindJSON(&bw); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error(), Code: codeInternal})
+			return
+		}
+		if err := bs.SetBandwidth(c.Request.Context(), c.Param("id"), bw); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	vms.DELETE("/:id", func(c *gin.Context) {
+		if err := hv.DeleteVM(c.Request.Context(), c.Param("id")); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	actions := map[string]func(*gin.Context, string) error{
+		"start":      func(c *gin.Context, id string) error { return hv.StartVM(c.Request.Context(), id) },
+		"stop":       func(c *gin.Context, id string) error { return hv.StopVM(c.Request.Context(), id) },
+		"force-stop": func(c *gin.Context, id string) error { return hv.ForceStopVM(c.Request.Context(), id) },
+		"reboot":     func(c *gin.Context, id string) error { return hv.RebootVM(c.Request.Context(), id) },
+	}
+	for name, action := range actions {
+		vms.POST("/:id/"+name, func(c *gin.Context) {
+			if err := action(c, c.Param("id")); err != nil {
+				abortWithError(c, err)
+				return
+			}
+			c.Status(http.StatusNoContent)
+		})
+	}
+}
+
+// exportWriter holds back the response status until the first byte of the
+// image, so that an export failing up front still gets a proper error.
+type exportWriter struct {
+	c       *gin.Context
+	started bool
+}
+
+func (w *exportWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.c.Header("Trailer", exportErrorTrailer)
+	w.c.Header("Content-Type", "application/octet-stream")
+	w.c.Status(http.StatusOK)
+	w.c.Writer.WriteHeaderNow()
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	w.start()
+	return w.c.Writer.Write(p)
+}
+
+// TokenMiddleware checks the bearer token in constant time.
+func TokenMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.Next()
+			return
+		}
+		auth := c.GetHeader("Authorization")
+		parts := strings.SplitN(auth, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") ||
+			subtle.ConstantTimeCompare([]byte(parts[1]), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse{Error: "invalid agent token", Code: codeInternal})
+			return
+		}
+		c.Next()
+	}
+}
+
+// NATApplier applies port forwards to the host the agent runs on.
+type NATApplier interface {
+	Apply(ctx context.Context, rules nat.Ruleset) error
+}
+
+// RegisterNATRoutes lets the master replace the host's port forwards. With
+// a nil fw the agent reports that the node does not forward ports.
+func RegisterNATRoutes(r *gin.Engine, fw NATApplier, token string) {
+	api := r.Group(apiPrefix)
+	api.Use(TokenMiddleware(token))
+	api.PUT("/nat", func(c *gin.Context) {
+		if fw == nil {
+			abortWithError(c, hypervisor.ErrNATUnsupported)
+			return
+		}
+		var rules nat.Ruleset
+		if err := c.ShouldBindJSON(&rules); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error(), Code: codeInternal})
+			return
+		}
+		if err := rules.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error(), Code: codeInternal})
+			return
+		}
+		if err := fw.Apply(c.Request.Context(), rules); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
+
+// FirewallApplier filters the traffic of the guests on the agent's host.
+type FirewallApplier interface {
+	Apply(ctx context.Context, rules firewall.Ruleset) error
+}
+
+// RegisterFirewallRoutes lets the master replace the host's guest
+// filtering. With a nil fw the agent reports that the node does not filter
+// guest traffic.
+func RegisterFirewallRoutes(r *gin.Engine, fw FirewallApplier, token string) {
+	api := r.Group(apiPrefix)
+	api.Use(TokenMiddleware(token))
+	api.PUT("/firewall", func(c *gin.Context) {
+		if fw == nil {
+			abortWithError(c, hypervisor.ErrFirewallUnsupported)
+			return
+		}
+		var rules firewall.Ruleset
+		if err := c.ShouldBindJSON(&rules); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error(), Code: codeInternal})
+			return
+		}
+		if err := rules.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse{Error: err.Error(), Code: codeInternal})
+			return
+		}
+		if err := fw.Apply(c.Request.Context(), rules); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
+
+func abortWithError(c *gin.Context, err error) {
+	for code, sentinel := range codeErrors {
+		if errors.Is(err, sentinel) {
+			status := http.StatusConflict
+			if code == codeNotFound || code == codeSnapshotNotFound {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, errorResponse{Error: err.Error(), Code: code})
+			return
+		}
+	}
+	c.JSON(http.StatusInternalServerError, errorResponse{Error: err.Error(), Code: codeInternal})
+}
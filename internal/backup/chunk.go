@@ -0,0 +1,181 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ChunkSize is the size images are cut into. The last chunk may be shorter.
+const ChunkSize = 4 << 20
+
+const manifestFile = "manifest.json"
+
+// Manifest lists the chunks an image was stored as, in order. A chunk
+// without a key is all zeros and was not stored.
+type Manifest struct {
+	Size      int64   `json:"size"`
+	ChunkSize int     `json:"chunk_size"`
+	Chunks    []Chunk `json:"chunks"`
+}
+
+type Chunk struct {
+	Hash string `json:"hash,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// Keys returns the keys of the chunks m refers to.
+func (m *Manifest) Keys() []string {
+	var keys []string
+	for _, c := range m.Chunks {
+		if c.Key != "" {
+			keys = append(keys, c.Key)
+		}
+	}
+	return keys
+}
+
+// Write stores the image read from r under prefix and returns its manifest
+// and the number of bytes it stored. A chunk that is unchanged from the
+// same chunk of parent points at the parent's copy instead of being stored
+// again; with a nil parent every chunk is stored. On failure the chunks
+// stored so far are removed again.
+func Write(ctx context.Context, t Target, prefix string, r io.Reader, parent *Manifest) (*Manifest, int64, error) {
+	if parent != nil && parent.ChunkSize != ChunkSize {
+		parent = nil
+	}
+	m := &Manifest{ChunkSize: ChunkSize}
+	var stored int64
+	var written []string
+	fail := func(err error) (*Manifest, int64, error) {
+		for _, key := range written {
+			_ = t.Delete(context.WithoutCancel(ctx), key)
+		}
+		return nil, 0, err
+	}
+
+	buf := make([]byte, ChunkSize)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			data := buf[:n]
+			m.Size += int64(n)
+			c := Chunk{}
+			if !isZero(data) {
+				c.Hash = hashChunk(data)
+				if parent != nil && i < len(parent.Chunks) && parent.Chunks[i].Hash == c.Hash {
+					c.Key = parent.Chunks[i].Key
+				} else {
+					c.Key = fmt.Sprintf("%s/%08d", prefix, i)
+					if err := t.Put(ctx, c.Key, data); err != nil {
+						return fail(fmt.Errorf("store chunk %d: %w", i, err))
+					}
+					written = append(written, c.Key)
+					stored += int64(n)
+				}
+			}
+			m.Chunks = append(m.Chunks, c)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fail(err)
+	}
+	if err := t.Put(ctx, prefix+"/"+manifestFile, data); err != nil {
+		return fail(fmt.Errorf("store manifest: %w", err))
+	}
+	return m, stored, nil
+}
+
+// Read writes the image described by m to w, checking every chunk against
+// its hash.
+func Read(ctx context.Context, t Target, m *Manifest, w io.Writer) error {
+	zeros := make([]byte, m.ChunkSize)
+	remaining := m.Size
+	for i, c := range m.Chunks {
+		size := int64(m.ChunkSize)
+		if remaining < size {
+			size = remaining
+		}
+		remaining -= size
+		data := zeros[:size]
+		if c.Key != "" {
+			var err error
+			if data, err = t.Get(ctx, c.Key); err != nil {
+				return fmt.Errorf("load chunk %d: %w", i, err)
+			}
+			if int64(len(data)) != size || hashChunk(data) != c.Hash {
+				return fmt.Errorf("chunk %d is corrupt", i)
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func LoadManifest(ctx context.Context, t Target, prefix string) (*Manifest, error) {
+	data, err := t.Get(ctx, prefix+"/"+manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// Delete removes the backup stored under prefix. Chunks that a manifest in
+// others still refers to are kept.
+func Delete(ctx context.Context, t Target, prefix string, m *Manifest, others []*Manifest) error {
+	keep := make(map[string]bool)
+	for _, o := range others {
+		for _, key := range o.Keys() {
+			keep[key] = true
+		}
+	}
+	// The manifest goes first so a half deleted backup is never read.
+	if err := t.Delete(ctx, prefix+"/"+manifestFile); err != nil {
+		return err
+	}
+	for _, key := range m.Keys() {
+		if keep[key] {
+			continue
+		}
+		if err := t.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashChunk(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func isZero(data []byte) bool {
+	var zero [4096]byte
+	for len(data) > 0 {
+		n := min(len(data), len(zero))
+		if !bytes.Equal(data[:n], zero[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func testImage(chunks int) []byte {
+	img := make([]byte, chunks*ChunkSize+1000)
+	for i := range img {
+		img[i] = byte(i % 251)
+	}
+	// The second chunk is unallocated.
+	clear(img[ChunkSize : 2*ChunkSize])
+	return img
+}
+
+func TestWriteAndRead(t *testing.T) {
+	ctx := context.Background()
+	target := NewLocalTarget(t.TempDir())
+	img := testImage(3)
+
+	full, stored, err := Write(ctx, target, "vms/1/1", bytes.NewReader(img), nil)
+	if err != nil {
+		t.Fatalf("full: %v", err)
+	}
+	if full.Size != int64(len(img)) || len(full.Chunks) != 4 || full.Chunks[1].Key != "" {
+		t.Fatalf("unexpected manifest %+v", full)
+	}
+	if stored != int64(len(img)-ChunkSize) {
+		t.Fatalf("stored %d bytes, want %d", stored, len(img)-ChunkSize)
+	}
+
+	img[2*ChunkSize+5] ^= 0xff
+	incr, stored, err := Write(ctx, target, "vms/1/2", bytes.NewReader(img), full)
+	if err != nil {
+		t.Fatalf("incremental: %v", err)
+	}
+	if stored != ChunkSize {
+		t.Fatalf("incremental stored %d bytes, want one chunk", stored)
+	}
+	if incr.Chunks[0].Key != full.Chunks[0].Key || incr.Chunks[2].Key == full.Chunks[2].Key {
+		t.Fatalf("unexpected chunk keys %+v", incr.Chunks)
+	}
+
+	// Deleting the parent keeps the chunks the incremental shares with it.
+	if err := Delete(ctx, target, "vms/1/1", full, []*Manifest{incr}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := LoadManifest(ctx, target, "vms/1/1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("manifest survived delete: %v", err)
+	}
+	if _, err := target.Get(ctx, full.Chunks[2].Key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unshared chunk survived delete: %v", err)
+	}
+	m, err := LoadManifest(ctx, target, "vms/1/2")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	var out bytes.Buffer
+	if err := Read(ctx, target, m, &out); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), img) {
+		t.Fatal("restored image differs")
+	}
+
+	if err := target.Put(ctx, incr.Chunks[3].Key, []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Read(ctx, target, m, &out); err == nil {
+		t.Fatal("expected corrupt chunk to be detected")
+	}
+}
+
+type failingTarget struct {
+	Target
+	puts int
+}
+
+func (f *failingTarget) Put(ctx context.Context, key string, data []byte) error {
+	f.puts++
+	if f.puts == 3 {
+		return errors.New("disk full")
+	}
+	return f.Target.Put(ctx, key, data)
+}
+
+func TestWriteCleansUpOnFailure(t *testing.T) {
+	ctx := context.Background()
+	local := NewLocalTarget(t.TempDir())
+	target := &failingTarget{Target: local}
+
+	full, _, err := Write(ctx, target, "vms/1/1", bytes.NewReader(testImage(3)), nil)
+	if err == nil {
+		t.Fatalf("expected failure, got %+v", full)
+	}
+	for _, key := range []string{"vms/1/1/00000000", "vms/1/1/00000002"} {
+		if _, err := local.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("chunk %s left behind: %v", key, err)
+		}
+	}
+}
+
+func TestLocalTargetRejectsEscapingKeys(t *testing.T) {
+	target := NewLocalTarget(t.TempDir())
+	for _, key := range []string{"", "/etc/passwd", "../x", "a/../../x", "a//b"} {
+		if err := target.Put(context.Background(), key, nil); err == nil {
+			t.Fatalf("key %q accepted", key)
+		}
+	}
+}
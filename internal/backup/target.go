@@ -0,0 +1,93 @@
+// Package backup stores VM disk images on a backup target. Images are cut
+// into fixed-size chunks so that a backup only stores the chunks that
+// changed since its parent.
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNotFound = errors.New("backup object not found")
+
+// Target is where backups are kept. Keys are slash separated paths.
+// Deleting a key that does not exist is not an error.
+type Target interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalTarget keeps backups in a directory, typically a mounted backup
+// volume.
+type LocalTarget struct {
+	dir string
+}
+
+func NewLocalTarget(dir string) *LocalTarget {
+	return &LocalTarget{dir: dir}
+}
+
+func (t *LocalTarget) Put(ctx context.Context, key string, data []byte) error {
+	p, err := t.path(key)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (t *LocalTarget) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := t.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (t *LocalTarget) Delete(ctx context.Context, key string) error {
+	p, err := t.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (t *LocalTarget) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(t.dir, filepath.FromSlash(key)), nil
+}
+
+// checkKey rejects keys that would escape the target's root.
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("invalid backup key %q", key)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+// Package cloudinit renders the NoCloud documents that configure a guest on
+// its first boot: user-data, meta-data and network-config.
+package cloudinit
+
+import (
+	"bytes"
+	"fmt"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Names of the documents in a NoCloud seed and the volume label cloud-init
+// looks for.
+const (
+	UserDataFile      = "user-data"
+	MetaDataFile      = "meta-data"
+	NetworkConfigFile = "network-config"
+	VolumeLabel       = "cidata"
+)
+
+// Config is what a guest is set up with. PasswordHash is a crypt(3) hash,
+// see HashPassword; plain passwords never leave the master.
+type Config struct {
+	InstanceID   string   `json:"instance_id,omitempty"`
+	Hostname     string   `json:"hostname"`
+	PasswordHash string   `json:"password_hash,omitempty"`
+	SSHKeys      []string `json:"ssh_keys,omitempty"`
+	Network      *Network `json:"network,omitempty"`
+}
+
+// Network describes the guest's interfaces. Without interfaces the first
+// ethernet device is configured through DHCP.
+type Network struct {
+	Interfaces []Interface `json:"interfaces"`
+}
+
+// Interface is matched by MAC when given, then by the name pattern Match,
+// such as "e*", and by name otherwise. Addresses are in CIDR notation.
+type Interface struct {
+	Name        string   `json:"name"`
+	MAC         string   `json:"mac,omitempty"`
+	Match       string   `json:"match,omitempty"`
+	DHCP4       bool     `json:"dhcp4,omitempty"`
+	DHCP6       bool     `json:"dhcp6,omitempty"`
+	Addresses   []string `json:"addresses,omitempty"`
+	Gateway4    string   `json:"gateway4,omitempty"`
+	Gateway6    string   `json:"gateway6,omitempty"`
+	Nameservers []string `json:"nameservers,omitempty"`
+}
+
+type userData struct {
+	Hostname       string     `yaml:"hostname"`
+	ManageEtcHosts bool       `yaml:"manage_etc_hosts"`
+	DisableRoot    bool       `yaml:"disable_root"`
+	SSHPwauth      bool       `yaml:"ssh_pwauth"`
+	Users          []userSpec `yaml:"users"`
+}
+
+type userSpec struct {
+	Name              string   `yaml:"name"`
+	LockPasswd        bool     `yaml:"lock_passwd"`
+	HashedPasswd      string   `yaml:"hashed_passwd,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+// RenderUserData renders the #cloud-config document. Root logs in with the
+// password and keys from cfg; password logins over SSH are only enabled
+// when a password is set.
+func RenderUserData(cfg Config) ([]byte, error) {
+	if cfg.Hostname == "" {
+		return nil, fmt.Errorf("cloud-init config requires a hostname")
+	}
+	doc := userData{
+		Hostname:       cfg.Hostname,
+		ManageEtcHosts: true,
+		DisableRoot:    false,
+		SSHPwauth:      cfg.PasswordHash != "",
+		Users: []userSpec{{
+			Name:              "root",
+			LockPasswd:        cfg.PasswordHash == "",
+			HashedPasswd:      cfg.PasswordHash,
+			SSHAuthorizedKeys: cfg.SSHKeys,
+		}},
+	}
+	out, err := marshalYAML(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), out...), nil
+}
+
+type metaData struct {
+	InstanceID    string `yaml:"instance-id"`
+	LocalHostname string `yaml:"local-hostname"`
+}
+
+// RenderMetaData renders meta-data. cloud-init runs its first-boot modules
+// again whenever the instance ID changes.
+func RenderMetaData(cfg Config) ([]byte, error) {
+	if cfg.InstanceID == "" {
+		return nil, fmt.Errorf("cloud-init config requires an instance id")
+	}
+	return marshalYAML(metaData{InstanceID: cfg.InstanceID, LocalHostname: cfg.Hostname})
+}
+
+type networkConfig struct {
+	Version   int                       `yaml:"version"`
+	Ethernets map[string]ethernetConfig `yaml:"ethernets"`
+}
+
+type ethernetConfig struct {
+	Match       *ethernetMatch     `yaml:"match,omitempty"`
+	SetName     string             `yaml:"set-name,omitempty"`
+	DHCP4       bool               `yaml:"dhcp4"`
+	DHCP6       bool               `yaml:"dhcp6"`
+	Addresses   []string           `yaml:"addresses,omitempty"`
+	Routes      []route            `yaml:"routes,omitempty"`
+	Nameservers *nameserversConfig `yaml:"nameservers,omitempty"`
+}
+
+type ethernetMatch struct {
+	Name       string `yaml:"name,omitempty"`
+	MACAddress string `yaml:"macaddress,omitempty"`
+}
+
+type route struct {
+	To  string `yaml:"to"`
+	Via string `yaml:"via"`
+}
+
+type nameserversConfig struct {
+	Addresses []string `yaml:"addresses"`
+}
+
+// RenderNetworkConfig renders a version 2 network-config.
+func RenderNetworkConfig(cfg Config) ([]byte, error) {
+	doc := networkConfig{Version: 2, Ethernets: map[string]ethernetConfig{}}
+	if cfg.Network == nil || len(cfg.Network.Interfaces) == 0 {
+		doc.Ethernets["eth0"] = ethernetConfig{Match: &ethernetMatch{Name: "e*"}, DHCP4: true}
+		return marshalYAML(doc)
+	}
+	for _, iface := range cfg.Network.Interfaces {
+		if iface.Name == "" {
+			return nil, fmt.Errorf("network interface without a name")
+		}
+		eth := ethernetConfig{
+			DHCP4:     iface.DHCP4,
+			DHCP6:     iface.DHCP6,
+			Addresses: iface.Addresses,
+		}
+		if iface.MAC != "" {
+			eth.Match = &ethernetMatch{MACAddress: iface.MAC}
+			eth.SetName = iface.Name
+		} else if iface.Match != "" {
+			eth.Match = &ethernetMatch{Name: iface.Match}
+		}
+		if iface.Gateway4 != "" {
+			eth.Routes = append(eth.Routes, route{To: "0.0.0.0/0", Via: iface.Gateway4})
+		}
+		if iface.Gateway6 != "" {
+			eth.Routes = append(eth.Routes, route{To: "::/0", Via: iface.Gateway6})
+		}
+		if len(iface.Nameservers) > 0 {
+			eth.Nameservers = &nameserversConfig{Addresses: iface.Nameservers}
+		}
+		doc.Ethernets[iface.Name] = eth
+	}
+	return marshalYAML(doc)
+}
+
+// Files renders all three documents keyed by their file name in the seed.
+func Files(cfg Config) (map[string][]byte, error) {
+	files := make(map[string][]byte, 3)
+	for name, render := range map[string]func(Config) ([]byte, error){
+		UserDataFile:      RenderUserData,
+		MetaDataFile:      RenderMetaData,
+		NetworkConfigFile: RenderNetworkConfig,
+	} {
+		data, err := render(cfg)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+func marshalYAML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,107 @@
+package cloudinit
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files")
+
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("write golden: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch\n--- got ---\n%s\n--- want ---\n%s", name, got, want)
+	}
+}
+
+func TestRender(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+	}{
+		{
+			name: "dhcp",
+			cfg: Config{
+				InstanceID: "vm-0011223344556677",
+				Hostname:   "web-1",
+				SSHKeys:    []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHjWQbW6LUNs5U9HVR9L8c1ObBbsmmB1TeuuT7BUgL8J alice@laptop"},
+			},
+		},
+		{
+			name: "static",
+			cfg: Config{
+				InstanceID:   "vm-8899aabbccddeeff",
+				Hostname:     "db",
+				PasswordHash: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+				Network: &Network{Interfaces: []Interface{{
+					Name:        "eth0",
+					MAC:         "52:54:00:12:34:56",
+					Addresses:   []string{"203.0.113.10/24", "2001:db8::10/64"},
+					Gateway4:    "203.0.113.1",
+					Gateway6:    "2001:db8::1",
+					Nameservers: []string{"1.1.1.1", "2606:4700:4700::1111"},
+				}}},
+			},
+		},
+		{
+			name: "pool",
+			cfg: Config{
+				InstanceID: "vm-0123456789abcdef",
+				Hostname:   "app",
+				Network: &Network{Interfaces: []Interface{{
+					Name:      "eth0",
+					Match:     "e*",
+					Addresses: []string{"198.51.100.7/24"},
+					Gateway4:  "198.51.100.1",
+				}}},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := Files(tc.cfg)
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+			for _, file := range []string{UserDataFile, MetaDataFile, NetworkConfigFile} {
+				assertGolden(t, tc.name+"."+file, files[file])
+			}
+		})
+	}
+}
+
+func TestRenderUserDataHeader(t *testing.T) {
+	out, err := RenderUserData(Config{Hostname: "web-1"})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !strings.HasPrefix(string(out), "#cloud-config\n") {
+		t.Fatalf("user-data must start with #cloud-config, got %q", out)
+	}
+}
+
+func TestRenderRequiresIdentity(t *testing.T) {
+	if _, err := RenderUserData(Config{InstanceID: "vm-x"}); err == nil {
+		t.Fatal("expected error for config without hostname")
+	}
+	if _, err := RenderMetaData(Config{Hostname: "web-1"}); err == nil {
+		t.Fatal("expected error for config without instance id")
+	}
+	if _, err := RenderNetworkConfig(Config{Network: &Network{Interfaces: []Interface{{DHCP4: true}}}}); err == nil {
+		t.Fatal("expected error for unnamed interface")
+	}
+}
@@ -0,0 +1,129 @@
+package cloudinit
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"strings"
+)
+
+const (
+	cryptAlphabet       = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	sha512DefaultRounds = 5000
+	sha512SaltLen       = 16
+)
+
+// HashPassword hashes password with SHA-512 crypt ("$6$"), the scheme every
+// current Linux distribution accepts in /etc/shadow.
+func HashPassword(password string) (string, error) {
+	b := make([]byte, sha512SaltLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	salt := make([]byte, sha512SaltLen)
+	for i, v := range b {
+		salt[i] = cryptAlphabet[int(v)%len(cryptAlphabet)]
+	}
+	return sha512Crypt(password, string(salt), sha512DefaultRounds), nil
+}
+
+// sha512Crypt implements the SHA-512 based crypt(3) scheme as specified by
+// Ulrich Drepper in "Unix crypt using SHA-256 and SHA-512".
+func sha512Crypt(password, salt string, rounds int) string {
+	if len(salt) > sha512SaltLen {
+		salt = salt[:sha512SaltLen]
+	}
+	key, s := []byte(password), []byte(salt)
+
+	b := sha512.New()
+	b.Write(key)
+	b.Write(s)
+	b.Write(key)
+	digestB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(key)
+	a.Write(s)
+	a.Write(repeatTo(digestB, len(key)))
+	for n := len(key); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(key)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range key {
+		dp.Write(key)
+	}
+	p := repeatTo(dp.Sum(nil), len(key))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(s)
+	}
+	sSeq := repeatTo(ds.Sum(nil), len(s))
+
+	c := digestA
+	for i := 0; i < rounds; i++ {
+		h := sha512.New()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sSeq)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$")
+	if rounds != sha512DefaultRounds {
+		fmt.Fprintf(&out, "rounds=%d$", rounds)
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	for _, g := range sha512Groups {
+		encode24(&out, c[g[0]], c[g[1]], c[g[2]], 4)
+	}
+	encode24(&out, 0, 0, c[63], 2)
+	return out.String()
+}
+
+// sha512Groups is the order in which digest bytes are encoded.
+var sha512Groups = [21][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+// repeatTo returns n bytes made of digest repeated.
+func repeatTo(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out)+len(digest) <= n {
+		out = append(out, digest...)
+	}
+	return append(out, digest[:n-len(out)]...)
+}
@@ -0,0 +1,48 @@
+package cloudinit
+
+import (
+	"strings"
+	"testing"
+)
+
+// Vectors from "Unix crypt using SHA-256 and SHA-512".
+func TestSHA512Crypt(t *testing.T) {
+	cases := []struct {
+		password, salt string
+		rounds         int
+		want           string
+	}{
+		{"Hello world!", "saltstring", 5000,
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"Hello world!", "saltstringsaltstring", 10000,
+			"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"This is just a test", "toolongsaltstring", 5000,
+			"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	}
+	for _, tc := range cases {
+		got := sha512Crypt(tc.password, tc.salt, tc.rounds)
+		// The default round count is implied in our output.
+		want := strings.Replace(tc.want, "$rounds=5000$", "$", 1)
+		if got != want {
+			t.Errorf("sha512Crypt(%q, %q, %d) = %s, want %s", tc.password, tc.salt, tc.rounds, got, want)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	a, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	b, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	if !strings.HasPrefix(a, "$6$") || a == b {
+		t.Fatalf("expected salted SHA-512 crypt hashes, got %s and %s", a, b)
+	}
+	salt := strings.Split(a, "$")[2]
+	if sha512Crypt("hunter2", salt, sha512DefaultRounds) != a {
+		t.Fatalf("hash %s does not verify", a)
+	}
+}
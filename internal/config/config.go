@@ -11,10 +11,25 @@ import (
 )
 
 type Config struct {
-	Server   ServerConfig   `mapstructure:"server" json:"server"`
-	Database DatabaseConfig `mapstructure:"database" json:"database"`
-	JWT      JWTConfig      `mapstructure:"jwt" json:"jwt"`
-	Logger   LoggerConfig   `mapstructure:"logger" json:"logger"`
+	Server     ServerConfig          `mapstructure:"server" json:"server"`
+	Database   DatabaseConfig        `mapstructure:"database" json:"database"`
+	JWT        JWTConfig             `mapstructure:"jwt" json:"jwt"`
+	Logger     LoggerConfig          `mapstructure:"logger" json:"logger"`
+	Hypervisor HypervisorConfig      `mapstructure:"hypervisor" json:"hypervisor"`
+	Agent      AgentConfig           `mapstructure:"agent" json:"agent"`
+	Scheduler  SchedulerConfig       `mapstructure:"scheduler" json:"scheduler"`
+	Tasks      TasksConfig           `mapstructure:"tasks" json:"tasks"`
+	Reconciler ReconcilerConfig      `mapstructure:"reconciler" json:"reconciler"`
+	Plans      map[string]PlanConfig `mapstructure:"plans" json:"plans"`
+	Backup     BackupConfig          `mapstructure:"backup" json:"backup"`
+	Console    ConsoleConfig         `mapstructure:"console" json:"console"`
+	IPAM       IPAMConfig            `mapstructure:"ipam" json:"ipam"`
+	NAT        NATConfig             `mapstructure:"nat" json:"nat"`
+	Firewall   FirewallConfig        `mapstructure:"firewall" json:"firewall"`
+	Traffic    TrafficConfig         `mapstructure:"traffic" json:"traffic"`
+
+	// DefaultPlan names the plan of VMs created without one.
+	DefaultPlan string `mapstructure:"default_plan" json:"default_plan"`
 }
 
 type ServerConfig struct {
@@ -39,6 +54,162 @@ type LoggerConfig struct {
 	Level  string `mapstructure:"level" json:"level"`
 }
 
+type HypervisorConfig struct {
+	Driver  string        `mapstructure:"driver" json:"driver"`
+	QEMU    QEMUConfig    `mapstructure:"qemu" json:"qemu"`
+	Libvirt LibvirtConfig `mapstructure:"libvirt" json:"libvirt"`
+	Remote  RemoteConfig  `mapstructure:"remote" json:"remote"`
+}
+
+type QEMUConfig struct {
+	Binary                 string `mapstructure:"binary" json:"binary"`
+	ImgBinary              string `mapstructure:"img_binary" json:"img_binary"`
+	ISOBinary              string `mapstructure:"iso_binary" json:"iso_binary"`
+	DataDir                string `mapstructure:"data_dir" json:"data_dir"`
+	ImageDir               string `mapstructure:"image_dir" json:"image_dir"`
+	Accel                  string `mapstructure:"accel" json:"accel"`
+	Machine                string `mapstructure:"machine" json:"machine"`
+	Bridge                 string `mapstructure:"bridge" json:"bridge"`
+	ShutdownTimeoutSeconds int    `mapstructure:"shutdown_timeout_seconds" json:"shutdown_timeout_seconds"`
+}
+
+type LibvirtConfig struct {
+	Socket                 string `mapstructure:"socket" json:"socket"`
+	StoragePool            string `mapstructure:"storage_pool" json:"storage_pool"`
+	ImageDir               string `mapstructure:"image_dir" json:"image_dir"`
+	SeedDir                string `mapstructure:"seed_dir" json:"seed_dir"`
+	ISOBinary              string `mapstructure:"iso_binary" json:"iso_binary"`
+	ImgBinary              string `mapstructure:"img_binary" json:"img_binary"`
+	Network                string `mapstructure:"network" json:"network"`
+	Bridge                 string `mapstructure:"bridge" json:"bridge"`
+	Machine                string `mapstructure:"machine" json:"machine"`
+	ShutdownTimeoutSeconds int    `mapstructure:"shutdown_timeout_seconds" json:"shutdown_timeout_seconds"`
+}
+
+// RemoteConfig selects the node whose agent serves hypervisor calls when
+// driver is "remote".
+type RemoteConfig struct {
+	Node string `mapstructure:"node" json:"node"`
+}
+
+// AgentConfig is shared by the node agent (server side) and the master
+// (client side). Each side configures its own certificate and the CA it
+// trusts for the peer.
+type AgentConfig struct {
+	Listen                   string    `mapstructure:"listen" json:"listen"`
+	Token                    string    `mapstructure:"token" json:"-"`
+	TLS                      TLSConfig `mapstructure:"tls" json:"tls"`
+	MasterURL                string    `mapstructure:"master_url" json:"master_url"`
+	NodeName                 string    `mapstructure:"node_name" json:"node_name"`
+	AdvertiseURL             string    `mapstructure:"advertise_url" json:"advertise_url"`
+	Region                   string    `mapstructure:"region" json:"region"`
+	HeartbeatIntervalSeconds int       `mapstructure:"heartbeat_interval_seconds" json:"heartbeat_interval_seconds"`
+	OfflineAfterSeconds      int       `mapstructure:"offline_after_seconds" json:"offline_after_seconds"`
+	// NATBackend, "nftables" or "iptables", lets the agent forward ports to
+	// NAT guests. Empty leaves the host firewall alone.
+	NATBackend string `mapstructure:"nat_backend" json:"nat_backend"`
+	// Firewall lets the agent filter guest traffic by security group with
+	// nftables.
+	Firewall bool `mapstructure:"firewall" json:"firewall"`
+}
+
+// SchedulerConfig picks how new VMs are placed on nodes: "spread" (default)
+// prefers the emptiest node, "binpack" fills the fullest node that still fits.
+type SchedulerConfig struct {
+	Policy string `mapstructure:"policy" json:"policy"`
+}
+
+type TasksConfig struct {
+	Workers int `mapstructure:"workers" json:"workers"`
+}
+
+// ReconcilerConfig controls the loop that brings VM rows back in line with
+// the hypervisors. VMs stuck in a transitional state for StaleAfterSeconds
+// are settled to whatever the hypervisor reports.
+type ReconcilerConfig struct {
+	IntervalSeconds   int `mapstructure:"interval_seconds" json:"interval_seconds"`
+	StaleAfterSeconds int `mapstructure:"stale_after_seconds" json:"stale_after_seconds"`
+}
+
+// PlanConfig sets the limits of a VM plan. Only admins assign plans; VMs
+// created without one get the plan named by DefaultPlan, or the one named
+// "default", which is unlimited unless configured. Port speeds are in Mbps
+// and TrafficGB is the monthly transfer allowance, both directions
+// counted; zero means unlimited.
+type PlanConfig struct {
+	MaxSnapshots int `mapstructure:"max_snapshots" json:"max_snapshots"`
+	InboundMbps  int `mapstructure:"inbound_mbps" json:"inbound_mbps"`
+	OutboundMbps int `mapstructure:"outbound_mbps" json:"outbound_mbps"`
+	TrafficGB    int `mapstructure:"traffic_gb" json:"traffic_gb"`
+}
+
+// BackupConfig picks where VM backups are stored: a local directory, which
+// should be shared storage when there are several masters, or an
+// S3-compatible bucket.
+type BackupConfig struct {
+	Target                  string   `mapstructure:"target" json:"target"`
+	Dir                     string   `mapstructure:"dir" json:"dir"`
+	S3                      S3Config `mapstructure:"s3" json:"s3"`
+	ScheduleIntervalSeconds int      `mapstructure:"schedule_interval_seconds" json:"schedule_interval_seconds"`
+}
+
+type S3Config struct {
+	Endpoint  string `mapstructure:"endpoint" json:"endpoint"`
+	Region    string `mapstructure:"region" json:"region"`
+	Bucket    string `mapstructure:"bucket" json:"bucket"`
+	Prefix    string `mapstructure:"prefix" json:"prefix"`
+	AccessKey string `mapstructure:"access_key" json:"access_key"`
+	SecretKey string `mapstructure:"secret_key" json:"-"`
+}
+
+// ConsoleConfig limits console access: a console token must be used within
+// TokenTTLSeconds and the session it opens is closed after
+// SessionTTLSeconds.
+type ConsoleConfig struct {
+	TokenTTLSeconds   int `mapstructure:"token_ttl_seconds" json:"token_ttl_seconds"`
+	SessionTTLSeconds int `mapstructure:"session_ttl_seconds" json:"session_ttl_seconds"`
+}
+
+// IPAMConfig sets how long an address given back by a deleted VM is held
+// before another VM may get it.
+type IPAMConfig struct {
+	QuarantineSeconds int `mapstructure:"quarantine_seconds" json:"quarantine_seconds"`
+}
+
+// NATConfig sets the public ports NAT VMs get: PortsPerVM consecutive ports
+// per VM, taken from PortStart to PortEnd on each node. PublicIP is the
+// address of the default hypervisor, which has no node record.
+type NATConfig struct {
+	PublicIP            string `mapstructure:"public_ip" json:"public_ip"`
+	PortStart           int    `mapstructure:"port_start" json:"port_start"`
+	PortEnd             int    `mapstructure:"port_end" json:"port_end"`
+	PortsPerVM          int    `mapstructure:"ports_per_vm" json:"ports_per_vm"`
+	SyncIntervalSeconds int    `mapstructure:"sync_interval_seconds" json:"sync_interval_seconds"`
+}
+
+// FirewallConfig sets how often every node's security group rules are
+// pushed again.
+type FirewallConfig struct {
+	SyncIntervalSeconds int `mapstructure:"sync_interval_seconds" json:"sync_interval_seconds"`
+}
+
+// TrafficConfig sets how often traffic counters are read from the nodes
+// and what happens to a VM over its monthly allowance: "none" only meters
+// it, "throttle" caps its port speed at ThrottleMbps and "suspend" stops it
+// and keeps its owner from starting it until the month ends.
+type TrafficConfig struct {
+	IntervalSeconds     int    `mapstructure:"interval_seconds" json:"interval_seconds"`
+	Policy              string `mapstructure:"policy" json:"policy"`
+	ThrottleMbps        int    `mapstructure:"throttle_mbps" json:"throttle_mbps"`
+	HourlyRetentionDays int    `mapstructure:"hourly_retention_days" json:"hourly_retention_days"`
+}
+
+type TLSConfig struct {
+	Cert string `mapstructure:"cert" json:"cert"`
+	Key  string `mapstructure:"key" json:"key"`
+	CA   string `mapstructure:"ca" json:"ca"`
+}
+
 func LoadConfig(path string) (*Config, error) {
 	v := viper.New()
 	v.SetConfigFile(path)
@@ -76,6 +247,18 @@ func LoadConfig(path string) (*Config, error) {
 	if l := os.Getenv("LOGGER_LEVEL"); l != "" {
 		cfg.Logger.Level = l
 	}
+	if d := os.Getenv("HYPERVISOR_DRIVER"); d != "" {
+		cfg.Hypervisor.Driver = d
+	}
+	if p := os.Getenv("SCHEDULER_POLICY"); p != "" {
+		cfg.Scheduler.Policy = p
+	}
+	if t := os.Getenv("AGENT_TOKEN"); t != "" {
+		cfg.Agent.Token = t
+	}
+	if k := os.Getenv("BACKUP_S3_SECRET_KEY"); k != "" {
+		cfg.Backup.S3.SecretKey = k
+	}
 
 	return &cfg, nil
 }
@@ -97,6 +280,138 @@ func (c *Config) GetJWTTTLSeconds() int64 {
 	return 86400
 }
 
+func (c *TasksConfig) WorkerCount() int {
+	if c.Workers > 0 {
+		return c.Workers
+	}
+	return 4
+}
+
+func (c *ReconcilerConfig) Interval() time.Duration {
+	if c.IntervalSeconds > 0 {
+		return time.Duration(c.IntervalSeconds) * time.Second
+	}
+	return time.Minute
+}
+
+func (c *ReconcilerConfig) StaleAfter() time.Duration {
+	if c.StaleAfterSeconds > 0 {
+		return time.Duration(c.StaleAfterSeconds) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+func (c *BackupConfig) Directory() string {
+	if c.Dir != "" {
+		return c.Dir
+	}
+	return "/var/lib/starstream/backups"
+}
+
+func (c *BackupConfig) ScheduleInterval() time.Duration {
+	if c.ScheduleIntervalSeconds > 0 {
+		return time.Duration(c.ScheduleIntervalSeconds) * time.Second
+	}
+	return time.Minute
+}
+
+func (c *ConsoleConfig) TokenTTL() time.Duration {
+	if c.TokenTTLSeconds > 0 {
+		return time.Duration(c.TokenTTLSeconds) * time.Second
+	}
+	return time.Minute
+}
+
+func (c *ConsoleConfig) SessionTTL() time.Duration {
+	if c.SessionTTLSeconds > 0 {
+		return time.Duration(c.SessionTTLSeconds) * time.Second
+	}
+	return time.Hour
+}
+
+// Quarantine defaults to a day; a negative setting turns it off.
+func (c *IPAMConfig) Quarantine() time.Duration {
+	switch {
+	case c.QuarantineSeconds > 0:
+		return time.Duration(c.QuarantineSeconds) * time.Second
+	case c.QuarantineSeconds < 0:
+		return 0
+	}
+	return 24 * time.Hour
+}
+
+// Ports defaults to 20000-59999.
+func (c *NATConfig) Ports() (start, end int) {
+	start, end = c.PortStart, c.PortEnd
+	if start <= 0 {
+		start = 20000
+	}
+	if end <= 0 || end > 65535 {
+		end = 59999
+	}
+	return start, end
+}
+
+func (c *NATConfig) PerVM() int {
+	if c.PortsPerVM > 0 {
+		return c.PortsPerVM
+	}
+	return 20
+}
+
+func (c *NATConfig) SyncInterval() time.Duration {
+	if c.SyncIntervalSeconds > 0 {
+		return time.Duration(c.SyncIntervalSeconds) * time.Second
+	}
+	return time.Minute
+}
+
+func (c *FirewallConfig) SyncInterval() time.Duration {
+	if c.SyncIntervalSeconds > 0 {
+		return time.Duration(c.SyncIntervalSeconds) * time.Second
+	}
+	return time.Minute
+}
+
+func (c *TrafficConfig) Interval() time.Duration {
+	if c.IntervalSeconds > 0 {
+		return time.Duration(c.IntervalSeconds) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+func (c *TrafficConfig) Throttle() int {
+	if c.ThrottleMbps > 0 {
+		return c.ThrottleMbps
+	}
+	return 10
+}
+
+// HourlyRetention is how long hourly usage is kept; monthly usage is kept
+// for good.
+func (c *TrafficConfig) HourlyRetention() time.Duration {
+	if c.HourlyRetentionDays > 0 {
+		return time.Duration(c.HourlyRetentionDays) * 24 * time.Hour
+	}
+	return 90 * 24 * time.Hour
+}
+
+func (c *AgentConfig) HeartbeatInterval() time.Duration {
+	if c.HeartbeatIntervalSeconds > 0 {
+		return time.Duration(c.HeartbeatIntervalSeconds) * time.Second
+	}
+	return 15 * time.Second
+}
+
+// OfflineAfter is how long the master waits for a heartbeat before marking
+// a node offline; it defaults to three missed heartbeats.
+func (c *AgentConfig) OfflineAfter() time.Duration {
+	if c.OfflineAfterSeconds > 0 {
+		return time.Duration(c.OfflineAfterSeconds) * time.Second
+	}
+	return 3 * c.HeartbeatInterval()
+}
+
 func NewZapLogger(cfg *LoggerConfig) (*zap.Logger, error) {
 	if cfg == nil {
 		cfg = &LoggerConfig{UseZap: true, Level: "info"}
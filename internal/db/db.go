@@ -18,7 +18,7 @@ import (
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
-	"Zjmf-kvm/internal/model"
+	"StarstreamAstra/internal/model"
 )
 
 type DBConn struct {
@@ -84,7 +84,26 @@ func InitDB(dsn string, useZap bool, zapLogger *zap.Logger, loggerChoice string)
 			&model.User{},
 			&model.Node{},
 			&model.VM{},
+			&model.VMTransition{},
 			&model.Order{},
+			&model.Task{},
+			&model.OutboxEvent{},
+			&model.Image{},
+			&model.SSHKey{},
+			&model.Snapshot{},
+			&model.Backup{},
+			&model.BackupSchedule{},
+			&model.ConsoleToken{},
+			&model.IPPool{},
+			&model.IPAddress{},
+			&model.NATPortRange{},
+			&model.PortForward{},
+			&model.SecurityGroup{},
+			&model.SecurityGroupRule{},
+			&model.VMSecurityGroup{},
+			&model.TrafficUsage{},
+			&model.TrafficCounter{},
+			&model.TrafficEnforcement{},
 		); err != nil {
 			zapLogger.Sugar().Warnf("auto migrate warning: %v", err)
 		}
@@ -116,7 +135,26 @@ func InitDB(dsn string, useZap bool, zapLogger *zap.Logger, loggerChoice string)
 		&model.User{},
 		&model.Node{},
 		&model.VM{},
+		&model.VMTransition{},
 		&model.Order{},
+		&model.Task{},
+		&model.OutboxEvent{},
+		&model.Image{},
+		&model.SSHKey{},
+		&model.Snapshot{},
+		&model.Backup{},
+		&model.BackupSchedule{},
+		&model.ConsoleToken{},
+		&model.IPPool{},
+		&model.IPAddress{},
+		&model.NATPortRange{},
+		&model.PortForward{},
+		&model.SecurityGroup{},
+		&model.SecurityGroupRule{},
+		&model.VMSecurityGroup{},
+		&model.TrafficUsage{},
+		&model.TrafficCounter{},
+		&model.TrafficEnforcement{},
 	); err != nil {
 		log.Printf("Auto migrate warning: %v", err)
 	}
@@ -0,0 +1,227 @@
+// Package firewall renders the security groups of a node's guests as one
+// nftables table and applies it. Guests are filtered on the host, so the
+// rules hold whatever the guest's own firewall does.
+//
+// A guest with rules only accepts inbound traffic a rule allows. Outbound
+// traffic is open unless the guest has outbound rules, in which case only
+// what they allow leaves. Replies to allowed connections always pass.
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// Rule directions.
+const (
+	Ingress = "ingress"
+	Egress  = "egress"
+)
+
+// Rule protocols. ProtocolAny matches every protocol and takes no ports.
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolICMP = "icmp"
+	ProtocolAny  = "any"
+)
+
+// table is the only part of the host's ruleset that is touched.
+const table = "starstream_fw"
+
+// Rule allows traffic of Protocol between the guest and CIDR. For TCP and
+// UDP, PortFrom-PortTo limits the guest's port inbound and the remote port
+// outbound; no ports means every port.
+type Rule struct {
+	Protocol string `json:"protocol"`
+	PortFrom int    `json:"port_from"`
+	PortTo   int    `json:"port_to"`
+	CIDR     string `json:"cidr"`
+}
+
+// Guest is the rules of one VM. Addresses are the guest's addresses or
+// the prefixes routed to it.
+type Guest struct {
+	VMID      uint     `json:"vm_id"`
+	Addresses []string `json:"addresses"`
+	Ingress   []Rule   `json:"ingress"`
+	Egress    []Rule   `json:"egress"`
+}
+
+// Ruleset is the filtering of every guest on a node that has rules.
+type Ruleset struct {
+	Guests []Guest `json:"guests"`
+}
+
+// Validate checks everything that ends up in a rule, so a ruleset that
+// passes renders into rules nft accepts.
+func (rs Ruleset) Validate() error {
+	for _, g := range rs.Guests {
+		if len(g.Addresses) == 0 {
+			return fmt.Errorf("guest %d has no addresses", g.VMID)
+		}
+		for _, addr := range g.Addresses {
+			if _, err := parseAddr(addr); err != nil {
+				return fmt.Errorf("guest %d: %w", g.VMID, err)
+			}
+		}
+		for _, r := range append(append([]Rule(nil), g.Ingress...), g.Egress...) {
+			if err := r.Validate(); err != nil {
+				return fmt.Errorf("guest %d: %w", g.VMID, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r Rule) Validate() error {
+	if _, err := netip.ParsePrefix(r.CIDR); err != nil {
+		return fmt.Errorf("invalid CIDR %q", r.CIDR)
+	}
+	switch r.Protocol {
+	case ProtocolTCP, ProtocolUDP:
+		if r.PortFrom == 0 && r.PortTo == 0 {
+			return nil
+		}
+		if r.PortFrom < 1 || r.PortTo > 65535 || r.PortFrom > r.PortTo {
+			return fmt.Errorf("invalid port range %d-%d", r.PortFrom, r.PortTo)
+		}
+	case ProtocolICMP, ProtocolAny:
+		if r.PortFrom != 0 || r.PortTo != 0 {
+			return fmt.Errorf("protocol %s takes no ports", r.Protocol)
+		}
+	default:
+		return fmt.Errorf("unknown protocol %q", r.Protocol)
+	}
+	return nil
+}
+
+// parseAddr accepts an address or a prefix and returns it as a prefix.
+func parseAddr(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid guest prefix %q", s)
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid guest address %q", s)
+	}
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// family returns the nft address match for p: "ip" or "ip6".
+func family(p netip.Prefix) string {
+	if p.Addr().Is4() {
+		return "ip"
+	}
+	return "ip6"
+}
+
+// match renders p as an nft address: a bare address for a single host.
+func match(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
+
+// Render renders the ruleset as an nft script. Like the NAT table it
+// creates the table before deleting it, so loading the script replaces
+// the table in one transaction whether or not it existed.
+func Render(rs Ruleset) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", table, table)
+	fmt.Fprintf(&b, "table inet %s {\n", table)
+	b.WriteString("\tchain forward {\n\t\ttype filter hook forward priority filter; policy accept;\n")
+	b.WriteString("\t\tct state established,related accept\n")
+	for _, g := range rs.Guests {
+		for _, addr := range g.Addresses {
+			p, _ := parseAddr(addr)
+			fmt.Fprintf(&b, "\t\t%s daddr %s jump vm%d_in\n", family(p), match(p), g.VMID)
+		}
+		if len(g.Egress) == 0 {
+			continue
+		}
+		for _, addr := range g.Addresses {
+			p, _ := parseAddr(addr)
+			fmt.Fprintf(&b, "\t\t%s saddr %s jump vm%d_out\n", family(p), match(p), g.VMID)
+		}
+	}
+	b.WriteString("\t}\n")
+	for _, g := range rs.Guests {
+		writeChain(&b, fmt.Sprintf("vm%d_in", g.VMID), "saddr", g.Ingress)
+		if len(g.Egress) > 0 {
+			writeChain(&b, fmt.Sprintf("vm%d_out", g.VMID), "daddr", g.Egress)
+		}
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// writeChain renders rules matching the remote end on peer ("saddr" or
+// "daddr"), followed by a drop of everything else.
+func writeChain(b *bytes.Buffer, name, peer string, rules []Rule) {
+	fmt.Fprintf(b, "\tchain %s {\n", name)
+	for _, r := range rules {
+		p, _ := netip.ParsePrefix(r.CIDR)
+		p = p.Masked()
+		fmt.Fprintf(b, "\t\t%s %s %s", family(p), peer, match(p))
+		switch r.Protocol {
+		case ProtocolTCP, ProtocolUDP:
+			switch {
+			case r.PortFrom == 0:
+				fmt.Fprintf(b, " meta l4proto %s", r.Protocol)
+			case r.PortFrom == r.PortTo:
+				fmt.Fprintf(b, " %s dport %d", r.Protocol, r.PortFrom)
+			default:
+				fmt.Fprintf(b, " %s dport %d-%d", r.Protocol, r.PortFrom, r.PortTo)
+			}
+		case ProtocolICMP:
+			if p.Addr().Is4() {
+				b.WriteString(" meta l4proto icmp")
+			} else {
+				b.WriteString(" meta l4proto ipv6-icmp")
+			}
+		}
+		b.WriteString(" accept\n")
+	}
+	b.WriteString("\t\tdrop\n\t}\n")
+}
+
+// runner executes name with stdin and returns its combined output.
+type runner func(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error)
+
+func execRunner(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// NFTables applies rulesets to the host it runs on with nft.
+type NFTables struct {
+	run runner
+}
+
+func NewNFTables() *NFTables {
+	return &NFTables{run: execRunner}
+}
+
+// Apply replaces the host's guest filtering with rs.
+func (n *NFTables) Apply(ctx context.Context, rs Ruleset) error {
+	if err := rs.Validate(); err != nil {
+		return err
+	}
+	_, err := n.run(ctx, Render(rs), "nft", "-f", "-")
+	return err
+}
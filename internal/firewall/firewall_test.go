@@ -0,0 +1,124 @@
+package firewall
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+var testRuleset = Ruleset{Guests: []Guest{
+	{
+		VMID:      7,
+		Addresses: []string{"198.51.100.2", "2001:db8:1::/64"},
+		Ingress: []Rule{
+			{Protocol: ProtocolTCP, PortFrom: 22, PortTo: 22, CIDR: "0.0.0.0/0"},
+			{Protocol: ProtocolTCP, PortFrom: 22, PortTo: 22, CIDR: "::/0"},
+			{Protocol: ProtocolUDP, PortFrom: 60000, PortTo: 61000, CIDR: "203.0.113.0/24"},
+			{Protocol: ProtocolICMP, CIDR: "0.0.0.0/0"},
+			{Protocol: ProtocolICMP, CIDR: "::/0"},
+		},
+	},
+	{
+		VMID:      9,
+		Addresses: []string{"10.10.0.5"},
+		Ingress:   []Rule{{Protocol: ProtocolAny, CIDR: "10.10.0.0/24"}},
+		Egress: []Rule{
+			{Protocol: ProtocolUDP, PortFrom: 53, PortTo: 53, CIDR: "10.10.0.1/32"},
+			{Protocol: ProtocolTCP, CIDR: "192.0.2.9/24"},
+		},
+	},
+}}
+
+func TestRender(t *testing.T) {
+	want := `table inet starstream_fw
+delete table inet starstream_fw
+table inet starstream_fw {
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		ct state established,related accept
+		ip daddr 198.51.100.2 jump vm7_in
+		ip6 daddr 2001:db8:1::/64 jump vm7_in
+		ip daddr 10.10.0.5 jump vm9_in
+		ip saddr 10.10.0.5 jump vm9_out
+	}
+	chain vm7_in {
+		ip saddr 0.0.0.0/0 tcp dport 22 accept
+		ip6 saddr ::/0 tcp dport 22 accept
+		ip saddr 203.0.113.0/24 udp dport 60000-61000 accept
+		ip saddr 0.0.0.0/0 meta l4proto icmp accept
+		ip6 saddr ::/0 meta l4proto ipv6-icmp accept
+		drop
+	}
+	chain vm9_in {
+		ip saddr 10.10.0.0/24 accept
+		drop
+	}
+	chain vm9_out {
+		ip daddr 10.10.0.1 udp dport 53 accept
+		ip daddr 192.0.2.0/24 meta l4proto tcp accept
+		drop
+	}
+}
+`
+	if got := string(Render(testRuleset)); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRenderEmpty(t *testing.T) {
+	// Without guests the table still replaces whatever rules were left.
+	want := `table inet starstream_fw
+delete table inet starstream_fw
+table inet starstream_fw {
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		ct state established,related accept
+	}
+}
+`
+	if got := string(Render(Ruleset{})); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := testRuleset.Validate(); err != nil {
+		t.Fatalf("valid ruleset rejected: %v", err)
+	}
+	guest := func(addr string, r Rule) Ruleset {
+		return Ruleset{Guests: []Guest{{VMID: 1, Addresses: []string{addr}, Ingress: []Rule{r}}}}
+	}
+	for _, rs := range []Ruleset{
+		{Guests: []Guest{{VMID: 1}}},
+		guest("198.51.100.2; flush ruleset", Rule{Protocol: ProtocolAny, CIDR: "0.0.0.0/0"}),
+		guest("198.51.100.2", Rule{Protocol: "gre", CIDR: "0.0.0.0/0"}),
+		guest("198.51.100.2", Rule{Protocol: ProtocolTCP, PortFrom: 80, PortTo: 22, CIDR: "0.0.0.0/0"}),
+		guest("198.51.100.2", Rule{Protocol: ProtocolTCP, PortFrom: 1, PortTo: 70000, CIDR: "0.0.0.0/0"}),
+		guest("198.51.100.2", Rule{Protocol: ProtocolICMP, PortFrom: 8, PortTo: 8, CIDR: "0.0.0.0/0"}),
+		guest("198.51.100.2", Rule{Protocol: ProtocolAny, CIDR: "0.0.0.0/0 accept"}),
+	} {
+		if err := rs.Validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", rs)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	var calls []string
+	var script string
+	n := &NFTables{run: func(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+		calls = append(calls, name+" "+strings.Join(args, " "))
+		script = string(stdin)
+		return nil, nil
+	}}
+	if err := n.Apply(context.Background(), testRuleset); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if len(calls) != 1 || calls[0] != "nft -f -" || script != string(Render(testRuleset)) {
+		t.Fatalf("calls %v with script\n%s", calls, script)
+	}
+	bad := Ruleset{Guests: []Guest{{VMID: 1, Addresses: []string{"not an address"}}}}
+	if err := n.Apply(context.Background(), bad); err == nil || len(calls) != 1 {
+		t.Fatalf("invalid ruleset = %v after %d calls, want rejected before nft runs", err, len(calls))
+	}
+}
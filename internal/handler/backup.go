@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"StarstreamAstra/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterBackupHandlers serves VM backups and backup schedules. Backups
+// and restores are queued as tasks and answered with 202 and the task.
+func RegisterBackupHandlers(rg *gin.RouterGroup, backupService *service.BackupService) {
+	rg.GET("", func(c *gin.Context) {
+		var vmID *uint
+		if v := c.Query("vm_id"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid vm_id"})
+				return
+			}
+			u := uint(id)
+			vmID = &u
+		}
+		backups, err := backupService.ListBackups(c.Request.Context(), principal(c), vmID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": backups})
+	})
+
+	rg.POST("", func(c *gin.Context) {
+		var req service.BackupCreateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		task, err := backupService.CreateBackupAsync(c.Request.Context(), principal(c), req)
+		if err != nil {
+			c.JSON(backupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"data": task})
+	})
+
+	rg.GET("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		b, err := backupService.GetBackup(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
+			c.JSON(backupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": b})
+	})
+
+	rg.DELETE("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err := backupService.DeleteBackup(c.Request.Context(), principal(c), uint(id)); err != nil {
+			c.JSON(backupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Backup deleted"})
+	})
+
+	rg.POST("/:id/restore", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var req service.BackupRestoreRequest
+		// The body is optional; without one the backup goes back into its VM.
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		task, err := backupService.RestoreBackupAsync(c.Request.Context(), principal(c), uint(id), req)
+		if err != nil {
+			c.JSON(backupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"data": task})
+	})
+
+	rg.GET("/schedules/:vm_id", func(c *gin.Context) {
+		vmID, _ := strconv.ParseUint(c.Param("vm_id"), 10, 64)
+		sched, err := backupService.GetSchedule(c.Request.Context(), principal(c), uint(vmID))
+		if err != nil {
+			c.JSON(backupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": sched})
+	})
+
+	rg.PUT("/schedules/:vm_id", func(c *gin.Context) {
+		vmID, _ := strconv.ParseUint(c.Param("vm_id"), 10, 64)
+		var req service.BackupScheduleRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sched, err := backupService.SetSchedule(c.Request.Context(), principal(c), uint(vmID), req)
+		if err != nil {
+			c.JSON(backupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": sched})
+	})
+
+	rg.DELETE("/schedules/:vm_id", func(c *gin.Context) {
+		vmID, _ := strconv.ParseUint(c.Param("vm_id"), 10, 64)
+		if err := backupService.DeleteSchedule(c.Request.Context(), principal(c), uint(vmID)); err != nil {
+			c.JSON(backupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Backup schedule deleted"})
+	})
+}
+
+// backupErrorStatus maps unknown backups, schedules and VMs to 404, a
+// restore target that cannot hold the backup to 400, plans picked by
+// non-admins to 403 and conflicts with the state of the VM or backup to
+// 409.
+func backupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrBackupNotFound),
+		errors.Is(err, service.ErrScheduleNotFound),
+		errors.Is(err, service.ErrVMNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrBackupTooLarge),
+		errors.Is(err, service.ErrUnknownPlan):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrPlanAdminOnly):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrBackupNotReady),
+		errors.Is(err, service.ErrBackupInProgress),
+		errors.Is(err, service.ErrInvalidTransition):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
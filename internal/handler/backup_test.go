@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/model"
+)
+
+func TestBackupHandlers(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	create := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10})
+	if task := awaitTask(t, r, 1, create); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("create: %+v", task)
+	}
+	if w := doJSON(r, http.MethodPost, "/backups", gin.H{"vm_id": 1, "kind": "weekly"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown kind, got %d", w.Code)
+	}
+	if task := awaitTask(t, r, 1, doJSON(r, http.MethodPost, "/backups", gin.H{"vm_id": 1})); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("backup: %+v", task)
+	}
+
+	var list struct {
+		Data []model.Backup `json:"data"`
+	}
+	w := doJSON(r, http.MethodGet, "/backups?vm_id=1", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 1 || list.Data[0].Status != model.BackupStatusReady {
+		t.Fatalf("list: %s", w.Body)
+	}
+	w = doJSONAs(r, 2, "user", http.MethodGet, "/backups", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 0 {
+		t.Fatalf("other user list: %s", w.Body)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+	}{
+		{http.MethodPost, "/backups"},
+		{http.MethodGet, "/backups/1"},
+		{http.MethodPost, "/backups/1/restore"},
+		{http.MethodDelete, "/backups/1"},
+		{http.MethodGet, "/backups/schedules/1"},
+		{http.MethodPut, "/backups/schedules/1"},
+	} {
+		body := interface{}(nil)
+		switch tc.method {
+		case http.MethodPost:
+			body = gin.H{"vm_id": 1}
+		case http.MethodPut:
+			body = gin.H{"keep_daily": 7}
+		}
+		if w := doJSONAs(r, 2, "user", tc.method, tc.path, body); w.Code != http.StatusNotFound {
+			t.Fatalf("%s %s as other user: %d %s", tc.method, tc.path, w.Code, w.Body)
+		}
+	}
+
+	if w := doJSON(r, http.MethodPut, "/backups/schedules/1", gin.H{"hour": 24, "keep_daily": 7}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for hour 24, got %d", w.Code)
+	}
+	if w := doJSON(r, http.MethodPut, "/backups/schedules/1", gin.H{"hour": 2, "keep_daily": 7, "keep_weekly": 4}); w.Code != http.StatusOK {
+		t.Fatalf("set schedule: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, http.MethodGet, "/backups/schedules/1", nil); w.Code != http.StatusOK {
+		t.Fatalf("get schedule: %d %s", w.Code, w.Body)
+	}
+
+	if w := doJSON(r, http.MethodPost, "/vm/1/start", nil); w.Code != http.StatusOK {
+		t.Fatalf("start: %d", w.Code)
+	}
+	if w := doJSON(r, http.MethodPost, "/backups/1/restore", nil); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 restoring into a running VM, got %d", w.Code)
+	}
+	if w := doJSON(r, http.MethodPost, "/vm/1/stop", nil); w.Code != http.StatusOK {
+		t.Fatalf("stop: %d", w.Code)
+	}
+	if task := awaitTask(t, r, 1, doJSON(r, http.MethodPost, "/backups/1/restore", nil)); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("restore: %+v", task)
+	}
+	restore := gin.H{"new_vm": gin.H{"name": "copy", "cpu": 1, "memory_mb": 512, "disk_gb": 5}}
+	if w := doJSON(r, http.MethodPost, "/backups/1/restore", restore); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 restoring into a smaller VM, got %d", w.Code)
+	}
+
+	if w := doJSON(r, http.MethodDelete, "/backups/1", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, http.MethodGet, "/backups/1", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", w.Code)
+	}
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/service"
+)
+
+// RegisterBandwidthHandlers lets admins change the port speed of a VM,
+// which the guest picks up without a reboot.
+func RegisterBandwidthHandlers(rg *gin.RouterGroup, vmService *service.VMService) {
+	rg.PUT("/:id/bandwidth", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var req service.BandwidthRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		vm, err := vmService.SetBandwidth(c.Request.Context(), principal(c), uint(id), req)
+		if err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": vm})
+	})
+}
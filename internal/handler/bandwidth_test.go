@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestBandwidthHandlers(t *testing.T) {
+	r, hv := newTestRouter(t)
+	create := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10})
+	if task := awaitTask(t, r, 1, create); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("create: %+v", task)
+	}
+
+	if w := doJSONAs(r, 1, "admin", http.MethodPut, "/admin/vm/1/bandwidth", gin.H{"inbound_mbps": -1}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a negative limit, got %d", w.Code)
+	}
+	if w := doJSONAs(r, 1, "admin", http.MethodPut, "/admin/vm/9/bandwidth", gin.H{"inbound_mbps": 100}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown VM, got %d", w.Code)
+	}
+	w := doJSONAs(r, 1, "admin", http.MethodPut, "/admin/vm/1/bandwidth", gin.H{"inbound_mbps": 100, "outbound_mbps": 50})
+	if w.Code != http.StatusOK {
+		t.Fatalf("set bandwidth: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Data model.VM `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode VM: %v", err)
+	}
+	vm := resp.Data
+	if vm.InboundMbps != 100 || vm.OutboundMbps != 50 {
+		t.Fatalf("unexpected VM %+v", vm)
+	}
+	if got := hv.Bandwidth(vm.HypervisorID); got != (hypervisor.Bandwidth{InboundMbps: 100, OutboundMbps: 50}) {
+		t.Fatalf("guest has %+v", got)
+	}
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/service"
+)
+
+// RegisterConsoleHandlers serves VM consoles. Tokens are issued under the
+// authenticated VM group; the WebSocket on ws is authenticated by the token
+// alone, since browsers cannot set headers on WebSocket requests.
+func RegisterConsoleHandlers(vms, ws *gin.RouterGroup, consoleService *service.ConsoleService) {
+	vms.POST("/:id/console", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		ticket, err := consoleService.IssueToken(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
+			c.JSON(consoleErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"data": gin.H{
+			"token":      ticket.Token,
+			"expires_at": ticket.ExpiresAt,
+			"url":        ws.BasePath() + "?token=" + url.QueryEscape(ticket.Token),
+		}})
+	})
+
+	ws.GET("", func(c *gin.Context) {
+		session, err := consoleService.OpenSession(c.Request.Context(), c.Query("token"))
+		if err != nil {
+			c.JSON(consoleErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		// Also closes the console if the WebSocket handshake fails.
+		defer session.Conn.Close()
+
+		server := websocket.Server{
+			Handshake: selectBinaryProtocol,
+			Handler: func(conn *websocket.Conn) {
+				conn.PayloadType = websocket.BinaryFrame
+				timer := time.AfterFunc(time.Until(session.Deadline), func() {
+					_ = conn.Close()
+					_ = session.Conn.Close()
+				})
+				defer timer.Stop()
+				hypervisor.Splice(conn, session.Conn)
+			},
+		}
+		server.ServeHTTP(c.Writer, c.Request)
+	})
+}
+
+// selectBinaryProtocol accepts the "binary" subprotocol noVNC asks for and
+// otherwise none. Origins are not checked: the one-time token already ties
+// the connection to the user who asked for it.
+func selectBinaryProtocol(cfg *websocket.Config, _ *http.Request) error {
+	offered := cfg.Protocol
+	cfg.Protocol = nil
+	for _, p := range offered {
+		if p == "binary" {
+			cfg.Protocol = []string{p}
+			break
+		}
+	}
+	return nil
+}
+
+// consoleErrorStatus maps unusable tokens to 401, unknown VMs to 404 and
+// VMs whose console cannot be reached in their current state to 409.
+func consoleErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrConsoleTokenInvalid):
+		return http.StatusUnauthorized
+	case errors.Is(err, service.ErrVMNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, hypervisor.ErrVMNotRunning),
+		errors.Is(err, hypervisor.ErrConsoleUnsupported):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
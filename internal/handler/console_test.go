@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestConsoleHandlers(t *testing.T) {
+	r, _ := newTestRouter(t)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	create := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10})
+	if task := awaitTask(t, r, 1, create); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("create: %+v", task)
+	}
+	if w := doJSON(r, http.MethodPost, "/vm/1/console", nil); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a stopped VM, got %d", w.Code)
+	}
+	if w := doJSON(r, http.MethodPost, "/vm/1/start", nil); w.Code != http.StatusOK {
+		t.Fatalf("start: %d", w.Code)
+	}
+	if w := doJSONAs(r, 2, "user", http.MethodPost, "/vm/1/console", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another user, got %d", w.Code)
+	}
+
+	w := doJSON(r, http.MethodPost, "/vm/1/console", nil)
+	var resp struct {
+		Data struct {
+			Token string `json:"token"`
+			URL   string `json:"url"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusCreated || resp.Data.Token == "" {
+		t.Fatalf("issue token: %d %s", w.Code, w.Body)
+	}
+	if !strings.HasPrefix(resp.Data.URL, "/console?token=") {
+		t.Fatalf("unexpected console url %q", resp.Data.URL)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + resp.Data.URL
+	conn, err := websocket.Dial(wsURL, "binary", srv.URL)
+	if err != nil {
+		t.Fatalf("dial console: %v", err)
+	}
+	defer conn.Close()
+	banner := make([]byte, len(hypervisor.FakeConsoleBanner))
+	if _, err := io.ReadFull(conn, banner); err != nil || string(banner) != hypervisor.FakeConsoleBanner {
+		t.Fatalf("banner = %q, %v", banner, err)
+	}
+	if err := websocket.Message.Send(conn, []byte("key")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	echo := make([]byte, 3)
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "key" {
+		t.Fatalf("echo = %q, %v", echo, err)
+	}
+
+	if _, err := websocket.Dial(wsURL, "binary", srv.URL); err == nil {
+		t.Fatal("console token accepted twice")
+	}
+	if w := doJSON(r, http.MethodGet, "/console?token=bogus", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bogus token, got %d", w.Code)
+	}
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"StarstreamAstra/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterImageHandlers serves the image catalog. Disabled images are only
+// shown to admins.
+func RegisterImageHandlers(rg *gin.RouterGroup, imageService *service.ImageService) {
+	rg.GET("", func(c *gin.Context) {
+		images, err := imageService.ListImages(c.Request.Context(), principal(c).Admin)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": images})
+	})
+
+	rg.GET("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		img, err := imageService.GetImage(c.Request.Context(), uint(id), principal(c).Admin)
+		if err != nil {
+			c.JSON(imageErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": img})
+	})
+}
+
+// RegisterImageAdminHandlers lets admins manage the catalog.
+func RegisterImageAdminHandlers(rg *gin.RouterGroup, imageService *service.ImageService) {
+	rg.POST("", func(c *gin.Context) {
+		var req service.ImageCreateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		img, err := imageService.CreateImage(c.Request.Context(), req)
+		if err != nil {
+			c.JSON(imageErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"data": img})
+	})
+
+	rg.PATCH("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var req service.ImageUpdateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		img, err := imageService.UpdateImage(c.Request.Context(), uint(id), req)
+		if err != nil {
+			c.JSON(imageErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": img})
+	})
+
+	rg.DELETE("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err := imageService.DeleteImage(c.Request.Context(), uint(id)); err != nil {
+			c.JSON(imageErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Image deleted"})
+	})
+}
+
+func imageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrImageNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrImageExists), errors.Is(err, service.ErrImageInUse):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
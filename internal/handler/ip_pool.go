@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"StarstreamAstra/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterIPPoolHandlers lets admins manage the pools VM addresses come
+// from and see how full they are.
+func RegisterIPPoolHandlers(rg *gin.RouterGroup, ipamService *service.IPAMService) {
+	rg.GET("", func(c *gin.Context) {
+		pools, err := ipamService.ListPools(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": pools})
+	})
+
+	rg.POST("", func(c *gin.Context) {
+		var req service.IPPoolRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		pool, err := ipamService.CreatePool(c.Request.Context(), req)
+		if err != nil {
+			c.JSON(ipPoolErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"data": pool})
+	})
+
+	rg.GET("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		pool, err := ipamService.GetPool(c.Request.Context(), uint(id))
+		if err != nil {
+			c.JSON(ipPoolErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": pool})
+	})
+
+	rg.DELETE("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err := ipamService.DeletePool(c.Request.Context(), uint(id)); err != nil {
+			c.JSON(ipPoolErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "IP pool deleted"})
+	})
+}
+
+// ipPoolErrorStatus maps invalid pools and unknown nodes to 400, unknown
+// pools to 404 and name clashes and pools still in use to 409.
+func ipPoolErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrInvalidPool),
+		errors.Is(err, service.ErrNodeNotFound):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrPoolNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrPoolExists),
+		errors.Is(err, service.ErrPoolInUse):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
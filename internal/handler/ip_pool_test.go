@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/model"
+	"StarstreamAstra/internal/service"
+)
+
+func TestIPPoolHandlers(t *testing.T) {
+	r, _ := newTestRouter(t)
+
+	if w := doJSON(r, http.MethodPost, "/admin/ip-pools", gin.H{"name": "bad", "cidr": "10.0.0.0/24", "gateway": "2001:db8::1"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a gateway of the wrong family, got %d %s", w.Code, w.Body)
+	}
+	pool := gin.H{"name": "public", "cidr": "192.0.2.0/28", "gateway": "192.0.2.1", "exclude": []string{"192.0.2.2-192.0.2.4"}}
+	if w := doJSON(r, http.MethodPost, "/admin/ip-pools", pool); w.Code != http.StatusCreated {
+		t.Fatalf("create pool: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, http.MethodPost, "/admin/ip-pools", pool); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a duplicate name, got %d", w.Code)
+	}
+
+	create := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10})
+	if task := awaitTask(t, r, 1, create); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("create: %+v", task)
+	}
+	var vm struct {
+		Data model.VM `json:"data"`
+	}
+	w := doJSON(r, http.MethodGet, "/vm/1", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &vm); err != nil || vm.Data.IPv4 != "192.0.2.5/28" {
+		t.Fatalf("vm: %s", w.Body)
+	}
+
+	var list struct {
+		Data []service.IPPoolUsage `json:"data"`
+	}
+	w = doJSON(r, http.MethodGet, "/admin/ip-pools", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 1 {
+		t.Fatalf("list: %s", w.Body)
+	}
+	// 16 addresses less network, broadcast, gateway and three excluded.
+	if u := list.Data[0]; u.Total != 10 || u.Allocated != 1 || u.Free != 9 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+	if w := doJSON(r, http.MethodGet, "/admin/ip-pools/1", nil); w.Code != http.StatusOK {
+		t.Fatalf("get pool: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, http.MethodGet, "/admin/ip-pools/9", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown pool, got %d", w.Code)
+	}
+	if w := doJSON(r, http.MethodDelete, "/admin/ip-pools/1", nil); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 deleting a pool in use, got %d", w.Code)
+	}
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/service"
+)
+
+// RegisterNATHandlers lets owners of NAT VMs see their public port range
+// and manage the ports forwarded into the VM.
+func RegisterNATHandlers(vms *gin.RouterGroup, natService *service.NATService) {
+	vms.GET("/:id/forwards", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		info, err := natService.GetNAT(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
+			c.JSON(natErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": info})
+	})
+
+	vms.POST("/:id/forwards", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var req service.PortForwardRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		fwd, err := natService.AddForward(c.Request.Context(), principal(c), uint(id), req)
+		if err != nil {
+			c.JSON(natErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"data": fwd})
+	})
+
+	vms.DELETE("/:id/forwards/:fid", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		fid, _ := strconv.ParseUint(c.Param("fid"), 10, 64)
+		if err := natService.DeleteForward(c.Request.Context(), principal(c), uint(id), uint(fid)); err != nil {
+			c.JSON(natErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "port forward deleted"})
+	})
+}
+
+// natErrorStatus maps ports outside the VM's range to 400, unknown VMs and
+// forwards to 404 and taken ports and VMs without NAT to 409.
+func natErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrPortOutOfRange):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrVMNotFound),
+		errors.Is(err, service.ErrForwardNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrNotNATVM),
+		errors.Is(err, service.ErrNATUnavailable),
+		errors.Is(err, service.ErrPortInUse),
+		errors.Is(err, service.ErrPortsExhausted),
+		errors.Is(err, hypervisor.ErrNATUnsupported):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/model"
+	"StarstreamAstra/internal/service"
+)
+
+func TestNATHandlers(t *testing.T) {
+	r, hv := newTestRouter(t)
+
+	if w := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10, "network_mode": "bridge"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown network mode, got %d", w.Code)
+	}
+	if w := doJSON(r, http.MethodPost, "/admin/ip-pools", gin.H{"name": "nat", "cidr": "10.10.0.0/24", "gateway": "10.10.0.1", "nat": true}); w.Code != http.StatusCreated {
+		t.Fatalf("create pool: %d %s", w.Code, w.Body)
+	}
+	create := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10, "network_mode": "nat"})
+	if task := awaitTask(t, r, 1, create); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("create: %+v", task)
+	}
+
+	w := doJSON(r, http.MethodPost, "/vm/1/forwards", gin.H{"protocol": "tcp", "private_port": 22, "description": "ssh"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add forward: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, http.MethodPost, "/vm/1/forwards", gin.H{"protocol": "tcp", "public_port": 20000, "private_port": 80}); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a taken port, got %d", w.Code)
+	}
+	if w := doJSON(r, http.MethodPost, "/vm/1/forwards", gin.H{"protocol": "tcp", "public_port": 443, "private_port": 443}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a port outside the range, got %d", w.Code)
+	}
+	if w := doJSONAs(r, 2, "", http.MethodGet, "/vm/1/forwards", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another user's VM, got %d", w.Code)
+	}
+
+	var info struct {
+		Data service.NATInfo `json:"data"`
+	}
+	w = doJSON(r, http.MethodGet, "/vm/1/forwards", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || len(info.Data.Forwards) != 1 {
+		t.Fatalf("forwards: %s", w.Body)
+	}
+	if d := info.Data; d.PublicIP != "203.0.113.10" || d.PortStart != 20000 || d.PortEnd != 20009 || d.Forwards[0].PublicPort != 20000 {
+		t.Fatalf("unexpected NAT info %+v", d)
+	}
+	if rules := hv.NAT(); len(rules.Forwards) != 1 || rules.Forwards[0].PrivatePort != 22 {
+		t.Fatalf("node rules %+v", rules)
+	}
+
+	if w := doJSON(r, http.MethodDelete, "/vm/1/forwards/1", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete forward: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, http.MethodDelete, "/vm/1/forwards/1", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a deleted forward, got %d", w.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"StarstreamAstra/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func RegisterNodeHandlers(rg *gin.RouterGroup, db *gorm.DB) {
+	nodeService := service.NewNodeService(db)
+
+	rg.GET("", func(c *gin.Context) {
+		nodes, err := nodeService.ListNodes(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": nodes})
+	})
+
+	rg.GET("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		node, err := nodeService.GetNode(c.Request.Context(), uint(id))
+		if err != nil {
+			if errors.Is(err, service.ErrNodeNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": node})
+	})
+
+	rg.PATCH("/:id/overcommit", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var req service.NodeOvercommitRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		node, err := nodeService.SetOvercommit(c.Request.Context(), uint(id), req)
+		if err != nil {
+			if errors.Is(err, service.ErrNodeNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": node})
+	})
+}
+
+// RegisterAgentHandlers serves the endpoints node agents call on the master.
+func RegisterAgentHandlers(rg *gin.RouterGroup, db *gorm.DB) {
+	nodeService := service.NewNodeService(db)
+
+	rg.POST("/register", func(c *gin.Context) {
+		var req service.NodeRegisterRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		node, err := nodeService.Register(c.Request.Context(), req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": node})
+	})
+
+	rg.POST("/heartbeat", func(c *gin.Context) {
+		var req service.NodeHeartbeatRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := nodeService.Heartbeat(c.Request.Context(), req); err != nil {
+			if errors.Is(err, service.ErrNodeNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "ok"})
+	})
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/service"
+)
+
+// RegisterPlanHandlers lets admins move a VM to another plan. Users cannot
+// pick plans themselves.
+func RegisterPlanHandlers(rg *gin.RouterGroup, vmService *service.VMService) {
+	rg.PUT("/:id/plan", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var req service.PlanRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		vm, err := vmService.SetPlan(c.Request.Context(), principal(c), uint(id), req)
+		if err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": vm})
+	})
+}
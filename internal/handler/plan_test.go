@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/model"
+	"StarstreamAstra/internal/service"
+)
+
+func TestPlanHandlers(t *testing.T) {
+	r, _ := newTestRouter(t)
+	if w := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10, "plan": service.DefaultPlan}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a plan picked by a user, got %d %s", w.Code, w.Body)
+	}
+	create := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10})
+	if task := awaitTask(t, r, 1, create); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("create: %+v", task)
+	}
+
+	if w := doJSON(r, http.MethodPut, "/admin/vm/1/plan", gin.H{"plan": service.DefaultPlan}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a plan change by a user, got %d", w.Code)
+	}
+	if w := doJSONAs(r, 1, "admin", http.MethodPut, "/admin/vm/1/plan", gin.H{"plan": "huge"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown plan, got %d", w.Code)
+	}
+	if w := doJSONAs(r, 1, "admin", http.MethodPut, "/admin/vm/1/plan", gin.H{"plan": service.DefaultPlan}); w.Code != http.StatusOK {
+		t.Fatalf("set plan: %d %s", w.Code, w.Body)
+	}
+}
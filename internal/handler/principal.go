@@ -0,0 +1,24 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+
+	"StarstreamAstra/internal/service"
+)
+
+// principal builds the acting user from what AuthMiddleware stored in the
+// gin context.
+func principal(c *gin.Context) service.Principal {
+	var p service.Principal
+	if id, ok := c.Get("user_id"); ok {
+		p.UserID, _ = id.(uint)
+	}
+	if claims, ok := c.Get("claims"); ok {
+		if mc, ok := claims.(jwt.MapClaims); ok {
+			role, _ := mc["role"].(string)
+			p.Admin = role == "admin"
+		}
+	}
+	return p
+}
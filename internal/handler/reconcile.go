@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+
+	"StarstreamAstra/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterReconcileHandlers exposes the reconciler's last report and lets
+// an admin trigger a pass without waiting for the next tick.
+func RegisterReconcileHandlers(rg *gin.RouterGroup, reconciler *service.Reconciler) {
+	rg.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"data": reconciler.LastReport()})
+	})
+
+	rg.POST("", func(c *gin.Context) {
+		report, err := reconciler.Reconcile(c.Request.Context(), log.Printf)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": report})
+	})
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/service"
+)
+
+// RegisterSecurityGroupHandlers serves the user's security groups on rg and
+// attaching them to VMs under the VM group.
+func RegisterSecurityGroupHandlers(rg, vms *gin.RouterGroup, groupService *service.SecurityGroupService) {
+	rg.GET("", func(c *gin.Context) {
+		groups, err := groupService.ListGroups(c.Request.Context(), principal(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": groups})
+	})
+
+	rg.POST("", func(c *gin.Context) {
+		var req service.SecurityGroupRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		group, err := groupService.CreateGroup(c.Request.Context(), principal(c), req)
+		if err != nil {
+			c.JSON(securityGroupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"data": group})
+	})
+
+	rg.GET("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		group, err := groupService.GetGroup(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
+			c.JSON(securityGroupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": group})
+	})
+
+	rg.PUT("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var req service.SecurityGroupRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		group, err := groupService.UpdateGroup(c.Request.Context(), principal(c), uint(id), req)
+		if err != nil {
+			c.JSON(securityGroupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": group})
+	})
+
+	rg.DELETE("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err := groupService.DeleteGroup(c.Request.Context(), principal(c), uint(id)); err != nil {
+			c.JSON(securityGroupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "security group deleted"})
+	})
+
+	vms.GET("/:id/security-groups", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		groups, err := groupService.VMGroups(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
+			c.JSON(securityGroupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": groups})
+	})
+
+	vms.PUT("/:id/security-groups/:gid", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		gid, _ := strconv.ParseUint(c.Param("gid"), 10, 64)
+		if err := groupService.AttachGroup(c.Request.Context(), principal(c), uint(id), uint(gid)); err != nil {
+			c.JSON(securityGroupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "security group attached"})
+	})
+
+	vms.DELETE("/:id/security-groups/:gid", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		gid, _ := strconv.ParseUint(c.Param("gid"), 10, 64)
+		if err := groupService.DetachGroup(c.Request.Context(), principal(c), uint(id), uint(gid)); err != nil {
+			c.JSON(securityGroupErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "security group detached"})
+	})
+}
+
+// securityGroupErrorStatus maps invalid rules to 400, unknown groups and
+// VMs to 404, and name clashes, groups in use and VMs that cannot be
+// filtered to 409.
+func securityGroupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrInvalidRule):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrSecurityGroupNotFound),
+		errors.Is(err, service.ErrVMNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrSecurityGroupExists),
+		errors.Is(err, service.ErrSecurityGroupInUse),
+		errors.Is(err, service.ErrNoGuestAddress),
+		errors.Is(err, hypervisor.ErrFirewallUnsupported):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/model"
+	"StarstreamAstra/internal/service"
+)
+
+func TestSecurityGroupHandlers(t *testing.T) {
+	r, hv := newTestRouter(t)
+
+	if w := doJSON(r, http.MethodPost, "/admin/ip-pools", gin.H{"name": "public", "cidr": "192.0.2.0/28"}); w.Code != http.StatusCreated {
+		t.Fatalf("create pool: %d %s", w.Code, w.Body)
+	}
+	create := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10})
+	if task := awaitTask(t, r, 1, create); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("create: %+v", task)
+	}
+
+	bad := gin.H{"name": "web", "rules": []gin.H{{"direction": "inbound", "protocol": "tcp", "cidr": "0.0.0.0/0"}}}
+	if w := doJSON(r, http.MethodPost, "/security-groups", bad); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown direction, got %d", w.Code)
+	}
+	bad = gin.H{"name": "web", "rules": []gin.H{{"direction": "ingress", "protocol": "tcp", "cidr": "example.com"}}}
+	if w := doJSON(r, http.MethodPost, "/security-groups", bad); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid CIDR, got %d", w.Code)
+	}
+	group := gin.H{"name": "web", "rules": []gin.H{{"direction": "ingress", "protocol": "tcp", "port_from": 80, "port_to": 443, "cidr": "0.0.0.0/0"}}}
+	w := doJSON(r, http.MethodPost, "/security-groups", group)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create group: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, http.MethodPost, "/security-groups", group); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a duplicate name, got %d", w.Code)
+	}
+	if w := doJSONAs(r, 2, "", http.MethodGet, "/security-groups/1", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another user's group, got %d", w.Code)
+	}
+
+	if w := doJSON(r, http.MethodPut, "/vm/1/security-groups/1", nil); w.Code != http.StatusOK {
+		t.Fatalf("attach: %d %s", w.Code, w.Body)
+	}
+	if rules := hv.Firewall(); len(rules.Guests) != 1 || rules.Guests[0].Ingress[0].PortTo != 443 {
+		t.Fatalf("node rules %+v", rules)
+	}
+	var groups struct {
+		Data []service.SecurityGroupDetail `json:"data"`
+	}
+	w = doJSON(r, http.MethodGet, "/vm/1/security-groups", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil || len(groups.Data) != 1 || len(groups.Data[0].VMIDs) != 1 {
+		t.Fatalf("VM groups: %s", w.Body)
+	}
+	if w := doJSON(r, http.MethodDelete, "/security-groups/1", nil); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 deleting an attached group, got %d", w.Code)
+	}
+	if w := doJSON(r, http.MethodDelete, "/vm/1/security-groups/1", nil); w.Code != http.StatusOK {
+		t.Fatalf("detach: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, http.MethodDelete, "/vm/1/security-groups/1", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 detaching a detached group, got %d", w.Code)
+	}
+	if w := doJSON(r, http.MethodDelete, "/security-groups/1", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete group: %d %s", w.Code, w.Body)
+	}
+}
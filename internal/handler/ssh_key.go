@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"StarstreamAstra/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterSSHKeyHandlers serves the caller's SSH keys.
+func RegisterSSHKeyHandlers(rg *gin.RouterGroup, keyService *service.SSHKeyService) {
+	rg.GET("", func(c *gin.Context) {
+		keys, err := keyService.ListKeys(c.Request.Context(), principal(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": keys})
+	})
+
+	rg.POST("", func(c *gin.Context) {
+		var req service.SSHKeyCreateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		key, err := keyService.CreateKey(c.Request.Context(), principal(c), req)
+		if err != nil {
+			c.JSON(sshKeyErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"data": key})
+	})
+
+	rg.GET("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		key, err := keyService.GetKey(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
+			c.JSON(sshKeyErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": key})
+	})
+
+	rg.PATCH("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var req service.SSHKeyUpdateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		key, err := keyService.UpdateKey(c.Request.Context(), principal(c), uint(id), req)
+		if err != nil {
+			c.JSON(sshKeyErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": key})
+	})
+
+	rg.DELETE("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err := keyService.DeleteKey(c.Request.Context(), principal(c), uint(id)); err != nil {
+			c.JSON(sshKeyErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "SSH key deleted"})
+	})
+}
+
+func sshKeyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrSSHKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrInvalidSSHKey):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrSSHKeyExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"StarstreamAstra/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterTaskHandlers(rg *gin.RouterGroup, taskService *service.TaskService) {
+	rg.GET("", func(c *gin.Context) {
+		tasks, err := taskService.ListTasks(c.Request.Context(), principal(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": tasks})
+	})
+
+	rg.GET("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		task, err := taskService.GetTask(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
+			if errors.Is(err, service.ErrTaskNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": task})
+	})
+}
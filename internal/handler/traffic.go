@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/service"
+)
+
+// RegisterTrafficHandlers lets owners see how much of its monthly transfer
+// quota a VM has used. ?hours= picks how many hours of hourly usage to
+// include.
+func RegisterTrafficHandlers(vms *gin.RouterGroup, trafficService *service.TrafficService) {
+	vms.GET("/:id/traffic", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		hours := 0
+		if v := c.Query("hours"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid hours"})
+				return
+			}
+			hours = n
+		}
+		report, err := trafficService.GetTraffic(c.Request.Context(), principal(c), uint(id), hours)
+		if err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": report})
+	})
+}
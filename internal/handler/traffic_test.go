@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"StarstreamAstra/internal/model"
+	"StarstreamAstra/internal/service"
+)
+
+func TestTrafficHandlers(t *testing.T) {
+	r, _ := newTestRouter(t)
+	create := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10})
+	if task := awaitTask(t, r, 1, create); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("create: %+v", task)
+	}
+
+	if w := doJSON(r, http.MethodGet, "/vm/1/traffic?hours=abc", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid hours, got %d", w.Code)
+	}
+	if w := doJSONAs(r, 2, "", http.MethodGet, "/vm/1/traffic", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another user's VM, got %d", w.Code)
+	}
+	w := doJSON(r, http.MethodGet, "/vm/1/traffic?hours=48", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get traffic: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Data service.TrafficReport `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	month := resp.Data.Month
+	if month.VMID != 1 || month.Period != model.TrafficPeriodMonth || month.PeriodStart.IsZero() || month.RxBytes != 0 || resp.Data.Action != "" {
+		t.Fatalf("unexpected report %+v", resp.Data)
+	}
+}
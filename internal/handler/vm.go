@@ -1,22 +1,21 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
-	"Zjmf-kvm/internal/hypervisor"
-	"Zjmf-kvm/internal/service"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/service"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
-func RegisterVMHandlers(rg *gin.RouterGroup, db *gorm.DB) {
-	hv := hypervisor.NewQEMUHypervisor()
-	vmService := service.NewVMService(db, hv)
-
+// RegisterVMHandlers serves the VM API. Create, resize, reinstall and
+// delete are queued as tasks and answered with 202 and the task to poll.
+func RegisterVMHandlers(rg *gin.RouterGroup, vmService *service.VMService) {
 	rg.GET("/list", func(c *gin.Context) {
-		vms, err := vmService.ListVMs()
+		vms, err := vmService.ListVMs(c.Request.Context(), principal(c))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -30,18 +29,18 @@ func RegisterVMHandlers(rg *gin.RouterGroup, db *gorm.DB) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		vm, err := vmService.CreateVM(req)
+		task, err := vmService.CreateVMAsync(c.Request.Context(), principal(c), req)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"data": vm})
+		c.JSON(http.StatusAccepted, gin.H{"data": task})
 	})
 
 	rg.POST("/:id/start", func(c *gin.Context) {
 		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-		if err := vmService.StartVM(uint(id)); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err := vmService.StartVM(c.Request.Context(), principal(c), uint(id)); err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"message": "VM started"})
@@ -49,20 +48,123 @@ func RegisterVMHandlers(rg *gin.RouterGroup, db *gorm.DB) {
 
 	rg.POST("/:id/stop", func(c *gin.Context) {
 		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-		if err := vmService.StopVM(uint(id)); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err := vmService.StopVM(c.Request.Context(), principal(c), uint(id)); err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"message": "VM stopped"})
 	})
 
-	rg.DELETE("/:id", func(c *gin.Context) {
+	rg.GET("/:id", func(c *gin.Context) {
 		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
-		if err := vmService.DeleteVM(uint(id)); err != nil {
+		vm, err := vmService.GetVMByID(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"message": "VM deleted"})
+		if vm == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "VM not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": vm})
+	})
+
+	rg.GET("/:id/history", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		history, err := vmService.History(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": history})
+	})
+
+	rg.POST("/:id/force-stop", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err := vmService.ForceStopVM(c.Request.Context(), principal(c), uint(id)); err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "VM force stopped"})
+	})
+
+	rg.POST("/:id/reboot", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err := vmService.RebootVM(c.Request.Context(), principal(c), uint(id)); err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "VM rebooted"})
+	})
+
+	rg.POST("/:id/reinstall", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var req service.VMReinstallRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		task, err := vmService.ReinstallVMAsync(c.Request.Context(), principal(c), uint(id), req)
+		if err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"data": task})
+	})
+
+	rg.GET("/:id/snapshots", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		snaps, err := vmService.ListSnapshots(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": snaps})
+	})
+
+	rg.POST("/:id/snapshots", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		var req service.SnapshotCreateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		snap, err := vmService.CreateSnapshot(c.Request.Context(), principal(c), uint(id), req)
+		if err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"data": snap})
+	})
+
+	rg.DELETE("/:id/snapshots/:sid", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		if err := vmService.DeleteSnapshot(c.Request.Context(), principal(c), uint(id), uint(sid)); err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "snapshot deleted"})
+	})
+
+	rg.POST("/:id/snapshots/:sid/revert", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		sid, _ := strconv.ParseUint(c.Param("sid"), 10, 64)
+		if err := vmService.RevertSnapshot(c.Request.Context(), principal(c), uint(id), uint(sid)); err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "VM reverted"})
+	})
+
+	rg.DELETE("/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+		task, err := vmService.DeleteVMAsync(c.Request.Context(), principal(c), uint(id))
+		if err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"data": task})
 	})
 
 	rg.PATCH("/:id", func(c *gin.Context) {
@@ -78,10 +180,48 @@ func RegisterVMHandlers(rg *gin.RouterGroup, db *gorm.DB) {
 			MemoryMB: req.MemoryMB,
 			DiskGB:   req.DiskGB,
 		}
-		if err := vmService.ResizeVM(uint(id), cfg); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		task, err := vmService.ResizeVMAsync(c.Request.Context(), principal(c), uint(id), cfg)
+		if err != nil {
+			c.JSON(vmErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"message": "VM configuration updated"})
+		c.JSON(http.StatusAccepted, gin.H{"data": task})
 	})
 }
+
+// vmErrorStatus maps unknown VMs and snapshots to 404, unusable images,
+// SSH keys and plans to 400, plans picked by non-admins to 403 and errors
+// that describe a conflict with the VM's or node's current state to 409;
+// anything else is a server error.
+func vmErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrVMNotFound),
+		errors.Is(err, service.ErrSnapshotNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrImageNotFound),
+		errors.Is(err, service.ErrImageTooSmall),
+		errors.Is(err, service.ErrInvalidSSHKey),
+		errors.Is(err, service.ErrSSHKeyNotFound),
+		errors.Is(err, service.ErrUnknownPlan):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrPlanAdminOnly):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrNoCapacity),
+		errors.Is(err, service.ErrPoolExhausted),
+		errors.Is(err, service.ErrNATUnavailable),
+		errors.Is(err, service.ErrPortRangeExhausted),
+		errors.Is(err, service.ErrInvalidTransition),
+		errors.Is(err, service.ErrHotplugUnsupported),
+		errors.Is(err, service.ErrVMSuspended),
+		errors.Is(err, service.ErrSnapshotLimit),
+		errors.Is(err, service.ErrSnapshotNotReady),
+		errors.Is(err, service.ErrResizeWithSnapshots),
+		errors.Is(err, hypervisor.ErrVMNotRunning),
+		errors.Is(err, hypervisor.ErrVMRunning),
+		errors.Is(err, hypervisor.ErrDiskShrink),
+		errors.Is(err, hypervisor.ErrBandwidthUnsupported):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"StarstreamAstra/internal/backup"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+	"StarstreamAstra/internal/service"
+)
+
+func newTestRouter(t *testing.T) (*gin.Engine, *hypervisor.FakeHypervisor) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	if err := db.AutoMigrate(&model.VM{}, &model.VMTransition{}, &model.Task{}, &model.OutboxEvent{}, &model.Image{}, &model.SSHKey{}, &model.Snapshot{}, &model.Backup{}, &model.BackupSchedule{}, &model.ConsoleToken{}, &model.IPPool{}, &model.IPAddress{}, &model.NATPortRange{}, &model.PortForward{}, &model.SecurityGroup{}, &model.SecurityGroupRule{}, &model.VMSecurityGroup{}, &model.TrafficUsage{}, &model.TrafficCounter{}, &model.TrafficEnforcement{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	hv := hypervisor.NewFakeHypervisor()
+	tasks := service.NewTaskService(db)
+	ipam := service.NewIPAMService(db, time.Hour)
+	vmService := service.NewVMService(db, hv).WithIPAM(ipam)
+	natService := service.NewNATService(db, vmService, service.NATOptions{PublicIP: "203.0.113.10", PortStart: 20000, PortEnd: 29999, PortsPerVM: 10})
+	vmService.WithNAT(natService)
+	groupService := service.NewSecurityGroupService(db, vmService)
+	vmService.WithSecurityGroups(groupService)
+	trafficService, err := service.NewTrafficService(db, vmService, service.TrafficOptions{Policy: service.TrafficPolicySuspend})
+	if err != nil {
+		t.Fatalf("traffic service: %v", err)
+	}
+	vmService.WithTraffic(trafficService)
+	vmService.RegisterTasks(tasks)
+	backupService := service.NewBackupService(db, vmService, backup.NewLocalTarget(t.TempDir()))
+	backupService.RegisterTasks(tasks)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tasks.RunWorkers(ctx, 1, t.Logf)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	r := gin.New()
+	r.Use(fakeAuth)
+	RegisterVMHandlers(r.Group("/vm"), vmService)
+	RegisterTaskHandlers(r.Group("/tasks"), tasks)
+	RegisterBackupHandlers(r.Group("/backups"), backupService)
+	RegisterConsoleHandlers(r.Group("/vm"), r.Group("/console"), service.NewConsoleService(db, vmService, time.Minute, time.Hour))
+	RegisterIPPoolHandlers(r.Group("/admin/ip-pools"), ipam)
+	RegisterBandwidthHandlers(r.Group("/admin/vm"), vmService)
+	RegisterPlanHandlers(r.Group("/admin/vm"), vmService)
+	RegisterNATHandlers(r.Group("/vm"), natService)
+	RegisterTrafficHandlers(r.Group("/vm"), trafficService)
+	RegisterSecurityGroupHandlers(r.Group("/security-groups"), r.Group("/vm"), groupService)
+	return r, hv
+}
+
+// fakeAuth stands in for router.AuthMiddleware, taking the user and role
+// from test headers. Requests without them act as user 1.
+func fakeAuth(c *gin.Context) {
+	uid := uint(1)
+	if v, err := strconv.ParseUint(c.GetHeader("X-Test-User"), 10, 64); err == nil {
+		uid = uint(v)
+	}
+	c.Set("user_id", uid)
+	c.Set("claims", jwt.MapClaims{"sub": float64(uid), "role": c.GetHeader("X-Test-Role")})
+	c.Next()
+}
+
+func doJSON(r http.Handler, method, path string, body interface{}) *httptest.ResponseRecorder {
+	return doJSONAs(r, 1, "", method, path, body)
+}
+
+func doJSONAs(r http.Handler, uid uint, role, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Test-User", strconv.FormatUint(uint64(uid), 10))
+	req.Header.Set("X-Test-Role", role)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// awaitTask expects w to be a 202 carrying a task and polls the task API
+// as uid until it finishes.
+func awaitTask(t *testing.T, r http.Handler, uid uint, w *httptest.ResponseRecorder) model.Task {
+	t.Helper()
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Data model.Task `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode task: %v", err)
+	}
+	path := "/tasks/" + strconv.FormatUint(uint64(resp.Data.ID), 10)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w := doJSONAs(r, uid, "", http.MethodGet, path, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("get task: %d %s", w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode task: %v", err)
+		}
+		if resp.Data.Status == model.TaskStatusSucceeded || resp.Data.Status == model.TaskStatusFailed {
+			return resp.Data
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("task %d did not finish", resp.Data.ID)
+	return resp.Data
+}
+
+func TestVMHandlersLifecycle(t *testing.T) {
+	r, hv := newTestRouter(t)
+
+	task := awaitTask(t, r, 1, doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10}))
+	if task.Status != model.TaskStatusSucceeded || task.VMID == nil {
+		t.Fatalf("create task: %+v", task)
+	}
+	var created model.VM
+	if err := json.Unmarshal(task.Result, &created); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if w := doJSON(r, http.MethodPost, "/vm/1/start", nil); w.Code != http.StatusOK {
+		t.Fatalf("start: %d %s", w.Code, w.Body)
+	}
+	if info, _ := hv.VM(created.HypervisorID); info.Status != "running" {
+		t.Fatalf("guest not running: %+v", info)
+	}
+
+	w := doJSON(r, http.MethodGet, "/vm/list", nil)
+	var list struct {
+		Data []model.VM `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 1 || list.Data[0].Status != "running" {
+		t.Fatalf("unexpected list %s", w.Body)
+	}
+
+	resize := gin.H{"name": "web", "cpu": 2, "memory_mb": 1024, "disk_gb": 10}
+	if w := doJSON(r, http.MethodPatch, "/vm/1", resize); w.Code != http.StatusConflict {
+		t.Fatalf("resize of running VM without hotplug: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, http.MethodPost, "/vm/1/start", nil); w.Code != http.StatusConflict {
+		t.Fatalf("start of running VM: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(r, http.MethodPost, "/vm/1/stop", nil); w.Code != http.StatusOK {
+		t.Fatalf("stop: %d %s", w.Code, w.Body)
+	}
+	task = awaitTask(t, r, 1, doJSON(r, http.MethodPatch, "/vm/1", resize))
+	if task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("resize task: %+v", task)
+	}
+	if info, _ := hv.VM(created.HypervisorID); info.CPU != 2 {
+		t.Fatalf("guest not resized: %+v", info)
+	}
+
+	w = doJSON(r, http.MethodGet, "/vm/1/history", nil)
+	var history struct {
+		Data []model.VMTransition `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil || len(history.Data) != 8 {
+		t.Fatalf("unexpected history %s", w.Body)
+	}
+
+	task = awaitTask(t, r, 1, doJSON(r, http.MethodDelete, "/vm/1", nil))
+	if task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("delete task: %+v", task)
+	}
+	if hv.Count() != 0 {
+		t.Fatalf("guest not deleted")
+	}
+}
+
+func TestVMHandlersErrors(t *testing.T) {
+	r, hv := newTestRouter(t)
+
+	if w := doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid body, got %d", w.Code)
+	}
+
+	hv.Inject(hypervisor.MethodCreateVM, hypervisor.Fault{Err: errors.New("boom")})
+	task := awaitTask(t, r, 1, doJSON(r, http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10}))
+	if task.Status != model.TaskStatusFailed || task.Error != "boom" {
+		t.Fatalf("expected failed task on hypervisor failure, got %+v", task)
+	}
+
+	if w := doJSON(r, http.MethodGet, "/tasks/999", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown task, got %d", w.Code)
+	}
+}
+
+func TestVMHandlersOwnership(t *testing.T) {
+	r, hv := newTestRouter(t)
+
+	create := doJSONAs(r, 1, "user", http.MethodPost, "/vm/create", gin.H{"name": "web", "cpu": 1, "memory_mb": 512, "disk_gb": 10})
+	if task := awaitTask(t, r, 1, create); task.Status != model.TaskStatusSucceeded {
+		t.Fatalf("create: %+v", task)
+	}
+	if w := doJSONAs(r, 2, "user", http.MethodGet, "/tasks/1", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("other user sees task: %d", w.Code)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+	}{
+		{http.MethodGet, "/vm/1"},
+		{http.MethodPost, "/vm/1/start"},
+		{http.MethodPost, "/vm/1/stop"},
+		{http.MethodPatch, "/vm/1"},
+		{http.MethodDelete, "/vm/1"},
+		{http.MethodGet, "/vm/1/snapshots"},
+		{http.MethodPost, "/vm/1/snapshots/1/revert"},
+		{http.MethodDelete, "/vm/1/snapshots/1"},
+	} {
+		body := interface{}(nil)
+		if tc.method == http.MethodPatch {
+			body = gin.H{"name": "web", "cpu": 2, "memory_mb": 512, "disk_gb": 10}
+		}
+		if w := doJSONAs(r, 2, "user", tc.method, tc.path, body); w.Code != http.StatusNotFound {
+			t.Fatalf("%s %s as other user: %d %s", tc.method, tc.path, w.Code, w.Body)
+		}
+	}
+	if hv.Count() != 1 {
+		t.Fatal("guest touched by another user")
+	}
+
+	var list struct {
+		Data []model.VM `json:"data"`
+	}
+	w := doJSONAs(r, 2, "user", http.MethodGet, "/vm/list", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 0 {
+		t.Fatalf("other user list: %s", w.Body)
+	}
+	w = doJSONAs(r, 3, "admin", http.MethodGet, "/vm/list", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 1 {
+		t.Fatalf("admin list: %s", w.Body)
+	}
+	if w := doJSONAs(r, 3, "admin", http.MethodPost, "/vm/1/start", nil); w.Code != http.StatusOK {
+		t.Fatalf("admin start: %d %s", w.Code, w.Body)
+	}
+}
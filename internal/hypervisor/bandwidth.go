@@ -0,0 +1,27 @@
+package hypervisor
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrBandwidthUnsupported = errors.New("hypervisor cannot limit guest bandwidth")
+
+// Bandwidth caps the guest's network interface in megabits per second.
+// Inbound is traffic towards the guest, outbound traffic it sends. Zero
+// means no limit.
+type Bandwidth struct {
+	InboundMbps  int `json:"inbound_mbps"`
+	OutboundMbps int `json:"outbound_mbps"`
+}
+
+// Limited reports whether either direction is capped.
+func (b Bandwidth) Limited() bool {
+	return b.InboundMbps > 0 || b.OutboundMbps > 0
+}
+
+// BandwidthSupport is implemented by drivers that can change the bandwidth
+// limits of a guest, running or not, without restarting it.
+type BandwidthSupport interface {
+	SetBandwidth(ctx context.Context, id string, bw Bandwidth) error
+}
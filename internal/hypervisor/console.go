@@ -0,0 +1,33 @@
+package hypervisor
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrConsoleUnsupported = errors.New("hypervisor does not provide guest consoles")
+
+// ConsoleSupport is implemented by drivers that expose the graphical
+// console of running guests over VNC.
+type ConsoleSupport interface {
+	// OpenConsole connects to the guest's VNC server. The returned stream
+	// speaks plain RFB and must be closed by the caller.
+	OpenConsole(ctx context.Context, id string) (io.ReadWriteCloser, error)
+}
+
+// Splice copies between a and b in both directions until either side is
+// done, then closes both.
+func Splice(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst io.Writer, src io.Reader) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+	<-done
+}
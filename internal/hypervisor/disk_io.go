@@ -0,0 +1,86 @@
+package hypervisor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// exportDisk converts the qcow2 image at disk to raw and copies it to w.
+// qemu-img cannot write raw images to a pipe, so the image is staged next
+// to the disk, where it stays sparse.
+func exportDisk(ctx context.Context, run commandRunner, imgBinary, disk, snapshot string, w io.Writer) error {
+	tmp, err := stageFile(disk, ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	// --force-share lets a running guest keep its lock; the snapshot it is
+	// read from does not change underneath.
+	args := []string{"convert", "--force-share", "-O", "raw"}
+	if snapshot != "" {
+		args = append(args, "-l", "snapshot.name="+snapshot)
+	}
+	if _, err := run(ctx, imgBinary, append(args, disk, tmp)...); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// importDisk replaces the qcow2 image at disk by the raw image read from r,
+// grown to sizeGB. The old image stays in place until the new one is
+// complete.
+func importDisk(ctx context.Context, run commandRunner, imgBinary, disk string, sizeGB int, r io.Reader) error {
+	tmp, err := stageFile(disk, ".import-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("receive image: %w", err)
+	}
+
+	next := disk + ".new"
+	if _, err := run(ctx, imgBinary, "convert", "-f", "raw", "-O", "qcow2", tmp, next); err != nil {
+		return err
+	}
+	if _, err := run(ctx, imgBinary, "resize", next, fmt.Sprintf("%dG", sizeGB)); err != nil {
+		_ = os.Remove(next)
+		return err
+	}
+	if err := os.Rename(next, disk); err != nil {
+		_ = os.Remove(next)
+		return err
+	}
+	return nil
+}
+
+func stageFile(disk, prefix string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(disk), prefix+"*.raw")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	if err := f.Close(); err != nil {
+		_ = os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
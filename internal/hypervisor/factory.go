@@ -0,0 +1,43 @@
+package hypervisor
+
+import (
+	"fmt"
+	"time"
+
+	"StarstreamAstra/internal/config"
+)
+
+// New builds the local driver selected by cfg.Driver.
+func New(cfg config.HypervisorConfig) (Hypervisor, error) {
+	switch cfg.Driver {
+	case "", "qemu":
+		q := cfg.QEMU
+		return NewQEMUHypervisor(QEMUOptions{
+			Binary:          q.Binary,
+			ImgBinary:       q.ImgBinary,
+			ISOBinary:       q.ISOBinary,
+			DataDir:         q.DataDir,
+			ImageDir:        q.ImageDir,
+			Accel:           q.Accel,
+			Machine:         q.Machine,
+			Bridge:          q.Bridge,
+			ShutdownTimeout: time.Duration(q.ShutdownTimeoutSeconds) * time.Second,
+		}), nil
+	case "libvirt":
+		l := cfg.Libvirt
+		return NewLibvirtHypervisor(LibvirtOptions{
+			Socket:          l.Socket,
+			StoragePool:     l.StoragePool,
+			ImageDir:        l.ImageDir,
+			SeedDir:         l.SeedDir,
+			ISOBinary:       l.ISOBinary,
+			ImgBinary:       l.ImgBinary,
+			Network:         l.Network,
+			Bridge:          l.Bridge,
+			Machine:         l.Machine,
+			ShutdownTimeout: time.Duration(l.ShutdownTimeoutSeconds) * time.Second,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown hypervisor driver %q", cfg.Driver)
+	}
+}
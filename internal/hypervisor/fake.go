@@ -0,0 +1,553 @@
+package hypervisor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"StarstreamAstra/internal/cloudinit"
+	"StarstreamAstra/internal/firewall"
+	"StarstreamAstra/internal/nat"
+)
+
+const (
+	MethodCreateVM    = "CreateVM"
+	MethodGetVM       = "GetVM"
+	MethodListVMs     = "ListVMs"
+	MethodStartVM     = "StartVM"
+	MethodStopVM      = "StopVM"
+	MethodForceStopVM = "ForceStopVM"
+	MethodRebootVM    = "RebootVM"
+	MethodDeleteVM    = "DeleteVM"
+	MethodResizeVM    = "ResizeVM"
+	MethodReinstallVM = "ReinstallVM"
+
+	MethodCreateSnapshot = "CreateSnapshot"
+	MethodDeleteSnapshot = "DeleteSnapshot"
+	MethodRevertSnapshot = "RevertSnapshot"
+	MethodExportDisk     = "ExportDisk"
+	MethodImportDisk     = "ImportDisk"
+	MethodOpenConsole    = "OpenConsole"
+	MethodApplyNAT       = "ApplyNAT"
+	MethodApplyFirewall  = "ApplyFirewall"
+	MethodSetBandwidth   = "SetBandwidth"
+	MethodTrafficStats   = "TrafficStats"
+)
+
+// Fault describes an injected failure for a FakeHypervisor method.
+type Fault struct {
+	Err     error
+	Latency time.Duration
+	// Partial applies the operation before returning Err, simulating a call
+	// that took effect on the host but failed to report success.
+	Partial bool
+	// Times limits how many calls are affected; zero means every call.
+	Times int
+}
+
+// FakeHypervisor is an in-memory Hypervisor for tests. It tracks guests and
+// their status like a real driver and supports per-method fault injection.
+type FakeHypervisor struct {
+	mu     sync.Mutex
+	seq    int
+	vms    map[string]*VMInfo
+	seeds  map[string]cloudinit.Config
+	snaps  map[string]map[string]bool
+	disks  map[string][]byte
+	faults map[string]*Fault
+	calls  map[string]int
+	nat    nat.Ruleset
+	fw     firewall.Ruleset
+	bw     map[string]Bandwidth
+	rxtx   map[string]TrafficCounters
+}
+
+func NewFakeHypervisor() *FakeHypervisor {
+	return &FakeHypervisor{
+		vms:    make(map[string]*VMInfo),
+		seeds:  make(map[string]cloudinit.Config),
+		snaps:  make(map[string]map[string]bool),
+		disks:  make(map[string][]byte),
+		faults: make(map[string]*Fault),
+		calls:  make(map[string]int),
+		bw:     make(map[string]Bandwidth),
+		rxtx:   make(map[string]TrafficCounters),
+	}
+}
+
+// Inject registers a fault for method, replacing any previous one.
+func (f *FakeHypervisor) Inject(method string, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[method] = &fault
+}
+
+// Reset clears all injected faults and call counters but keeps the guests.
+func (f *FakeHypervisor) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = make(map[string]*Fault)
+	f.calls = make(map[string]int)
+}
+
+func (f *FakeHypervisor) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// VM returns a copy of the guest's current state.
+func (f *FakeHypervisor) VM(id string) (VMInfo, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vm, ok := f.vms[id]
+	if !ok {
+		return VMInfo{}, false
+	}
+	return *vm, true
+}
+
+// Seed returns the cloud-init config the guest was created with.
+func (f *FakeHypervisor) Seed(id string) (cloudinit.Config, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ci, ok := f.seeds[id]
+	return ci, ok
+}
+
+// Snapshots returns the number of snapshots the guest has.
+func (f *FakeHypervisor) Snapshots(id string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.snaps[id])
+}
+
+// Disk returns the contents of the guest's disk. Disks start out empty.
+func (f *FakeHypervisor) Disk(id string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]byte(nil), f.disks[id]...)
+}
+
+// SetDisk replaces the contents of the guest's disk, as the guest would by
+// writing to it.
+func (f *FakeHypervisor) SetDisk(id string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.disks[id] = append([]byte(nil), data...)
+}
+
+func (f *FakeHypervisor) Count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.vms)
+}
+
+func (f *FakeHypervisor) CreateVM(ctx context.Context, cfg VMConfig) (*VMInfo, error) {
+	fault, err := f.begin(ctx, MethodCreateVM)
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil && !fault.Partial {
+		return nil, fault.Err
+	}
+
+	f.mu.Lock()
+	f.seq++
+	vm := &VMInfo{
+		ID:       fmt.Sprintf("fake-vm-%d", f.seq),
+		Name:     cfg.Name,
+		Status:   "stopped",
+		CPU:      cfg.CPU,
+		MemoryMB: cfg.MemoryMB,
+		DiskGB:   cfg.DiskGB,
+	}
+	if cfg.Image != nil {
+		vm.Image = cfg.Image.Name
+	}
+	if cfg.CloudInit != nil {
+		ci := *cfg.CloudInit
+		if ci.InstanceID == "" {
+			ci.InstanceID = vm.ID
+		}
+		f.seeds[vm.ID] = ci
+	}
+	f.bw[vm.ID] = cfg.Bandwidth
+	f.vms[vm.ID] = vm
+	out := *vm
+	f.mu.Unlock()
+
+	if fault != nil {
+		return nil, fault.Err
+	}
+	return &out, nil
+}
+
+func (f *FakeHypervisor) GetVM(ctx context.Context, id string) (*VMInfo, error) {
+	var out VMInfo
+	err := f.mutate(ctx, MethodGetVM, id, func(vm *VMInfo) error {
+		out = *vm
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (f *FakeHypervisor) ListVMs(ctx context.Context) ([]*VMInfo, error) {
+	fault, err := f.begin(ctx, MethodListVMs)
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil {
+		return nil, fault.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vms := make([]*VMInfo, 0, len(f.vms))
+	for _, vm := range f.vms {
+		c := *vm
+		vms = append(vms, &c)
+	}
+	return vms, nil
+}
+
+func (f *FakeHypervisor) StartVM(ctx context.Context, id string) error {
+	return f.mutate(ctx, MethodStartVM, id, func(vm *VMInfo) error {
+		vm.Status = "running"
+		return nil
+	})
+}
+
+func (f *FakeHypervisor) StopVM(ctx context.Context, id string) error {
+	return f.mutate(ctx, MethodStopVM, id, func(vm *VMInfo) error {
+		vm.Status = "stopped"
+		delete(f.rxtx, id)
+		return nil
+	})
+}
+
+func (f *FakeHypervisor) ForceStopVM(ctx context.Context, id string) error {
+	return f.mutate(ctx, MethodForceStopVM, id, func(vm *VMInfo) error {
+		vm.Status = "stopped"
+		delete(f.rxtx, id)
+		return nil
+	})
+}
+
+func (f *FakeHypervisor) RebootVM(ctx context.Context, id string) error {
+	return f.mutate(ctx, MethodRebootVM, id, func(vm *VMInfo) error {
+		if vm.Status != "running" {
+			return ErrVMNotRunning
+		}
+		return nil
+	})
+}
+
+func (f *FakeHypervisor) DeleteVM(ctx context.Context, id string) error {
+	return f.mutate(ctx, MethodDeleteVM, id, func(vm *VMInfo) error {
+		delete(f.vms, id)
+		delete(f.seeds, id)
+		delete(f.snaps, id)
+		delete(f.disks, id)
+		delete(f.bw, id)
+		delete(f.rxtx, id)
+		return nil
+	})
+}
+
+func (f *FakeHypervisor) ResizeVM(ctx context.Context, id string, cfg VMConfig) error {
+	return f.mutate(ctx, MethodResizeVM, id, func(vm *VMInfo) error {
+		if cfg.DiskGB < vm.DiskGB {
+			return ErrDiskShrink
+		}
+		vm.DiskGB = cfg.DiskGB
+		if cfg.CPU > 0 {
+			vm.CPU = cfg.CPU
+		}
+		if cfg.MemoryMB > 0 {
+			vm.MemoryMB = cfg.MemoryMB
+		}
+		return nil
+	})
+}
+
+func (f *FakeHypervisor) ReinstallVM(ctx context.Context, id string, cfg VMConfig) error {
+	return f.mutate(ctx, MethodReinstallVM, id, func(vm *VMInfo) error {
+		if vm.Status != "stopped" {
+			return ErrVMRunning
+		}
+		vm.DiskGB = cfg.DiskGB
+		vm.Image = ""
+		if cfg.Image != nil {
+			vm.Image = cfg.Image.Name
+		}
+		delete(f.seeds, id)
+		delete(f.snaps, id)
+		delete(f.disks, id)
+		f.bw[id] = cfg.Bandwidth
+		if cfg.CloudInit != nil {
+			ci := *cfg.CloudInit
+			if ci.InstanceID == "" {
+				ci.InstanceID = id
+			}
+			f.seeds[id] = ci
+		}
+		return nil
+	})
+}
+
+func (f *FakeHypervisor) CreateSnapshot(ctx context.Context, id, name string) error {
+	return f.mutate(ctx, MethodCreateSnapshot, id, func(vm *VMInfo) error {
+		if f.snaps[id] == nil {
+			f.snaps[id] = make(map[string]bool)
+		}
+		f.snaps[id][name] = true
+		return nil
+	})
+}
+
+func (f *FakeHypervisor) DeleteSnapshot(ctx context.Context, id, name string) error {
+	return f.mutate(ctx, MethodDeleteSnapshot, id, func(vm *VMInfo) error {
+		if !f.snaps[id][name] {
+			return ErrSnapshotNotFound
+		}
+		delete(f.snaps[id], name)
+		return nil
+	})
+}
+
+func (f *FakeHypervisor) RevertSnapshot(ctx context.Context, id, name string) error {
+	return f.mutate(ctx, MethodRevertSnapshot, id, func(vm *VMInfo) error {
+		if vm.Status != "stopped" {
+			return ErrVMRunning
+		}
+		if !f.snaps[id][name] {
+			return ErrSnapshotNotFound
+		}
+		return nil
+	})
+}
+
+// ExportDisk writes the disk as it is now; snapshots do not keep contents.
+func (f *FakeHypervisor) ExportDisk(ctx context.Context, id, snapshot string, w io.Writer) error {
+	var data []byte
+	err := f.mutate(ctx, MethodExportDisk, id, func(vm *VMInfo) error {
+		if snapshot == "" && vm.Status != "stopped" {
+			return ErrVMRunning
+		}
+		if snapshot != "" && !f.snaps[id][snapshot] {
+			return ErrSnapshotNotFound
+		}
+		data = f.disks[id]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (f *FakeHypervisor) ImportDisk(ctx context.Context, id string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return f.mutate(ctx, MethodImportDisk, id, func(vm *VMInfo) error {
+		if vm.Status != "stopped" {
+			return ErrVMRunning
+		}
+		f.disks[id] = data
+		delete(f.snaps, id)
+		return nil
+	})
+}
+
+// FakeConsoleBanner is what a console opened on the fake sends first; it
+// echoes everything written to it after that.
+const FakeConsoleBanner = "RFB 003.008\n"
+
+func (f *FakeHypervisor) OpenConsole(ctx context.Context, id string) (io.ReadWriteCloser, error) {
+	err := f.mutate(ctx, MethodOpenConsole, id, func(vm *VMInfo) error {
+		if vm.Status != "running" {
+			return ErrVMNotRunning
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		if _, err := io.WriteString(server, FakeConsoleBanner); err != nil {
+			return
+		}
+		_, _ = io.Copy(server, server)
+	}()
+	return client, nil
+}
+
+func (f *FakeHypervisor) ApplyNAT(ctx context.Context, rules nat.Ruleset) error {
+	fault, err := f.begin(ctx, MethodApplyNAT)
+	if err != nil {
+		return err
+	}
+	if fault != nil {
+		return fault.Err
+	}
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nat = rules
+	return nil
+}
+
+// NAT returns the ruleset last applied.
+func (f *FakeHypervisor) NAT() nat.Ruleset {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nat
+}
+
+func (f *FakeHypervisor) ApplyFirewall(ctx context.Context, rules firewall.Ruleset) error {
+	fault, err := f.begin(ctx, MethodApplyFirewall)
+	if err != nil {
+		return err
+	}
+	if fault != nil {
+		return fault.Err
+	}
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fw = rules
+	return nil
+}
+
+// Firewall returns the firewall ruleset last applied.
+func (f *FakeHypervisor) Firewall() firewall.Ruleset {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fw
+}
+
+func (f *FakeHypervisor) SetBandwidth(ctx context.Context, id string, bw Bandwidth) error {
+	return f.mutate(ctx, MethodSetBandwidth, id, func(vm *VMInfo) error {
+		f.bw[id] = bw
+		return nil
+	})
+}
+
+// Bandwidth returns the guest's current bandwidth limits.
+func (f *FakeHypervisor) Bandwidth(id string) Bandwidth {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bw[id]
+}
+
+// AddTraffic counts traffic of a guest, as its interface would while the
+// guest runs. Counters start over when the guest stops.
+func (f *FakeHypervisor) AddTraffic(id string, rx, tx uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.rxtx[id]
+	c.ID = id
+	c.RxBytes += rx
+	c.TxBytes += tx
+	f.rxtx[id] = c
+}
+
+func (f *FakeHypervisor) TrafficStats(ctx context.Context) ([]TrafficCounters, error) {
+	fault, err := f.begin(ctx, MethodTrafficStats)
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil {
+		return nil, fault.Err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var stats []TrafficCounters
+	for id, vm := range f.vms {
+		if vm.Status == "running" {
+			stats = append(stats, TrafficCounters{ID: id, RxBytes: f.rxtx[id].RxBytes, TxBytes: f.rxtx[id].TxBytes})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats, nil
+}
+
+func (f *FakeHypervisor) mutate(ctx context.Context, method, id string, apply func(vm *VMInfo) error) error {
+	fault, err := f.begin(ctx, method)
+	if err != nil {
+		return err
+	}
+	if fault != nil && !fault.Partial {
+		return fault.Err
+	}
+
+	f.mu.Lock()
+	vm, ok := f.vms[id]
+	if !ok {
+		f.mu.Unlock()
+		return ErrVMNotFound
+	}
+	err = apply(vm)
+	f.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if fault != nil {
+		return fault.Err
+	}
+	return nil
+}
+
+// begin records the call, sleeps for any injected latency and returns the
+// fault that applies to this call, if any. A cancelled ctx aborts the sleep.
+func (f *FakeHypervisor) begin(ctx context.Context, method string) (*Fault, error) {
+	f.mu.Lock()
+	f.calls[method]++
+	fault, ok := f.faults[method]
+	var active *Fault
+	if ok {
+		c := *fault
+		active = &c
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				delete(f.faults, method)
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	if active != nil && active.Latency > 0 {
+		timer := time.NewTimer(active.Latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if active == nil || active.Err == nil {
+		return nil, nil
+	}
+	return active, nil
+}
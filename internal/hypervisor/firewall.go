@@ -0,0 +1,18 @@
+package hypervisor
+
+import (
+	"context"
+	"errors"
+
+	"StarstreamAstra/internal/firewall"
+)
+
+var ErrFirewallUnsupported = errors.New("node does not filter guest traffic")
+
+// FirewallSupport is implemented by drivers whose host filters guest
+// traffic by security group.
+type FirewallSupport interface {
+	// ApplyFirewall replaces the filtering of every guest on the host with
+	// rules.
+	ApplyFirewall(ctx context.Context, rules firewall.Ruleset) error
+}
@@ -1,29 +1,78 @@
 package hypervisor
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"io"
 
+	"StarstreamAstra/internal/cloudinit"
+)
+
+// VMConfig describes a guest. Image and CloudInit are only used by CreateVM
+// and ReinstallVM: with an image the disk is a copy-on-write overlay on that
+// base image instead of blank, and with CloudInit the guest gets a NoCloud
+// seed ISO attached as a CD-ROM.
 type VMConfig struct {
-	Name     string
-	CPU      int
-	MemoryMB int
-	DiskGB   int
+	Name      string            `json:"name"`
+	CPU       int               `json:"cpu"`
+	MemoryMB  int               `json:"memory_mb"`
+	DiskGB    int               `json:"disk_gb"`
+	Image     *ImageSpec        `json:"image,omitempty"`
+	CloudInit *cloudinit.Config `json:"cloud_init,omitempty"`
+	Bandwidth Bandwidth         `json:"bandwidth"`
 }
 
 type VMInfo struct {
-	ID       string
-	Name     string
-	Status   string
-	CPU      int
-	MemoryMB int
-	DiskGB   int
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	CPU      int    `json:"cpu"`
+	MemoryMB int    `json:"memory_mb"`
+	DiskGB   int    `json:"disk_gb"`
+	Image    string `json:"image,omitempty"`
 }
 
 type Hypervisor interface {
-	CreateVM(cfg VMConfig) (*VMInfo, error)
-	StartVM(id string) error
-	StopVM(id string) error
-	DeleteVM(id string) error
-	ResizeVM(id string, cfg VMConfig) error
+	CreateVM(ctx context.Context, cfg VMConfig) (*VMInfo, error)
+	GetVM(ctx context.Context, id string) (*VMInfo, error)
+	ListVMs(ctx context.Context) ([]*VMInfo, error)
+	StartVM(ctx context.Context, id string) error
+	StopVM(ctx context.Context, id string) error
+	ForceStopVM(ctx context.Context, id string) error
+	RebootVM(ctx context.Context, id string) error
+	DeleteVM(ctx context.Context, id string) error
+	ResizeVM(ctx context.Context, id string, cfg VMConfig) error
+	// ReinstallVM replaces a stopped guest's disk and cloud-init seed with
+	// fresh ones built from cfg as CreateVM would, keeping the guest's ID.
+	// CPU and memory are left as they are.
+	ReinstallVM(ctx context.Context, id string, cfg VMConfig) error
+	// CreateSnapshot takes an internal snapshot of the guest's disk called
+	// name; of a running guest its memory is saved as well.
+	CreateSnapshot(ctx context.Context, id, name string) error
+	DeleteSnapshot(ctx context.Context, id, name string) error
+	// RevertSnapshot rolls a stopped guest's disk back to snapshot name.
+	RevertSnapshot(ctx context.Context, id, name string) error
+	// ExportDisk writes the guest's disk to w as a raw image. With a
+	// snapshot name the disk as of that snapshot is written, which is how
+	// running guests are exported; without one the guest must be stopped.
+	ExportDisk(ctx context.Context, id, snapshot string, w io.Writer) error
+	// ImportDisk replaces a stopped guest's disk, and with it its
+	// snapshots, by the raw image read from r. A smaller image is grown
+	// to the disk's size.
+	ImportDisk(ctx context.Context, id string, r io.Reader) error
+}
+
+// HotplugSupport is implemented by drivers that can change the CPU count
+// and memory of a running guest. Drivers without it only apply such changes
+// to stopped guests.
+type HotplugSupport interface {
+	SupportsHotplug() bool
 }
 
-var ErrVMNotFound = errors.New("VM not found")
+var (
+	ErrVMNotFound   = errors.New("VM not found")
+	ErrVMNotRunning = errors.New("VM is not running")
+	ErrVMRunning    = errors.New("VM is running")
+
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
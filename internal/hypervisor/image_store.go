@@ -0,0 +1,127 @@
+package hypervisor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var ErrImageChecksum = errors.New("image checksum mismatch")
+
+// ImageSpec names the base image a new VM's disk is cloned from.
+type ImageSpec struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	SHA256 string `json:"sha256"`
+}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ImageStore keeps qcow2 base images on a node. Files are named by their
+// SHA-256, so a base never changes underneath the overlays that use it and
+// the same image is downloaded once however many VMs are cloned from it.
+type ImageStore struct {
+	dir    string
+	client *http.Client
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func NewImageStore(dir string) *ImageStore {
+	return &ImageStore{dir: dir, client: http.DefaultClient, locks: make(map[string]*sync.Mutex)}
+}
+
+// Path is where the base image with the given checksum is stored.
+func (s *ImageStore) Path(sha string) string {
+	return filepath.Join(s.dir, sha+".qcow2")
+}
+
+// Ensure returns the path of img, downloading and verifying it first if the
+// node does not have it yet. Source is an http(s) URL or a local path.
+func (s *ImageStore) Ensure(ctx context.Context, img ImageSpec) (string, error) {
+	sha := strings.ToLower(img.SHA256)
+	if !sha256Pattern.MatchString(sha) {
+		return "", fmt.Errorf("image %s: invalid sha256 %q", img.Name, img.SHA256)
+	}
+	unlock := s.lock(sha)
+	defer unlock()
+
+	path := s.Path(sha)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return "", err
+	}
+	src, err := s.open(ctx, img.Source)
+	if err != nil {
+		return "", fmt.Errorf("image %s: %w", img.Name, err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(s.dir, sha+".*.part")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), src); err != nil {
+		_ = tmp.Close()
+		return "", fmt.Errorf("image %s: download: %w", img.Name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sha {
+		return "", fmt.Errorf("image %s: %w: got %s", img.Name, ErrImageChecksum, got)
+	}
+	// Bases are only ever read; overlays must not be able to write them.
+	if err := os.Chmod(tmp.Name(), 0o440); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (s *ImageStore) open(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(strings.TrimPrefix(source, "file://"))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download %s: %s", source, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *ImageStore) lock(sha string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[sha]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[sha] = l
+	}
+	s.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
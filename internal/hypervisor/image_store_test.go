@@ -0,0 +1,90 @@
+package hypervisor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func serveImage(t *testing.T, body string) (*httptest.Server, *int32) {
+	t.Helper()
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestImageStoreEnsure(t *testing.T) {
+	ctx := context.Background()
+	srv, hits := serveImage(t, "qcow2 image")
+	store := NewImageStore(t.TempDir())
+	img := ImageSpec{Name: "debian", Source: srv.URL + "/debian.qcow2", SHA256: sha256Hex("qcow2 image")}
+
+	path, err := store.Ensure(ctx, img)
+	if err != nil {
+		t.Fatalf("ensure: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "qcow2 image" {
+		t.Fatalf("unexpected image contents %q", data)
+	}
+	if again, err := store.Ensure(ctx, img); err != nil || again != path || *hits != 1 {
+		t.Fatalf("second ensure = %q, %v after %d downloads; want cached %q", again, err, *hits, path)
+	}
+}
+
+func TestImageStoreRejectsBadChecksum(t *testing.T) {
+	srv, _ := serveImage(t, "tampered")
+	dir := t.TempDir()
+	store := NewImageStore(dir)
+
+	_, err := store.Ensure(context.Background(), ImageSpec{Name: "debian", Source: srv.URL, SHA256: sha256Hex("original")})
+	if !errors.Is(err, ErrImageChecksum) {
+		t.Fatalf("expected ErrImageChecksum, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("rejected download left files behind: %v", entries)
+	}
+	if _, err := store.Ensure(context.Background(), ImageSpec{Name: "debian", Source: srv.URL, SHA256: "abc"}); err == nil {
+		t.Fatal("expected invalid checksum to be refused")
+	}
+}
+
+func TestQEMUCreateFromImage(t *testing.T) {
+	ctx := context.Background()
+	q, calls := newTestQEMU(t)
+	src := filepath.Join(t.TempDir(), "base.qcow2")
+	if err := os.WriteFile(src, []byte("base"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	q.images = NewImageStore(filepath.Join(q.opts.DataDir, "images"))
+
+	img := ImageSpec{Name: "ubuntu-24.04", Source: src, SHA256: sha256Hex("base")}
+	info, err := q.CreateVM(ctx, VMConfig{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 20, Image: &img})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if info.Image != "ubuntu-24.04" {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	args := strings.Join((*calls)[0].args, " ")
+	want := "create -f qcow2 -F qcow2 -b " + q.images.Path(img.SHA256)
+	if !strings.HasPrefix(args, want) || !strings.HasSuffix(args, "disk.qcow2 20G") {
+		t.Fatalf("qemu-img args %q, want overlay on %s", args, q.images.Path(img.SHA256))
+	}
+}
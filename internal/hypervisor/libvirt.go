@@ -0,0 +1,744 @@
+package hypervisor
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/digitalocean/go-libvirt/socket/dialers"
+)
+
+// maxSnapshotNames bounds the snapshot listing libvirt returns; per-plan
+// limits keep real guests far below it.
+const maxSnapshotNames = 1024
+
+type LibvirtOptions struct {
+	Socket          string
+	StoragePool     string
+	ImageDir        string
+	SeedDir         string
+	ISOBinary       string
+	ImgBinary       string
+	Network         string
+	Bridge          string
+	Machine         string
+	DialTimeout     time.Duration
+	ShutdownTimeout time.Duration
+}
+
+// LibvirtHypervisor manages domains through libvirtd's RPC socket. The
+// domain name is the hypervisor ID; the user facing name is kept in <title>.
+type LibvirtHypervisor struct {
+	opts   LibvirtOptions
+	images *ImageStore
+	mu     sync.Mutex // guards conn
+	conn   *libvirt.Libvirt
+}
+
+func NewLibvirtHypervisor(opts LibvirtOptions) *LibvirtHypervisor {
+	if opts.Socket == "" {
+		opts.Socket = "/var/run/libvirt/libvirt-sock"
+	}
+	if opts.StoragePool == "" {
+		opts.StoragePool = "default"
+	}
+	if opts.ImageDir == "" {
+		opts.ImageDir = "/var/lib/starstream/images"
+	}
+	if opts.SeedDir == "" {
+		opts.SeedDir = "/var/lib/starstream/seeds"
+	}
+	if opts.ISOBinary == "" {
+		opts.ISOBinary = "genisoimage"
+	}
+	if opts.ImgBinary == "" {
+		opts.ImgBinary = "qemu-img"
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = 60 * time.Second
+	}
+	return &LibvirtHypervisor{opts: opts, images: NewImageStore(opts.ImageDir)}
+}
+
+func (h *LibvirtHypervisor) CreateVM(ctx context.Context, cfg VMConfig) (*VMInfo, error) {
+	l, err := h.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newVMID()
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := l.StoragePoolLookupByName(h.opts.StoragePool)
+	if err != nil {
+		return nil, fmt.Errorf("lookup storage pool %s: %w", h.opts.StoragePool, err)
+	}
+	var backing, image string
+	if cfg.Image != nil {
+		if backing, err = h.images.Ensure(ctx, *cfg.Image); err != nil {
+			return nil, err
+		}
+		image = cfg.Image.Name
+	}
+	volXML, err := RenderVolumeXML(volumeName(id), cfg.DiskGB, backing)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := l.StorageVolCreateXML(pool, string(volXML), 0)
+	if err != nil {
+		return nil, fmt.Errorf("create volume: %w", err)
+	}
+	diskPath, err := l.StorageVolGetPath(vol)
+	if err != nil {
+		_ = l.StorageVolDelete(vol, 0)
+		return nil, err
+	}
+	var seedPath string
+	if cfg.CloudInit != nil {
+		seedPath = h.seedPath(id)
+		if err := os.MkdirAll(h.opts.SeedDir, 0o755); err != nil {
+			_ = l.StorageVolDelete(vol, 0)
+			return nil, err
+		}
+		if err := buildSeedISO(ctx, execRunner, h.opts.ISOBinary, seedPath, id, *cfg.CloudInit); err != nil {
+			_ = l.StorageVolDelete(vol, 0)
+			return nil, err
+		}
+	}
+	cleanup := func() {
+		_ = l.StorageVolDelete(vol, 0)
+		if seedPath != "" {
+			_ = os.Remove(seedPath)
+		}
+	}
+
+	domXML, err := RenderDomainXML(DomainSpec{
+		ID:        id,
+		Title:     cfg.Name,
+		CPU:       cfg.CPU,
+		MemoryMB:  cfg.MemoryMB,
+		DiskPath:  diskPath,
+		SeedPath:  seedPath,
+		Machine:   h.opts.Machine,
+		Network:   h.opts.Network,
+		Bridge:    h.opts.Bridge,
+		Bandwidth: cfg.Bandwidth,
+	})
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if _, err := l.DomainDefineXML(string(domXML)); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("define domain: %w", err)
+	}
+
+	return &VMInfo{
+		ID:       id,
+		Name:     cfg.Name,
+		Status:   "stopped",
+		CPU:      cfg.CPU,
+		MemoryMB: cfg.MemoryMB,
+		DiskGB:   cfg.DiskGB,
+		Image:    image,
+	}, nil
+}
+
+func (h *LibvirtHypervisor) StartVM(ctx context.Context, id string) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if h.isActive(l, dom) {
+		return nil
+	}
+	return l.DomainCreate(dom)
+}
+
+func (h *LibvirtHypervisor) StopVM(ctx context.Context, id string) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !h.isActive(l, dom) {
+		return nil
+	}
+	if err := l.DomainShutdown(dom); err != nil {
+		return err
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, h.opts.ShutdownTimeout)
+	defer cancel()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for h.isActive(l, dom) {
+		select {
+		case <-waitCtx.Done():
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return l.DomainDestroy(dom)
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (h *LibvirtHypervisor) ForceStopVM(ctx context.Context, id string) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !h.isActive(l, dom) {
+		return nil
+	}
+	return l.DomainDestroy(dom)
+}
+
+func (h *LibvirtHypervisor) RebootVM(ctx context.Context, id string) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !h.isActive(l, dom) {
+		return ErrVMNotRunning
+	}
+	return l.DomainReboot(dom, 0)
+}
+
+func (h *LibvirtHypervisor) GetVM(ctx context.Context, id string) (*VMInfo, error) {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return h.describe(l, dom)
+}
+
+func (h *LibvirtHypervisor) ListVMs(ctx context.Context) ([]*VMInfo, error) {
+	l, err := h.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	doms, _, err := l.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive|libvirt.ConnectListDomainsInactive)
+	if err != nil {
+		return nil, err
+	}
+	vms := make([]*VMInfo, 0, len(doms))
+	for _, dom := range doms {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		info, err := h.describe(l, dom)
+		if err != nil {
+			if libvirt.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		vms = append(vms, info)
+	}
+	return vms, nil
+}
+
+func (h *LibvirtHypervisor) DeleteVM(ctx context.Context, id string) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if h.isActive(l, dom) {
+		if err := l.DomainDestroy(dom); err != nil {
+			return err
+		}
+	}
+	if err := l.DomainUndefineFlags(dom, libvirt.DomainUndefineManagedSave|libvirt.DomainUndefineNvram|libvirt.DomainUndefineSnapshotsMetadata); err != nil {
+		return err
+	}
+	if err := os.Remove(h.seedPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	pool, err := l.StoragePoolLookupByName(h.opts.StoragePool)
+	if err != nil {
+		return err
+	}
+	// Either name may hold the root volume, and both do after a reinstall
+	// that could not remove the old one.
+	for _, name := range []string{volumeName(id), spareVolumeName(id)} {
+		vol, err := l.StorageVolLookupByName(pool, name)
+		if err != nil {
+			continue
+		}
+		if err := l.StorageVolDelete(vol, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReinstallVM builds a new root volume and seed next to the old ones and
+// redefines the domain with the same name and UUID, so libvirt updates it
+// in place. The old volume is only deleted once the domain points at the
+// new one, so a failed reinstall leaves the guest as it was.
+func (h *LibvirtHypervisor) ReinstallVM(ctx context.Context, id string, cfg VMConfig) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if h.isActive(l, dom) {
+		return ErrVMRunning
+	}
+	info, err := h.describe(l, dom)
+	if err != nil {
+		return err
+	}
+	var backing string
+	if cfg.Image != nil {
+		if backing, err = h.images.Ensure(ctx, *cfg.Image); err != nil {
+			return err
+		}
+	}
+	pool, old, oldPath, err := h.volume(l, dom)
+	if err != nil {
+		return err
+	}
+	// The new volume takes the name the domain does not use, replacing
+	// whatever an earlier failed reinstall left there.
+	name := volumeName(id)
+	if filepath.Base(oldPath) == name {
+		name = spareVolumeName(id)
+	}
+	if stale, err := l.StorageVolLookupByName(pool, name); err == nil {
+		if err := l.StorageVolDelete(stale, 0); err != nil {
+			return fmt.Errorf("delete volume: %w", err)
+		}
+	}
+	volXML, err := RenderVolumeXML(name, cfg.DiskGB, backing)
+	if err != nil {
+		return err
+	}
+	vol, err := l.StorageVolCreateXML(pool, string(volXML), 0)
+	if err != nil {
+		return fmt.Errorf("create volume: %w", err)
+	}
+	diskPath, err := l.StorageVolGetPath(vol)
+	if err != nil {
+		_ = l.StorageVolDelete(vol, 0)
+		return err
+	}
+
+	const suffix = ".new"
+	var seedPath string
+	cleanup := func() {
+		_ = l.StorageVolDelete(vol, 0)
+		if seedPath != "" {
+			_ = os.Remove(seedPath + suffix)
+		}
+	}
+	if cfg.CloudInit != nil {
+		seedPath = h.seedPath(id)
+		if err := os.MkdirAll(h.opts.SeedDir, 0o755); err != nil {
+			cleanup()
+			return err
+		}
+		if err := buildSeedISO(ctx, execRunner, h.opts.ISOBinary, seedPath+suffix, id, *cfg.CloudInit); err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	domXML, err := RenderDomainXML(DomainSpec{
+		ID:        id,
+		UUID:      formatUUID(dom.UUID),
+		Title:     info.Name,
+		CPU:       info.CPU,
+		MemoryMB:  info.MemoryMB,
+		DiskPath:  diskPath,
+		SeedPath:  seedPath,
+		Machine:   h.opts.Machine,
+		Network:   h.opts.Network,
+		Bridge:    h.opts.Bridge,
+		Bandwidth: cfg.Bandwidth,
+	})
+	if err != nil {
+		cleanup()
+		return err
+	}
+	if err := dropSnapshotMetadata(l, dom); err != nil {
+		cleanup()
+		return err
+	}
+	if _, err := l.DomainDefineXML(string(domXML)); err != nil {
+		cleanup()
+		return fmt.Errorf("define domain: %w", err)
+	}
+
+	if seedPath != "" {
+		err = os.Rename(seedPath+suffix, seedPath)
+	} else {
+		err = os.Remove(h.seedPath(id))
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// A volume that cannot be deleted now is replaced by the next
+	// reinstall or removed with the domain.
+	_ = l.StorageVolDelete(old, 0)
+	return nil
+}
+
+func (h *LibvirtHypervisor) CreateSnapshot(ctx context.Context, id, name string) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	snapXML, err := RenderSnapshotXML(name)
+	if err != nil {
+		return err
+	}
+	if _, err := l.DomainSnapshotCreateXML(dom, string(snapXML), 0); err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	return nil
+}
+
+func (h *LibvirtHypervisor) DeleteSnapshot(ctx context.Context, id, name string) error {
+	l, snap, err := h.lookupSnapshot(ctx, id, name)
+	if err != nil {
+		return err
+	}
+	return l.DomainSnapshotDelete(snap, 0)
+}
+
+// RevertSnapshot reverts a stopped domain. Snapshots taken while the guest
+// was running carry its memory and libvirt resumes them, so the domain is
+// destroyed again to leave it stopped as the caller expects.
+func (h *LibvirtHypervisor) RevertSnapshot(ctx context.Context, id, name string) error {
+	l, snap, err := h.lookupSnapshot(ctx, id, name)
+	if err != nil {
+		return err
+	}
+	if h.isActive(l, snap.Dom) {
+		return ErrVMRunning
+	}
+	if err := l.DomainRevertToSnapshot(snap, 0); err != nil {
+		return err
+	}
+	if h.isActive(l, snap.Dom) {
+		return l.DomainDestroy(snap.Dom)
+	}
+	return nil
+}
+
+// ExportDisk and ImportDisk work on the volume's file with a local
+// qemu-img, as the storage pool is a directory on this host.
+func (h *LibvirtHypervisor) ExportDisk(ctx context.Context, id, snapshot string, w io.Writer) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if snapshot == "" && h.isActive(l, dom) {
+		return ErrVMRunning
+	}
+	_, _, path, err := h.volume(l, dom)
+	if err != nil {
+		return err
+	}
+	return exportDisk(ctx, execRunner, h.opts.ImgBinary, path, snapshot, w)
+}
+
+func (h *LibvirtHypervisor) ImportDisk(ctx context.Context, id string, r io.Reader) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	if h.isActive(l, dom) {
+		return ErrVMRunning
+	}
+	pool, vol, path, err := h.volume(l, dom)
+	if err != nil {
+		return err
+	}
+	_, capacity, _, err := l.StorageVolGetInfo(vol)
+	if err != nil {
+		return err
+	}
+	if err := importDisk(ctx, execRunner, h.opts.ImgBinary, path, int(capacity>>30), r); err != nil {
+		return err
+	}
+	if err := dropSnapshotMetadata(l, dom); err != nil {
+		return err
+	}
+	return l.StoragePoolRefresh(pool, 0)
+}
+
+// ResizeVM updates the persistent definition; CPU and memory changes apply on
+// the next boot while disk growth is applied online when the domain runs.
+func (h *LibvirtHypervisor) ResizeVM(ctx context.Context, id string, cfg VMConfig) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	_, vol, _, err := h.volume(l, dom)
+	if err != nil {
+		return err
+	}
+	_, capacity, _, err := l.StorageVolGetInfo(vol)
+	if err != nil {
+		return err
+	}
+	size := uint64(cfg.DiskGB) << 30
+	if size < capacity {
+		return ErrDiskShrink
+	}
+	if size > capacity {
+		if h.isActive(l, dom) {
+			err = l.DomainBlockResize(dom, "vda", size, libvirt.DomainBlockResizeBytes)
+		} else {
+			err = l.StorageVolResize(vol, size, 0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.CPU > 0 {
+		flags := uint32(libvirt.DomainVCPUConfig)
+		if err := l.DomainSetVcpusFlags(dom, uint32(cfg.CPU), flags|uint32(libvirt.DomainVCPUMaximum)); err != nil {
+			return err
+		}
+		if err := l.DomainSetVcpusFlags(dom, uint32(cfg.CPU), flags); err != nil {
+			return err
+		}
+	}
+	if cfg.MemoryMB > 0 {
+		kib := uint64(cfg.MemoryMB) * 1024
+		flags := uint32(libvirt.DomainMemConfig)
+		if err := l.DomainSetMemoryFlags(dom, kib, flags|uint32(libvirt.DomainMemMaximum)); err != nil {
+			return err
+		}
+		if err := l.DomainSetMemoryFlags(dom, kib, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetBandwidth changes the limits of the guest's interface in its
+// definition and, when it is running, live. A zero rate removes the limit.
+func (h *LibvirtHypervisor) SetBandwidth(ctx context.Context, id string, bw Bandwidth) error {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	desc, err := l.DomainGetXMLDesc(dom, libvirt.DomainXMLInactive)
+	if err != nil {
+		return err
+	}
+	var def domainXML
+	if err := xml.Unmarshal([]byte(desc), &def); err != nil {
+		return fmt.Errorf("parse domain xml: %w", err)
+	}
+	if len(def.Devices.Interfaces) == 0 || def.Devices.Interfaces[0].MAC == nil {
+		return fmt.Errorf("domain %s has no network interface", id)
+	}
+	flags := libvirt.DomainAffectConfig
+	if h.isActive(l, dom) {
+		flags |= libvirt.DomainAffectLive
+	}
+	params := []libvirt.TypedParam{
+		{Field: "inbound.average", Value: *libvirt.NewTypedParamValueUint(uint32(kilobytesPerSecond(bw.InboundMbps)))},
+		{Field: "outbound.average", Value: *libvirt.NewTypedParamValueUint(uint32(kilobytesPerSecond(bw.OutboundMbps)))},
+	}
+	return l.DomainSetInterfaceParameters(dom, def.Devices.Interfaces[0].MAC.Address, params, uint32(flags))
+}
+
+// TrafficStats sums the interface counters of every running domain.
+// libvirt reports them from the guest's side.
+func (h *LibvirtHypervisor) TrafficStats(ctx context.Context) ([]TrafficCounters, error) {
+	l, err := h.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records, err := l.ConnectGetAllDomainStats(nil, uint32(libvirt.DomainStatsInterface), uint32(libvirt.ConnectGetAllDomainsStatsActive))
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]TrafficCounters, 0, len(records))
+	for _, rec := range records {
+		c := TrafficCounters{ID: rec.Dom.Name}
+		for _, p := range rec.Params {
+			v, ok := p.Value.I.(uint64)
+			if !ok || !strings.HasPrefix(p.Field, "net.") {
+				continue
+			}
+			switch {
+			case strings.HasSuffix(p.Field, ".rx.bytes"):
+				c.RxBytes += v
+			case strings.HasSuffix(p.Field, ".tx.bytes"):
+				c.TxBytes += v
+			}
+		}
+		stats = append(stats, c)
+	}
+	return stats, nil
+}
+
+// describe builds a VMInfo from the persistent domain definition, its run
+// state and the size of its root volume.
+func (h *LibvirtHypervisor) describe(l *libvirt.Libvirt, dom libvirt.Domain) (*VMInfo, error) {
+	desc, err := l.DomainGetXMLDesc(dom, libvirt.DomainXMLInactive)
+	if err != nil {
+		return nil, err
+	}
+	var def domainXML
+	if err := xml.Unmarshal([]byte(desc), &def); err != nil {
+		return nil, fmt.Errorf("parse domain xml: %w", err)
+	}
+	info := &VMInfo{
+		ID:       dom.Name,
+		Name:     def.Title,
+		Status:   "stopped",
+		CPU:      def.VCPU,
+		MemoryMB: def.Memory.mebibytes(),
+	}
+	if h.isActive(l, dom) {
+		info.Status = "running"
+	}
+	if vol, err := l.StorageVolLookupByPath(def.rootDisk()); err == nil {
+		if _, capacity, _, err := l.StorageVolGetInfo(vol); err == nil {
+			info.DiskGB = int(capacity >> 30)
+		}
+	}
+	return info, nil
+}
+
+// client returns a connected libvirt client, reconnecting if the previous
+// connection dropped. go-libvirt has no context support, so ctx is only
+// checked before issuing calls.
+func (h *LibvirtHypervisor) client(ctx context.Context) (*libvirt.Libvirt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn != nil && h.conn.IsConnected() {
+		return h.conn, nil
+	}
+	dialer := dialers.NewLocal(dialers.WithSocket(h.opts.Socket), dialers.WithLocalTimeout(h.opts.DialTimeout))
+	l := libvirt.NewWithDialer(dialer)
+	if err := l.Connect(); err != nil {
+		return nil, fmt.Errorf("connect libvirt: %w", err)
+	}
+	h.conn = l
+	return l, nil
+}
+
+func (h *LibvirtHypervisor) lookup(ctx context.Context, id string) (*libvirt.Libvirt, libvirt.Domain, error) {
+	l, err := h.client(ctx)
+	if err != nil {
+		return nil, libvirt.Domain{}, err
+	}
+	dom, err := l.DomainLookupByName(id)
+	if err != nil {
+		if libvirt.IsNotFound(err) {
+			return nil, libvirt.Domain{}, ErrVMNotFound
+		}
+		return nil, libvirt.Domain{}, err
+	}
+	return l, dom, nil
+}
+
+// dropSnapshotMetadata forgets the domain's snapshots. It is used when the
+// volume holding them is replaced; the snapshots go with it.
+func dropSnapshotMetadata(l *libvirt.Libvirt, dom libvirt.Domain) error {
+	names, err := l.DomainSnapshotListNames(dom, maxSnapshotNames, 0)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		snap, err := l.DomainSnapshotLookupByName(dom, name, 0)
+		if err != nil {
+			return err
+		}
+		if err := l.DomainSnapshotDelete(snap, libvirt.DomainSnapshotDeleteMetadataOnly); err != nil {
+			return fmt.Errorf("delete snapshot %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// volume returns the domain's root volume and its path on the host. The
+// volume is found through the domain's disk, as a reinstall moves it
+// between volumeName and spareVolumeName.
+func (h *LibvirtHypervisor) volume(l *libvirt.Libvirt, dom libvirt.Domain) (libvirt.StoragePool, libvirt.StorageVol, string, error) {
+	pool, err := l.StoragePoolLookupByName(h.opts.StoragePool)
+	if err != nil {
+		return libvirt.StoragePool{}, libvirt.StorageVol{}, "", fmt.Errorf("lookup storage pool %s: %w", h.opts.StoragePool, err)
+	}
+	desc, err := l.DomainGetXMLDesc(dom, libvirt.DomainXMLInactive)
+	if err != nil {
+		return libvirt.StoragePool{}, libvirt.StorageVol{}, "", err
+	}
+	var def domainXML
+	if err := xml.Unmarshal([]byte(desc), &def); err != nil {
+		return libvirt.StoragePool{}, libvirt.StorageVol{}, "", fmt.Errorf("parse domain xml: %w", err)
+	}
+	path := def.rootDisk()
+	vol, err := l.StorageVolLookupByPath(path)
+	if err != nil {
+		return libvirt.StoragePool{}, libvirt.StorageVol{}, "", err
+	}
+	return pool, vol, path, nil
+}
+
+func (h *LibvirtHypervisor) lookupSnapshot(ctx context.Context, id, name string) (*libvirt.Libvirt, libvirt.DomainSnapshot, error) {
+	l, dom, err := h.lookup(ctx, id)
+	if err != nil {
+		return nil, libvirt.DomainSnapshot{}, err
+	}
+	snap, err := l.DomainSnapshotLookupByName(dom, name, 0)
+	if err != nil {
+		var lerr libvirt.Error
+		if errors.As(err, &lerr) && lerr.Code == uint32(libvirt.ErrNoDomainSnapshot) {
+			return nil, libvirt.DomainSnapshot{}, ErrSnapshotNotFound
+		}
+		return nil, libvirt.DomainSnapshot{}, err
+	}
+	return l, snap, nil
+}
+
+func (h *LibvirtHypervisor) isActive(l *libvirt.Libvirt, dom libvirt.Domain) bool {
+	active, err := l.DomainIsActive(dom)
+	return err == nil && active == 1
+}
+
+// seedPath is where the domain's cloud-init seed ISO lives. The file is
+// read by the local qemu process, so it sits next to libvirtd rather than
+// in the storage pool.
+func (h *LibvirtHypervisor) seedPath(id string) string {
+	return filepath.Join(h.opts.SeedDir, id+".iso")
+}
+
+func formatUUID(u libvirt.UUID) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func volumeName(id string) string {
+	return id + ".qcow2"
+}
+
+// spareVolumeName is where a reinstall builds the new root volume of a
+// domain whose volume is at volumeName, and the other way round.
+func spareVolumeName(id string) string {
+	return id + "-1.qcow2"
+}
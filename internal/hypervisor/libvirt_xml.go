@@ -0,0 +1,285 @@
+package hypervisor
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// DomainSpec describes everything needed to render a libvirt domain.
+type DomainSpec struct {
+	ID        string
+	UUID      string
+	Title     string
+	CPU       int
+	MemoryMB  int
+	DiskPath  string
+	SeedPath  string
+	Machine   string
+	Network   string
+	Bridge    string
+	Bandwidth Bandwidth
+}
+
+type domainXML struct {
+	XMLName  xml.Name         `xml:"domain"`
+	Type     string           `xml:"type,attr"`
+	Name     string           `xml:"name"`
+	UUID     string           `xml:"uuid,omitempty"`
+	Title    string           `xml:"title,omitempty"`
+	Memory   sizeXML          `xml:"memory"`
+	VCPU     int              `xml:"vcpu"`
+	OS       domainOSXML      `xml:"os"`
+	Features domainFeatures   `xml:"features"`
+	CPU      domainCPUXML     `xml:"cpu"`
+	OnCrash  string           `xml:"on_crash"`
+	Devices  domainDevicesXML `xml:"devices"`
+}
+
+type sizeXML struct {
+	Unit  string `xml:"unit,attr"`
+	Value int    `xml:",chardata"`
+}
+
+// mebibytes converts a libvirt memory element to MiB; libvirt reports KiB
+// unless a unit is given.
+func (s sizeXML) mebibytes() int {
+	switch s.Unit {
+	case "b", "bytes":
+		return s.Value >> 20
+	case "M", "MiB":
+		return s.Value
+	case "G", "GiB":
+		return s.Value << 10
+	default:
+		return s.Value >> 10
+	}
+}
+
+type domainOSXML struct {
+	Type domainOSTypeXML `xml:"type"`
+	Boot struct {
+		Dev string `xml:"dev,attr"`
+	} `xml:"boot"`
+}
+
+type domainOSTypeXML struct {
+	Arch    string `xml:"arch,attr"`
+	Machine string `xml:"machine,attr"`
+	Value   string `xml:",chardata"`
+}
+
+type domainFeatures struct {
+	ACPI struct{} `xml:"acpi"`
+	APIC struct{} `xml:"apic"`
+}
+
+type domainCPUXML struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type domainDevicesXML struct {
+	Disks      []domainDiskXML      `xml:"disk"`
+	Interfaces []domainInterfaceXML `xml:"interface"`
+	Serial     domainConsoleXML     `xml:"serial"`
+	Console    domainConsoleXML     `xml:"console"`
+}
+
+type domainDiskXML struct {
+	Type   string `xml:"type,attr"`
+	Device string `xml:"device,attr"`
+	Driver struct {
+		Name    string `xml:"name,attr"`
+		Type    string `xml:"type,attr"`
+		Cache   string `xml:"cache,attr,omitempty"`
+		Discard string `xml:"discard,attr,omitempty"`
+	} `xml:"driver"`
+	Source struct {
+		File string `xml:"file,attr"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+		Bus string `xml:"bus,attr"`
+	} `xml:"target"`
+	Readonly *struct{} `xml:"readonly"`
+}
+
+// rootDisk returns the file behind the domain's vda disk, or "" if it has
+// none.
+func (d *domainXML) rootDisk() string {
+	for _, disk := range d.Devices.Disks {
+		if disk.Target.Dev == "vda" {
+			return disk.Source.File
+		}
+	}
+	return ""
+}
+
+type domainInterfaceXML struct {
+	Type string `xml:"type,attr"`
+	MAC  *struct {
+		Address string `xml:"address,attr"`
+	} `xml:"mac,omitempty"`
+	Source struct {
+		Network string `xml:"network,attr,omitempty"`
+		Bridge  string `xml:"bridge,attr,omitempty"`
+	} `xml:"source"`
+	Model struct {
+		Type string `xml:"type,attr"`
+	} `xml:"model"`
+	Bandwidth *domainBandwidthXML `xml:"bandwidth,omitempty"`
+}
+
+type domainBandwidthXML struct {
+	Inbound  *domainRateXML `xml:"inbound,omitempty"`
+	Outbound *domainRateXML `xml:"outbound,omitempty"`
+}
+
+// domainRateXML is a libvirt interface rate in kilobytes per second.
+type domainRateXML struct {
+	Average int `xml:"average,attr"`
+}
+
+// kilobytesPerSecond converts megabits per second to libvirt's rate unit.
+func kilobytesPerSecond(mbps int) int {
+	return mbps * 1000 / 8
+}
+
+type domainConsoleXML struct {
+	Type   string                  `xml:"type,attr"`
+	Target *domainConsoleTargetXML `xml:"target,omitempty"`
+}
+
+type domainConsoleTargetXML struct {
+	Type string `xml:"type,attr"`
+	Port int    `xml:"port,attr"`
+}
+
+type volumeXML struct {
+	XMLName  xml.Name `xml:"volume"`
+	Name     string   `xml:"name"`
+	Capacity sizeXML  `xml:"capacity"`
+	Target   struct {
+		Format struct {
+			Type string `xml:"type,attr"`
+		} `xml:"format"`
+	} `xml:"target"`
+	BackingStore *volumeBackingXML `xml:"backingStore,omitempty"`
+}
+
+type volumeBackingXML struct {
+	Path   string `xml:"path"`
+	Format struct {
+		Type string `xml:"type,attr"`
+	} `xml:"format"`
+}
+
+type snapshotXML struct {
+	XMLName xml.Name `xml:"domainsnapshot"`
+	Name    string   `xml:"name"`
+}
+
+// RenderDomainXML renders a KVM domain definition for spec.
+func RenderDomainXML(spec DomainSpec) ([]byte, error) {
+	if spec.ID == "" || spec.DiskPath == "" {
+		return nil, fmt.Errorf("domain spec requires id and disk path")
+	}
+	machine := spec.Machine
+	if machine == "" {
+		machine = "q35"
+	}
+
+	d := domainXML{
+		Type:    "kvm",
+		Name:    spec.ID,
+		UUID:    spec.UUID,
+		Title:   spec.Title,
+		Memory:  sizeXML{Unit: "MiB", Value: spec.MemoryMB},
+		VCPU:    spec.CPU,
+		OnCrash: "restart",
+	}
+	d.OS.Type = domainOSTypeXML{Arch: "x86_64", Machine: machine, Value: "hvm"}
+	d.OS.Boot.Dev = "hd"
+	d.CPU.Mode = "host-passthrough"
+
+	var disk domainDiskXML
+	disk.Type = "file"
+	disk.Device = "disk"
+	disk.Driver.Name = "qemu"
+	disk.Driver.Type = "qcow2"
+	disk.Driver.Cache = "none"
+	disk.Driver.Discard = "unmap"
+	disk.Source.File = spec.DiskPath
+	disk.Target.Dev = "vda"
+	disk.Target.Bus = "virtio"
+	d.Devices.Disks = append(d.Devices.Disks, disk)
+
+	if spec.SeedPath != "" {
+		var seed domainDiskXML
+		seed.Type = "file"
+		seed.Device = "cdrom"
+		seed.Driver.Name = "qemu"
+		seed.Driver.Type = "raw"
+		seed.Source.File = spec.SeedPath
+		seed.Target.Dev = "sda"
+		seed.Target.Bus = "sata"
+		seed.Readonly = &struct{}{}
+		d.Devices.Disks = append(d.Devices.Disks, seed)
+	}
+
+	var iface domainInterfaceXML
+	if spec.Bridge != "" {
+		iface.Type = "bridge"
+		iface.Source.Bridge = spec.Bridge
+	} else {
+		iface.Type = "network"
+		iface.Source.Network = spec.Network
+		if iface.Source.Network == "" {
+			iface.Source.Network = "default"
+		}
+	}
+	iface.Model.Type = "virtio"
+	if bw := spec.Bandwidth; bw.Limited() {
+		iface.Bandwidth = &domainBandwidthXML{}
+		if bw.InboundMbps > 0 {
+			iface.Bandwidth.Inbound = &domainRateXML{Average: kilobytesPerSecond(bw.InboundMbps)}
+		}
+		if bw.OutboundMbps > 0 {
+			iface.Bandwidth.Outbound = &domainRateXML{Average: kilobytesPerSecond(bw.OutboundMbps)}
+		}
+	}
+	d.Devices.Interfaces = append(d.Devices.Interfaces, iface)
+
+	d.Devices.Serial = domainConsoleXML{Type: "pty", Target: &domainConsoleTargetXML{Type: "isa-serial"}}
+	d.Devices.Console = domainConsoleXML{Type: "pty"}
+
+	return marshalXML(d)
+}
+
+// RenderVolumeXML renders a qcow2 storage volume definition. With a
+// backingPath the volume is a copy-on-write overlay on that qcow2 image.
+func RenderVolumeXML(name string, sizeGB int, backingPath string) ([]byte, error) {
+	v := volumeXML{Name: name, Capacity: sizeXML{Unit: "GiB", Value: sizeGB}}
+	v.Target.Format.Type = "qcow2"
+	if backingPath != "" {
+		v.BackingStore = &volumeBackingXML{Path: backingPath}
+		v.BackingStore.Format.Type = "qcow2"
+	}
+	return marshalXML(v)
+}
+
+// RenderSnapshotXML renders a domain snapshot definition. Everything but the
+// name is left to libvirt, which takes internal snapshots of qcow2 disks.
+func RenderSnapshotXML(name string) ([]byte, error) {
+	if name == "" {
+		return nil, fmt.Errorf("snapshot requires a name")
+	}
+	return marshalXML(snapshotXML{Name: name})
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
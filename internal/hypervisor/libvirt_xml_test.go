@@ -0,0 +1,131 @@
+package hypervisor
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files")
+
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("write golden: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch\n--- got ---\n%s\n--- want ---\n%s", name, got, want)
+	}
+}
+
+func TestRenderDomainXML(t *testing.T) {
+	cases := []struct {
+		golden string
+		spec   DomainSpec
+	}{
+		{
+			golden: "domain_network.xml",
+			spec: DomainSpec{
+				ID:       "vm-0011223344556677",
+				Title:    "web <prod>",
+				CPU:      2,
+				MemoryMB: 2048,
+				DiskPath: "/var/lib/libvirt/images/vm-0011223344556677.qcow2",
+			},
+		},
+		{
+			golden: "domain_bridge.xml",
+			spec: DomainSpec{
+				ID:        "vm-8899aabbccddeeff",
+				Title:     "db",
+				CPU:       4,
+				MemoryMB:  8192,
+				DiskPath:  "/data/pool/vm-8899aabbccddeeff.qcow2",
+				Machine:   "pc-q35-8.2",
+				Bridge:    "br0",
+				Bandwidth: Bandwidth{InboundMbps: 100, OutboundMbps: 50},
+			},
+		},
+		{
+			golden: "domain_seed.xml",
+			spec: DomainSpec{
+				ID:       "vm-0011223344556677",
+				Title:    "web",
+				CPU:      1,
+				MemoryMB: 1024,
+				DiskPath: "/var/lib/libvirt/images/vm-0011223344556677.qcow2",
+				SeedPath: "/var/lib/starstream/seeds/vm-0011223344556677.iso",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.golden, func(t *testing.T) {
+			got, err := RenderDomainXML(tc.spec)
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+			assertGolden(t, tc.golden, got)
+		})
+	}
+
+	if _, err := RenderDomainXML(DomainSpec{ID: "vm-x"}); err == nil {
+		t.Fatal("expected error for spec without disk path")
+	}
+}
+
+func TestDomainRootDisk(t *testing.T) {
+	spec := DomainSpec{
+		ID:       "vm-0011223344556677",
+		CPU:      1,
+		MemoryMB: 1024,
+		DiskPath: "/var/lib/libvirt/images/vm-0011223344556677-1.qcow2",
+		SeedPath: "/var/lib/starstream/seeds/vm-0011223344556677.iso",
+	}
+	out, err := RenderDomainXML(spec)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	var def domainXML
+	if err := xml.Unmarshal(out, &def); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got := def.rootDisk(); got != spec.DiskPath {
+		t.Fatalf("root disk = %q, want %q", got, spec.DiskPath)
+	}
+}
+
+func TestRenderVolumeXML(t *testing.T) {
+	got, err := RenderVolumeXML("vm-0011223344556677.qcow2", 40, "")
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	assertGolden(t, "volume.xml", got)
+
+	got, err = RenderVolumeXML("vm-0011223344556677.qcow2", 40, "/var/lib/starstream/images/base.qcow2")
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	assertGolden(t, "volume_backing.xml", got)
+}
+
+func TestRenderSnapshotXML(t *testing.T) {
+	got, err := RenderSnapshotXML("snap-42")
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	assertGolden(t, "snapshot.xml", got)
+
+	if _, err := RenderSnapshotXML(""); err == nil {
+		t.Fatal("expected error for snapshot without name")
+	}
+}
@@ -0,0 +1,17 @@
+package hypervisor
+
+import (
+	"context"
+	"errors"
+
+	"StarstreamAstra/internal/nat"
+)
+
+var ErrNATUnsupported = errors.New("node does not forward ports to NAT guests")
+
+// NATSupport is implemented by drivers whose host forwards ports of its
+// public address to guests.
+type NATSupport interface {
+	// ApplyNAT replaces every forward on the host with rules.
+	ApplyNAT(ctx context.Context, rules nat.Ruleset) error
+}
@@ -1,24 +1,802 @@
 package hypervisor
 
-type QEMUHypervisor struct{}
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
 
-func NewQEMUHypervisor() *QEMUHypervisor {
-	return &QEMUHypervisor{}
+const (
+	qemuDiskFile  = "disk.qcow2"
+	qemuQMPSocket = "qmp.sock"
+	qemuVNCSocket = "vnc.sock"
+	qemuPIDFile   = "qemu.pid"
+	qemuMetaFile  = "vm.json"
+	qemuSeedFile  = "seed.iso"
+	qemuDiskID    = "drive0"
+)
+
+var ErrDiskShrink = errors.New("disk cannot be shrunk")
+
+type QEMUOptions struct {
+	Binary          string
+	ImgBinary       string
+	ISOBinary       string
+	DataDir         string
+	ImageDir        string
+	Accel           string
+	Machine         string
+	Bridge          string
+	QMPTimeout      time.Duration
+	ShutdownTimeout time.Duration
+}
+
+// commandRunner executes an external program and returns its combined output.
+type commandRunner func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+func execRunner(ctx context.Context, name string, args ...string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%s: %w: %s", name, err, out)
+	}
+	return out, nil
+}
+
+// QEMUHypervisor manages qemu-system processes directly. Every guest owns a
+// directory under DataDir holding its disk, QMP socket, pid file and metadata.
+type QEMUHypervisor struct {
+	opts   QEMUOptions
+	run    commandRunner
+	images *ImageStore
+	mu     sync.Mutex
+	locks  map[string]*sync.Mutex
+	// netDir is where the kernel exposes network device statistics.
+	netDir string
+}
+
+type qemuMeta struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CPU       int       `json:"cpu"`
+	MemoryMB  int       `json:"memory_mb"`
+	DiskGB    int       `json:"disk_gb"`
+	Image     string    `json:"image,omitempty"`
+	Seed      bool      `json:"seed,omitempty"`
+	Bandwidth Bandwidth `json:"bandwidth"`
+}
+
+func NewQEMUHypervisor(opts QEMUOptions) *QEMUHypervisor {
+	if opts.Binary == "" {
+		opts.Binary = "qemu-system-x86_64"
+	}
+	if opts.ImgBinary == "" {
+		opts.ImgBinary = "qemu-img"
+	}
+	if opts.ISOBinary == "" {
+		opts.ISOBinary = "genisoimage"
+	}
+	if opts.DataDir == "" {
+		opts.DataDir = "/var/lib/starstream/vms"
+	}
+	if opts.ImageDir == "" {
+		opts.ImageDir = "/var/lib/starstream/images"
+	}
+	if opts.Accel == "" {
+		opts.Accel = "kvm"
+	}
+	if opts.Machine == "" {
+		opts.Machine = "q35"
+	}
+	if opts.QMPTimeout <= 0 {
+		opts.QMPTimeout = 5 * time.Second
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = 60 * time.Second
+	}
+	return &QEMUHypervisor{
+		opts:   opts,
+		run:    execRunner,
+		images: NewImageStore(opts.ImageDir),
+		locks:  make(map[string]*sync.Mutex),
+		netDir: "/sys/class/net",
+	}
+}
+
+func (q *QEMUHypervisor) CreateVM(ctx context.Context, cfg VMConfig) (*VMInfo, error) {
+	if cfg.Bandwidth.Limited() && q.opts.Bridge == "" {
+		return nil, ErrBandwidthUnsupported
+	}
+	id, err := newVMID()
+	if err != nil {
+		return nil, err
+	}
+	unlock := q.lock(id)
+	defer unlock()
+
+	dir := q.vmDir(id)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	meta := &qemuMeta{ID: id, Name: cfg.Name, CPU: cfg.CPU, MemoryMB: cfg.MemoryMB, Bandwidth: cfg.Bandwidth}
+	if err := q.install(ctx, meta, cfg, ""); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := q.saveMeta(meta); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	return meta.info("stopped"), nil
+}
+
+// install builds the guest's disk and seed from cfg and records them in
+// meta. Files are written with suffix and left for the caller to move into
+// place, so a failed reinstall keeps the old disk.
+func (q *QEMUHypervisor) install(ctx context.Context, meta *qemuMeta, cfg VMConfig, suffix string) error {
+	dir := q.vmDir(meta.ID)
+	args := []string{"create", "-f", "qcow2"}
+	meta.Image = ""
+	if cfg.Image != nil {
+		base, err := q.images.Ensure(ctx, *cfg.Image)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-F", "qcow2", "-b", base)
+		meta.Image = cfg.Image.Name
+	}
+	args = append(args, filepath.Join(dir, qemuDiskFile+suffix), fmt.Sprintf("%dG", cfg.DiskGB))
+	if _, err := q.run(ctx, q.opts.ImgBinary, args...); err != nil {
+		return err
+	}
+	meta.DiskGB = cfg.DiskGB
+	meta.Seed = cfg.CloudInit != nil
+	if meta.Seed {
+		return buildSeedISO(ctx, q.run, q.opts.ISOBinary, filepath.Join(dir, qemuSeedFile+suffix), meta.ID, *cfg.CloudInit)
+	}
+	return nil
+}
+
+func (q *QEMUHypervisor) GetVM(ctx context.Context, id string) (*VMInfo, error) {
+	meta, err := q.loadMeta(id)
+	if err != nil {
+		return nil, err
+	}
+	return meta.info(q.status(ctx, id)), nil
+}
+
+func (q *QEMUHypervisor) ListVMs(ctx context.Context) ([]*VMInfo, error) {
+	entries, err := os.ReadDir(q.opts.DataDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var vms []*VMInfo
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		meta, err := q.loadMeta(e.Name())
+		if err != nil {
+			continue
+		}
+		vms = append(vms, meta.info(q.status(ctx, meta.ID)))
+	}
+	return vms, nil
+}
+
+func (q *QEMUHypervisor) StartVM(ctx context.Context, id string) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	meta, err := q.loadMeta(id)
+	if err != nil {
+		return err
+	}
+	if q.isRunning(ctx, id) {
+		return nil
+	}
+	_ = os.Remove(q.socketPath(id))
+	_ = os.Remove(q.vncPath(id))
+	if _, err := q.run(ctx, q.opts.Binary, q.commandLine(meta)...); err != nil {
+		return err
+	}
+	if q.opts.Bridge == "" {
+		return nil
+	}
+	// A guest that is not on the bridge or not shaped as paid for is
+	// stopped again rather than left running half set up.
+	tap := tapName(id)
+	if _, err := q.run(ctx, "ip", "link", "set", "dev", tap, "master", q.opts.Bridge, "up"); err != nil {
+		_ = q.quit(ctx, id)
+		return err
+	}
+	if err := q.shape(ctx, tap, meta.Bandwidth); err != nil {
+		_ = q.quit(ctx, id)
+		return err
+	}
+	return nil
+}
+
+func (q *QEMUHypervisor) StopVM(ctx context.Context, id string) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	if _, err := q.loadMeta(id); err != nil {
+		return err
+	}
+	return q.shutdown(ctx, id)
+}
+
+func (q *QEMUHypervisor) ForceStopVM(ctx context.Context, id string) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	if _, err := q.loadMeta(id); err != nil {
+		return err
+	}
+	return q.quit(ctx, id)
+}
+
+func (q *QEMUHypervisor) RebootVM(ctx context.Context, id string) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	if _, err := q.loadMeta(id); err != nil {
+		return err
+	}
+	if !q.isRunning(ctx, id) {
+		return ErrVMNotRunning
+	}
+	return q.execute(ctx, id, "system_reset", nil)
+}
+
+func (q *QEMUHypervisor) DeleteVM(ctx context.Context, id string) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	if _, err := q.loadMeta(id); err != nil {
+		return err
+	}
+	if err := q.quit(ctx, id); err != nil {
+		return err
+	}
+	return os.RemoveAll(q.vmDir(id))
+}
+
+// ResizeVM grows the disk online through QMP when the guest is running.
+// CPU and memory changes are persisted and take effect on the next boot.
+func (q *QEMUHypervisor) ResizeVM(ctx context.Context, id string, cfg VMConfig) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	meta, err := q.loadMeta(id)
+	if err != nil {
+		return err
+	}
+	if cfg.DiskGB < meta.DiskGB {
+		return ErrDiskShrink
+	}
+	if cfg.DiskGB > meta.DiskGB {
+		if q.isRunning(ctx, id) {
+			args := map[string]interface{}{"device": qemuDiskID, "size": int64(cfg.DiskGB) << 30}
+			if err := q.execute(ctx, id, "block_resize", args); err != nil {
+				return err
+			}
+		} else {
+			disk := filepath.Join(q.vmDir(id), qemuDiskFile)
+			if _, err := q.run(ctx, q.opts.ImgBinary, "resize", disk, fmt.Sprintf("%dG", cfg.DiskGB)); err != nil {
+				return err
+			}
+		}
+		meta.DiskGB = cfg.DiskGB
+	}
+	if cfg.CPU > 0 {
+		meta.CPU = cfg.CPU
+	}
+	if cfg.MemoryMB > 0 {
+		meta.MemoryMB = cfg.MemoryMB
+	}
+	return q.saveMeta(meta)
+}
+
+func (q *QEMUHypervisor) ReinstallVM(ctx context.Context, id string, cfg VMConfig) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	meta, err := q.loadMeta(id)
+	if err != nil {
+		return err
+	}
+	if q.isRunning(ctx, id) {
+		return ErrVMRunning
+	}
+	const suffix = ".new"
+	dir := q.vmDir(id)
+	disk, seed := filepath.Join(dir, qemuDiskFile), filepath.Join(dir, qemuSeedFile)
+	if err := q.install(ctx, meta, cfg, suffix); err != nil {
+		_ = os.Remove(disk + suffix)
+		_ = os.Remove(seed + suffix)
+		return err
+	}
+	if err := os.Rename(disk+suffix, disk); err != nil {
+		return err
+	}
+	if meta.Seed {
+		err = os.Rename(seed+suffix, seed)
+	} else {
+		err = os.Remove(seed)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return q.saveMeta(meta)
+}
+
+// CreateSnapshot uses savevm on a running guest, which stores its memory
+// alongside the disk, and qemu-img on a stopped one.
+func (q *QEMUHypervisor) CreateSnapshot(ctx context.Context, id, name string) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	if _, err := q.loadMeta(id); err != nil {
+		return err
+	}
+	if q.isRunning(ctx, id) {
+		return q.monitor(ctx, id, "savevm "+name)
+	}
+	_, err := q.run(ctx, q.opts.ImgBinary, "snapshot", "-c", name, q.diskPath(id))
+	return err
+}
+
+func (q *QEMUHypervisor) DeleteSnapshot(ctx context.Context, id, name string) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	if _, err := q.loadMeta(id); err != nil {
+		return err
+	}
+	if err := q.findSnapshot(ctx, id, name); err != nil {
+		return err
+	}
+	if q.isRunning(ctx, id) {
+		return q.monitor(ctx, id, "delvm "+name)
+	}
+	_, err := q.run(ctx, q.opts.ImgBinary, "snapshot", "-d", name, q.diskPath(id))
+	return err
+}
+
+func (q *QEMUHypervisor) RevertSnapshot(ctx context.Context, id, name string) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	if _, err := q.loadMeta(id); err != nil {
+		return err
+	}
+	if q.isRunning(ctx, id) {
+		return ErrVMRunning
+	}
+	if err := q.findSnapshot(ctx, id, name); err != nil {
+		return err
+	}
+	_, err := q.run(ctx, q.opts.ImgBinary, "snapshot", "-a", name, q.diskPath(id))
+	return err
+}
+
+func (q *QEMUHypervisor) ExportDisk(ctx context.Context, id, snapshot string, w io.Writer) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	if _, err := q.loadMeta(id); err != nil {
+		return err
+	}
+	if snapshot == "" && q.isRunning(ctx, id) {
+		return ErrVMRunning
+	}
+	return exportDisk(ctx, q.run, q.opts.ImgBinary, q.diskPath(id), snapshot, w)
+}
+
+func (q *QEMUHypervisor) ImportDisk(ctx context.Context, id string, r io.Reader) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	meta, err := q.loadMeta(id)
+	if err != nil {
+		return err
+	}
+	if q.isRunning(ctx, id) {
+		return ErrVMRunning
+	}
+	return importDisk(ctx, q.run, q.opts.ImgBinary, q.diskPath(id), meta.DiskGB, r)
+}
+
+// SetBandwidth stores the limits for the next boot and reshapes the tap
+// device of a running guest. Guests on user-mode networking have no tap
+// device to shape.
+func (q *QEMUHypervisor) SetBandwidth(ctx context.Context, id string, bw Bandwidth) error {
+	unlock := q.lock(id)
+	defer unlock()
+
+	meta, err := q.loadMeta(id)
+	if err != nil {
+		return err
+	}
+	if q.opts.Bridge == "" {
+		if bw.Limited() {
+			return ErrBandwidthUnsupported
+		}
+	} else if q.isRunning(ctx, id) {
+		if err := q.shape(ctx, tapName(id), bw); err != nil {
+			return err
+		}
+	}
+	meta.Bandwidth = bw
+	return q.saveMeta(meta)
+}
+
+// TrafficStats reads the counters of the guests' tap devices, which only
+// exist while a guest runs. The tap sees traffic from the host's side, so
+// what it transmits is what the guest received.
+func (q *QEMUHypervisor) TrafficStats(ctx context.Context) ([]TrafficCounters, error) {
+	if q.opts.Bridge == "" {
+		return nil, ErrTrafficUnsupported
+	}
+	entries, err := os.ReadDir(q.opts.DataDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var stats []TrafficCounters
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(q.netDir, tapName(e.Name()), "statistics")
+		rx, err := readCounter(filepath.Join(dir, "tx_bytes"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tx, err := readCounter(filepath.Join(dir, "rx_bytes"))
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, TrafficCounters{ID: e.Name(), RxBytes: rx, TxBytes: tx})
+	}
+	return stats, nil
+}
+
+func readCounter(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// OpenConsole does not take the guest's lock: a console stays open for as
+// long as the user likes and must not hold up other operations.
+func (q *QEMUHypervisor) OpenConsole(ctx context.Context, id string) (io.ReadWriteCloser, error) {
+	if _, err := q.loadMeta(id); err != nil {
+		return nil, err
+	}
+	if !q.isRunning(ctx, id) {
+		return nil, ErrVMNotRunning
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", q.vncPath(id))
+}
+
+// findSnapshot returns ErrSnapshotNotFound unless the guest's disk holds an
+// internal snapshot called name. --force-share lets it read the disk of a
+// running guest.
+func (q *QEMUHypervisor) findSnapshot(ctx context.Context, id, name string) error {
+	out, err := q.run(ctx, q.opts.ImgBinary, "info", "--force-share", "--output=json", q.diskPath(id))
+	if err != nil {
+		return err
+	}
+	var info struct {
+		Snapshots []struct {
+			Name string `json:"name"`
+		} `json:"snapshots"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return fmt.Errorf("parse image info: %w", err)
+	}
+	for _, s := range info.Snapshots {
+		if s.Name == name {
+			return nil
+		}
+	}
+	return ErrSnapshotNotFound
+}
+
+func (q *QEMUHypervisor) commandLine(meta *qemuMeta) []string {
+	dir := q.vmDir(meta.ID)
+	cpuModel := "host"
+	if q.opts.Accel != "kvm" {
+		cpuModel = "max"
+	}
+	netdev := "user,id=net0"
+	if q.opts.Bridge != "" {
+		// StartVM attaches the tap to the bridge itself so that it knows
+		// the device to shape.
+		netdev = "tap,id=net0,ifname=" + tapName(meta.ID) + ",script=no,downscript=no"
+	}
+	args := []string{
+		"-name", "guest=" + qemuOptValue(meta.Name) + ",debug-threads=on",
+		"-machine", q.opts.Machine + ",accel=" + q.opts.Accel,
+		"-cpu", cpuModel,
+		"-smp", strconv.Itoa(meta.CPU),
+		"-m", strconv.Itoa(meta.MemoryMB),
+		"-drive", "file=" + qemuOptValue(filepath.Join(dir, qemuDiskFile)) + ",if=none,id=" + qemuDiskID + ",format=qcow2,cache=none,discard=unmap",
+		"-device", "virtio-blk-pci,drive=" + qemuDiskID + ",bootindex=1",
+		"-netdev", netdev,
+		"-device", "virtio-net-pci,netdev=net0",
+		"-qmp", "unix:" + q.socketPath(meta.ID) + ",server=on,wait=off",
+		"-pidfile", filepath.Join(dir, qemuPIDFile),
+		"-display", "none",
+		"-vnc", "unix:" + q.vncPath(meta.ID),
+		"-daemonize",
+	}
+	if meta.Seed {
+		args = append(args, "-drive", "file="+qemuOptValue(filepath.Join(dir, qemuSeedFile))+",if=ide,media=cdrom,readonly=on,format=raw")
+	}
+	return args
+}
+
+// qemuOptValue quotes s for use as the value of a QEMU sub-option, where
+// a comma starts the next option unless it is doubled. The VM name comes
+// from users.
+func qemuOptValue(s string) string {
+	return strings.ReplaceAll(s, ",", ",,")
+}
+
+// shape limits the guest's traffic with tc on its tap device. Traffic the
+// host sends into the tap is what the guest receives, so inbound is shaped
+// by a tbf root qdisc and outbound policed on the tap's ingress.
+func (q *QEMUHypervisor) shape(ctx context.Context, tap string, bw Bandwidth) error {
+	if bw.InboundMbps > 0 {
+		rate := strconv.Itoa(bw.InboundMbps) + "mbit"
+		if _, err := q.run(ctx, "tc", "qdisc", "replace", "dev", tap, "root", "tbf", "rate", rate, "burst", tcBurst(bw.InboundMbps), "latency", "50ms"); err != nil {
+			return err
+		}
+	} else {
+		// Fails when there is no limit to remove.
+		_, _ = q.run(ctx, "tc", "qdisc", "del", "dev", tap, "root")
+	}
+	_, _ = q.run(ctx, "tc", "qdisc", "del", "dev", tap, "ingress")
+	if bw.OutboundMbps == 0 {
+		return nil
+	}
+	if _, err := q.run(ctx, "tc", "qdisc", "add", "dev", tap, "handle", "ffff:", "ingress"); err != nil {
+		return err
+	}
+	rate := strconv.Itoa(bw.OutboundMbps) + "mbit"
+	_, err := q.run(ctx, "tc", "filter", "add", "dev", tap, "parent", "ffff:", "protocol", "all",
+		"u32", "match", "u32", "0", "0", "police", "rate", rate, "burst", tcBurst(bw.OutboundMbps), "drop", "flowid", ":1")
+	return err
+}
+
+// tcBurst is the bucket size for a rate of mbps: 10ms worth of traffic,
+// but at least 32KiB so full-size packets always fit.
+func tcBurst(mbps int) string {
+	burst := mbps * 1000 * 1000 / 8 / 100
+	if burst < 32<<10 {
+		burst = 32 << 10
+	}
+	return strconv.Itoa(burst)
+}
+
+// tapName is the guest's tap device, named after its ID within the 15
+// characters Linux allows.
+func tapName(id string) string {
+	name := "tap" + strings.TrimPrefix(id, "vm-")
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+func (q *QEMUHypervisor) shutdown(ctx context.Context, id string) error {
+	if !q.isRunning(ctx, id) {
+		return nil
+	}
+	if err := q.execute(ctx, id, "system_powerdown", nil); err != nil {
+		return err
+	}
+	if q.waitStopped(ctx, id, q.opts.ShutdownTimeout) {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return q.quit(ctx, id)
+}
+
+func (q *QEMUHypervisor) quit(ctx context.Context, id string) error {
+	if !q.isRunning(ctx, id) {
+		return nil
+	}
+	if err := q.execute(ctx, id, "quit", nil); err != nil {
+		return err
+	}
+	if !q.waitStopped(ctx, id, q.opts.QMPTimeout) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("vm %s did not stop", id)
+	}
+	return nil
 }
 
-func (q *QEMUHypervisor) CreateVM(cfg VMConfig) (*VMInfo, error) {
-	// TODO: 调用 QEMU CLI 或 libvirt API
+func (q *QEMUHypervisor) execute(ctx context.Context, id, command string, args interface{}) error {
+	client, err := DialQMP(ctx, q.socketPath(id), q.opts.QMPTimeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	_, err = client.Execute(ctx, command, args)
+	return err
+}
+
+// monitor runs an HMP command for which QMP has no equivalent. HMP reports
+// failures as output text rather than as an error.
+func (q *QEMUHypervisor) monitor(ctx context.Context, id, command string) error {
+	client, err := DialQMP(ctx, q.socketPath(id), q.opts.QMPTimeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	raw, err := client.Execute(ctx, "human-monitor-command", map[string]string{"command-line": command})
+	if err != nil {
+		return err
+	}
+	var out string
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return fmt.Errorf("parse monitor output: %w", err)
+	}
+	if out = strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("%s: %s", command, out)
+	}
+	return nil
+}
+
+func (q *QEMUHypervisor) status(ctx context.Context, id string) string {
+	if q.isRunning(ctx, id) {
+		return "running"
+	}
+	return "stopped"
+}
+
+// isRunning reports whether the guest's QMP socket accepts connections.
+func (q *QEMUHypervisor) isRunning(ctx context.Context, id string) bool {
+	client, err := DialQMP(ctx, q.socketPath(id), q.opts.QMPTimeout)
+	if err != nil {
+		return false
+	}
+	_ = client.Close()
+	return true
+}
+
+func (q *QEMUHypervisor) waitStopped(ctx context.Context, id string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if !q.isRunning(ctx, id) {
+			return ctx.Err() == nil
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// lock serialises operations on a single guest.
+func (q *QEMUHypervisor) lock(id string) func() {
+	q.mu.Lock()
+	l, ok := q.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		q.locks[id] = l
+	}
+	q.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (q *QEMUHypervisor) vmDir(id string) string {
+	return filepath.Join(q.opts.DataDir, id)
+}
+
+func (q *QEMUHypervisor) diskPath(id string) string {
+	return filepath.Join(q.vmDir(id), qemuDiskFile)
+}
+
+func (q *QEMUHypervisor) socketPath(id string) string {
+	return filepath.Join(q.vmDir(id), qemuQMPSocket)
+}
+
+// vncPath is the guest's VNC server. It listens on a socket in the guest's
+// directory rather than a TCP port, so only the host can reach it.
+func (q *QEMUHypervisor) vncPath(id string) string {
+	return filepath.Join(q.vmDir(id), qemuVNCSocket)
+}
+
+func (q *QEMUHypervisor) loadMeta(id string) (*qemuMeta, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, ErrVMNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(q.vmDir(id), qemuMetaFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrVMNotFound
+		}
+		return nil, err
+	}
+	var meta qemuMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (q *QEMUHypervisor) saveMeta(meta *qemuMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(q.vmDir(meta.ID), qemuMetaFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (m *qemuMeta) info(status string) *VMInfo {
 	return &VMInfo{
-		ID:       "vm-123",
-		Name:     cfg.Name,
-		Status:   "stopped",
-		CPU:      cfg.CPU,
-		MemoryMB: cfg.MemoryMB,
-		DiskGB:   cfg.DiskGB,
-	}, nil
-}
-
-func (q *QEMUHypervisor) StartVM(id string) error                { return nil }
-func (q *QEMUHypervisor) StopVM(id string) error                 { return nil }
-func (q *QEMUHypervisor) DeleteVM(id string) error               { return nil }
-func (q *QEMUHypervisor) ResizeVM(id string, cfg VMConfig) error { return nil }
+		ID:       m.ID,
+		Name:     m.Name,
+		Status:   status,
+		CPU:      m.CPU,
+		MemoryMB: m.MemoryMB,
+		DiskGB:   m.DiskGB,
+		Image:    m.Image,
+	}
+}
+
+func newVMID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "vm-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,576 @@
+package hypervisor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"StarstreamAstra/internal/cloudinit"
+)
+
+// fakeQMP is a minimal QMP server listening on a unix socket. It records
+// every command it receives and shuts itself down on powerdown/quit.
+type fakeQMP struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	commands []qmpCommand
+	closed   bool
+}
+
+func startFakeQMP(t *testing.T, path string) *fakeQMP {
+	t.Helper()
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakeQMP{ln: ln}
+	go f.serve()
+	t.Cleanup(f.close)
+	return f
+}
+
+func (f *fakeQMP) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeQMP) handle(conn net.Conn) {
+	defer conn.Close()
+	_, _ = conn.Write([]byte(`{"QMP": {"version": {"qemu": {"major": 8}}, "capabilities": []}}` + "\n"))
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var cmd qmpCommand
+		if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			return
+		}
+		if cmd.Execute != "qmp_capabilities" {
+			f.mu.Lock()
+			f.commands = append(f.commands, cmd)
+			f.mu.Unlock()
+		}
+		switch cmd.Execute {
+		case "bogus":
+			_, _ = conn.Write([]byte(`{"error": {"class": "CommandNotFound", "desc": "bogus"}}` + "\n"))
+		case "human-monitor-command":
+			_, _ = conn.Write([]byte(`{"return": ""}` + "\n"))
+		case "system_powerdown", "quit":
+			_, _ = conn.Write([]byte(`{"event": "POWERDOWN", "timestamp": {"seconds": 1}}` + "\n"))
+			_, _ = conn.Write([]byte(`{"return": {}}` + "\n"))
+			f.close()
+			return
+		default:
+			_, _ = conn.Write([]byte(`{"return": {}}` + "\n"))
+		}
+	}
+}
+
+func (f *fakeQMP) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		_ = f.ln.Close()
+	}
+}
+
+func (f *fakeQMP) executed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for _, c := range f.commands {
+		names = append(names, c.Execute)
+	}
+	return names
+}
+
+type recordedCall struct {
+	name string
+	args []string
+}
+
+func newTestQEMU(t *testing.T) (*QEMUHypervisor, *[]recordedCall) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	q := NewQEMUHypervisor(QEMUOptions{
+		DataDir:         dir,
+		QMPTimeout:      time.Second,
+		ShutdownTimeout: time.Second,
+	})
+	var calls []recordedCall
+	q.run = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		calls = append(calls, recordedCall{name: name, args: args})
+		return nil, nil
+	}
+	return q, &calls
+}
+
+func TestQMPExecute(t *testing.T) {
+	q, _ := newTestQEMU(t)
+	sock := filepath.Join(q.opts.DataDir, "test.sock")
+	srv := startFakeQMP(t, sock)
+
+	client, err := DialQMP(context.Background(), sock, time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Execute(context.Background(), "query-status", nil); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	_, err = client.Execute(context.Background(), "bogus", nil)
+	var qmpErr *QMPError
+	if !errors.As(err, &qmpErr) || qmpErr.Class != "CommandNotFound" {
+		t.Fatalf("expected CommandNotFound, got %v", err)
+	}
+	if got := strings.Join(srv.executed(), ","); got != "query-status,bogus" {
+		t.Fatalf("unexpected commands %q", got)
+	}
+}
+
+func TestQMPExecuteCancelled(t *testing.T) {
+	q, _ := newTestQEMU(t)
+	sock := filepath.Join(q.opts.DataDir, "test.sock")
+	startFakeQMP(t, sock)
+
+	client, err := DialQMP(context.Background(), sock, time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Execute(ctx, "query-status", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestQEMUCreateAndStart(t *testing.T) {
+	ctx := context.Background()
+	q, calls := newTestQEMU(t)
+
+	info, err := q.CreateVM(ctx, VMConfig{Name: "web", CPU: 2, MemoryMB: 2048, DiskGB: 20})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if info.Status != "stopped" || info.CPU != 2 || !strings.HasPrefix(info.ID, "vm-") {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	if len(*calls) != 1 || (*calls)[0].name != "qemu-img" {
+		t.Fatalf("expected qemu-img call, got %+v", *calls)
+	}
+	if args := strings.Join((*calls)[0].args, " "); !strings.HasSuffix(args, "disk.qcow2 20G") {
+		t.Fatalf("unexpected qemu-img args %q", args)
+	}
+
+	if err := q.StartVM(ctx, info.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	start := (*calls)[1]
+	args := strings.Join(start.args, " ")
+	if start.name != "qemu-system-x86_64" {
+		t.Fatalf("unexpected binary %q", start.name)
+	}
+	for _, want := range []string{"-smp 2", "-m 2048", "accel=kvm", "-daemonize", "qmp.sock,server=on,wait=off", "-vnc unix:"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("command line %q missing %q", args, want)
+		}
+	}
+
+	if err := q.StartVM(ctx, "vm-missing"); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("expected ErrVMNotFound, got %v", err)
+	}
+}
+
+func TestQEMUCommandLineQuoting(t *testing.T) {
+	q, _ := newTestQEMU(t)
+	args := q.commandLine(&qemuMeta{ID: "vm-1", Name: "web,debug-threads=off,process=x", CPU: 1, MemoryMB: 512})
+	if args[0] != "-name" || args[1] != "guest=web,,debug-threads=off,,process=x,debug-threads=on" {
+		t.Fatalf("name not quoted: %q", args[1])
+	}
+}
+
+func TestQEMUStopAndResize(t *testing.T) {
+	ctx := context.Background()
+	q, calls := newTestQEMU(t)
+	info, err := q.CreateVM(ctx, VMConfig{Name: "db", CPU: 1, MemoryMB: 1024, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	srv := startFakeQMP(t, q.socketPath(info.ID))
+
+	if err := q.ResizeVM(ctx, info.ID, VMConfig{CPU: 2, MemoryMB: 2048, DiskGB: 5}); !errors.Is(err, ErrDiskShrink) {
+		t.Fatalf("expected ErrDiskShrink, got %v", err)
+	}
+	if err := q.ResizeVM(ctx, info.ID, VMConfig{CPU: 2, MemoryMB: 2048, DiskGB: 20}); err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	if got, err := q.GetVM(ctx, info.ID); err != nil || got.Status != "running" || got.DiskGB != 20 {
+		t.Fatalf("unexpected vm %+v (%v)", got, err)
+	}
+	if err := q.RebootVM(ctx, info.ID); err != nil {
+		t.Fatalf("reboot: %v", err)
+	}
+	if err := q.StopVM(ctx, info.ID); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if err := q.RebootVM(ctx, info.ID); !errors.Is(err, ErrVMNotRunning) {
+		t.Fatalf("expected ErrVMNotRunning, got %v", err)
+	}
+	if got := strings.Join(srv.executed(), ","); got != "block_resize,system_reset,system_powerdown" {
+		t.Fatalf("unexpected commands %q", got)
+	}
+	if len(*calls) != 1 {
+		t.Fatalf("online resize must not call qemu-img, got %+v", *calls)
+	}
+
+	meta, err := q.loadMeta(info.ID)
+	if err != nil {
+		t.Fatalf("load meta: %v", err)
+	}
+	if meta.CPU != 2 || meta.MemoryMB != 2048 || meta.DiskGB != 20 {
+		t.Fatalf("unexpected meta %+v", meta)
+	}
+
+	vms, err := q.ListVMs(ctx)
+	if err != nil || len(vms) != 1 || vms[0].Status != "stopped" {
+		t.Fatalf("unexpected list %+v (%v)", vms, err)
+	}
+
+	if err := q.DeleteVM(ctx, info.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := os.Stat(q.vmDir(info.ID)); !os.IsNotExist(err) {
+		t.Fatalf("vm dir still present: %v", err)
+	}
+}
+
+func TestQEMUCreateWithCloudInit(t *testing.T) {
+	ctx := context.Background()
+	q, calls := newTestQEMU(t)
+	seeded := map[string]string{}
+	q.run = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		*calls = append(*calls, recordedCall{name: name, args: args})
+		if name == "genisoimage" {
+			for _, arg := range args[6:] {
+				data, err := os.ReadFile(arg)
+				if err != nil {
+					return nil, err
+				}
+				seeded[filepath.Base(arg)] = string(data)
+			}
+		}
+		return nil, nil
+	}
+
+	ci := &cloudinit.Config{Hostname: "web", SSHKeys: []string{"ssh-ed25519 AAAA test"}}
+	info, err := q.CreateVM(ctx, VMConfig{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 20, CloudInit: ci})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if len(*calls) != 2 || (*calls)[1].name != "genisoimage" {
+		t.Fatalf("expected genisoimage call, got %+v", *calls)
+	}
+	seed := filepath.Join(q.vmDir(info.ID), qemuSeedFile)
+	args := strings.Join((*calls)[1].args, " ")
+	if !strings.HasPrefix(args, "-output "+seed+" -volid cidata") {
+		t.Fatalf("unexpected genisoimage args %q", args)
+	}
+	if !strings.Contains(seeded["meta-data"], "instance-id: "+info.ID) {
+		t.Fatalf("meta-data should default the instance id to the VM, got %q", seeded["meta-data"])
+	}
+	if !strings.Contains(seeded["user-data"], "ssh-ed25519 AAAA test") || seeded["network-config"] == "" {
+		t.Fatalf("unexpected seed %v", seeded)
+	}
+
+	if err := q.StartVM(ctx, info.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if cmd := strings.Join((*calls)[2].args, " "); !strings.Contains(cmd, "file="+seed+",if=ide,media=cdrom,readonly=on") {
+		t.Fatalf("command line %q does not attach the seed", cmd)
+	}
+}
+
+func TestQEMUReinstall(t *testing.T) {
+	ctx := context.Background()
+	q, calls := newTestQEMU(t)
+	// Materialise the files the tools would write so they can be renamed.
+	q.run = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		*calls = append(*calls, recordedCall{name: name, args: args})
+		out := ""
+		switch name {
+		case "qemu-img":
+			out = args[len(args)-2]
+		case "genisoimage":
+			out = args[1]
+		}
+		if out != "" {
+			return nil, os.WriteFile(out, []byte(name), 0o600)
+		}
+		return nil, nil
+	}
+
+	info, err := q.CreateVM(ctx, VMConfig{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 20, CloudInit: &cloudinit.Config{Hostname: "web"}})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	dir := q.vmDir(info.ID)
+	if err := q.ReinstallVM(ctx, info.ID, VMConfig{DiskGB: 30}); err != nil {
+		t.Fatalf("reinstall: %v", err)
+	}
+	last := (*calls)[len(*calls)-1]
+	if last.name != "qemu-img" || !strings.HasSuffix(strings.Join(last.args, " "), "disk.qcow2.new 30G") {
+		t.Fatalf("unexpected call %+v", last)
+	}
+	if _, err := os.Stat(filepath.Join(dir, qemuDiskFile)); err != nil {
+		t.Fatalf("new disk not in place: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, qemuSeedFile)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("stale seed left behind: %v", err)
+	}
+	got, err := q.GetVM(ctx, info.ID)
+	if err != nil || got.DiskGB != 30 || got.CPU != 1 {
+		t.Fatalf("unexpected info %+v, %v", got, err)
+	}
+
+	startFakeQMP(t, q.socketPath(info.ID))
+	if err := q.ReinstallVM(ctx, info.ID, VMConfig{DiskGB: 30}); !errors.Is(err, ErrVMRunning) {
+		t.Fatalf("expected ErrVMRunning, got %v", err)
+	}
+}
+
+func TestQEMUSnapshots(t *testing.T) {
+	ctx := context.Background()
+	q, calls := newTestQEMU(t)
+	q.run = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		*calls = append(*calls, recordedCall{name: name, args: args})
+		if len(args) > 0 && args[0] == "info" {
+			return []byte(`{"format": "qcow2", "snapshots": [{"id": "1", "name": "snap-1"}]}`), nil
+		}
+		return nil, nil
+	}
+	info, err := q.CreateVM(ctx, VMConfig{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 20})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	disk := q.diskPath(info.ID)
+
+	*calls = nil
+	if err := q.CreateSnapshot(ctx, info.ID, "snap-1"); err != nil {
+		t.Fatalf("create snapshot: %v", err)
+	}
+	if err := q.RevertSnapshot(ctx, info.ID, "snap-1"); err != nil {
+		t.Fatalf("revert: %v", err)
+	}
+	if err := q.DeleteSnapshot(ctx, info.ID, "missing"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected ErrSnapshotNotFound, got %v", err)
+	}
+	var got []string
+	for _, c := range *calls {
+		if c.args[0] == "snapshot" {
+			got = append(got, strings.Join(c.args, " "))
+		}
+	}
+	want := []string{"snapshot -c snap-1 " + disk, "snapshot -a snap-1 " + disk}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("unexpected qemu-img calls %q", got)
+	}
+
+	// A running guest is snapshotted through the monitor and cannot revert.
+	srv := startFakeQMP(t, q.socketPath(info.ID))
+	if err := q.CreateSnapshot(ctx, info.ID, "snap-2"); err != nil {
+		t.Fatalf("live snapshot: %v", err)
+	}
+	if err := q.DeleteSnapshot(ctx, info.ID, "snap-1"); err != nil {
+		t.Fatalf("live delete: %v", err)
+	}
+	if err := q.RevertSnapshot(ctx, info.ID, "snap-1"); !errors.Is(err, ErrVMRunning) {
+		t.Fatalf("expected ErrVMRunning, got %v", err)
+	}
+	var lines []string
+	srv.mu.Lock()
+	for _, c := range srv.commands {
+		if c.Execute == "human-monitor-command" {
+			raw, _ := json.Marshal(c.Arguments)
+			lines = append(lines, string(raw))
+		}
+	}
+	srv.mu.Unlock()
+	if len(lines) != 2 || !strings.Contains(lines[0], "savevm snap-2") || !strings.Contains(lines[1], "delvm snap-1") {
+		t.Fatalf("unexpected monitor commands %q", lines)
+	}
+}
+
+func TestQEMUExportImportDisk(t *testing.T) {
+	ctx := context.Background()
+	q, calls := newTestQEMU(t)
+	var imported []byte
+	q.run = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		*calls = append(*calls, recordedCall{name: name, args: args})
+		if args[0] == "convert" {
+			if args[1] == "-f" {
+				imported, _ = os.ReadFile(args[len(args)-2])
+			}
+			return nil, os.WriteFile(args[len(args)-1], []byte("image of "+args[len(args)-2]), 0o600)
+		}
+		return nil, nil
+	}
+	info, err := q.CreateVM(ctx, VMConfig{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 20})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	disk := q.diskPath(info.ID)
+
+	var out strings.Builder
+	if err := q.ExportDisk(ctx, info.ID, "", &out); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if out.String() != "image of "+disk {
+		t.Fatalf("exported %q", out.String())
+	}
+	last := (*calls)[len(*calls)-1]
+	if got := strings.Join(last.args[:4], " "); got != "convert --force-share -O raw" {
+		t.Fatalf("unexpected export call %+v", last)
+	}
+
+	*calls = nil
+	if err := q.ImportDisk(ctx, info.ID, strings.NewReader("raw bytes")); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if string(imported) != "raw bytes" {
+		t.Fatalf("qemu-img read %q", imported)
+	}
+	if len(*calls) != 2 || strings.Join((*calls)[1].args, " ") != "resize "+disk+".new 20G" {
+		t.Fatalf("unexpected calls %+v", *calls)
+	}
+	if data, _ := os.ReadFile(disk); !strings.HasPrefix(string(data), "image of ") {
+		t.Fatalf("disk not replaced: %q", data)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(q.vmDir(info.ID), "*.raw")); len(leftovers) != 0 {
+		t.Fatalf("staging files left behind: %v", leftovers)
+	}
+
+	// A running guest can only be exported from a snapshot.
+	startFakeQMP(t, q.socketPath(info.ID))
+	if err := q.ExportDisk(ctx, info.ID, "", &out); !errors.Is(err, ErrVMRunning) {
+		t.Fatalf("expected ErrVMRunning, got %v", err)
+	}
+	if err := q.ExportDisk(ctx, info.ID, "backup-1", &out); err != nil {
+		t.Fatalf("export from snapshot: %v", err)
+	}
+	if last := (*calls)[len(*calls)-1]; !strings.Contains(strings.Join(last.args, " "), "-l snapshot.name=backup-1") {
+		t.Fatalf("snapshot not selected: %+v", last)
+	}
+	if err := q.ImportDisk(ctx, info.ID, strings.NewReader("x")); !errors.Is(err, ErrVMRunning) {
+		t.Fatalf("expected ErrVMRunning, got %v", err)
+	}
+}
+
+func TestQEMUBandwidth(t *testing.T) {
+	ctx := context.Background()
+	q, calls := newTestQEMU(t)
+	limit := Bandwidth{InboundMbps: 100, OutboundMbps: 50}
+	if _, err := q.CreateVM(ctx, VMConfig{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 10, Bandwidth: limit}); !errors.Is(err, ErrBandwidthUnsupported) {
+		t.Fatalf("user-mode networking: expected ErrBandwidthUnsupported, got %v", err)
+	}
+
+	q.opts.Bridge = "br0"
+	info, err := q.CreateVM(ctx, VMConfig{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 10, Bandwidth: limit})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	tap := tapName(info.ID)
+	if len(tap) != 15 || !strings.HasPrefix(tap, "tap") {
+		t.Fatalf("unexpected tap name %q", tap)
+	}
+	*calls = nil
+	if err := q.StartVM(ctx, info.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	var got []string
+	for _, c := range *calls {
+		got = append(got, c.name+" "+strings.Join(c.args, " "))
+	}
+	if !strings.Contains(got[0], "-netdev tap,id=net0,ifname="+tap+",script=no,downscript=no") {
+		t.Fatalf("unexpected command line %q", got[0])
+	}
+	want := []string{
+		"ip link set dev " + tap + " master br0 up",
+		"tc qdisc replace dev " + tap + " root tbf rate 100mbit burst 125000 latency 50ms",
+		"tc qdisc del dev " + tap + " ingress",
+		"tc qdisc add dev " + tap + " handle ffff: ingress",
+		"tc filter add dev " + tap + " parent ffff: protocol all u32 match u32 0 0 police rate 50mbit burst 62500 drop flowid :1",
+	}
+	if strings.Join(got[1:], "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected calls\n%s", strings.Join(got[1:], "\n"))
+	}
+
+	// Running: the tap is reshaped in place. Lifting the outbound cap only
+	// drops the ingress policer.
+	startFakeQMP(t, q.socketPath(info.ID))
+	*calls = nil
+	if err := q.SetBandwidth(ctx, info.ID, Bandwidth{InboundMbps: 1000}); err != nil {
+		t.Fatalf("set bandwidth: %v", err)
+	}
+	if len(*calls) != 2 || strings.Join((*calls)[0].args, " ") != "qdisc replace dev "+tap+" root tbf rate 1000mbit burst 1250000 latency 50ms" {
+		t.Fatalf("unexpected calls %+v", *calls)
+	}
+	meta, err := q.loadMeta(info.ID)
+	if err != nil || meta.Bandwidth != (Bandwidth{InboundMbps: 1000}) {
+		t.Fatalf("limits not stored: %+v (%v)", meta, err)
+	}
+}
+
+func TestQEMUTrafficStats(t *testing.T) {
+	ctx := context.Background()
+	q, _ := newTestQEMU(t)
+	if _, err := q.TrafficStats(ctx); !errors.Is(err, ErrTrafficUnsupported) {
+		t.Fatalf("user-mode networking: expected ErrTrafficUnsupported, got %v", err)
+	}
+
+	q.opts.Bridge = "br0"
+	q.netDir = t.TempDir()
+	running, err := q.CreateVM(ctx, VMConfig{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := q.CreateVM(ctx, VMConfig{Name: "db", CPU: 1, MemoryMB: 1024, DiskGB: 10}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// Only the running guest has a tap device. The tap transmits what the
+	// guest receives.
+	dir := filepath.Join(q.netDir, tapName(running.ID), "statistics")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"tx_bytes": "5000\n", "rx_bytes": "700\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := q.TrafficStats(ctx)
+	if err != nil {
+		t.Fatalf("traffic stats: %v", err)
+	}
+	if len(stats) != 1 || stats[0] != (TrafficCounters{ID: running.ID, RxBytes: 5000, TxBytes: 700}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,135 @@
+package hypervisor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// QMPClient speaks the QEMU Machine Protocol over a unix socket.
+type QMPClient struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	mu      sync.Mutex
+}
+
+type QMPError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *QMPError) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Desc)
+}
+
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type qmpResponse struct {
+	QMP    json.RawMessage `json:"QMP"`
+	Return json.RawMessage `json:"return"`
+	Error  *QMPError       `json:"error"`
+	Event  string          `json:"event"`
+}
+
+// DialQMP connects to a QMP socket, consumes the greeting and negotiates
+// capabilities. timeout bounds every exchange in addition to ctx.
+func DialQMP(ctx context.Context, path string, timeout time.Duration) (*QMPClient, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	c := &QMPClient{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+
+	stop := c.watch(ctx)
+	greeting, err := c.readMessage()
+	stop()
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("qmp greeting: %w", err)
+	}
+	if greeting.QMP == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("qmp greeting: unexpected message")
+	}
+	if _, err := c.Execute(ctx, "qmp_capabilities", nil); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("qmp capabilities: %w", err)
+	}
+	return c, nil
+}
+
+// Execute runs a command and returns its raw "return" payload. Asynchronous
+// events received while waiting for the reply are discarded.
+func (c *QMPClient) Execute(ctx context.Context, command string, args interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := c.watch(ctx)
+	defer stop()
+	payload, err := json.Marshal(qmpCommand{Execute: command, Arguments: args})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(append(payload, '\n')); err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, err
+		}
+		if msg.Event != "" {
+			continue
+		}
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return msg.Return, nil
+	}
+}
+
+func (c *QMPClient) Close() error {
+	return c.conn.Close()
+}
+
+// watch arms the connection deadline and aborts pending I/O as soon as ctx
+// is cancelled. The returned func must be called once the exchange is over.
+func (c *QMPClient) watch(ctx context.Context) func() {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.conn.SetDeadline(time.Now())
+	})
+	return func() { stop() }
+}
+
+func (c *QMPClient) readMessage() (*qmpResponse, error) {
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var msg qmpResponse
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return nil, fmt.Errorf("qmp decode: %w", err)
+	}
+	return &msg, nil
+}
@@ -0,0 +1,39 @@
+package hypervisor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"StarstreamAstra/internal/cloudinit"
+)
+
+// buildSeedISO writes a NoCloud seed for ci to isoPath. The instance ID
+// defaults to the hypervisor ID so cloud-init treats every new guest as a
+// first boot, even on a disk cloned from a base image.
+func buildSeedISO(ctx context.Context, run commandRunner, binary, isoPath, id string, ci cloudinit.Config) error {
+	if ci.InstanceID == "" {
+		ci.InstanceID = id
+	}
+	files, err := cloudinit.Files(ci)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(isoPath), ".seed-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{cloudinit.UserDataFile, cloudinit.MetaDataFile, cloudinit.NetworkConfigFile}
+	args := []string{"-output", isoPath, "-volid", cloudinit.VolumeLabel, "-joliet", "-rock"}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, files[name], 0o600); err != nil {
+			return err
+		}
+		args = append(args, path)
+	}
+	_, err = run(ctx, binary, args...)
+	return err
+}
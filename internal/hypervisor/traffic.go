@@ -0,0 +1,23 @@
+package hypervisor
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrTrafficUnsupported = errors.New("hypervisor does not count guest traffic")
+
+// TrafficCounters are the bytes a guest's network interface moved since
+// the guest started. Rx is what the guest received, Tx what it sent.
+type TrafficCounters struct {
+	ID      string `json:"id"`
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// TrafficSupport is implemented by drivers that can read the traffic
+// counters of their guests.
+type TrafficSupport interface {
+	// TrafficStats returns the counters of every running guest.
+	TrafficStats(ctx context.Context) ([]TrafficCounters, error)
+}
@@ -0,0 +1,50 @@
+package model
+
+import "time"
+
+const (
+	BackupKindFull        = "full"
+	BackupKindIncremental = "incremental"
+
+	BackupStatusCreating = "creating"
+	BackupStatusReady    = "ready"
+	BackupStatusFailed   = "failed"
+)
+
+// Backup is a copy of a VM's disk on the backup target. An incremental
+// backup only stored the chunks that changed since ParentID. Backups
+// outlive their VM so they can be restored into a new one.
+type Backup struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	VMID        uint       `gorm:"index;not null" json:"vm_id"`
+	UserID      uint       `gorm:"index;not null" json:"user_id"`
+	ParentID    *uint      `json:"parent_id"`
+	Kind        string     `gorm:"size:16;not null" json:"kind"`
+	Status      string     `gorm:"size:16;not null" json:"status"`
+	Scheduled   bool       `gorm:"not null;default:false" json:"scheduled"`
+	DiskGB      int        `gorm:"not null" json:"disk_gb"`
+	SizeBytes   int64      `gorm:"not null;default:0" json:"size_bytes"`
+	StoredBytes int64      `gorm:"not null;default:0" json:"stored_bytes"`
+	Error       string     `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt   time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+// BackupSchedule backs a VM up every day at Hour (UTC). After each run
+// the VM's scheduled backups are pruned to the newest of each of the last
+// KeepDaily days and KeepWeekly weeks. Every FullEvery-th scheduled backup
+// is a full one.
+type BackupSchedule struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	VMID       uint       `gorm:"uniqueIndex;not null" json:"vm_id"`
+	UserID     uint       `gorm:"not null" json:"user_id"`
+	Hour       int        `gorm:"not null" json:"hour"`
+	KeepDaily  int        `gorm:"not null" json:"keep_daily"`
+	KeepWeekly int        `gorm:"not null" json:"keep_weekly"`
+	FullEvery  int        `gorm:"not null" json:"full_every"`
+	Enabled    bool       `gorm:"not null" json:"enabled"`
+	NextRunAt  time.Time  `gorm:"index;not null" json:"next_run_at"`
+	LastRunAt  *time.Time `json:"last_run_at"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt  time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
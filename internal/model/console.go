@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// ConsoleToken lets the holder open one console session to a VM. Only the
+// SHA-256 of the token is stored; it is spent on first use.
+type ConsoleToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	TokenHash string     `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	VMID      uint       `gorm:"index;not null" json:"vm_id"`
+	UserID    uint       `gorm:"not null" json:"user_id"`
+	ExpiresAt time.Time  `gorm:"index;not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+const (
+	ImageStatusActive   = "active"
+	ImageStatusDisabled = "disabled"
+)
+
+// Image is a base operating system image that new VMs are cloned from.
+// Nodes fetch it from SourceURL on first use and keep it under its SHA256.
+// Disabled images stay attached to existing VMs but cannot be chosen for
+// new ones.
+type Image struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Name        string    `gorm:"size:64;uniqueIndex;not null" json:"name"`
+	OSType      string    `gorm:"size:32;not null;default:linux" json:"os_type"`
+	Version     string    `gorm:"size:64" json:"version"`
+	Arch        string    `gorm:"size:16;not null;default:x86_64" json:"arch"`
+	SourceURL   string    `gorm:"size:512;not null" json:"source_url"`
+	SHA256      string    `gorm:"size:64;not null" json:"sha256"`
+	MinDiskGB   int       `gorm:"not null;default:0" json:"min_disk_gb"`
+	MinMemoryMB int       `gorm:"not null;default:0" json:"min_memory_mb"`
+	Status      string    `gorm:"size:16;not null;default:active" json:"status"`
+	Description string    `gorm:"size:255" json:"description"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
@@ -0,0 +1,47 @@
+package model
+
+import "time"
+
+// IP address states. A released address stays quarantined for a while so
+// that traffic meant for the old VM does not reach a new one.
+const (
+	IPStatusAllocated   = "allocated"
+	IPStatusQuarantined = "quarantined"
+)
+
+// IPPool is a range VM addresses are allocated from. A pool belongs to a
+// node, to all nodes of a region, or, with neither set, to every VM. IPv4
+// pools hand out single addresses; IPv6 pools hand out a prefix of
+// AssignPrefixLen bits, such as a /64, of which the VM uses the first
+// address. NAT pools hold the private addresses of NAT VMs and serve no
+// other VMs. Exclude and Nameservers are comma separated; exclusions are
+// addresses, "first-last" ranges or CIDRs.
+type IPPool struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	Name            string    `gorm:"size:64;not null;uniqueIndex" json:"name"`
+	Family          int       `gorm:"not null" json:"family"`
+	CIDR            string    `gorm:"size:64;not null" json:"cidr"`
+	Gateway         string    `gorm:"size:64" json:"gateway"`
+	AssignPrefixLen int       `gorm:"not null" json:"assign_prefix_len"`
+	NodeID          *uint     `gorm:"index" json:"node_id"`
+	Region          string    `gorm:"size:64;index;not null;default:''" json:"region"`
+	NAT             bool      `gorm:"not null;default:false" json:"nat"`
+	Exclude         string    `gorm:"type:text" json:"exclude"`
+	Nameservers     string    `gorm:"size:255" json:"nameservers"`
+	CreatedAt       time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt       time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// IPAddress is an address taken from a pool, either by a VM or, after the
+// VM is gone, by quarantine. Free addresses have no row; the unique index
+// is what keeps two VMs from taking the same one.
+type IPAddress struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	PoolID     uint       `gorm:"not null;uniqueIndex:idx_ip_addresses_pool_address" json:"pool_id"`
+	Address    string     `gorm:"size:64;not null;uniqueIndex:idx_ip_addresses_pool_address" json:"address"`
+	PrefixLen  int        `gorm:"not null" json:"prefix_len"`
+	VMID       *uint      `gorm:"index" json:"vm_id"`
+	Status     string     `gorm:"size:32;not null" json:"status"`
+	ReleasedAt *time.Time `json:"released_at"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
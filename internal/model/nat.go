@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+// VM network modes. Public VMs get routable addresses; NAT VMs get a
+// private address and a block of ports on their node's public address.
+const (
+	NetworkModePublic = "public"
+	NetworkModeNAT    = "nat"
+)
+
+// NATPortRange is the block of public ports of a node that a NAT VM may
+// forward. NodeID is 0 for VMs on the default hypervisor.
+type NATPortRange struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	NodeID    uint      `gorm:"not null;uniqueIndex:idx_nat_port_ranges_node_start" json:"node_id"`
+	PortStart int       `gorm:"not null;uniqueIndex:idx_nat_port_ranges_node_start" json:"port_start"`
+	PortEnd   int       `gorm:"not null" json:"port_end"`
+	VMID      uint      `gorm:"not null;uniqueIndex" json:"vm_id"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// PortForward sends a public port from the VM's range to a port of the VM.
+type PortForward struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	VMID        uint      `gorm:"not null;uniqueIndex:idx_port_forwards_vm_port" json:"vm_id"`
+	Protocol    string    `gorm:"size:8;not null;uniqueIndex:idx_port_forwards_vm_port" json:"protocol"`
+	PublicPort  int       `gorm:"not null;uniqueIndex:idx_port_forwards_vm_port" json:"public_port"`
+	PrivatePort int       `gorm:"not null" json:"private_port"`
+	Description string    `gorm:"size:255;not null;default:''" json:"description"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
@@ -2,18 +2,49 @@ package model
 
 import "time"
 
+const (
+	NodeStatusOnline  = "online"
+	NodeStatusOffline = "offline"
+)
+
 type Node struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Name      string    `gorm:"size:128;not null;uniqueIndex" json:"name"`
-	Hostname  string    `gorm:"size:256;not null" json:"hostname"`
-	IP        string    `gorm:"size:64" json:"ip"`
-	CPUTotal  int       `gorm:"not null" json:"cpu_total"`
-	CPUUsed   int       `gorm:"not null" json:"cpu_used"`
-	MemTotal  int       `gorm:"not null" json:"mem_total"`
-	MenUsed   int       `gorm:"not null" json:"mem_used"`
-	DiskTotal int       `gorm:"not null" json:"disk_total"`
-	DiskUsed  int       `gorm:"not null" json:"disk_used"`
-	Status    string    `gorm:"size:32;not null" json:"status"`
-	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
-	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	Name            string     `gorm:"size:128;not null;uniqueIndex" json:"name"`
+	Hostname        string     `gorm:"size:256;not null" json:"hostname"`
+	IP              string     `gorm:"size:64" json:"ip"`
+	AgentURL        string     `gorm:"size:256" json:"agent_url"`
+	Region          string     `gorm:"size:64;index;not null;default:''" json:"region"`
+	CPUTotal        int        `gorm:"not null" json:"cpu_total"`
+	CPUUsed         int        `gorm:"not null" json:"cpu_used"`
+	MemTotal        int        `gorm:"not null" json:"mem_total"`
+	MenUsed         int        `gorm:"not null" json:"mem_used"`
+	DiskTotal       int        `gorm:"not null" json:"disk_total"`
+	DiskUsed        int        `gorm:"not null" json:"disk_used"`
+	CPUOvercommit   float64    `gorm:"not null;default:1" json:"cpu_overcommit"`
+	MemOvercommit   float64    `gorm:"not null;default:1" json:"mem_overcommit"`
+	Status          string     `gorm:"size:32;not null" json:"status"`
+	CPUUsagePercent float64    `gorm:"not null;default:0" json:"cpu_usage_percent"`
+	MemUsageMB      int        `gorm:"not null;default:0" json:"mem_usage_mb"`
+	DiskUsageGB     int        `gorm:"not null;default:0" json:"disk_usage_gb"`
+	LastHeartbeatAt *time.Time `json:"last_heartbeat_at"`
+	CreatedAt       time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt       time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// CPUCapacity is the number of vCPUs that may be allocated on the node once
+// the overcommit ratio is applied.
+func (n *Node) CPUCapacity() int {
+	return int(float64(n.CPUTotal) * overcommit(n.CPUOvercommit))
+}
+
+// MemCapacity is the allocatable memory in MB after overcommit.
+func (n *Node) MemCapacity() int {
+	return int(float64(n.MemTotal) * overcommit(n.MemOvercommit))
+}
+
+func overcommit(ratio float64) float64 {
+	if ratio <= 0 {
+		return 1
+	}
+	return ratio
 }
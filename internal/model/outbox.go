@@ -0,0 +1,29 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	OutboxStatusHeld    = "held"
+	OutboxStatusPending = "pending"
+	OutboxStatusFailed  = "failed"
+)
+
+// OutboxEvent is a side effect the master still owes: the compensation for
+// a saga step or a step that has to be retried. Held events belong to a
+// saga that is still running and are discarded when it commits; pending
+// events are dispatched until they succeed, and deleted once they have.
+type OutboxEvent struct {
+	ID          uint            `gorm:"primaryKey" json:"id"`
+	SagaID      string          `gorm:"size:32;not null;index" json:"saga_id"`
+	Kind        string          `gorm:"size:64;not null" json:"kind"`
+	Status      string          `gorm:"size:16;not null;index" json:"status"`
+	Payload     json.RawMessage `gorm:"type:text;not null" json:"payload"`
+	Attempts    int             `gorm:"not null;default:0" json:"attempts"`
+	Error       string          `gorm:"type:text" json:"error,omitempty"`
+	AvailableAt time.Time       `gorm:"index" json:"available_at"`
+	CreatedAt   time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
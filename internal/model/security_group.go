@@ -0,0 +1,34 @@
+package model
+
+import "time"
+
+// SecurityGroup is a named set of rules a user attaches to VMs. The node
+// filters a VM's traffic by the rules of all its groups together.
+type SecurityGroup struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      uint      `gorm:"not null;uniqueIndex:idx_security_groups_user_name" json:"user_id"`
+	Name        string    `gorm:"size:64;not null;uniqueIndex:idx_security_groups_user_name" json:"name"`
+	Description string    `gorm:"size:255" json:"description"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// SecurityGroupRule allows traffic in one direction between a VM and CIDR.
+// Ports only apply to TCP and UDP; zero ports mean all of them.
+type SecurityGroupRule struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	GroupID     uint   `gorm:"not null;index" json:"group_id"`
+	Direction   string `gorm:"size:16;not null" json:"direction"`
+	Protocol    string `gorm:"size:8;not null" json:"protocol"`
+	PortFrom    int    `gorm:"not null;default:0" json:"port_from"`
+	PortTo      int    `gorm:"not null;default:0" json:"port_to"`
+	CIDR        string `gorm:"size:64;not null" json:"cidr"`
+	Description string `gorm:"size:255" json:"description"`
+}
+
+// VMSecurityGroup attaches a group to a VM.
+type VMSecurityGroup struct {
+	VMID      uint      `gorm:"primaryKey;autoIncrement:false" json:"vm_id"`
+	GroupID   uint      `gorm:"primaryKey;autoIncrement:false;index" json:"group_id"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
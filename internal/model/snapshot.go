@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// Snapshot states. A snapshot is creating while the hypervisor takes it.
+const (
+	SnapshotStatusCreating = "creating"
+	SnapshotStatusReady    = "ready"
+)
+
+// Snapshot is an internal snapshot of a VM's disk. Tag is the name it has
+// on the hypervisor; Name is the label the user gave it.
+type Snapshot struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	VMID      uint      `gorm:"index;not null" json:"vm_id"`
+	Name      string    `gorm:"size:64;not null" json:"name"`
+	Tag       string    `gorm:"size:64;not null" json:"-"`
+	Status    string    `gorm:"size:32;not null" json:"status"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// SSHKey is a public key a user keeps on file to have it installed in their
+// VMs. Fingerprint is the OpenSSH SHA256 fingerprint; a user cannot store
+// the same key twice.
+type SSHKey struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      uint      `gorm:"uniqueIndex:idx_ssh_keys_user_fingerprint;not null" json:"user_id"`
+	Name        string    `gorm:"size:64;not null" json:"name"`
+	Type        string    `gorm:"size:32;not null" json:"type"`
+	PublicKey   string    `gorm:"type:text;not null" json:"public_key"`
+	Fingerprint string    `gorm:"size:64;uniqueIndex:idx_ssh_keys_user_fingerprint;not null" json:"fingerprint"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
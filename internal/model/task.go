@@ -0,0 +1,32 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	TaskStatusPending   = "pending"
+	TaskStatusRunning   = "running"
+	TaskStatusSucceeded = "succeeded"
+	TaskStatusFailed    = "failed"
+)
+
+// Task is a long-running operation executed by the master's worker pool.
+// Payload and Result hold JSON documents whose shape depends on Type.
+type Task struct {
+	ID         uint            `gorm:"primaryKey" json:"id"`
+	Type       string          `gorm:"size:64;not null;index" json:"type"`
+	Status     string          `gorm:"size:32;not null;index" json:"status"`
+	UserID     uint            `gorm:"index;not null" json:"user_id"`
+	VMID       *uint           `gorm:"index" json:"vm_id"`
+	Payload    json.RawMessage `gorm:"type:text;not null" json:"-"`
+	Result     json.RawMessage `gorm:"type:text" json:"result,omitempty"`
+	Error      string          `gorm:"type:text" json:"error,omitempty"`
+	Progress   int             `gorm:"not null;default:0" json:"progress"`
+	Attempts   int             `gorm:"not null;default:0" json:"attempts"`
+	StartedAt  *time.Time      `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at"`
+	CreatedAt  time.Time       `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt  time.Time       `gorm:"autoUpdateTime" json:"updated_at"`
+}
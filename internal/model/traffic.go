@@ -0,0 +1,47 @@
+package model
+
+import "time"
+
+// Traffic bucket periods. Hours start on the hour and months on the first
+// of the month, both in UTC.
+const (
+	TrafficPeriodHour  = "hour"
+	TrafficPeriodMonth = "month"
+)
+
+// Actions taken against a VM over its monthly transfer quota.
+const (
+	TrafficActionThrottle = "throttle"
+	TrafficActionSuspend  = "suspend"
+)
+
+// TrafficUsage is the traffic of a VM in one hour or month. Rx is what the
+// VM received, Tx what it sent. Usage outlives the VM for billing.
+type TrafficUsage struct {
+	ID          uint      `gorm:"primaryKey" json:"-"`
+	VMID        uint      `gorm:"not null;uniqueIndex:idx_traffic_usages_bucket" json:"vm_id"`
+	Period      string    `gorm:"size:8;not null;uniqueIndex:idx_traffic_usages_bucket" json:"period"`
+	PeriodStart time.Time `gorm:"not null;uniqueIndex:idx_traffic_usages_bucket" json:"period_start"`
+	RxBytes     int64     `gorm:"not null;default:0" json:"rx_bytes"`
+	TxBytes     int64     `gorm:"not null;default:0" json:"tx_bytes"`
+}
+
+// TrafficCounter is the last reading of a VM's interface counters, which
+// the next reading is counted against.
+type TrafficCounter struct {
+	VMID      uint      `gorm:"primaryKey;autoIncrement:false" json:"vm_id"`
+	RxBytes   int64     `gorm:"not null" json:"rx_bytes"`
+	TxBytes   int64     `gorm:"not null" json:"tx_bytes"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// TrafficEnforcement records that a VM went over its quota in Month and
+// what is done about it; Applied once the node carried that out. It is
+// lifted when the next month starts.
+type TrafficEnforcement struct {
+	VMID      uint      `gorm:"primaryKey;autoIncrement:false" json:"vm_id"`
+	Month     time.Time `gorm:"not null;index" json:"month"`
+	Action    string    `gorm:"size:16;not null" json:"action"`
+	Applied   bool      `gorm:"not null;default:false" json:"applied"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
@@ -4,6 +4,25 @@ import (
 	"time"
 )
 
+// VM lifecycle states. Creating, starting, stopping, resizing, reinstalling,
+// reverting, backing up, restoring and deleting are held only while an
+// operation is in flight.
+const (
+	VMStatusCreating     = "creating"
+	VMStatusStopped      = "stopped"
+	VMStatusStarting     = "starting"
+	VMStatusRunning      = "running"
+	VMStatusStopping     = "stopping"
+	VMStatusResizing     = "resizing"
+	VMStatusReinstalling = "reinstalling"
+	VMStatusReverting    = "reverting"
+	VMStatusBackingUp    = "backing_up"
+	VMStatusRestoring    = "restoring"
+	VMStatusDeleting     = "deleting"
+	VMStatusError        = "error"
+	VMStatusSuspended    = "suspended"
+)
+
 type VM struct {
 	ID           uint      `gorm:"primaryKey" json:"id"`
 	Name         string    `gorm:"size:64;not null" json:"name"`
@@ -12,7 +31,28 @@ type VM struct {
 	DiskGB       int       `gorm:"not null" json:"disk_gb"`
 	Status       string    `gorm:"size:32;not null" json:"status"`
 	Description  string    `gorm:"size:255;not null" json:"description"`
-	HypervisorID string    `gorm:"size:64;uniqueIndex;not null" json:"hypervisor_id"`
+	HypervisorID string    `gorm:"size:64;uniqueIndex:idx_vms_node_hypervisor;not null" json:"hypervisor_id"`
+	NodeID       *uint     `gorm:"uniqueIndex:idx_vms_node_hypervisor" json:"node_id"`
+	UserID       uint      `gorm:"index;not null;default:0" json:"user_id"`
+	ImageID      *uint     `gorm:"index" json:"image_id"`
+	Plan         string    `gorm:"size:32;not null;default:default" json:"plan"`
+	IPv4         string    `gorm:"size:64;not null;default:''" json:"ipv4"`
+	IPv6         string    `gorm:"size:64;not null;default:''" json:"ipv6"`
+	NetworkMode  string    `gorm:"size:16;not null;default:public" json:"network_mode"`
+	InboundMbps  int       `gorm:"not null;default:0" json:"inbound_mbps"`
+	OutboundMbps int       `gorm:"not null;default:0" json:"outbound_mbps"`
 	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
 	UpdatedAt    time.Time `gorm:"autoUpdateTime" json:"updated_at"`
 }
+
+// VMTransition records one change of a VM's status.
+type VMTransition struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	VMID       uint      `gorm:"index;not null" json:"vm_id"`
+	FromStatus string    `gorm:"size:32;not null" json:"from_status"`
+	ToStatus   string    `gorm:"size:32;not null" json:"to_status"`
+	Action     string    `gorm:"size:32;not null" json:"action"`
+	ActorID    uint      `gorm:"not null" json:"actor_id"`
+	Error      string    `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
@@ -0,0 +1,173 @@
+// Package nat renders the port forwards of NAT VMs as host firewall rules
+// and applies them. A node's rules are always replaced as a whole, so the
+// firewall ends up matching the ruleset no matter what it held before.
+package nat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// Firewall backends.
+const (
+	BackendNFTables = "nftables"
+	BackendIPTables = "iptables"
+)
+
+// Names of the nftables table and the iptables chains the rules live in.
+// Nothing else in the host's firewall is touched.
+const (
+	nftTable     = "starstream_nat"
+	iptDNATChain = "STARSTREAM-DNAT"
+	iptSNATChain = "STARSTREAM-SNAT"
+)
+
+// Forward sends traffic for PublicPort on the node's public address to
+// PrivatePort of a guest.
+type Forward struct {
+	Protocol    string `json:"protocol"`
+	PublicPort  int    `json:"public_port"`
+	PrivateIP   string `json:"private_ip"`
+	PrivatePort int    `json:"private_port"`
+}
+
+// Ruleset is everything a node forwards. Outbound traffic from the
+// Masquerade networks leaves with the node's address.
+type Ruleset struct {
+	PublicIP   string    `json:"public_ip"`
+	Masquerade []string  `json:"masquerade"`
+	Forwards   []Forward `json:"forwards"`
+}
+
+// Validate checks everything that ends up in a rule, so a ruleset that
+// passes renders into rules the firewall accepts. Only IPv4 is forwarded.
+func (rs Ruleset) Validate() error {
+	if len(rs.Forwards) > 0 {
+		if ip, err := netip.ParseAddr(rs.PublicIP); err != nil || !ip.Is4() {
+			return fmt.Errorf("public address %q is not an IPv4 address", rs.PublicIP)
+		}
+	}
+	for _, cidr := range rs.Masquerade {
+		if p, err := netip.ParsePrefix(cidr); err != nil || !p.Addr().Is4() {
+			return fmt.Errorf("masquerade network %q is not an IPv4 CIDR", cidr)
+		}
+	}
+	for _, f := range rs.Forwards {
+		if f.Protocol != "tcp" && f.Protocol != "udp" {
+			return fmt.Errorf("unknown protocol %q", f.Protocol)
+		}
+		if !validPort(f.PublicPort) || !validPort(f.PrivatePort) {
+			return fmt.Errorf("invalid port in forward %d -> %d", f.PublicPort, f.PrivatePort)
+		}
+		if ip, err := netip.ParseAddr(f.PrivateIP); err != nil || !ip.Is4() {
+			return fmt.Errorf("private address %q is not an IPv4 address", f.PrivateIP)
+		}
+	}
+	return nil
+}
+
+func validPort(p int) bool {
+	return p > 0 && p <= 65535
+}
+
+// RenderNFTables renders the ruleset as an nft script. It creates the
+// table before deleting it, so loading the script replaces the table in
+// one transaction whether or not it existed.
+func RenderNFTables(rs Ruleset) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "table ip %s\ndelete table ip %s\n", nftTable, nftTable)
+	fmt.Fprintf(&b, "table ip %s {\n", nftTable)
+	b.WriteString("\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+	for _, f := range rs.Forwards {
+		fmt.Fprintf(&b, "\t\tip daddr %s %s dport %d dnat to %s:%d\n", rs.PublicIP, f.Protocol, f.PublicPort, f.PrivateIP, f.PrivatePort)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("\tchain postrouting {\n\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	for _, cidr := range rs.Masquerade {
+		fmt.Fprintf(&b, "\t\tip saddr %s ip daddr != %s masquerade\n", cidr, cidr)
+	}
+	b.WriteString("\t}\n}\n")
+	return b.Bytes()
+}
+
+// RenderIPTables renders the ruleset for iptables-restore --noflush. The
+// chains are flushed and refilled; the jumps to them from PREROUTING and
+// POSTROUTING are added by Firewall.Apply.
+func RenderIPTables(rs Ruleset) []byte {
+	var b bytes.Buffer
+	b.WriteString("*nat\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n:%s - [0:0]\n", iptDNATChain, iptSNATChain)
+	fmt.Fprintf(&b, "-F %s\n-F %s\n", iptDNATChain, iptSNATChain)
+	for _, f := range rs.Forwards {
+		fmt.Fprintf(&b, "-A %s -d %s/32 -p %s -m %s --dport %d -j DNAT --to-destination %s:%d\n",
+			iptDNATChain, rs.PublicIP, f.Protocol, f.Protocol, f.PublicPort, f.PrivateIP, f.PrivatePort)
+	}
+	for _, cidr := range rs.Masquerade {
+		fmt.Fprintf(&b, "-A %s -s %s ! -d %s -j MASQUERADE\n", iptSNATChain, cidr, cidr)
+	}
+	b.WriteString("COMMIT\n")
+	return b.Bytes()
+}
+
+// runner executes name with stdin and returns its combined output.
+type runner func(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error)
+
+func execRunner(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// Firewall applies rulesets to the host it runs on.
+type Firewall struct {
+	backend string
+	run     runner
+}
+
+// NewFirewall returns a firewall that uses backend, "nftables" by default.
+func NewFirewall(backend string) (*Firewall, error) {
+	switch backend {
+	case "":
+		backend = BackendNFTables
+	case BackendNFTables, BackendIPTables:
+	default:
+		return nil, fmt.Errorf("unknown NAT backend %q", backend)
+	}
+	return &Firewall{backend: backend, run: execRunner}, nil
+}
+
+// Apply replaces the host's NAT rules with rs.
+func (f *Firewall) Apply(ctx context.Context, rs Ruleset) error {
+	if err := rs.Validate(); err != nil {
+		return err
+	}
+	if f.backend == BackendNFTables {
+		_, err := f.run(ctx, RenderNFTables(rs), "nft", "-f", "-")
+		return err
+	}
+	if _, err := f.run(ctx, RenderIPTables(rs), "iptables-restore", "--noflush"); err != nil {
+		return err
+	}
+	for _, jump := range []struct{ chain, target string }{
+		{"PREROUTING", iptDNATChain},
+		{"POSTROUTING", iptSNATChain},
+	} {
+		if _, err := f.run(ctx, nil, "iptables", "-t", "nat", "-C", jump.chain, "-j", jump.target); err == nil {
+			continue
+		}
+		if _, err := f.run(ctx, nil, "iptables", "-t", "nat", "-I", jump.chain, "-j", jump.target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
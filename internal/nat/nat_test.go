@@ -0,0 +1,99 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testRuleset = Ruleset{
+	PublicIP:   "203.0.113.10",
+	Masquerade: []string{"10.10.0.0/24"},
+	Forwards: []Forward{
+		{Protocol: "tcp", PublicPort: 20001, PrivateIP: "10.10.0.5", PrivatePort: 22},
+		{Protocol: "udp", PublicPort: 20002, PrivateIP: "10.10.0.5", PrivatePort: 51820},
+	},
+}
+
+func TestRenderNFTables(t *testing.T) {
+	want := `table ip starstream_nat
+delete table ip starstream_nat
+table ip starstream_nat {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		ip daddr 203.0.113.10 tcp dport 20001 dnat to 10.10.0.5:22
+		ip daddr 203.0.113.10 udp dport 20002 dnat to 10.10.0.5:51820
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr 10.10.0.0/24 ip daddr != 10.10.0.0/24 masquerade
+	}
+}
+`
+	if got := string(RenderNFTables(testRuleset)); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRenderIPTables(t *testing.T) {
+	want := `*nat
+:STARSTREAM-DNAT - [0:0]
+:STARSTREAM-SNAT - [0:0]
+-F STARSTREAM-DNAT
+-F STARSTREAM-SNAT
+-A STARSTREAM-DNAT -d 203.0.113.10/32 -p tcp -m tcp --dport 20001 -j DNAT --to-destination 10.10.0.5:22
+-A STARSTREAM-DNAT -d 203.0.113.10/32 -p udp -m udp --dport 20002 -j DNAT --to-destination 10.10.0.5:51820
+-A STARSTREAM-SNAT -s 10.10.0.0/24 ! -d 10.10.0.0/24 -j MASQUERADE
+COMMIT
+`
+	if got := string(RenderIPTables(testRuleset)); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (Ruleset{Masquerade: []string{"10.0.0.0/8"}}).Validate(); err != nil {
+		t.Fatalf("ruleset without forwards needs no public address: %v", err)
+	}
+	for _, rs := range []Ruleset{
+		{PublicIP: "2001:db8::1", Forwards: testRuleset.Forwards},
+		{PublicIP: "203.0.113.10", Forwards: []Forward{{Protocol: "icmp", PublicPort: 1, PrivateIP: "10.0.0.1", PrivatePort: 1}}},
+		{PublicIP: "203.0.113.10", Forwards: []Forward{{Protocol: "tcp", PublicPort: 70000, PrivateIP: "10.0.0.1", PrivatePort: 1}}},
+		{PublicIP: "203.0.113.10", Forwards: []Forward{{Protocol: "tcp", PublicPort: 1, PrivateIP: "10.0.0.1; flush ruleset", PrivatePort: 1}}},
+		{Masquerade: []string{"10.0.0.0/8 accept"}},
+	} {
+		if err := rs.Validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", rs)
+		}
+	}
+}
+
+func TestFirewallApplyIPTables(t *testing.T) {
+	var calls []string
+	f := &Firewall{backend: BackendIPTables, run: func(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+		call := name + " " + strings.Join(args, " ")
+		calls = append(calls, call)
+		// The DNAT jump exists already, the SNAT one does not.
+		if strings.Contains(call, "-C POSTROUTING") {
+			return nil, errors.New("no such rule")
+		}
+		return nil, nil
+	}}
+	if err := f.Apply(context.Background(), testRuleset); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	want := []string{
+		"iptables-restore --noflush",
+		"iptables -t nat -C PREROUTING -j STARSTREAM-DNAT",
+		"iptables -t nat -C POSTROUTING -j STARSTREAM-SNAT",
+		"iptables -t nat -I POSTROUTING -j STARSTREAM-SNAT",
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("calls:\n%s\nwant:\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+
+	if _, err := NewFirewall("pf"); err == nil {
+		t.Fatal("expected unknown backend to be rejected")
+	}
+}
@@ -1,6 +1,10 @@
 package router
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
@@ -9,13 +13,21 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
 
-	"Zjmf-kvm/internal/config"
-	"Zjmf-kvm/internal/db"
-	"Zjmf-kvm/internal/handler"
+	"StarstreamAstra/internal/agent"
+	"StarstreamAstra/internal/backup"
+	"StarstreamAstra/internal/config"
+	"StarstreamAstra/internal/db"
+	"StarstreamAstra/internal/handler"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+	"StarstreamAstra/internal/service"
 )
 
-func RegisterRoutes(r *gin.Engine, dbConn *db.DBConn, cfg *config.Config) {
+// RegisterRoutes mounts the API on r. Background workers behind the API,
+// such as the task pool, run until ctx is cancelled.
+func RegisterRoutes(ctx context.Context, r *gin.Engine, dbConn *db.DBConn, cfg *config.Config) {
 	api := r.Group("/api/v1")
 
 	auth := api.Group("/auth")
@@ -25,11 +37,128 @@ func RegisterRoutes(r *gin.Engine, dbConn *db.DBConn, cfg *config.Config) {
 	_ = tokenTTL
 	auth.POST("/login", handler.LoginHandler(dbConn.Gorm, jwtSecret, tokenTTL))
 
+	agentAPI := api.Group("/agent")
+	agentAPI.Use(requireAgentToken(cfg))
+	handler.RegisterAgentHandlers(agentAPI, dbConn.Gorm)
+
 	protected := api.Group("")
 	protected.Use(AuthMiddleware(jwtSecret))
 
+	taskService := service.NewTaskService(dbConn.Gorm)
+	ipamCfg := config.IPAMConfig{}
+	if cfg != nil {
+		ipamCfg = cfg.IPAM
+	}
+	ipamService := service.NewIPAMService(dbConn.Gorm, ipamCfg.Quarantine())
+	vmService := newVMService(cfg, dbConn.Gorm).WithIPAM(ipamService)
+	natCfg := config.NATConfig{}
+	if cfg != nil {
+		natCfg = cfg.NAT
+	}
+	portStart, portEnd := natCfg.Ports()
+	natService := service.NewNATService(dbConn.Gorm, vmService, service.NATOptions{
+		PublicIP:   natCfg.PublicIP,
+		PortStart:  portStart,
+		PortEnd:    portEnd,
+		PortsPerVM: natCfg.PerVM(),
+	})
+	vmService.WithNAT(natService)
+	groupService := service.NewSecurityGroupService(dbConn.Gorm, vmService)
+	vmService.WithSecurityGroups(groupService)
+	trafficCfg := config.TrafficConfig{}
+	if cfg != nil {
+		trafficCfg = cfg.Traffic
+	}
+	trafficOpts := service.TrafficOptions{
+		Policy:          trafficCfg.Policy,
+		ThrottleMbps:    trafficCfg.Throttle(),
+		HourlyRetention: trafficCfg.HourlyRetention(),
+	}
+	trafficService, err := service.NewTrafficService(dbConn.Gorm, vmService, trafficOpts)
+	if err != nil {
+		log.Printf("Traffic quotas disabled: %v", err)
+		trafficOpts.Policy = service.TrafficPolicyNone
+		trafficService, _ = service.NewTrafficService(dbConn.Gorm, vmService, trafficOpts)
+	}
+	vmService.WithTraffic(trafficService)
+	enforced := trafficOpts.Policy != "" && trafficOpts.Policy != service.TrafficPolicyNone
+	if fallback := defaultPlan(cfg); enforced && cfg.Plans[fallback].TrafficGB == 0 {
+		log.Printf("Traffic quotas do not cover VMs without a plan: plan %q has no traffic_gb", fallback)
+	}
+	vmService.RegisterTasks(taskService)
+	backupCfg := config.BackupConfig{}
+	if cfg != nil {
+		backupCfg = cfg.Backup
+	}
+	if target, err := newBackupTarget(backupCfg); err != nil {
+		log.Printf("Backups disabled: %v", err)
+	} else {
+		backupService := service.NewBackupService(dbConn.Gorm, vmService, target)
+		backupService.RegisterTasks(taskService)
+		go backupService.RunSchedules(ctx, backupCfg.ScheduleInterval(), log.Printf)
+		handler.RegisterBackupHandlers(protected.Group("/backups"), backupService)
+	}
+	workers := 0
+	if cfg != nil {
+		workers = cfg.Tasks.WorkerCount()
+	}
+	go taskService.RunWorkers(ctx, workers, log.Printf)
+	go vmService.Outbox().Run(ctx, log.Printf)
+	go natService.Run(ctx, natCfg.SyncInterval(), log.Printf)
+	firewallCfg := config.FirewallConfig{}
+	if cfg != nil {
+		firewallCfg = cfg.Firewall
+	}
+	go groupService.Run(ctx, firewallCfg.SyncInterval(), log.Printf)
+	go trafficService.Run(ctx, trafficCfg.Interval(), log.Printf)
+
+	reconcileCfg := config.ReconcilerConfig{}
+	if cfg != nil {
+		reconcileCfg = cfg.Reconciler
+	}
+	reconciler := service.NewReconciler(vmService, reconcileCfg.StaleAfter())
+	go reconciler.Run(ctx, reconcileCfg.Interval(), log.Printf)
+
 	vmGroup := protected.Group("/vm")
-	handler.RegisterVMHandlers(vmGroup, dbConn.Gorm)
+	handler.RegisterVMHandlers(vmGroup, vmService)
+
+	consoleCfg := config.ConsoleConfig{}
+	if cfg != nil {
+		consoleCfg = cfg.Console
+	}
+	consoleService := service.NewConsoleService(dbConn.Gorm, vmService, consoleCfg.TokenTTL(), consoleCfg.SessionTTL())
+	handler.RegisterConsoleHandlers(vmGroup, api.Group("/console"), consoleService)
+	handler.RegisterNATHandlers(vmGroup, natService)
+	handler.RegisterTrafficHandlers(vmGroup, trafficService)
+	handler.RegisterSecurityGroupHandlers(protected.Group("/security-groups"), vmGroup, groupService)
+
+	imageService := service.NewImageService(dbConn.Gorm)
+	handler.RegisterImageHandlers(protected.Group("/images"), imageService)
+	imageAdmin := protected.Group("/images")
+	imageAdmin.Use(RequireRole("admin"))
+	handler.RegisterImageAdminHandlers(imageAdmin, imageService)
+
+	handler.RegisterSSHKeyHandlers(protected.Group("/keys"), service.NewSSHKeyService(dbConn.Gorm))
+
+	taskGroup := protected.Group("/tasks")
+	handler.RegisterTaskHandlers(taskGroup, taskService)
+
+	nodeGroup := protected.Group("/nodes")
+	nodeGroup.Use(RequireRole("admin"))
+	handler.RegisterNodeHandlers(nodeGroup, dbConn.Gorm)
+
+	ipPoolGroup := protected.Group("/admin/ip-pools")
+	ipPoolGroup.Use(RequireRole("admin"))
+	handler.RegisterIPPoolHandlers(ipPoolGroup, ipamService)
+
+	vmAdminGroup := protected.Group("/admin/vm")
+	vmAdminGroup.Use(RequireRole("admin"))
+	handler.RegisterBandwidthHandlers(vmAdminGroup, vmService)
+	handler.RegisterPlanHandlers(vmAdminGroup, vmService)
+
+	reconcileGroup := protected.Group("/admin/reconcile")
+	reconcileGroup.Use(RequireRole("admin"))
+	handler.RegisterReconcileHandlers(reconcileGroup, reconciler)
 
 	adminGroup := vmGroup.Group("/admin")
 	adminGroup.Use(RequireRole("admin"))
@@ -38,6 +167,120 @@ func RegisterRoutes(r *gin.Engine, dbConn *db.DBConn, cfg *config.Config) {
 	})
 }
 
+// requireAgentToken authenticates node agents with the shared agent token.
+// Agent endpoints stay closed when no token is configured.
+func requireAgentToken(cfg *config.Config) gin.HandlerFunc {
+	if cfg == nil || cfg.Agent.Token == "" {
+		return func(c *gin.Context) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"Error": "agent token not configured"})
+		}
+	}
+	return agent.TokenMiddleware(cfg.Agent.Token)
+}
+
+// defaultPlan is the plan VMs created without one get.
+func defaultPlan(cfg *config.Config) string {
+	if cfg != nil {
+		if _, ok := cfg.Plans[cfg.DefaultPlan]; ok {
+			return cfg.DefaultPlan
+		}
+	}
+	return service.DefaultPlan
+}
+
+// newVMService wires the VM service to the configured hypervisor. With the
+// remote driver new VMs are scheduled across all online nodes; the driver's
+// own hypervisor still serves VMs created before scheduling was enabled.
+func newVMService(cfg *config.Config, gdb *gorm.DB) *service.VMService {
+	vmService := service.NewVMService(gdb, newHypervisor(cfg, gdb))
+	if cfg != nil && len(cfg.Plans) > 0 {
+		plans := make(map[string]service.Plan, len(cfg.Plans))
+		for name, p := range cfg.Plans {
+			plans[name] = service.Plan{
+				MaxSnapshots: p.MaxSnapshots,
+				InboundMbps:  p.InboundMbps,
+				OutboundMbps: p.OutboundMbps,
+				TrafficGB:    p.TrafficGB,
+			}
+		}
+		vmService.WithPlans(plans).WithDefaultPlan(defaultPlan(cfg))
+		if defaultPlan(cfg) != cfg.DefaultPlan && cfg.DefaultPlan != "" {
+			log.Printf("Unknown default plan %q; VMs without a plan get the built-in default", cfg.DefaultPlan)
+		}
+	}
+	if cfg == nil || cfg.Hypervisor.Driver != "remote" {
+		return vmService
+	}
+	sched, err := service.NewScheduler(gdb, cfg.Scheduler.Policy)
+	if err != nil {
+		log.Printf("Scheduler disabled: %v", err)
+		return vmService
+	}
+	tlsConfig, err := agentClientTLS(cfg)
+	if err != nil {
+		log.Printf("Scheduler disabled: %v", err)
+		return vmService
+	}
+	return vmService.WithScheduler(sched, agent.NewPool(cfg.Agent.Token, tlsConfig))
+}
+
+func newBackupTarget(cfg config.BackupConfig) (backup.Target, error) {
+	switch cfg.Target {
+	case "", "local":
+		return backup.NewLocalTarget(cfg.Directory()), nil
+	case "s3":
+		return backup.NewS3Target(backup.S3Options{
+			Endpoint:  cfg.S3.Endpoint,
+			Region:    cfg.S3.Region,
+			Bucket:    cfg.S3.Bucket,
+			Prefix:    cfg.S3.Prefix,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey,
+		})
+	default:
+		return nil, fmt.Errorf("unknown backup target %q", cfg.Target)
+	}
+}
+
+func newHypervisor(cfg *config.Config, gdb *gorm.DB) hypervisor.Hypervisor {
+	if cfg == nil {
+		return hypervisor.NewQEMUHypervisor(hypervisor.QEMUOptions{})
+	}
+	if cfg.Hypervisor.Driver == "remote" {
+		hv, err := newRemoteHypervisor(cfg, gdb)
+		if err == nil {
+			return hv
+		}
+		log.Printf("Failed to set up remote hypervisor, falling back to qemu: %v", err)
+		return hypervisor.NewQEMUHypervisor(hypervisor.QEMUOptions{})
+	}
+	hv, err := hypervisor.New(cfg.Hypervisor)
+	if err != nil {
+		log.Printf("%v, falling back to qemu", err)
+		return hypervisor.NewQEMUHypervisor(hypervisor.QEMUOptions{})
+	}
+	return hv
+}
+
+func newRemoteHypervisor(cfg *config.Config, gdb *gorm.DB) (hypervisor.Hypervisor, error) {
+	var node model.Node
+	if err := gdb.Where("name = ?", cfg.Hypervisor.Remote.Node).First(&node).Error; err != nil {
+		return nil, fmt.Errorf("lookup node %q: %w", cfg.Hypervisor.Remote.Node, err)
+	}
+	tlsConfig, err := agentClientTLS(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return agent.NewPool(cfg.Agent.Token, tlsConfig).ForNode(&node), nil
+}
+
+func agentClientTLS(cfg *config.Config) (*tls.Config, error) {
+	if cfg.Agent.TLS.CA == "" && cfg.Agent.TLS.Cert == "" {
+		return nil, nil
+	}
+	return agent.ClientTLSConfig(cfg.Agent.TLS)
+}
+
 func resolveJWTConfig(cfg *config.Config) (string, time.Duration) {
 	secret := "please-change-this-secret"
 	ttl := 24 * time.Hour
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/model"
+)
+
+var ErrScheduleNotFound = errors.New("backup schedule not found")
+
+// defaultFullEvery is how many scheduled backups make up a chain, the full
+// one included, when a schedule does not say.
+const defaultFullEvery = 7
+
+// BackupScheduleRequest sets up daily backups of a VM. Enabled defaults to
+// true.
+type BackupScheduleRequest struct {
+	Hour       int   `json:"hour" binding:"gte=0,lte=23"`
+	KeepDaily  int   `json:"keep_daily" binding:"required,gte=1,lte=90"`
+	KeepWeekly int   `json:"keep_weekly" binding:"gte=0,lte=52"`
+	FullEvery  int   `json:"full_every" binding:"gte=0,lte=30"`
+	Enabled    *bool `json:"enabled"`
+}
+
+func (s *BackupService) GetSchedule(ctx context.Context, p Principal, vmID uint) (*model.BackupSchedule, error) {
+	if _, err := s.vms.ownedVM(ctx, p, vmID); err != nil {
+		return nil, err
+	}
+	return s.schedule(ctx, vmID)
+}
+
+// SetSchedule creates or replaces the VM's schedule. Scheduled backups run
+// as the VM's owner, whoever set them up.
+func (s *BackupService) SetSchedule(ctx context.Context, p Principal, vmID uint, req BackupScheduleRequest) (*model.BackupSchedule, error) {
+	vm, err := s.vms.ownedVM(ctx, p, vmID)
+	if err != nil {
+		return nil, err
+	}
+	sched, err := s.schedule(ctx, vm.ID)
+	if errors.Is(err, ErrScheduleNotFound) {
+		sched, err = &model.BackupSchedule{VMID: vm.ID, Enabled: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sched.UserID = vm.UserID
+	sched.Hour = req.Hour
+	sched.KeepDaily = req.KeepDaily
+	sched.KeepWeekly = req.KeepWeekly
+	sched.FullEvery = req.FullEvery
+	if sched.FullEvery == 0 {
+		sched.FullEvery = defaultFullEvery
+	}
+	if req.Enabled != nil {
+		sched.Enabled = *req.Enabled
+	}
+	sched.NextRunAt = nextRun(time.Now(), sched.Hour)
+	if err := s.db.WithContext(ctx).Save(sched).Error; err != nil {
+		return nil, err
+	}
+	return sched, nil
+}
+
+// DeleteSchedule stops scheduled backups of the VM. The backups already
+// taken are kept.
+func (s *BackupService) DeleteSchedule(ctx context.Context, p Principal, vmID uint) error {
+	if _, err := s.vms.ownedVM(ctx, p, vmID); err != nil {
+		return err
+	}
+	res := s.db.WithContext(ctx).Where("vm_id = ?", vmID).Delete(&model.BackupSchedule{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+func (s *BackupService) schedule(ctx context.Context, vmID uint) (*model.BackupSchedule, error) {
+	var sched model.BackupSchedule
+	if err := s.db.WithContext(ctx).Where("vm_id = ?", vmID).First(&sched).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, err
+	}
+	return &sched, nil
+}
+
+// nextRun returns the first time after now at hour:00 UTC.
+func nextRun(now time.Time, hour int) time.Time {
+	now = now.UTC()
+	t := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// RunSchedules queues the backups that are due every interval until ctx is
+// cancelled.
+func (s *BackupService) RunSchedules(ctx context.Context, interval time.Duration, logf func(string, ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.runDue(ctx, time.Now()); err != nil && ctx.Err() == nil {
+				logf("Backup schedules failed: %v", err)
+			}
+		}
+	}
+}
+
+// runDue queues a backup for every enabled schedule due at now and returns
+// how many it queued. Each schedule is claimed by moving its next run on
+// first, so that several masters never queue the same backup twice.
+func (s *BackupService) runDue(ctx context.Context, now time.Time) (int, error) {
+	var due []*model.BackupSchedule
+	err := s.db.WithContext(ctx).
+		Where("enabled = ? AND next_run_at <= ?", true, now).
+		Order("next_run_at").Find(&due).Error
+	if err != nil {
+		return 0, err
+	}
+	queued := 0
+	for _, sched := range due {
+		res := s.db.WithContext(ctx).Model(&model.BackupSchedule{}).
+			Where("id = ? AND next_run_at <= ?", sched.ID, now).
+			Updates(map[string]interface{}{"next_run_at": nextRun(now, sched.Hour), "last_run_at": now})
+		if res.Error != nil {
+			return queued, res.Error
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+		owner := Principal{UserID: sched.UserID}
+		payload := backupTaskPayload{Principal: owner, Scheduled: true}
+		if _, err := s.tasks.Enqueue(ctx, owner, TaskVMBackup, &sched.VMID, payload); err != nil {
+			return queued, err
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+// prune deletes the VM's scheduled backups that retained does not keep.
+// Backups taken on request are never pruned.
+func (s *BackupService) prune(ctx context.Context, vmID uint, keepDaily, keepWeekly int) error {
+	var backups []*model.Backup
+	err := s.db.WithContext(ctx).
+		Where("vm_id = ? AND scheduled = ? AND status = ?", vmID, true, model.BackupStatusReady).
+		Order("created_at DESC, id DESC").Find(&backups).Error
+	if err != nil {
+		return err
+	}
+	keep := retained(backups, keepDaily, keepWeekly)
+	for _, b := range backups {
+		if keep[b.ID] {
+			continue
+		}
+		if err := s.deleteBackup(ctx, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retained picks the backups to keep out of backups, newest first: the
+// newest backup of each of the latest daily days that have one, and the
+// newest of each of the latest weekly ISO weeks that have one.
+func retained(backups []*model.Backup, daily, weekly int) map[uint]bool {
+	keep := make(map[uint]bool)
+	var lastDay, lastWeek string
+	days, weeks := 0, 0
+	for _, b := range backups {
+		t := b.CreatedAt.UTC()
+		if day := t.Format("2006-01-02"); day != lastDay && days < daily {
+			keep[b.ID] = true
+			lastDay = day
+			days++
+		}
+		year, w := t.ISOWeek()
+		if week := fmt.Sprintf("%d-%02d", year, w); week != lastWeek && weeks < weekly {
+			keep[b.ID] = true
+			lastWeek = week
+			weeks++
+		}
+	}
+	return keep
+}
@@ -0,0 +1,520 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/backup"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+const (
+	TaskVMBackup  = "vm.backup"
+	TaskVMRestore = "vm.restore"
+)
+
+var (
+	ErrBackupNotFound   = errors.New("backup not found")
+	ErrBackupNotReady   = errors.New("backup is not ready")
+	ErrBackupInProgress = errors.New("a backup of the VM is in progress")
+	ErrBackupTooLarge   = errors.New("backup is larger than the VM's disk")
+)
+
+// heartbeatInterval is how often a running backup or restore refreshes the
+// VM's updated_at, so the reconciler does not take it for abandoned.
+const heartbeatInterval = time.Minute
+
+// BackupService copies VM disks to a backup target and restores them. The
+// first backup of a VM is full; later ones only store the chunks that
+// changed since the VM's latest backup.
+type BackupService struct {
+	db     *gorm.DB
+	vms    *VMService
+	target backup.Target
+	tasks  *TaskService
+}
+
+func NewBackupService(db *gorm.DB, vms *VMService, target backup.Target) *BackupService {
+	return &BackupService{db: db, vms: vms, target: target}
+}
+
+type BackupCreateRequest struct {
+	VMID uint `json:"vm_id" binding:"required"`
+	// Kind forces a full backup; by default the backup is incremental
+	// whenever the VM has an earlier one.
+	Kind string `json:"kind" binding:"omitempty,oneof=full incremental"`
+}
+
+// BackupRestoreRequest restores a backup into the VM it was taken from,
+// or into a new VM when NewVM is set.
+type BackupRestoreRequest struct {
+	NewVM *RestoreVMRequest `json:"new_vm"`
+}
+
+// RestoreVMRequest describes the VM a backup is restored into. DiskGB
+// defaults to the size of the backed up disk and may not be smaller.
+type RestoreVMRequest struct {
+	Name     string `json:"name" binding:"required,max=64"`
+	CPU      int    `json:"cpu" binding:"required"`
+	MemoryMB int    `json:"memory_mb" binding:"required"`
+	DiskGB   int    `json:"disk_gb" binding:"gte=0"`
+	Plan     string `json:"plan" binding:"omitempty,max=32"`
+}
+
+type backupTaskPayload struct {
+	Principal Principal `json:"principal"`
+	Kind      string    `json:"kind,omitempty"`
+	Scheduled bool      `json:"scheduled,omitempty"`
+	BackupID  uint      `json:"backup_id,omitempty"`
+}
+
+// RegisterTasks installs the backup and restore task handlers.
+func (s *BackupService) RegisterTasks(tasks *TaskService) {
+	s.tasks = tasks
+	tasks.Handle(TaskVMBackup, s.runBackupTask)
+	tasks.Handle(TaskVMRestore, s.runRestoreTask)
+}
+
+// CreateBackupAsync queues a backup of a stopped or running VM.
+func (s *BackupService) CreateBackupAsync(ctx context.Context, p Principal, req BackupCreateRequest) (*model.Task, error) {
+	vm, err := s.vms.ownedVM(ctx, p, req.VMID)
+	if err != nil {
+		return nil, err
+	}
+	if !canTransition(vm.Status, model.VMStatusBackingUp) {
+		return nil, &TransitionError{VMID: vm.ID, From: vm.Status, To: model.VMStatusBackingUp}
+	}
+	return s.tasks.Enqueue(ctx, p, TaskVMBackup, &vm.ID, backupTaskPayload{Principal: p, Kind: req.Kind})
+}
+
+func (s *BackupService) ListBackups(ctx context.Context, p Principal, vmID *uint) ([]*model.Backup, error) {
+	q := p.scope(s.db.WithContext(ctx))
+	if vmID != nil {
+		q = q.Where("vm_id = ?", *vmID)
+	}
+	var backups []*model.Backup
+	if err := q.Order("id DESC").Find(&backups).Error; err != nil {
+		return nil, err
+	}
+	return backups, nil
+}
+
+func (s *BackupService) GetBackup(ctx context.Context, p Principal, id uint) (*model.Backup, error) {
+	var b model.Backup
+	if err := p.scope(s.db.WithContext(ctx)).First(&b, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrBackupNotFound
+		}
+		return nil, err
+	}
+	return &b, nil
+}
+
+// DeleteBackup removes a backup and the chunks no other backup of the VM
+// still uses.
+func (s *BackupService) DeleteBackup(ctx context.Context, p Principal, id uint) error {
+	b, err := s.GetBackup(ctx, p, id)
+	if err != nil {
+		return err
+	}
+	return s.deleteBackup(ctx, b)
+}
+
+// RestoreBackupAsync checks the restore up front and queues it. Restoring
+// into a new VM records that VM with the task, like CreateVMAsync.
+func (s *BackupService) RestoreBackupAsync(ctx context.Context, p Principal, id uint, req BackupRestoreRequest) (*model.Task, error) {
+	b, err := s.GetBackup(ctx, p, id)
+	if err != nil {
+		return nil, err
+	}
+	if b.Status != model.BackupStatusReady {
+		return nil, ErrBackupNotReady
+	}
+	payload := backupTaskPayload{Principal: p, BackupID: b.ID}
+	if req.NewVM == nil {
+		vm, err := s.vms.ownedVM(ctx, p, b.VMID)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRestore(vm, b); err != nil {
+			return nil, err
+		}
+		return s.tasks.Enqueue(ctx, p, TaskVMRestore, &vm.ID, payload)
+	}
+
+	disk := req.NewVM.DiskGB
+	if disk == 0 {
+		disk = b.DiskGB
+	}
+	if disk < b.DiskGB {
+		return nil, ErrBackupTooLarge
+	}
+	var task *model.Task
+	_, err = s.vms.insertVM(ctx, p, VMCreateRequest{
+		Name:        req.NewVM.Name,
+		CPU:         req.NewVM.CPU,
+		MemoryMB:    req.NewVM.MemoryMB,
+		DiskGB:      disk,
+		Plan:        req.NewVM.Plan,
+		Description: fmt.Sprintf("Restored from backup %d", b.ID),
+	}, func(tx *gorm.DB, vm *model.VM) (err error) {
+		task, err = s.tasks.enqueue(tx, p, TaskVMRestore, &vm.ID, payload)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.tasks.notify()
+	return task, nil
+}
+
+func checkRestore(vm *model.VM, b *model.Backup) error {
+	if vm.Status != model.VMStatusRestoring && !canTransition(vm.Status, model.VMStatusRestoring) {
+		return &TransitionError{VMID: vm.ID, From: vm.Status, To: model.VMStatusRestoring}
+	}
+	if b.DiskGB > vm.DiskGB {
+		return ErrBackupTooLarge
+	}
+	return nil
+}
+
+func decodeBackupTask(task *model.Task) (backupTaskPayload, error) {
+	var payload backupTaskPayload
+	err := json.Unmarshal(task.Payload, &payload)
+	return payload, err
+}
+
+func (s *BackupService) runBackupTask(ctx context.Context, task *model.Task, progress func(int)) (interface{}, error) {
+	payload, err := decodeBackupTask(task)
+	if err != nil {
+		return nil, err
+	}
+	vm, hv, err := s.vms.vmAndHypervisor(ctx, payload.Principal, *task.VMID)
+	if err != nil {
+		return nil, err
+	}
+	var sched *model.BackupSchedule
+	if payload.Scheduled {
+		// A schedule deleted since the task was queued still gets its
+		// backup, just without pruning.
+		sched, err = s.schedule(ctx, vm.ID)
+		if err != nil && !errors.Is(err, ErrScheduleNotFound) {
+			return nil, err
+		}
+	}
+	b, err := s.backup(ctx, payload.Principal, vm, hv, payload.Kind, payload.Scheduled, sched, progress)
+	if err != nil {
+		return nil, err
+	}
+	if sched != nil {
+		if err := s.prune(ctx, vm.ID, sched.KeepDaily, sched.KeepWeekly); err != nil {
+			return nil, fmt.Errorf("backup %d stored, pruning old backups failed: %w", b.ID, err)
+		}
+	}
+	return b, nil
+}
+
+// backup copies vm's disk to the target. A running VM keeps running: the
+// copy is taken from a temporary snapshot. A VM found in backing_up is a
+// rerun after a restart; the backup it left behind is marked failed.
+func (s *BackupService) backup(ctx context.Context, p Principal, vm *model.VM, hv hypervisor.Hypervisor, kind string, scheduled bool, sched *model.BackupSchedule, progress func(int)) (*model.Backup, error) {
+	from := vm.Status
+	if from == model.VMStatusBackingUp {
+		info, err := hv.GetVM(ctx, vm.HypervisorID)
+		if err != nil {
+			return nil, err
+		}
+		from = model.VMStatusStopped
+		if info.Status == "running" {
+			from = model.VMStatusRunning
+		}
+		err = s.db.WithContext(ctx).Model(&model.Backup{}).
+			Where("vm_id = ? AND status = ?", vm.ID, model.BackupStatusCreating).
+			Updates(map[string]interface{}{"status": model.BackupStatusFailed, "error": "interrupted"}).Error
+		if err != nil {
+			return nil, err
+		}
+	} else if err := s.vms.transition(ctx, p, vm, model.VMStatusBackingUp, actionBackup, nil, nil); err != nil {
+		return nil, err
+	}
+
+	b, parent, err := s.startBackup(ctx, vm, kind, scheduled, sched)
+	if err != nil {
+		return nil, s.vms.settle(ctx, p, vm, actionBackup, from, from, err)
+	}
+	err = s.copyDisk(ctx, vm, hv, b, parent, from == model.VMStatusRunning, progress)
+
+	db := s.db.WithContext(context.WithoutCancel(ctx))
+	if err != nil {
+		_ = db.Model(b).Updates(map[string]interface{}{"status": model.BackupStatusFailed, "error": err.Error()}).Error
+		// The VM's disk was only read, so it goes back to where it was.
+		return nil, s.vms.settle(ctx, p, vm, actionBackup, from, from, err)
+	}
+	now := time.Now()
+	b.Status = model.BackupStatusReady
+	b.CompletedAt = &now
+	err = db.Model(b).Updates(map[string]interface{}{
+		"status":       b.Status,
+		"size_bytes":   b.SizeBytes,
+		"stored_bytes": b.StoredBytes,
+		"completed_at": now,
+	}).Error
+	if err := s.vms.settle(ctx, p, vm, actionBackup, from, from, err); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// startBackup records the backup and picks its parent: the VM's latest
+// ready backup, unless a full backup is asked for or due by sched.
+func (s *BackupService) startBackup(ctx context.Context, vm *model.VM, kind string, scheduled bool, sched *model.BackupSchedule) (*model.Backup, *backup.Manifest, error) {
+	var recent []*model.Backup
+	err := s.db.WithContext(ctx).
+		Where("vm_id = ? AND status = ?", vm.ID, model.BackupStatusReady).
+		Order("id DESC").Find(&recent).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	b := &model.Backup{
+		VMID:      vm.ID,
+		UserID:    vm.UserID,
+		Kind:      model.BackupKindFull,
+		Status:    model.BackupStatusCreating,
+		Scheduled: scheduled,
+		DiskGB:    vm.DiskGB,
+	}
+	var parent *backup.Manifest
+	if kind != model.BackupKindFull && len(recent) > 0 && !fullDue(recent, sched) {
+		parent, err = backup.LoadManifest(ctx, s.target, backupPrefix(recent[0]))
+		if err != nil && !errors.Is(err, backup.ErrNotFound) {
+			return nil, nil, err
+		}
+		if parent != nil {
+			b.Kind = model.BackupKindIncremental
+			b.ParentID = &recent[0].ID
+		}
+	}
+	if err := s.db.WithContext(ctx).Create(b).Error; err != nil {
+		return nil, nil, err
+	}
+	return b, parent, nil
+}
+
+// fullDue reports whether the next scheduled backup must be full, given
+// the VM's ready backups newest first.
+func fullDue(recent []*model.Backup, sched *model.BackupSchedule) bool {
+	if sched == nil || sched.FullEvery <= 0 {
+		return false
+	}
+	n := 0
+	for _, b := range recent {
+		if b.Kind == model.BackupKindFull {
+			break
+		}
+		n++
+	}
+	return n+1 >= sched.FullEvery
+}
+
+// copyDisk streams the VM's disk into the target under b's prefix and
+// fills in b's sizes.
+func (s *BackupService) copyDisk(ctx context.Context, vm *model.VM, hv hypervisor.Hypervisor, b *model.Backup, parent *backup.Manifest, running bool, progress func(int)) error {
+	var tag string
+	if running {
+		tag = "backup-" + snapshotTag()
+		if err := hv.CreateSnapshot(ctx, vm.HypervisorID, tag); err != nil {
+			_ = hv.DeleteSnapshot(context.WithoutCancel(ctx), vm.HypervisorID, tag)
+			return err
+		}
+		defer func() { _ = hv.DeleteSnapshot(context.WithoutCancel(ctx), vm.HypervisorID, tag) }()
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(hv.ExportDisk(ctx, vm.HypervisorID, tag, pw))
+	}()
+	m, stored, err := backup.Write(ctx, s.target, backupPrefix(b), s.heartbeat(ctx, vm, pr, progress), parent)
+	// Unblocks the export if the write gave up early.
+	pr.CloseWithError(err)
+	<-done
+	if err != nil {
+		return err
+	}
+	b.SizeBytes = m.Size
+	b.StoredBytes = stored
+	return nil
+}
+
+func (s *BackupService) runRestoreTask(ctx context.Context, task *model.Task, progress func(int)) (interface{}, error) {
+	payload, err := decodeBackupTask(task)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.GetBackup(ctx, payload.Principal, payload.BackupID)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := s.vms.ownedVM(ctx, payload.Principal, *task.VMID)
+	if err != nil {
+		return nil, err
+	}
+	// A VM restored into a new VM is built first, with a blank disk.
+	if vm.Status == model.VMStatusCreating {
+		if err := s.vms.provision(ctx, payload.Principal, vm, nil); err != nil {
+			return nil, err
+		}
+	}
+	hv, err := s.vms.hypervisorFor(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	progress(10)
+	if err := s.restore(ctx, payload.Principal, vm, hv, b, progress); err != nil {
+		return nil, err
+	}
+	return s.vms.ownedVM(ctx, payload.Principal, vm.ID)
+}
+
+// restore replaces vm's disk with the backup's contents and leaves the VM
+// stopped. The hypervisor only swaps the disk once the new one is
+// complete, so a failed restore leaves the VM as it was.
+func (s *BackupService) restore(ctx context.Context, p Principal, vm *model.VM, hv hypervisor.Hypervisor, b *model.Backup, progress func(int)) error {
+	if err := checkRestore(vm, b); err != nil {
+		return err
+	}
+	from := vm.Status
+	if from == model.VMStatusRestoring {
+		from = model.VMStatusError
+	} else if err := s.vms.transition(ctx, p, vm, model.VMStatusRestoring, actionRestore, nil, nil); err != nil {
+		return err
+	}
+	m, err := backup.LoadManifest(ctx, s.target, backupPrefix(b))
+	if err != nil {
+		return s.vms.settle(ctx, p, vm, actionRestore, from, from, err)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(backup.Read(ctx, s.target, m, pw))
+	}()
+	err = hv.ImportDisk(ctx, vm.HypervisorID, s.heartbeat(ctx, vm, pr, progress))
+	pr.CloseWithError(err)
+	<-done
+	if err != nil {
+		return s.vms.settle(ctx, p, vm, actionRestore, from, from, err)
+	}
+	// The snapshots went with the old disk.
+	err = s.db.WithContext(context.WithoutCancel(ctx)).Transaction(func(tx *gorm.DB) error {
+		if err := applyTransition(tx, p, vm, model.VMStatusStopped, actionRestore, nil, nil); err != nil {
+			return err
+		}
+		return deleteSnapshots(tx, vm.ID)
+	})
+	if err != nil {
+		return err
+	}
+	vm.Status = model.VMStatusStopped
+	return nil
+}
+
+// deleteBackup is refused while a backup of the same VM is being taken,
+// since it may be using this one's chunks.
+func (s *BackupService) deleteBackup(ctx context.Context, b *model.Backup) error {
+	var creating int64
+	err := s.db.WithContext(ctx).Model(&model.Backup{}).
+		Where("vm_id = ? AND status = ?", b.VMID, model.BackupStatusCreating).
+		Count(&creating).Error
+	if err != nil {
+		return err
+	}
+	if creating > 0 {
+		return ErrBackupInProgress
+	}
+	// Failed backups removed their chunks already.
+	if b.Status == model.BackupStatusReady {
+		if err := s.deleteChunks(ctx, b); err != nil {
+			return err
+		}
+	}
+	return s.db.WithContext(context.WithoutCancel(ctx)).Delete(b).Error
+}
+
+func (s *BackupService) deleteChunks(ctx context.Context, b *model.Backup) error {
+	m, err := backup.LoadManifest(ctx, s.target, backupPrefix(b))
+	if errors.Is(err, backup.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var siblings []*model.Backup
+	err = s.db.WithContext(ctx).
+		Where("vm_id = ? AND status = ? AND id <> ?", b.VMID, model.BackupStatusReady, b.ID).
+		Find(&siblings).Error
+	if err != nil {
+		return err
+	}
+	others := make([]*backup.Manifest, 0, len(siblings))
+	for _, o := range siblings {
+		om, err := backup.LoadManifest(ctx, s.target, backupPrefix(o))
+		if errors.Is(err, backup.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		others = append(others, om)
+	}
+	return backup.Delete(ctx, s.target, backupPrefix(b), m, others)
+}
+
+func backupPrefix(b *model.Backup) string {
+	return fmt.Sprintf("vms/%d/%d", b.VMID, b.ID)
+}
+
+// heartbeat wraps r so that reading from it reports progress against the
+// VM's disk size and keeps the VM's updated_at fresh.
+func (s *BackupService) heartbeat(ctx context.Context, vm *model.VM, r io.Reader, progress func(int)) io.Reader {
+	total := int64(vm.DiskGB) << 30
+	return &heartbeatReader{
+		r:    r,
+		last: time.Now(),
+		beat: func(done int64) {
+			if progress != nil && total > 0 && done <= total {
+				// 10-90%, leaving room for the steps around the copy.
+				progress(10 + int(80*done/total))
+			}
+			_ = s.db.WithContext(ctx).Model(&model.VM{}).
+				Where("id = ? AND status = ?", vm.ID, vm.Status).
+				Update("updated_at", time.Now()).Error
+		},
+	}
+}
+
+type heartbeatReader struct {
+	r    io.Reader
+	done int64
+	last time.Time
+	beat func(done int64)
+}
+
+func (h *heartbeatReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.done += int64(n)
+	if now := time.Now(); now.Sub(h.last) >= heartbeatInterval {
+		h.last = now
+		h.beat(h.done)
+	}
+	return n, err
+}
@@ -0,0 +1,256 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"StarstreamAstra/internal/backup"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func newTestBackupService(t *testing.T) (*BackupService, *TaskService, *hypervisor.FakeHypervisor) {
+	t.Helper()
+	s, hv, db := newTestVMService(t)
+	tasks := NewTaskService(db)
+	s.RegisterTasks(tasks)
+	b := NewBackupService(db, s, backup.NewLocalTarget(t.TempDir()))
+	b.RegisterTasks(tasks)
+	startTestWorkers(t, tasks)
+	return b, tasks, hv
+}
+
+// testDisk returns a disk image of a little over two chunks whose chunks
+// are filled with the given bytes.
+func testDisk(fill ...byte) []byte {
+	var buf bytes.Buffer
+	for i, f := range fill {
+		n := backup.ChunkSize
+		if i == len(fill)-1 {
+			n = 100
+		}
+		buf.Write(bytes.Repeat([]byte{f}, n))
+	}
+	return buf.Bytes()
+}
+
+func runBackup(t *testing.T, s *BackupService, tasks *TaskService, req BackupCreateRequest) *model.Backup {
+	t.Helper()
+	task, err := s.CreateBackupAsync(ctx, owner, req)
+	if err != nil {
+		t.Fatalf("enqueue backup: %v", err)
+	}
+	if done := waitTask(t, tasks, owner, task.ID); done.Status != model.TaskStatusSucceeded {
+		t.Fatalf("backup task %s: %s", done.Status, done.Error)
+	}
+	backups, err := s.ListBackups(ctx, owner, &req.VMID)
+	if err != nil || len(backups) == 0 {
+		t.Fatalf("list backups: %v %v", backups, err)
+	}
+	return backups[0]
+}
+
+func TestBackupFullAndIncremental(t *testing.T) {
+	s, tasks, hv := newTestBackupService(t)
+	vm := createTestVM(t, s.vms)
+	hv.SetDisk(vm.HypervisorID, testDisk('a', 'b', 'c'))
+
+	full := runBackup(t, s, tasks, BackupCreateRequest{VMID: vm.ID})
+	if full.Kind != model.BackupKindFull || full.Status != model.BackupStatusReady || full.StoredBytes != full.SizeBytes {
+		t.Fatalf("unexpected full backup %+v", full)
+	}
+
+	// A running VM is backed up from a snapshot that is dropped afterwards.
+	if err := s.vms.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	hv.SetDisk(vm.HypervisorID, testDisk('a', 'x', 'c'))
+	incr := runBackup(t, s, tasks, BackupCreateRequest{VMID: vm.ID})
+	if incr.Kind != model.BackupKindIncremental || incr.ParentID == nil || *incr.ParentID != full.ID {
+		t.Fatalf("unexpected incremental backup %+v", incr)
+	}
+	if incr.StoredBytes != int64(backup.ChunkSize) {
+		t.Fatalf("incremental stored %d bytes, want one chunk", incr.StoredBytes)
+	}
+	if hv.Snapshots(vm.HypervisorID) != 0 {
+		t.Fatal("backup snapshot left behind")
+	}
+	assertStatus(t, s.vms, hv, vm, model.VMStatusRunning)
+
+	forced := runBackup(t, s, tasks, BackupCreateRequest{VMID: vm.ID, Kind: model.BackupKindFull})
+	if forced.Kind != model.BackupKindFull || forced.ParentID != nil {
+		t.Fatalf("unexpected forced full backup %+v", forced)
+	}
+
+	if _, err := s.GetBackup(ctx, Principal{UserID: 2}, full.ID); !errors.Is(err, ErrBackupNotFound) {
+		t.Fatalf("get by other user = %v, want ErrBackupNotFound", err)
+	}
+}
+
+func TestBackupFailureKeepsVM(t *testing.T) {
+	s, tasks, hv := newTestBackupService(t)
+	vm := createTestVM(t, s.vms)
+	hv.Inject(hypervisor.MethodExportDisk, hypervisor.Fault{Err: errInjected})
+
+	task, err := s.CreateBackupAsync(ctx, owner, BackupCreateRequest{VMID: vm.ID})
+	if err != nil {
+		t.Fatalf("enqueue backup: %v", err)
+	}
+	if done := waitTask(t, tasks, owner, task.ID); done.Status != model.TaskStatusFailed {
+		t.Fatalf("backup task %s, want failed", done.Status)
+	}
+	backups, _ := s.ListBackups(ctx, owner, nil)
+	if len(backups) != 1 || backups[0].Status != model.BackupStatusFailed || backups[0].Error == "" {
+		t.Fatalf("unexpected backups %+v", backups)
+	}
+	assertStatus(t, s.vms, hv, vm, model.VMStatusStopped)
+
+	if _, err := s.RestoreBackupAsync(ctx, owner, backups[0].ID, BackupRestoreRequest{}); !errors.Is(err, ErrBackupNotReady) {
+		t.Fatalf("restore failed backup = %v, want ErrBackupNotReady", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	s, tasks, hv := newTestBackupService(t)
+	vm := createTestVM(t, s.vms)
+	original := testDisk('a', 0, 'c')
+	hv.SetDisk(vm.HypervisorID, original)
+	full := runBackup(t, s, tasks, BackupCreateRequest{VMID: vm.ID})
+	changed := testDisk('a', 'b', 'd')
+	hv.SetDisk(vm.HypervisorID, changed)
+	incr := runBackup(t, s, tasks, BackupCreateRequest{VMID: vm.ID})
+
+	// The incremental backup still has the chunk it shares with the full one.
+	if err := s.DeleteBackup(ctx, owner, full.ID); err != nil {
+		t.Fatalf("delete full backup: %v", err)
+	}
+
+	restore := func(req BackupRestoreRequest) *model.VM {
+		t.Helper()
+		task, err := s.RestoreBackupAsync(ctx, owner, incr.ID, req)
+		if err != nil {
+			t.Fatalf("enqueue restore: %v", err)
+		}
+		if done := waitTask(t, tasks, owner, task.ID); done.Status != model.TaskStatusSucceeded {
+			t.Fatalf("restore task %s: %s", done.Status, done.Error)
+		}
+		restored, err := s.vms.ownedVM(ctx, owner, *task.VMID)
+		if err != nil {
+			t.Fatalf("load restored vm: %v", err)
+		}
+		return restored
+	}
+
+	hv.SetDisk(vm.HypervisorID, []byte("garbage"))
+	if err := s.vms.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if _, err := s.RestoreBackupAsync(ctx, owner, incr.ID, BackupRestoreRequest{}); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("restore into running vm = %v, want ErrInvalidTransition", err)
+	}
+	if err := s.vms.StopVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	same := restore(BackupRestoreRequest{})
+	if same.ID != vm.ID || same.Status != model.VMStatusStopped || !bytes.Equal(hv.Disk(vm.HypervisorID), changed) {
+		t.Fatalf("restore into same vm: %+v", same)
+	}
+
+	if _, err := s.RestoreBackupAsync(ctx, owner, incr.ID, BackupRestoreRequest{
+		NewVM: &RestoreVMRequest{Name: "small", CPU: 1, MemoryMB: 512, DiskGB: 10},
+	}); !errors.Is(err, ErrBackupTooLarge) {
+		t.Fatalf("restore into smaller vm = %v, want ErrBackupTooLarge", err)
+	}
+	fresh := restore(BackupRestoreRequest{NewVM: &RestoreVMRequest{Name: "copy", CPU: 1, MemoryMB: 512}})
+	if fresh.ID == vm.ID || fresh.DiskGB != vm.DiskGB || fresh.Status != model.VMStatusStopped {
+		t.Fatalf("unexpected restored vm %+v", fresh)
+	}
+	if !bytes.Equal(hv.Disk(fresh.HypervisorID), changed) {
+		t.Fatal("new vm does not have the backed up disk")
+	}
+}
+
+func TestBackupRetained(t *testing.T) {
+	day := func(d, hour int) time.Time { return time.Date(2026, 3, d, hour, 0, 0, 0, time.UTC) }
+	// Newest first: two backups on the 16th, then one a day back to the
+	// 1st. The 16th is a Monday.
+	backups := []*model.Backup{{ID: 100, CreatedAt: day(16, 12)}, {ID: 99, CreatedAt: day(16, 1)}}
+	for d := 15; d >= 1; d-- {
+		backups = append(backups, &model.Backup{ID: uint(d), CreatedAt: day(d, 1)})
+	}
+
+	keep := retained(backups, 3, 2)
+	// Daily: the newest of the 16th, the 15th and the 14th. Weekly: the
+	// newest of the week of the 16th and of the week ending on the 15th.
+	want := []uint{100, 15, 14}
+	if len(keep) != len(want) {
+		t.Fatalf("kept %v, want %v", keep, want)
+	}
+	for _, id := range want {
+		if !keep[id] {
+			t.Fatalf("kept %v, want %v", keep, want)
+		}
+	}
+
+	keep = retained(backups, 1, 3)
+	for _, id := range []uint{100, 15, 8} {
+		if !keep[id] {
+			t.Fatalf("kept %v, want the newest of three weeks", keep)
+		}
+	}
+}
+
+func TestBackupSchedule(t *testing.T) {
+	s, tasks, hv := newTestBackupService(t)
+	vm := createTestVM(t, s.vms)
+	hv.SetDisk(vm.HypervisorID, testDisk('a', 'b'))
+
+	sched, err := s.SetSchedule(ctx, owner, vm.ID, BackupScheduleRequest{Hour: 3, KeepDaily: 1})
+	if err != nil {
+		t.Fatalf("set schedule: %v", err)
+	}
+	if !sched.Enabled || sched.FullEvery != defaultFullEvery || sched.NextRunAt.Hour() != 3 || !sched.NextRunAt.After(time.Now()) {
+		t.Fatalf("unexpected schedule %+v", sched)
+	}
+	if _, err := s.GetSchedule(ctx, Principal{UserID: 2}, vm.ID); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("get by other user = %v, want ErrVMNotFound", err)
+	}
+
+	// A manual backup is never pruned.
+	manual := runBackup(t, s, tasks, BackupCreateRequest{VMID: vm.ID})
+
+	runScheduled := func(now time.Time) {
+		t.Helper()
+		n, err := s.runDue(ctx, now)
+		if err != nil || n != 1 {
+			t.Fatalf("run due = %d, %v; want 1 queued", n, err)
+		}
+		if n, _ := s.runDue(ctx, now); n != 0 {
+			t.Fatalf("schedule queued twice")
+		}
+		var task model.Task
+		s.db.Where("type = ?", TaskVMBackup).Order("id DESC").First(&task)
+		if done := waitTask(t, tasks, owner, task.ID); done.Status != model.TaskStatusSucceeded {
+			t.Fatalf("scheduled backup %s: %s", done.Status, done.Error)
+		}
+	}
+	runScheduled(sched.NextRunAt)
+	// Pretend the first scheduled backup was taken a day earlier, so that
+	// keeping one day prunes it.
+	s.db.Model(&model.Backup{}).Where("scheduled = ?", true).Update("created_at", time.Now().AddDate(0, 0, -1))
+	runScheduled(sched.NextRunAt.AddDate(0, 0, 1))
+
+	backups, _ := s.ListBackups(ctx, owner, &vm.ID)
+	if len(backups) != 2 || backups[1].ID != manual.ID || !backups[0].Scheduled {
+		t.Fatalf("unexpected backups after pruning %+v", backups)
+	}
+
+	if err := s.DeleteSchedule(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("delete schedule: %v", err)
+	}
+	if _, err := s.GetSchedule(ctx, owner, vm.ID); !errors.Is(err, ErrScheduleNotFound) {
+		t.Fatalf("get deleted schedule = %v, want ErrScheduleNotFound", err)
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+// BandwidthRequest sets the port speed of a VM in Mbps; zero lifts the
+// limit in that direction.
+type BandwidthRequest struct {
+	InboundMbps  int `json:"inbound_mbps" binding:"min=0,max=100000"`
+	OutboundMbps int `json:"outbound_mbps" binding:"min=0,max=100000"`
+}
+
+// SetBandwidth changes a VM's limits, such as when its owner upgrades.
+// The driver applies them to the guest in place, running or not; the new
+// limits are only stored if it did.
+func (s *VMService) SetBandwidth(ctx context.Context, p Principal, id uint, req BandwidthRequest) (*model.VM, error) {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, id)
+	if err != nil {
+		return nil, err
+	}
+	bs, ok := hv.(hypervisor.BandwidthSupport)
+	if !ok {
+		return nil, hypervisor.ErrBandwidthUnsupported
+	}
+	// Until it is created the guest has nothing to apply limits to; a VM
+	// being deleted keeps the ones it has.
+	if vm.Status == model.VMStatusCreating || vm.Status == model.VMStatusDeleting {
+		return nil, ErrInvalidTransition
+	}
+	vm.InboundMbps, vm.OutboundMbps = req.InboundMbps, req.OutboundMbps
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		columns := map[string]interface{}{"inbound_mbps": vm.InboundMbps, "outbound_mbps": vm.OutboundMbps}
+		if err := tx.Model(vm).Updates(columns).Error; err != nil {
+			return err
+		}
+		// A VM throttled for its traffic stays throttled until the month ends.
+		bw, err := s.bandwidth(tx, vm)
+		if err != nil {
+			return err
+		}
+		return bs.SetBandwidth(ctx, vm.HypervisorID, bw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+func vmBandwidth(vm *model.VM) hypervisor.Bandwidth {
+	return hypervisor.Bandwidth{InboundMbps: vm.InboundMbps, OutboundMbps: vm.OutboundMbps}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestBandwidth(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	s.WithPlans(map[string]Plan{"basic": {InboundMbps: 100, OutboundMbps: 50}, "pro": {InboundMbps: 500}}).WithDefaultPlan("basic")
+
+	// Users cannot opt out of the operator's default limits.
+	vm, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if vm.Plan != "basic" || vm.InboundMbps != 100 || vm.OutboundMbps != 50 {
+		t.Fatalf("default plan limits not applied: %s %d/%d", vm.Plan, vm.InboundMbps, vm.OutboundMbps)
+	}
+	if got := hv.Bandwidth(vm.HypervisorID); got != (hypervisor.Bandwidth{InboundMbps: 100, OutboundMbps: 50}) {
+		t.Fatalf("guest created with %+v", got)
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	// A plan assigned by an admin brings its own limits.
+	if vm, err = s.SetPlan(ctx, Principal{Admin: true}, vm.ID, PlanRequest{Plan: "pro"}); err != nil {
+		t.Fatalf("set plan: %v", err)
+	}
+	if got := hv.Bandwidth(vm.HypervisorID); vm.InboundMbps != 500 || got != (hypervisor.Bandwidth{InboundMbps: 500}) {
+		t.Fatalf("plan limits not applied: VM %d, guest %+v", vm.InboundMbps, got)
+	}
+
+	// An upgrade applies to the running guest.
+	upgraded, err := s.SetBandwidth(ctx, owner, vm.ID, BandwidthRequest{InboundMbps: 1000})
+	if err != nil {
+		t.Fatalf("set bandwidth: %v", err)
+	}
+	if upgraded.InboundMbps != 1000 || upgraded.OutboundMbps != 0 || upgraded.Status != model.VMStatusRunning {
+		t.Fatalf("unexpected VM %+v", upgraded)
+	}
+	if got := hv.Bandwidth(vm.HypervisorID); got != (hypervisor.Bandwidth{InboundMbps: 1000}) {
+		t.Fatalf("guest has %+v", got)
+	}
+
+	// Limits the driver refused are not kept.
+	hv.Inject(hypervisor.MethodSetBandwidth, hypervisor.Fault{Err: errInjected, Times: 1})
+	if _, err := s.SetBandwidth(ctx, owner, vm.ID, BandwidthRequest{InboundMbps: 10, OutboundMbps: 10}); !errors.Is(err, errInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	var stored model.VM
+	if err := db.First(&stored, vm.ID).Error; err != nil || stored.InboundMbps != 1000 || stored.OutboundMbps != 0 {
+		t.Fatalf("stored limits %d/%d (%v)", stored.InboundMbps, stored.OutboundMbps, err)
+	}
+
+	if _, err := s.SetBandwidth(ctx, Principal{UserID: 2}, vm.ID, BandwidthRequest{}); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("expected ErrVMNotFound for another user, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"StarstreamAstra/internal/model"
+)
+
+// CapacityError reports that a node cannot take an allocation. It matches
+// ErrNoCapacity under errors.Is.
+type CapacityError struct {
+	NodeID    uint
+	Resource  string
+	Requested int
+	Available int
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("node %d has insufficient %s: requested %d, available %d",
+		e.NodeID, e.Resource, e.Requested, e.Available)
+}
+
+func (e *CapacityError) Is(target error) bool {
+	return target == ErrNoCapacity
+}
+
+// Resources is the CPU, memory and disk a VM claims on its node.
+type Resources struct {
+	CPU      int `json:"cpu"`
+	MemoryMB int `json:"memory_mb"`
+	DiskGB   int `json:"disk_gb"`
+}
+
+func (r Resources) sub(o Resources) Resources {
+	return Resources{CPU: r.CPU - o.CPU, MemoryMB: r.MemoryMB - o.MemoryMB, DiskGB: r.DiskGB - o.DiskGB}
+}
+
+func (r Resources) isZero() bool {
+	return r == Resources{}
+}
+
+func vmAllocation(vm *model.VM) Resources {
+	return Resources{CPU: vm.CPU, MemoryMB: vm.MemoryMB, DiskGB: vm.DiskGB}
+}
+
+// adjustNode applies delta to the node's allocation counters in a single
+// conditional UPDATE. Growing components must fit within the node's
+// overcommitted capacity, otherwise nothing is changed and a *CapacityError
+// is returned. Shrinking components never fail and are clamped at zero.
+func adjustNode(db *gorm.DB, nodeID uint, delta Resources) error {
+	if delta.isZero() {
+		return nil
+	}
+	q := db.Model(&model.Node{}).Where("id = ?", nodeID)
+	if delta.CPU > 0 {
+		q = q.Where("cpu_used + ? <= cpu_total * cpu_overcommit", delta.CPU)
+	}
+	if delta.MemoryMB > 0 {
+		q = q.Where("men_used + ? <= mem_total * mem_overcommit", delta.MemoryMB)
+	}
+	if delta.DiskGB > 0 {
+		q = q.Where("disk_used + ? <= disk_total", delta.DiskGB)
+	}
+	result := q.Updates(map[string]interface{}{
+		"cpu_used":  counterExpr("cpu_used", delta.CPU),
+		"men_used":  counterExpr("men_used", delta.MemoryMB),
+		"disk_used": counterExpr("disk_used", delta.DiskGB),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 1 {
+		return nil
+	}
+	return capacityError(db, nodeID, delta)
+}
+
+func counterExpr(column string, delta int) clause.Expr {
+	if delta >= 0 {
+		return gorm.Expr(column+" + ?", delta)
+	}
+	return gorm.Expr("CASE WHEN "+column+" > ? THEN "+column+" - ? ELSE 0 END", -delta, -delta)
+}
+
+// capacityError works out which resource made adjustNode refuse delta.
+func capacityError(db *gorm.DB, nodeID uint, delta Resources) error {
+	var node model.Node
+	if err := db.First(&node, nodeID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNodeNotFound
+		}
+		return err
+	}
+	switch {
+	case delta.CPU > 0 && node.CPUUsed+delta.CPU > node.CPUCapacity():
+		return &CapacityError{NodeID: nodeID, Resource: "cpu", Requested: delta.CPU, Available: node.CPUCapacity() - node.CPUUsed}
+	case delta.MemoryMB > 0 && node.MenUsed+delta.MemoryMB > node.MemCapacity():
+		return &CapacityError{NodeID: nodeID, Resource: "memory", Requested: delta.MemoryMB, Available: node.MemCapacity() - node.MenUsed}
+	default:
+		return &CapacityError{NodeID: nodeID, Resource: "disk", Requested: delta.DiskGB, Available: node.DiskTotal - node.DiskUsed}
+	}
+}
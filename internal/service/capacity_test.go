@@ -0,0 +1,80 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestSchedulerHonoursOvercommit(t *testing.T) {
+	db := newTestDB(t)
+	node := createTestNode(t, db, "n1", 4, 4096, 100)
+	sched, _ := NewScheduler(db, PolicySpread)
+	res := Resources{CPU: 6, MemoryMB: 1024, DiskGB: 10}
+
+	if _, err := sched.Reserve(ctx, res); !errors.Is(err, ErrNoCapacity) {
+		t.Fatalf("reserve without overcommit = %v, want ErrNoCapacity", err)
+	}
+	if _, err := NewNodeService(db).SetOvercommit(ctx, node.ID, NodeOvercommitRequest{CPUOvercommit: 2, MemOvercommit: 1}); err != nil {
+		t.Fatalf("set overcommit: %v", err)
+	}
+	if _, err := sched.Reserve(ctx, res); err != nil {
+		t.Fatalf("reserve with 2x cpu overcommit: %v", err)
+	}
+	if got := reloadNode(t, db, node.ID); got.CPUUsed != 6 {
+		t.Fatalf("cpu_used = %d, want 6", got.CPUUsed)
+	}
+}
+
+func newScheduledVMService(t *testing.T, cpu, memMB, diskGB int) (*VMService, *hypervisor.FakeHypervisor, *model.Node) {
+	t.Helper()
+	db := newTestDB(t)
+	node := createTestNode(t, db, "n1", cpu, memMB, diskGB)
+	hv := hypervisor.NewFakeHypervisor()
+	sched, _ := NewScheduler(db, PolicySpread)
+	return NewVMService(db, nil).WithScheduler(sched, fakeNodeHypervisors{node.ID: hv}), hv, node
+}
+
+func TestVMServiceResizeAccounting(t *testing.T) {
+	s, _, node := newScheduledVMService(t, 4, 4096, 100)
+	vm := createTestVM(t, s)
+
+	if err := s.ResizeVM(ctx, owner, vm.ID, hypervisor.VMConfig{CPU: 4, MemoryMB: 1024, DiskGB: 40}); err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	got := reloadNode(t, s.db, node.ID)
+	if got.CPUUsed != 4 || got.MenUsed != 1024 || got.DiskUsed != 40 {
+		t.Fatalf("counters after resize: %+v", got)
+	}
+
+	err := s.ResizeVM(ctx, owner, vm.ID, hypervisor.VMConfig{CPU: 4, MemoryMB: 8192, DiskGB: 40})
+	var capErr *CapacityError
+	if !errors.As(err, &capErr) || capErr.Resource != "memory" || capErr.Available != 3072 {
+		t.Fatalf("oversized resize = %v, want memory CapacityError", err)
+	}
+	if !errors.Is(err, ErrNoCapacity) {
+		t.Fatal("CapacityError should match ErrNoCapacity")
+	}
+	if got := reloadNode(t, s.db, node.ID); got.MenUsed != 1024 {
+		t.Fatalf("refused resize changed counters: %+v", got)
+	}
+	if cur, _ := s.GetVMByID(ctx, owner, vm.ID); cur.MemoryMB != 1024 {
+		t.Fatalf("refused resize changed vm: %+v", cur)
+	}
+}
+
+func TestVMServiceResizeFailureRestoresCounters(t *testing.T) {
+	s, hv, node := newScheduledVMService(t, 8, 8192, 100)
+	vm := createTestVM(t, s)
+	hv.Inject(hypervisor.MethodResizeVM, hypervisor.Fault{Err: errInjected})
+
+	if err := s.ResizeVM(ctx, owner, vm.ID, hypervisor.VMConfig{CPU: 6, MemoryMB: 4096, DiskGB: 50}); !errors.Is(err, errInjected) {
+		t.Fatalf("resize = %v, want injected error", err)
+	}
+	got := reloadNode(t, s.db, node.ID)
+	if got.CPUUsed != vm.CPU || got.MenUsed != vm.MemoryMB || got.DiskUsed != vm.DiskGB {
+		t.Fatalf("counters not restored: %+v", got)
+	}
+}
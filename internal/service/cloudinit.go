@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	"StarstreamAstra/internal/cloudinit"
+)
+
+// cloudInitFor builds the first-boot configuration for the VM called name.
+// VMs from an image always get one so the guest learns its hostname; blank
+// disks only when setup asks for something. Keys on file are looked up
+// among p's own. The password is hashed here so it is never persisted or
+// sent to a node in the clear.
+func (s *VMService) cloudInitFor(ctx context.Context, p Principal, name string, imageID *uint, setup GuestSetup) (*cloudinit.Config, error) {
+	if imageID == nil && setup.isZero() {
+		return nil, nil
+	}
+	ci := &cloudinit.Config{Hostname: setup.Hostname}
+	if ci.Hostname == "" {
+		ci.Hostname = hostnameFromName(name)
+	}
+	stored, err := NewSSHKeyService(s.db).AuthorizedKeys(ctx, p, setup.SSHKeyIDs)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, line := range append(stored, setup.SSHKeys...) {
+		pub, comment, err := parseSSHKey(line)
+		if err != nil {
+			return nil, err
+		}
+		if blob := string(pub.Marshal()); !seen[blob] {
+			seen[blob] = true
+			ci.SSHKeys = append(ci.SSHKeys, authorizedKey(pub, comment))
+		}
+	}
+	if setup.RootPassword != "" {
+		hash, err := cloudinit.HashPassword(setup.RootPassword)
+		if err != nil {
+			return nil, err
+		}
+		ci.PasswordHash = hash
+	}
+	return ci, nil
+}
+
+// hostnameFromName turns a VM name into a valid host name label.
+func hostnameFromName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	host := b.String()
+	if len(host) > 63 {
+		host = host[:63]
+	}
+	host = strings.Trim(host, "-")
+	if host == "" {
+		return "vm"
+	}
+	return host
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"StarstreamAstra/internal/model"
+)
+
+const testSSHKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHjWQbW6LUNs5U9HVR9L8c1ObBbsmmB1TeuuT7BUgL8J alice@laptop"
+
+func TestVMServiceCreateWithCloudInit(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+
+	vm, err := s.CreateVM(ctx, owner, VMCreateRequest{
+		Name: "Web Server #1", CPU: 1, MemoryMB: 512, DiskGB: 10,
+		GuestSetup: GuestSetup{RootPassword: "correct horse", SSHKeys: []string{testSSHKey}},
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	ci, ok := hv.Seed(vm.HypervisorID)
+	if !ok {
+		t.Fatal("guest created without a cloud-init seed")
+	}
+	if ci.Hostname != "web-server-1" || ci.InstanceID != vm.HypervisorID {
+		t.Fatalf("unexpected seed %+v", ci)
+	}
+	if !strings.HasPrefix(ci.PasswordHash, "$6$") || strings.Contains(ci.PasswordHash, "correct horse") {
+		t.Fatalf("password not hashed: %q", ci.PasswordHash)
+	}
+	if len(ci.SSHKeys) != 1 || ci.SSHKeys[0] != testSSHKey {
+		t.Fatalf("unexpected keys %q", ci.SSHKeys)
+	}
+
+	plain, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "blank", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, ok := hv.Seed(plain.HypervisorID); ok {
+		t.Fatal("blank VM without cloud-init fields should not get a seed")
+	}
+}
+
+func TestVMServiceCreateRejectsBadSSHKey(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	_, err := s.CreateVMAsync(ctx, owner, VMCreateRequest{
+		Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10, GuestSetup: GuestSetup{SSHKeys: []string{"ssh-rsa not-base64"}},
+	})
+	if !errors.Is(err, ErrInvalidSSHKey) {
+		t.Fatalf("expected ErrInvalidSSHKey, got %v", err)
+	}
+	var n int64
+	db.Model(&model.VM{}).Count(&n)
+	if n != 0 || hv.Count() != 0 {
+		t.Fatalf("rejected request left %d VMs and %d guests", n, hv.Count())
+	}
+}
+
+func TestHostnameFromName(t *testing.T) {
+	for name, want := range map[string]string{
+		"web":                   "web",
+		"Web Server #1":         "web-server-1",
+		"--db--":                "db",
+		"日本":                    "vm",
+		strings.Repeat("a", 70): strings.Repeat("a", 63),
+	} {
+		if got := hostnameFromName(name); got != want {
+			t.Errorf("hostnameFromName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
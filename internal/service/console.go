@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+var ErrConsoleTokenInvalid = errors.New("console token is invalid, expired or already used")
+
+// ConsoleService hands out one-time tokens for VM consoles and redeems them
+// for a connection to the guest's VNC server. Tokens live in the database,
+// so any master can redeem a token another one issued.
+type ConsoleService struct {
+	db         *gorm.DB
+	vms        *VMService
+	tokenTTL   time.Duration
+	sessionTTL time.Duration
+}
+
+// NewConsoleService issues tokens that must be redeemed within tokenTTL
+// for sessions that are cut after sessionTTL.
+func NewConsoleService(db *gorm.DB, vms *VMService, tokenTTL, sessionTTL time.Duration) *ConsoleService {
+	return &ConsoleService{db: db, vms: vms, tokenTTL: tokenTTL, sessionTTL: sessionTTL}
+}
+
+// ConsoleTicket is handed to the user to open a console with.
+type ConsoleTicket struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ConsoleSession is a redeemed token: an open RFB stream to the guest that
+// must be closed by Deadline.
+type ConsoleSession struct {
+	VM       *model.VM
+	Conn     io.ReadWriteCloser
+	Deadline time.Time
+}
+
+// IssueToken returns a token for the console of a running VM owned by p.
+func (s *ConsoleService) IssueToken(ctx context.Context, p Principal, vmID uint) (*ConsoleTicket, error) {
+	vm, hv, err := s.vms.vmAndHypervisor(ctx, p, vmID)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Status != model.VMStatusRunning {
+		return nil, hypervisor.ErrVMNotRunning
+	}
+	if _, ok := hv.(hypervisor.ConsoleSupport); !ok {
+		return nil, hypervisor.ErrConsoleUnsupported
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+	row := &model.ConsoleToken{
+		TokenHash: consoleTokenHash(token),
+		VMID:      vm.ID,
+		UserID:    p.UserID,
+		ExpiresAt: now.Add(s.tokenTTL),
+	}
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Expired tokens are of no further use; clear them as we go.
+		if err := tx.Where("expires_at < ?", now).Delete(&model.ConsoleToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(row).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ConsoleTicket{Token: token, ExpiresAt: row.ExpiresAt}, nil
+}
+
+// OpenSession spends token and connects to the console of its VM. The
+// token was checked against the VM's owner when it was issued.
+func (s *ConsoleService) OpenSession(ctx context.Context, token string) (*ConsoleSession, error) {
+	if token == "" {
+		return nil, ErrConsoleTokenInvalid
+	}
+	hash := consoleTokenHash(token)
+	now := time.Now()
+	res := s.db.WithContext(ctx).Model(&model.ConsoleToken{}).
+		Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hash, now).
+		Update("used_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrConsoleTokenInvalid
+	}
+	var row model.ConsoleToken
+	if err := s.db.WithContext(ctx).Where("token_hash = ?", hash).First(&row).Error; err != nil {
+		return nil, err
+	}
+
+	var vm model.VM
+	if err := s.db.WithContext(ctx).First(&vm, row.VMID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrVMNotFound
+		}
+		return nil, err
+	}
+	if vm.Status != model.VMStatusRunning {
+		return nil, hypervisor.ErrVMNotRunning
+	}
+	hv, err := s.vms.hypervisorFor(ctx, &vm)
+	if err != nil {
+		return nil, err
+	}
+	cs, ok := hv.(hypervisor.ConsoleSupport)
+	if !ok {
+		return nil, hypervisor.ErrConsoleUnsupported
+	}
+	conn, err := cs.OpenConsole(ctx, vm.HypervisorID)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsoleSession{VM: &vm, Conn: conn, Deadline: now.Add(s.sessionTTL)}, nil
+}
+
+func consoleTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestConsoleTokens(t *testing.T) {
+	s, _, db := newTestVMService(t)
+	consoles := NewConsoleService(db, s, time.Minute, time.Hour)
+	vm := createTestVM(t, s)
+
+	if _, err := consoles.IssueToken(ctx, owner, vm.ID); !errors.Is(err, hypervisor.ErrVMNotRunning) {
+		t.Fatalf("issue for stopped vm = %v, want ErrVMNotRunning", err)
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if _, err := consoles.IssueToken(ctx, Principal{UserID: 2}, vm.ID); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("issue by other user = %v, want ErrVMNotFound", err)
+	}
+
+	ticket, err := consoles.IssueToken(ctx, owner, vm.ID)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	var row model.ConsoleToken
+	db.First(&row)
+	if row.TokenHash == ticket.Token || row.TokenHash != consoleTokenHash(ticket.Token) {
+		t.Fatal("token not stored hashed")
+	}
+	session, err := consoles.OpenSession(ctx, ticket.Token)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	session.Conn.Close()
+	if session.VM.ID != vm.ID || time.Until(session.Deadline) < 59*time.Minute {
+		t.Fatalf("unexpected session %+v", session)
+	}
+	if _, err := consoles.OpenSession(ctx, ticket.Token); !errors.Is(err, ErrConsoleTokenInvalid) {
+		t.Fatalf("reuse = %v, want ErrConsoleTokenInvalid", err)
+	}
+
+	expired, err := consoles.IssueToken(ctx, owner, vm.ID)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	db.Model(&model.ConsoleToken{}).Where("token_hash = ?", consoleTokenHash(expired.Token)).
+		Update("expires_at", time.Now().Add(-time.Second))
+	if _, err := consoles.OpenSession(ctx, expired.Token); !errors.Is(err, ErrConsoleTokenInvalid) {
+		t.Fatalf("expired token = %v, want ErrConsoleTokenInvalid", err)
+	}
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+var (
+	ErrImageNotFound = errors.New("image not found")
+	ErrImageExists   = errors.New("an image with this name already exists")
+	ErrImageInUse    = errors.New("image is used by existing VMs")
+	ErrImageTooSmall = errors.New("VM is smaller than the image requires")
+)
+
+type ImageService struct {
+	db *gorm.DB
+}
+
+func NewImageService(db *gorm.DB) *ImageService {
+	return &ImageService{db: db}
+}
+
+type ImageCreateRequest struct {
+	Name        string `json:"name" binding:"required,max=64"`
+	OSType      string `json:"os_type" binding:"omitempty,oneof=linux windows"`
+	Version     string `json:"version"`
+	Arch        string `json:"arch" binding:"omitempty,oneof=x86_64 aarch64"`
+	SourceURL   string `json:"source_url" binding:"required"`
+	SHA256      string `json:"sha256" binding:"required,len=64,hexadecimal"`
+	MinDiskGB   int    `json:"min_disk_gb" binding:"gte=0"`
+	MinMemoryMB int    `json:"min_memory_mb" binding:"gte=0"`
+	Description string `json:"description"`
+}
+
+// ImageUpdateRequest changes only the fields that are set.
+type ImageUpdateRequest struct {
+	Name        *string `json:"name" binding:"omitempty,max=64"`
+	Version     *string `json:"version"`
+	SourceURL   *string `json:"source_url"`
+	SHA256      *string `json:"sha256" binding:"omitempty,len=64,hexadecimal"`
+	MinDiskGB   *int    `json:"min_disk_gb" binding:"omitempty,gte=0"`
+	MinMemoryMB *int    `json:"min_memory_mb" binding:"omitempty,gte=0"`
+	Status      *string `json:"status" binding:"omitempty,oneof=active disabled"`
+	Description *string `json:"description"`
+}
+
+func (s *ImageService) CreateImage(ctx context.Context, req ImageCreateRequest) (*model.Image, error) {
+	img := &model.Image{
+		Name:        req.Name,
+		OSType:      req.OSType,
+		Version:     req.Version,
+		Arch:        req.Arch,
+		SourceURL:   req.SourceURL,
+		SHA256:      strings.ToLower(req.SHA256),
+		MinDiskGB:   req.MinDiskGB,
+		MinMemoryMB: req.MinMemoryMB,
+		Status:      model.ImageStatusActive,
+		Description: req.Description,
+	}
+	if img.OSType == "" {
+		img.OSType = "linux"
+	}
+	if img.Arch == "" {
+		img.Arch = "x86_64"
+	}
+	if err := s.checkName(ctx, img.Name, 0); err != nil {
+		return nil, err
+	}
+	if err := s.db.WithContext(ctx).Create(img).Error; err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func (s *ImageService) UpdateImage(ctx context.Context, id uint, req ImageUpdateRequest) (*model.Image, error) {
+	if _, err := s.GetImage(ctx, id, true); err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{}
+	if req.Name != nil {
+		if err := s.checkName(ctx, *req.Name, id); err != nil {
+			return nil, err
+		}
+		updates["name"] = *req.Name
+	}
+	if req.Version != nil {
+		updates["version"] = *req.Version
+	}
+	if req.SourceURL != nil {
+		updates["source_url"] = *req.SourceURL
+	}
+	if req.SHA256 != nil {
+		updates["sha256"] = strings.ToLower(*req.SHA256)
+	}
+	if req.MinDiskGB != nil {
+		updates["min_disk_gb"] = *req.MinDiskGB
+	}
+	if req.MinMemoryMB != nil {
+		updates["min_memory_mb"] = *req.MinMemoryMB
+	}
+	if req.Status != nil {
+		updates["status"] = *req.Status
+	}
+	if req.Description != nil {
+		updates["description"] = *req.Description
+	}
+	if len(updates) > 0 {
+		if err := s.db.WithContext(ctx).Model(&model.Image{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+	return s.GetImage(ctx, id, true)
+}
+
+// DeleteImage removes an image from the catalog. Images still referenced by
+// VMs can only be disabled.
+func (s *ImageService) DeleteImage(ctx context.Context, id uint) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var inUse int64
+		if err := tx.Model(&model.VM{}).Where("image_id = ?", id).Count(&inUse).Error; err != nil {
+			return err
+		}
+		if inUse > 0 {
+			return ErrImageInUse
+		}
+		res := tx.Delete(&model.Image{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrImageNotFound
+		}
+		return nil
+	})
+}
+
+// ListImages returns the catalog; disabled images only when withDisabled.
+func (s *ImageService) ListImages(ctx context.Context, withDisabled bool) ([]*model.Image, error) {
+	q := s.db.WithContext(ctx).Order("name")
+	if !withDisabled {
+		q = q.Where("status = ?", model.ImageStatusActive)
+	}
+	var images []*model.Image
+	if err := q.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (s *ImageService) GetImage(ctx context.Context, id uint, withDisabled bool) (*model.Image, error) {
+	q := s.db.WithContext(ctx)
+	if !withDisabled {
+		q = q.Where("status = ?", model.ImageStatusActive)
+	}
+	var img model.Image
+	if err := q.First(&img, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrImageNotFound
+		}
+		return nil, err
+	}
+	return &img, nil
+}
+
+func (s *ImageService) checkName(ctx context.Context, name string, exceptID uint) error {
+	var n int64
+	if err := s.db.WithContext(ctx).Model(&model.Image{}).Where("name = ? AND id <> ?", name, exceptID).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrImageExists
+	}
+	return nil
+}
+
+// checkImageFits verifies that a VM of the requested size can run img.
+func checkImageFits(img *model.Image, memoryMB, diskGB int) error {
+	if diskGB < img.MinDiskGB {
+		return fmt.Errorf("%w: %s needs %d GB of disk", ErrImageTooSmall, img.Name, img.MinDiskGB)
+	}
+	if memoryMB < img.MinMemoryMB {
+		return fmt.Errorf("%w: %s needs %d MB of memory", ErrImageTooSmall, img.Name, img.MinMemoryMB)
+	}
+	return nil
+}
+
+func imageSpec(img *model.Image) *hypervisor.ImageSpec {
+	return &hypervisor.ImageSpec{Name: img.Name, Source: img.SourceURL, SHA256: img.SHA256}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"StarstreamAstra/internal/model"
+)
+
+func createTestImage(t *testing.T, s *ImageService, name string) *model.Image {
+	t.Helper()
+	img, err := s.CreateImage(ctx, ImageCreateRequest{
+		Name:        name,
+		SourceURL:   "https://images.example.com/" + name + ".qcow2",
+		SHA256:      strings.Repeat("AB", 32),
+		MinDiskGB:   10,
+		MinMemoryMB: 512,
+	})
+	if err != nil {
+		t.Fatalf("create image: %v", err)
+	}
+	return img
+}
+
+func TestImageServiceCatalog(t *testing.T) {
+	s := NewImageService(newTestDB(t))
+	img := createTestImage(t, s, "debian-12")
+	if img.OSType != "linux" || img.Arch != "x86_64" || img.SHA256 != strings.Repeat("ab", 32) {
+		t.Fatalf("unexpected image %+v", img)
+	}
+	if _, err := s.CreateImage(ctx, ImageCreateRequest{Name: "debian-12", SourceURL: "x", SHA256: img.SHA256}); !errors.Is(err, ErrImageExists) {
+		t.Fatalf("expected ErrImageExists, got %v", err)
+	}
+
+	disabled := model.ImageStatusDisabled
+	if _, err := s.UpdateImage(ctx, img.ID, ImageUpdateRequest{Status: &disabled}); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	if images, _ := s.ListImages(ctx, false); len(images) != 0 {
+		t.Fatalf("disabled image listed for users: %+v", images)
+	}
+	if _, err := s.GetImage(ctx, img.ID, false); !errors.Is(err, ErrImageNotFound) {
+		t.Fatalf("expected disabled image hidden, got %v", err)
+	}
+	if images, _ := s.ListImages(ctx, true); len(images) != 1 {
+		t.Fatalf("admin sees %d images, want 1", len(images))
+	}
+
+	if err := s.DeleteImage(ctx, img.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := s.DeleteImage(ctx, img.ID); !errors.Is(err, ErrImageNotFound) {
+		t.Fatalf("expected ErrImageNotFound, got %v", err)
+	}
+}
+
+func TestVMServiceCreateFromImage(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	images := NewImageService(db)
+	img := createTestImage(t, images, "ubuntu-24.04")
+
+	vm, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 20, ImageID: &img.ID})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if vm.ImageID == nil || *vm.ImageID != img.ID {
+		t.Fatalf("image not recorded on vm: %+v", vm)
+	}
+	if info, _ := hv.VM(vm.HypervisorID); info.Image != "ubuntu-24.04" {
+		t.Fatalf("guest not cloned from image: %+v", info)
+	}
+	if err := images.DeleteImage(ctx, img.ID); !errors.Is(err, ErrImageInUse) {
+		t.Fatalf("expected ErrImageInUse, got %v", err)
+	}
+
+	_, err = s.CreateVM(ctx, owner, VMCreateRequest{Name: "tiny", CPU: 1, MemoryMB: 1024, DiskGB: 5, ImageID: &img.ID})
+	if !errors.Is(err, ErrImageTooSmall) {
+		t.Fatalf("expected ErrImageTooSmall, got %v", err)
+	}
+	missing := uint(999)
+	if _, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "x", CPU: 1, MemoryMB: 1024, DiskGB: 20, ImageID: &missing}); !errors.Is(err, ErrImageNotFound) {
+		t.Fatalf("expected ErrImageNotFound, got %v", err)
+	}
+	if hv.Count() != 1 {
+		t.Fatalf("rejected requests created guests: %d", hv.Count())
+	}
+}
@@ -0,0 +1,428 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/cloudinit"
+	"StarstreamAstra/internal/model"
+)
+
+var (
+	ErrInvalidPool   = errors.New("invalid IP pool")
+	ErrPoolNotFound  = errors.New("IP pool not found")
+	ErrPoolExists    = errors.New("an IP pool with this name already exists")
+	ErrPoolInUse     = errors.New("IP pool has addresses in use")
+	ErrPoolExhausted = errors.New("no free address left in the IP pools")
+)
+
+// IPAMService manages the pools VM addresses come from. Each new VM gets
+// one address of each family that has a pool for its node; an address a
+// deleted VM gave back is quarantined for the configured time before it
+// is handed out again.
+type IPAMService struct {
+	db         *gorm.DB
+	quarantine time.Duration
+}
+
+func NewIPAMService(db *gorm.DB, quarantine time.Duration) *IPAMService {
+	return &IPAMService{db: db, quarantine: quarantine}
+}
+
+// WithIPAM gives new VMs addresses from the pools of ipam.
+func (s *VMService) WithIPAM(ipam *IPAMService) *VMService {
+	s.ipam = ipam
+	return s
+}
+
+// IPPoolRequest creates a pool. The family follows from the CIDR. IPv6
+// pools assign /64 prefixes unless AssignPrefixLen says otherwise. NodeID
+// and Region are exclusive; a pool with neither serves every VM. NAT pools
+// only serve NAT VMs.
+type IPPoolRequest struct {
+	Name            string   `json:"name" binding:"required,max=64"`
+	CIDR            string   `json:"cidr" binding:"required"`
+	Gateway         string   `json:"gateway"`
+	AssignPrefixLen int      `json:"assign_prefix_len" binding:"omitempty,min=1,max=128"`
+	NodeID          *uint    `json:"node_id"`
+	Region          string   `json:"region" binding:"max=64"`
+	Exclude         []string `json:"exclude" binding:"max=256"`
+	Nameservers     []string `json:"nameservers" binding:"max=8"`
+	NAT             bool     `json:"nat"`
+}
+
+// IPPoolUsage is a pool with counts of its addresses. Total leaves out the
+// network, broadcast and gateway addresses and the exclusions.
+type IPPoolUsage struct {
+	*model.IPPool
+	Total       uint64 `json:"total"`
+	Allocated   int64  `json:"allocated"`
+	Quarantined int64  `json:"quarantined"`
+	Free        uint64 `json:"free"`
+}
+
+// IPPoolDetail is a pool with its usage and the addresses taken from it.
+type IPPoolDetail struct {
+	IPPoolUsage
+	Addresses []*model.IPAddress `json:"addresses"`
+}
+
+func (s *IPAMService) CreatePool(ctx context.Context, req IPPoolRequest) (*model.IPPool, error) {
+	if req.NodeID != nil && req.Region != "" {
+		return nil, fmt.Errorf("%w: a pool belongs to a node or to a region, not both", ErrInvalidPool)
+	}
+	for _, ns := range req.Nameservers {
+		if _, err := netip.ParseAddr(strings.TrimSpace(ns)); err != nil {
+			return nil, fmt.Errorf("%w: nameserver %q is not an address", ErrInvalidPool, ns)
+		}
+	}
+	pool := &model.IPPool{
+		Name:            req.Name,
+		CIDR:            req.CIDR,
+		Gateway:         req.Gateway,
+		AssignPrefixLen: req.AssignPrefixLen,
+		NodeID:          req.NodeID,
+		Region:          req.Region,
+		NAT:             req.NAT,
+		Exclude:         strings.Join(req.Exclude, ","),
+		Nameservers:     strings.Join(req.Nameservers, ","),
+	}
+	if _, err := parsePool(pool); err != nil {
+		return nil, err
+	}
+	db := s.db.WithContext(ctx)
+	if req.NodeID != nil {
+		if err := db.First(&model.Node{}, *req.NodeID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrNodeNotFound
+			}
+			return nil, err
+		}
+	}
+	var n int64
+	if err := db.Model(&model.IPPool{}).Where("name = ?", req.Name).Count(&n).Error; err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, ErrPoolExists
+	}
+	if err := db.Create(pool).Error; err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func (s *IPAMService) ListPools(ctx context.Context) ([]*IPPoolUsage, error) {
+	var pools []*model.IPPool
+	if err := s.db.WithContext(ctx).Order("id").Find(&pools).Error; err != nil {
+		return nil, err
+	}
+	out := make([]*IPPoolUsage, 0, len(pools))
+	for _, pool := range pools {
+		usage, err := s.usage(ctx, pool)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, usage)
+	}
+	return out, nil
+}
+
+func (s *IPAMService) GetPool(ctx context.Context, id uint) (*IPPoolDetail, error) {
+	pool, err := s.pool(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := s.usage(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	detail := &IPPoolDetail{IPPoolUsage: *usage}
+	if err := s.db.WithContext(ctx).Where("pool_id = ?", id).Order("id").Find(&detail.Addresses).Error; err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+// DeletePool removes a pool no VM has an address from. Quarantined
+// addresses go with it.
+func (s *IPAMService) DeletePool(ctx context.Context, id uint) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var pool model.IPPool
+		if err := tx.First(&pool, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrPoolNotFound
+			}
+			return err
+		}
+		var inUse int64
+		if err := tx.Model(&model.IPAddress{}).Where("pool_id = ? AND status = ?", id, model.IPStatusAllocated).Count(&inUse).Error; err != nil {
+			return err
+		}
+		if inUse > 0 {
+			return ErrPoolInUse
+		}
+		if err := tx.Where("pool_id = ?", id).Delete(&model.IPAddress{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&pool).Error
+	})
+}
+
+func (s *IPAMService) pool(ctx context.Context, id uint) (*model.IPPool, error) {
+	var pool model.IPPool
+	if err := s.db.WithContext(ctx).First(&pool, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPoolNotFound
+		}
+		return nil, err
+	}
+	return &pool, nil
+}
+
+func (s *IPAMService) usage(ctx context.Context, pool *model.IPPool) (*IPPoolUsage, error) {
+	r, err := parsePool(pool)
+	if err != nil {
+		return nil, err
+	}
+	var counts []struct {
+		Status string
+		N      int64
+	}
+	err = s.db.WithContext(ctx).Model(&model.IPAddress{}).Select("status, COUNT(*) AS n").
+		Where("pool_id = ?", pool.ID).Group("status").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	usage := &IPPoolUsage{IPPool: pool, Total: r.usable()}
+	for _, c := range counts {
+		switch c.Status {
+		case model.IPStatusAllocated:
+			usage.Allocated = c.N
+		case model.IPStatusQuarantined:
+			usage.Quarantined = c.N
+		}
+	}
+	if taken := uint64(usage.Allocated + usage.Quarantined); taken < usage.Total {
+		usage.Free = usage.Total - taken
+	}
+	return usage, nil
+}
+
+// ipLease is an address a VM holds and the pool it came from.
+type ipLease struct {
+	Pool    *model.IPPool
+	Address *model.IPAddress
+}
+
+func (l ipLease) cidr() string {
+	return fmt.Sprintf("%s/%d", l.Address.Address, l.Address.PrefixLen)
+}
+
+// allocate gives the VM vmID, placed on node, an address of each family
+// from the most specific pool with one free: the node's own pools, then
+// its region's, then the global ones. NAT VMs only use NAT pools and other
+// VMs only the others. Families without a pool are skipped.
+// Addresses the VM already holds, from an earlier attempt, are kept. On
+// error the leases taken so far are returned with it.
+func (s *IPAMService) allocate(ctx context.Context, vmID uint, node *model.Node, natMode bool) ([]ipLease, error) {
+	leases, err := s.leases(ctx, vmID)
+	if err != nil {
+		return nil, err
+	}
+	held := map[int]bool{}
+	for _, l := range leases {
+		held[l.Pool.Family] = true
+	}
+	for _, family := range []int{4, 6} {
+		if held[family] {
+			continue
+		}
+		pools, err := s.poolsFor(ctx, family, node, natMode)
+		if err != nil {
+			return leases, err
+		}
+		if len(pools) == 0 {
+			continue
+		}
+		var lease *ipLease
+		for _, pool := range pools {
+			addr, err := s.allocateFrom(ctx, pool, vmID)
+			if err != nil {
+				return leases, err
+			}
+			if addr != nil {
+				lease = &ipLease{Pool: pool, Address: addr}
+				break
+			}
+		}
+		if lease == nil {
+			return leases, fmt.Errorf("%w: IPv%d", ErrPoolExhausted, family)
+		}
+		leases = append(leases, *lease)
+	}
+	return leases, nil
+}
+
+// poolsFor returns the pools of family that serve node, most specific
+// first.
+func (s *IPAMService) poolsFor(ctx context.Context, family int, node *model.Node, natMode bool) ([]*model.IPPool, error) {
+	return servingPools(s.db.WithContext(ctx).Where("family = ? AND nat = ?", family, natMode), node)
+}
+
+// servingPools returns the pools found by query that serve node, most
+// specific first. VMs without a node only use global pools.
+func servingPools(query *gorm.DB, node *model.Node) ([]*model.IPPool, error) {
+	var pools []*model.IPPool
+	if err := query.Order("id").Find(&pools).Error; err != nil {
+		return nil, err
+	}
+	rank := func(pool *model.IPPool) int {
+		switch {
+		case pool.NodeID == nil && pool.Region == "":
+			return 2
+		case node == nil:
+			return -1
+		case pool.NodeID != nil && *pool.NodeID == node.ID:
+			return 0
+		case pool.NodeID == nil && node.Region != "" && pool.Region == node.Region:
+			return 1
+		default:
+			return -1
+		}
+	}
+	out := pools[:0]
+	for _, pool := range pools {
+		if rank(pool) >= 0 {
+			out = append(out, pool)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return rank(out[i]) < rank(out[j]) })
+	return out, nil
+}
+
+// allocateFrom takes the lowest free address of pool for vmID, or returns
+// nil if the pool is full. Concurrent allocations may pick the same
+// address; the unique index lets one of them in and the others move on.
+func (s *IPAMService) allocateFrom(ctx context.Context, pool *model.IPPool, vmID uint) (*model.IPAddress, error) {
+	r, err := parsePool(pool)
+	if err != nil {
+		return nil, err
+	}
+	db := s.db.WithContext(ctx)
+	// Addresses whose quarantine is over are free again.
+	err = db.Where("pool_id = ? AND status = ? AND released_at < ?", pool.ID, model.IPStatusQuarantined, time.Now().Add(-s.quarantine)).
+		Delete(&model.IPAddress{}).Error
+	if err != nil {
+		return nil, err
+	}
+	var taken []string
+	if err := db.Model(&model.IPAddress{}).Where("pool_id = ?", pool.ID).Pluck("address", &taken).Error; err != nil {
+		return nil, err
+	}
+	used := make(map[uint64]bool, len(taken))
+	for _, a := range taken {
+		if addr, err := netip.ParseAddr(a); err == nil {
+			if i, ok := r.index(addr); ok {
+				used[i] = true
+			}
+		}
+	}
+	for {
+		i, ok := r.free(used)
+		if !ok {
+			return nil, nil
+		}
+		row := &model.IPAddress{
+			PoolID:    pool.ID,
+			Address:   r.addr(i).String(),
+			PrefixLen: r.prefixLen,
+			VMID:      &vmID,
+			Status:    model.IPStatusAllocated,
+		}
+		err := db.Create(row).Error
+		if err == nil {
+			return row, nil
+		}
+		var n int64
+		if cerr := db.Model(&model.IPAddress{}).Where("pool_id = ? AND address = ?", pool.ID, row.Address).Count(&n).Error; cerr != nil || n == 0 {
+			return nil, err
+		}
+		used[i] = true
+	}
+}
+
+// leases returns the addresses vmID holds.
+func (s *IPAMService) leases(ctx context.Context, vmID uint) ([]ipLease, error) {
+	var addrs []*model.IPAddress
+	err := s.db.WithContext(ctx).Where("vm_id = ? AND status = ?", vmID, model.IPStatusAllocated).Order("id").Find(&addrs).Error
+	if err != nil {
+		return nil, err
+	}
+	leases := make([]ipLease, 0, len(addrs))
+	for _, addr := range addrs {
+		pool, err := s.pool(ctx, addr.PoolID)
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, ipLease{Pool: pool, Address: addr})
+	}
+	return leases, nil
+}
+
+// leaseColumns are the VM columns that show its addresses.
+func leaseColumns(leases []ipLease) map[string]interface{} {
+	cols := map[string]interface{}{}
+	for _, l := range leases {
+		if l.Pool.Family == 6 {
+			cols["ipv6"] = l.cidr()
+		} else {
+			cols["ipv4"] = l.cidr()
+		}
+	}
+	return cols
+}
+
+// withGuestNetwork returns ci with the leased addresses configured
+// statically on the guest's first ethernet device. Without leases, or when
+// ci already carries a network, ci is returned as is.
+func withGuestNetwork(ci *cloudinit.Config, leases []ipLease) *cloudinit.Config {
+	if ci == nil || ci.Network != nil || len(leases) == 0 {
+		return ci
+	}
+	iface := cloudinit.Interface{Name: "eth0", Match: "e*"}
+	for _, l := range leases {
+		iface.Addresses = append(iface.Addresses, l.cidr())
+		if l.Pool.Family == 6 {
+			iface.Gateway6 = l.Pool.Gateway
+		} else {
+			iface.Gateway4 = l.Pool.Gateway
+		}
+		iface.Nameservers = append(iface.Nameservers, splitList(l.Pool.Nameservers)...)
+	}
+	out := *ci
+	out.Network = &cloudinit.Network{Interfaces: []cloudinit.Interface{iface}}
+	return &out
+}
+
+// releaseLeases drops the addresses of a VM that never came to be. They
+// were never in use, so they skip quarantine.
+func releaseLeases(tx *gorm.DB, vmID uint) error {
+	return tx.Where("vm_id = ? AND status = ?", vmID, model.IPStatusAllocated).Delete(&model.IPAddress{}).Error
+}
+
+// quarantineLeases takes the addresses back from a deleted VM.
+func quarantineLeases(tx *gorm.DB, vmID uint) error {
+	return tx.Model(&model.IPAddress{}).Where("vm_id = ?", vmID).Updates(map[string]interface{}{
+		"vm_id":       nil,
+		"status":      model.IPStatusQuarantined,
+		"released_at": time.Now(),
+	}).Error
+}
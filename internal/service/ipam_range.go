@@ -0,0 +1,239 @@
+package service
+
+import (
+	"fmt"
+	"math/big"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"StarstreamAstra/internal/model"
+)
+
+// maxPoolBits caps a pool at 2^32 assignable addresses or prefixes, which
+// keeps every index in a uint64 and a whole IPv4 space within reach.
+const maxPoolBits = 32
+
+// poolRange numbers what a pool can hand out: single addresses for IPv4
+// and, for IPv6, prefixes of the pool's assign length. Index i is the i-th
+// address or prefix in the pool's CIDR.
+type poolRange struct {
+	prefix    netip.Prefix
+	shift     uint
+	size      uint64
+	prefixLen int
+	// reserved holds the indexes that are never handed out, sorted and
+	// merged: the network and broadcast addresses, the gateway and the
+	// pool's exclusions.
+	reserved []indexRange
+}
+
+type indexRange struct {
+	lo, hi uint64
+}
+
+// parsePool validates pool and fills in its family and assign length when
+// they were left out.
+func parsePool(pool *model.IPPool) (*poolRange, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(pool.CIDR))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPool, err)
+	}
+	prefix = prefix.Masked()
+	bits := prefix.Addr().BitLen()
+	family := 4
+	if bits == 128 {
+		family = 6
+	}
+	if pool.Family != 0 && pool.Family != family {
+		return nil, fmt.Errorf("%w: %s is not an IPv%d range", ErrInvalidPool, prefix, pool.Family)
+	}
+	pool.Family = family
+	pool.CIDR = prefix.String()
+
+	switch {
+	case family == 4 && pool.AssignPrefixLen == 0:
+		pool.AssignPrefixLen = 32
+	case family == 6 && pool.AssignPrefixLen == 0:
+		pool.AssignPrefixLen = 64
+	}
+	if family == 4 && pool.AssignPrefixLen != 32 {
+		return nil, fmt.Errorf("%w: IPv4 pools assign single addresses", ErrInvalidPool)
+	}
+	if pool.AssignPrefixLen < prefix.Bits() || pool.AssignPrefixLen > bits {
+		return nil, fmt.Errorf("%w: cannot assign /%d prefixes from %s", ErrInvalidPool, pool.AssignPrefixLen, prefix)
+	}
+	if pool.AssignPrefixLen-prefix.Bits() > maxPoolBits {
+		return nil, fmt.Errorf("%w: %s holds more than 2^%d /%d prefixes", ErrInvalidPool, prefix, maxPoolBits, pool.AssignPrefixLen)
+	}
+
+	r := &poolRange{
+		prefix:    prefix,
+		shift:     uint(bits - pool.AssignPrefixLen),
+		size:      1 << uint(pool.AssignPrefixLen-prefix.Bits()),
+		prefixLen: prefix.Bits(),
+	}
+	if r.shift > 0 {
+		// The VM gets the whole prefix, so its address is on a link of its own.
+		r.prefixLen = pool.AssignPrefixLen
+	}
+
+	var reserved []indexRange
+	switch {
+	case family == 4 && r.size > 2:
+		// Network and broadcast; /31 and /32 pools use every address.
+		reserved = append(reserved, indexRange{0, 0}, indexRange{r.size - 1, r.size - 1})
+	case family == 6 && r.shift == 0 && r.size > 1:
+		// The subnet-router anycast address.
+		reserved = append(reserved, indexRange{0, 0})
+	}
+	if pool.Gateway = strings.TrimSpace(pool.Gateway); pool.Gateway != "" {
+		gw, err := netip.ParseAddr(pool.Gateway)
+		if err != nil || gw.BitLen() != bits {
+			return nil, fmt.Errorf("%w: gateway %q is not an IPv%d address", ErrInvalidPool, pool.Gateway, family)
+		}
+		if ir, ok := r.indexes(gw, gw); ok {
+			reserved = append(reserved, ir)
+		}
+	}
+	for _, ex := range splitList(pool.Exclude) {
+		first, last, err := parseAddrRange(ex)
+		if err != nil || first.BitLen() != bits {
+			return nil, fmt.Errorf("%w: exclusion %q is not an IPv%d address, range or CIDR", ErrInvalidPool, ex, family)
+		}
+		if ir, ok := r.indexes(first, last); ok {
+			reserved = append(reserved, ir)
+		}
+	}
+	r.reserved = mergeRanges(reserved)
+	return r, nil
+}
+
+// indexes returns the indexes of the addresses or prefixes that overlap
+// first through last, or false if none do.
+func (r *poolRange) indexes(first, last netip.Addr) (indexRange, bool) {
+	base := addrInt(r.prefix.Addr())
+	end := new(big.Int).Lsh(new(big.Int).SetUint64(r.size), r.shift)
+	end.Add(end, base).Sub(end, big.NewInt(1))
+	lo, hi := addrInt(first), addrInt(last)
+	if lo.Cmp(base) < 0 {
+		lo = base
+	}
+	if hi.Cmp(end) > 0 {
+		hi = end
+	}
+	if lo.Cmp(hi) > 0 {
+		return indexRange{}, false
+	}
+	lo.Sub(lo, base).Rsh(lo, r.shift)
+	hi.Sub(hi, base).Rsh(hi, r.shift)
+	return indexRange{lo.Uint64(), hi.Uint64()}, true
+}
+
+// index returns the index addr falls in.
+func (r *poolRange) index(addr netip.Addr) (uint64, bool) {
+	ir, ok := r.indexes(addr, addr)
+	return ir.lo, ok
+}
+
+// addr returns the address a VM given index i uses: the address itself, or
+// the first address of the prefix.
+func (r *poolRange) addr(i uint64) netip.Addr {
+	n := new(big.Int).Lsh(new(big.Int).SetUint64(i), r.shift)
+	n.Add(n, addrInt(r.prefix.Addr()))
+	if r.shift > 0 {
+		n.Add(n, big.NewInt(1))
+	}
+	b := make([]byte, r.prefix.Addr().BitLen()/8)
+	addr, _ := netip.AddrFromSlice(n.FillBytes(b))
+	return addr
+}
+
+// usable is the number of indexes that may be handed out.
+func (r *poolRange) usable() uint64 {
+	n := r.size
+	for _, ir := range r.reserved {
+		n -= ir.hi - ir.lo + 1
+	}
+	return n
+}
+
+// free returns the lowest index that is neither reserved nor in used.
+func (r *poolRange) free(used map[uint64]bool) (uint64, bool) {
+	j := 0
+	for i := uint64(0); i < r.size; {
+		if j < len(r.reserved) && i >= r.reserved[j].lo {
+			i = r.reserved[j].hi + 1
+			j++
+			continue
+		}
+		if !used[i] {
+			return i, true
+		}
+		i++
+	}
+	return 0, false
+}
+
+func addrInt(addr netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(addr.AsSlice())
+}
+
+// parseAddrRange parses an address, a "first-last" range or a CIDR.
+func parseAddrRange(s string) (netip.Addr, netip.Addr, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Addr{}, netip.Addr{}, err
+		}
+		p = p.Masked()
+		last := addrInt(p.Addr())
+		host := new(big.Int).Lsh(big.NewInt(1), uint(p.Addr().BitLen()-p.Bits()))
+		last.Add(last, host).Sub(last, big.NewInt(1))
+		b := make([]byte, p.Addr().BitLen()/8)
+		end, _ := netip.AddrFromSlice(last.FillBytes(b))
+		return p.Addr(), end, nil
+	}
+	from, to, isRange := strings.Cut(s, "-")
+	first, err := netip.ParseAddr(strings.TrimSpace(from))
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
+	if !isRange {
+		return first, first, nil
+	}
+	last, err := netip.ParseAddr(strings.TrimSpace(to))
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
+	if last.BitLen() != first.BitLen() || last.Less(first) {
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("invalid range %q", s)
+	}
+	return first, last, nil
+}
+
+func mergeRanges(ranges []indexRange) []indexRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].lo < ranges[j].lo })
+	var merged []indexRange
+	for _, ir := range ranges {
+		if n := len(merged); n > 0 && ir.lo <= merged[n-1].hi+1 {
+			if ir.hi > merged[n-1].hi {
+				merged[n-1].hi = ir.hi
+			}
+			continue
+		}
+		merged = append(merged, ir)
+	}
+	return merged
+}
+
+// splitList splits a comma separated column, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
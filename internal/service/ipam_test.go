@@ -0,0 +1,224 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestPoolRange(t *testing.T) {
+	v4 := &model.IPPool{CIDR: "192.0.2.9/29", Gateway: "192.0.2.1", Exclude: "192.0.2.13, 192.0.2.100-192.0.2.200"}
+	r, err := parsePool(v4)
+	if err != nil {
+		t.Fatalf("parse v4: %v", err)
+	}
+	if v4.Family != 4 || v4.CIDR != "192.0.2.8/29" || v4.AssignPrefixLen != 32 {
+		t.Fatalf("unexpected normalised pool %+v", v4)
+	}
+	// Eight addresses less network, broadcast and the exclusion; the gateway
+	// and the range lie outside the pool.
+	if r.usable() != 5 || r.prefixLen != 29 {
+		t.Fatalf("usable = %d /%d, want 5 /29", r.usable(), r.prefixLen)
+	}
+	used := map[uint64]bool{}
+	var got []string
+	for {
+		i, ok := r.free(used)
+		if !ok {
+			break
+		}
+		used[i] = true
+		got = append(got, r.addr(i).String())
+	}
+	if fmt.Sprint(got) != "[192.0.2.9 192.0.2.10 192.0.2.11 192.0.2.12 192.0.2.14]" {
+		t.Fatalf("handed out %v", got)
+	}
+
+	v6 := &model.IPPool{CIDR: "2001:db8::/48", Gateway: "fe80::1"}
+	r, err = parsePool(v6)
+	if err != nil {
+		t.Fatalf("parse v6: %v", err)
+	}
+	if v6.Family != 6 || v6.AssignPrefixLen != 64 || r.usable() != 1<<16 || r.prefixLen != 64 {
+		t.Fatalf("unexpected v6 pool %+v, %d usable", v6, r.usable())
+	}
+	if addr := r.addr(1); addr.String() != "2001:db8:0:1::1" {
+		t.Fatalf("second prefix uses %s", addr)
+	}
+	if i, ok := r.index(netip.MustParseAddr("2001:db8:0:1::1")); !ok || i != 1 {
+		t.Fatalf("index = %d, %v; want 1", i, ok)
+	}
+
+	for _, bad := range []*model.IPPool{
+		{CIDR: "10.0.0.0/24", AssignPrefixLen: 28},
+		{CIDR: "10.0.0.0/24", Family: 6},
+		{CIDR: "10.0.0.0/24", Gateway: "2001:db8::1"},
+		{CIDR: "10.0.0.0/24", Exclude: "10.0.0.9-10.0.0.2"},
+		{CIDR: "2001:db8::/16"},
+		{CIDR: "not a cidr"},
+	} {
+		if _, err := parsePool(bad); !errors.Is(err, ErrInvalidPool) {
+			t.Fatalf("parse %+v = %v, want ErrInvalidPool", bad, err)
+		}
+	}
+}
+
+func newTestIPAM(t *testing.T, quarantine time.Duration) (*VMService, *IPAMService, *hypervisor.FakeHypervisor) {
+	t.Helper()
+	s, hv, db := newTestVMService(t)
+	ipam := NewIPAMService(db, quarantine)
+	s.WithIPAM(ipam)
+	return s, ipam, hv
+}
+
+func TestIPAMAllocateAndQuarantine(t *testing.T) {
+	s, ipam, hv := newTestIPAM(t, time.Hour)
+	v4, err := ipam.CreatePool(ctx, IPPoolRequest{Name: "v4", CIDR: "198.51.100.0/30", Gateway: "198.51.100.1", Nameservers: []string{"198.51.100.53"}})
+	if err != nil {
+		t.Fatalf("create v4 pool: %v", err)
+	}
+	if _, err := ipam.CreatePool(ctx, IPPoolRequest{Name: "v6", CIDR: "2001:db8:1::/56", Gateway: "fe80::1"}); err != nil {
+		t.Fatalf("create v6 pool: %v", err)
+	}
+	if _, err := ipam.CreatePool(ctx, IPPoolRequest{Name: "v4", CIDR: "10.0.0.0/24"}); !errors.Is(err, ErrPoolExists) {
+		t.Fatalf("duplicate pool = %v, want ErrPoolExists", err)
+	}
+
+	vm, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10, GuestSetup: GuestSetup{Hostname: "web"}})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if vm.IPv4 != "198.51.100.2/30" || vm.IPv6 != "2001:db8:1::1/64" {
+		t.Fatalf("vm got %q and %q", vm.IPv4, vm.IPv6)
+	}
+	seed, ok := hv.Seed(vm.HypervisorID)
+	if !ok || seed.Network == nil || len(seed.Network.Interfaces) != 1 {
+		t.Fatalf("guest network not configured: %+v", seed)
+	}
+	if iface := seed.Network.Interfaces[0]; fmt.Sprint(iface.Addresses) != "[198.51.100.2/30 2001:db8:1::1/64]" ||
+		iface.Gateway4 != "198.51.100.1" || iface.Gateway6 != "fe80::1" || fmt.Sprint(iface.Nameservers) != "[198.51.100.53]" {
+		t.Fatalf("unexpected guest interface %+v", iface)
+	}
+
+	// The only usable IPv4 address is taken; the IPv6 prefix the second VM
+	// got is handed back when its creation fails.
+	if _, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "db", CPU: 1, MemoryMB: 512, DiskGB: 10}); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("create with a full pool = %v, want ErrPoolExhausted", err)
+	}
+	detail, err := ipam.GetPool(ctx, v4.ID)
+	if err != nil {
+		t.Fatalf("get pool: %v", err)
+	}
+	if detail.Total != 1 || detail.Allocated != 1 || detail.Free != 0 || len(detail.Addresses) != 1 {
+		t.Fatalf("unexpected usage %+v", detail.IPPoolUsage)
+	}
+	var leased int64
+	s.db.Model(&model.IPAddress{}).Where("status = ?", model.IPStatusAllocated).Count(&leased)
+	if leased != 2 {
+		t.Fatalf("%d addresses allocated, want the first VM's two", leased)
+	}
+
+	if err := ipam.DeletePool(ctx, v4.ID); !errors.Is(err, ErrPoolInUse) {
+		t.Fatalf("delete pool in use = %v, want ErrPoolInUse", err)
+	}
+	if err := s.DeleteVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	pools, _ := ipam.ListPools(ctx)
+	if len(pools) != 2 || pools[0].Quarantined != 1 || pools[0].Allocated != 0 {
+		t.Fatalf("unexpected usage after delete %+v", pools[0])
+	}
+	if _, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "db", CPU: 1, MemoryMB: 512, DiskGB: 10}); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("create during quarantine = %v, want ErrPoolExhausted", err)
+	}
+
+	s.db.Model(&model.IPAddress{}).Where("status = ?", model.IPStatusQuarantined).Update("released_at", time.Now().Add(-2*time.Hour))
+	again, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "db", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("create after quarantine: %v", err)
+	}
+	if again.IPv4 != vm.IPv4 {
+		t.Fatalf("got %q after quarantine, want %q again", again.IPv4, vm.IPv4)
+	}
+}
+
+func TestIPAMConcurrentAllocation(t *testing.T) {
+	_, ipam, _ := newTestIPAM(t, 0)
+	pool, err := ipam.CreatePool(ctx, IPPoolRequest{Name: "small", CIDR: "203.0.113.0/28"})
+	if err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = map[string]bool{}
+	)
+	for vmID := uint(1); vmID <= 16; vmID++ {
+		wg.Add(1)
+		go func(vmID uint) {
+			defer wg.Done()
+			addr, err := ipam.allocateFrom(ctx, pool, vmID)
+			if err != nil {
+				t.Errorf("allocate: %v", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if addr == nil {
+				return
+			}
+			if seen[addr.Address] {
+				t.Errorf("%s handed out twice", addr.Address)
+			}
+			seen[addr.Address] = true
+		}(vmID)
+	}
+	wg.Wait()
+	if len(seen) != 14 {
+		t.Fatalf("handed out %d addresses, want all 14", len(seen))
+	}
+}
+
+func TestIPAMPoolPrecedence(t *testing.T) {
+	_, ipam, _ := newTestIPAM(t, 0)
+	node := &model.Node{Name: "n1", Hostname: "n1", Region: "eu", Status: model.NodeStatusOnline, CPUTotal: 8, MemTotal: 8192, DiskTotal: 100}
+	if err := ipam.db.Create(node).Error; err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	for _, req := range []IPPoolRequest{
+		{Name: "global", CIDR: "10.0.0.0/24"},
+		{Name: "other-region", CIDR: "10.1.0.0/24", Region: "us"},
+		{Name: "region", CIDR: "10.2.0.0/24", Region: "eu"},
+		{Name: "node", CIDR: "10.3.0.0/24", NodeID: &node.ID},
+	} {
+		if _, err := ipam.CreatePool(ctx, req); err != nil {
+			t.Fatalf("create pool %s: %v", req.Name, err)
+		}
+	}
+	names := func(node *model.Node) string {
+		pools, err := ipam.poolsFor(ctx, 4, node, false)
+		if err != nil {
+			t.Fatalf("pools: %v", err)
+		}
+		var out []string
+		for _, p := range pools {
+			out = append(out, p.Name)
+		}
+		return fmt.Sprint(out)
+	}
+	if got := names(node); got != "[node region global]" {
+		t.Fatalf("pools for node = %s", got)
+	}
+	if got := names(nil); got != "[global]" {
+		t.Fatalf("pools without node = %s", got)
+	}
+	if _, err := ipam.CreatePool(ctx, IPPoolRequest{Name: "both", CIDR: "10.4.0.0/24", Region: "eu", NodeID: &node.ID}); !errors.Is(err, ErrInvalidPool) {
+		t.Fatalf("pool with node and region = %v, want ErrInvalidPool", err)
+	}
+}
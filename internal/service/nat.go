@@ -0,0 +1,387 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+	"StarstreamAstra/internal/nat"
+)
+
+var (
+	ErrNATUnavailable     = errors.New("NAT networking is not available for the VM")
+	ErrNotNATVM           = errors.New("VM does not use NAT networking")
+	ErrForwardNotFound    = errors.New("port forward not found")
+	ErrPortOutOfRange     = errors.New("public port is outside the VM's port range")
+	ErrPortInUse          = errors.New("public port is already forwarded")
+	ErrPortsExhausted     = errors.New("every port in the VM's range is forwarded")
+	ErrPortRangeExhausted = errors.New("no free port range left on the node")
+)
+
+// NATOptions sets how public ports are split between NAT VMs: each VM gets
+// PortsPerVM consecutive ports between PortStart and PortEnd on its node.
+// VMs on nodes are reached at the node's IP, VMs on the default hypervisor
+// at PublicIP.
+type NATOptions struct {
+	PublicIP   string
+	PortStart  int
+	PortEnd    int
+	PortsPerVM int
+}
+
+// NATService manages the port forwards of NAT VMs. Forwards are kept in
+// the database and pushed to a node as one ruleset whenever they change
+// there; Run pushes every node's ruleset again periodically, which also
+// restores rules a restarted node lost.
+type NATService struct {
+	db   *gorm.DB
+	vms  *VMService
+	opts NATOptions
+}
+
+func NewNATService(db *gorm.DB, vms *VMService, opts NATOptions) *NATService {
+	return &NATService{db: db, vms: vms, opts: opts}
+}
+
+// WithNAT lets VMs be created in NAT mode with port ranges from n.
+func (s *VMService) WithNAT(n *NATService) *VMService {
+	s.nat = n
+	s.outbox.Handle(outboxApplyNAT, n.applyEvent)
+	return s
+}
+
+// PortForwardRequest adds a forward. Without a public port the lowest free
+// one in the VM's range is used.
+type PortForwardRequest struct {
+	Protocol    string `json:"protocol" binding:"required,oneof=tcp udp"`
+	PublicPort  int    `json:"public_port" binding:"omitempty,min=1,max=65535"`
+	PrivatePort int    `json:"private_port" binding:"required,min=1,max=65535"`
+	Description string `json:"description" binding:"max=255"`
+}
+
+// NATInfo is how a NAT VM is reached from outside.
+type NATInfo struct {
+	PublicIP  string               `json:"public_ip"`
+	PortStart int                  `json:"port_start"`
+	PortEnd   int                  `json:"port_end"`
+	Forwards  []*model.PortForward `json:"forwards"`
+}
+
+func (n *NATService) GetNAT(ctx context.Context, p Principal, vmID uint) (*NATInfo, error) {
+	vm, rng, err := n.natVM(ctx, p, vmID)
+	if err != nil {
+		return nil, err
+	}
+	db := n.db.WithContext(ctx)
+	node, err := n.node(db, vm.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	info := &NATInfo{PublicIP: n.publicIP(node), PortStart: rng.PortStart, PortEnd: rng.PortEnd}
+	if err := db.Where("vm_id = ?", vm.ID).Order("public_port, protocol").Find(&info.Forwards).Error; err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// AddForward stores a forward and applies the node's rules in the same
+// transaction, so a forward the node refused is not kept.
+func (n *NATService) AddForward(ctx context.Context, p Principal, vmID uint, req PortForwardRequest) (*model.PortForward, error) {
+	vm, rng, err := n.natVM(ctx, p, vmID)
+	if err != nil {
+		return nil, err
+	}
+	if req.PublicPort != 0 && (req.PublicPort < rng.PortStart || req.PublicPort > rng.PortEnd) {
+		return nil, ErrPortOutOfRange
+	}
+	fwd := &model.PortForward{
+		VMID:        vm.ID,
+		Protocol:    req.Protocol,
+		PublicPort:  req.PublicPort,
+		PrivatePort: req.PrivatePort,
+		Description: req.Description,
+	}
+	err = n.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var taken []int
+		if err := tx.Model(&model.PortForward{}).Where("vm_id = ? AND protocol = ?", vm.ID, req.Protocol).Pluck("public_port", &taken).Error; err != nil {
+			return err
+		}
+		used := make(map[int]bool, len(taken))
+		for _, port := range taken {
+			used[port] = true
+		}
+		if fwd.PublicPort == 0 {
+			for port := rng.PortStart; port <= rng.PortEnd; port++ {
+				if !used[port] {
+					fwd.PublicPort = port
+					break
+				}
+			}
+			if fwd.PublicPort == 0 {
+				return ErrPortsExhausted
+			}
+		} else if used[fwd.PublicPort] {
+			return ErrPortInUse
+		}
+		if err := tx.Create(fwd).Error; err != nil {
+			return err
+		}
+		return n.apply(ctx, tx, vm.NodeID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fwd, nil
+}
+
+func (n *NATService) DeleteForward(ctx context.Context, p Principal, vmID, forwardID uint) error {
+	vm, _, err := n.natVM(ctx, p, vmID)
+	if err != nil {
+		return err
+	}
+	return n.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND vm_id = ?", forwardID, vm.ID).Delete(&model.PortForward{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrForwardNotFound
+		}
+		return n.apply(ctx, tx, vm.NodeID)
+	})
+}
+
+// Run pushes the rules of every node with NAT VMs every interval until ctx
+// is cancelled.
+func (n *NATService) Run(ctx context.Context, interval time.Duration, logf func(string, ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.syncAll(ctx, logf)
+		}
+	}
+}
+
+func (n *NATService) syncAll(ctx context.Context, logf func(string, ...interface{})) {
+	db := n.db.WithContext(ctx)
+	nodeIDs, err := vmNodes(db.Where("network_mode = ?", model.NetworkModeNAT))
+	if err != nil {
+		logf("NAT sync: list nodes: %v", err)
+		return
+	}
+	for _, nodeID := range nodeIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return n.apply(ctx, tx, nodeID)
+		})
+		if err != nil {
+			logf("NAT sync: node %s: %v", nodeName(nodeID), err)
+		}
+	}
+}
+
+// applyEvent pushes a node's ruleset for the outbox. A node that has been
+// removed since has no rules left to update.
+func (n *NATService) applyEvent(ctx context.Context, tx *gorm.DB, raw json.RawMessage) error {
+	var p applyRulesPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	if err := n.apply(ctx, tx, p.NodeID); err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return nil
+}
+
+func nodeName(nodeID *uint) string {
+	if nodeID == nil {
+		return "default"
+	}
+	return fmt.Sprint(*nodeID)
+}
+
+// natVM loads a NAT VM owned by p and its port range.
+func (n *NATService) natVM(ctx context.Context, p Principal, vmID uint) (*model.VM, *model.NATPortRange, error) {
+	vm, err := n.vms.ownedVM(ctx, p, vmID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if vm.NetworkMode != model.NetworkModeNAT {
+		return nil, nil, ErrNotNATVM
+	}
+	var rng model.NATPortRange
+	if err := n.db.WithContext(ctx).Where("vm_id = ?", vm.ID).First(&rng).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Still being created, or creation failed.
+			return nil, nil, ErrNATUnavailable
+		}
+		return nil, nil, err
+	}
+	return vm, &rng, nil
+}
+
+func (n *NATService) node(db *gorm.DB, nodeID *uint) (*model.Node, error) {
+	if nodeID == nil {
+		return nil, nil
+	}
+	var node model.Node
+	if err := db.First(&node, *nodeID).Error; err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func (n *NATService) publicIP(node *model.Node) string {
+	if node == nil {
+		return n.opts.PublicIP
+	}
+	return node.IP
+}
+
+// apply pushes the ruleset of the node nodeID, as seen by the transaction
+// tx, to the node. It holds the node's NAT lock until tx ends.
+func (n *NATService) apply(ctx context.Context, tx *gorm.DB, nodeID *uint) error {
+	if err := lockRuleset(tx, natRulesetLock, nodeID); err != nil {
+		return err
+	}
+	hv, err := n.vms.nodeHypervisor(tx, nodeID)
+	if err != nil {
+		return err
+	}
+	ns, ok := hv.(hypervisor.NATSupport)
+	if !ok {
+		return hypervisor.ErrNATUnsupported
+	}
+	rules, err := n.ruleset(tx, nodeID)
+	if err != nil {
+		return err
+	}
+	return ns.ApplyNAT(ctx, rules)
+}
+
+// Advisory lock classes of the rulesets pushed to nodes.
+const (
+	natRulesetLock = iota + 1
+	firewallRulesetLock
+)
+
+// lockRuleset serialises the transactions that push one kind of ruleset
+// to a node until tx ends. Without it two changes could each push rules
+// read before the other committed, and the node would keep only one.
+// Only PostgreSQL has advisory locks; the SQLite test database runs one
+// transaction at a time.
+func lockRuleset(tx *gorm.DB, class int, nodeID *uint) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	var id uint
+	if nodeID != nil {
+		id = *nodeID
+	}
+	return tx.Exec("SELECT pg_advisory_xact_lock(?, ?)", class, id).Error
+}
+
+// ruleset collects the forwards of the NAT VMs on a node and the NAT
+// networks that serve it.
+func (n *NATService) ruleset(db *gorm.DB, nodeID *uint) (nat.Ruleset, error) {
+	node, err := n.node(db, nodeID)
+	if err != nil {
+		return nat.Ruleset{}, err
+	}
+	rules := nat.Ruleset{PublicIP: n.publicIP(node)}
+
+	pools, err := servingPools(db.Where("family = ? AND nat = ?", 4, true), node)
+	if err != nil {
+		return nat.Ruleset{}, err
+	}
+	for _, pool := range pools {
+		rules.Masquerade = append(rules.Masquerade, pool.CIDR)
+	}
+
+	var vms []*model.VM
+	if err := onNode(db, nodeID).Where("network_mode = ?", model.NetworkModeNAT).Find(&vms).Error; err != nil {
+		return nat.Ruleset{}, err
+	}
+	privateIPs := make(map[uint]string, len(vms))
+	ids := make([]uint, 0, len(vms))
+	for _, vm := range vms {
+		if addr, _, _ := strings.Cut(vm.IPv4, "/"); addr != "" {
+			privateIPs[vm.ID] = addr
+			ids = append(ids, vm.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return rules, nil
+	}
+	var forwards []*model.PortForward
+	if err := db.Where("vm_id IN ?", ids).Order("id").Find(&forwards).Error; err != nil {
+		return nat.Ruleset{}, err
+	}
+	for _, f := range forwards {
+		rules.Forwards = append(rules.Forwards, nat.Forward{
+			Protocol:    f.Protocol,
+			PublicPort:  f.PublicPort,
+			PrivateIP:   privateIPs[f.VMID],
+			PrivatePort: f.PrivatePort,
+		})
+	}
+	return rules, nil
+}
+
+// allocateRange gives the VM vmID a block of public ports on the node
+// nodeID, keeping a block it already has. Concurrent allocations may pick
+// the same block; the unique index lets one of them in and the others
+// move on.
+func (n *NATService) allocateRange(ctx context.Context, vmID, nodeID uint) (*model.NATPortRange, error) {
+	db := n.db.WithContext(ctx)
+	var existing model.NATPortRange
+	err := db.Where("vm_id = ?", vmID).First(&existing).Error
+	if err == nil {
+		return &existing, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	var starts []int
+	if err := db.Model(&model.NATPortRange{}).Where("node_id = ?", nodeID).Pluck("port_start", &starts).Error; err != nil {
+		return nil, err
+	}
+	used := make(map[int]bool, len(starts))
+	for _, start := range starts {
+		used[start] = true
+	}
+	size := n.opts.PortsPerVM
+	for start := n.opts.PortStart; size > 0 && start+size-1 <= n.opts.PortEnd; start += size {
+		if used[start] {
+			continue
+		}
+		rng := &model.NATPortRange{NodeID: nodeID, PortStart: start, PortEnd: start + size - 1, VMID: vmID}
+		err := db.Create(rng).Error
+		if err == nil {
+			return rng, nil
+		}
+		var taken int64
+		if cerr := db.Model(&model.NATPortRange{}).Where("node_id = ? AND port_start = ?", nodeID, start).Count(&taken).Error; cerr != nil || taken == 0 {
+			return nil, err
+		}
+	}
+	return nil, ErrPortRangeExhausted
+}
+
+// releasePorts drops the port range and forwards of a VM.
+func releasePorts(tx *gorm.DB, vmID uint) error {
+	if err := tx.Where("vm_id = ?", vmID).Delete(&model.PortForward{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("vm_id = ?", vmID).Delete(&model.NATPortRange{}).Error
+}
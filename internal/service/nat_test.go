@@ -0,0 +1,140 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestNATForwards(t *testing.T) {
+	s, ipam, hv := newTestIPAM(t, 0)
+	n := NewNATService(s.db, s, NATOptions{PublicIP: "203.0.113.10", PortStart: 20000, PortEnd: 20011, PortsPerVM: 5})
+	s.WithNAT(n)
+	for _, req := range []IPPoolRequest{
+		{Name: "public", CIDR: "198.51.100.0/24"},
+		{Name: "private", CIDR: "10.10.0.0/24", Gateway: "10.10.0.1", NAT: true},
+	} {
+		if _, err := ipam.CreatePool(ctx, req); err != nil {
+			t.Fatalf("create pool %s: %v", req.Name, err)
+		}
+	}
+
+	vm, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "nat", CPU: 1, MemoryMB: 512, DiskGB: 10, NetworkMode: model.NetworkModeNAT})
+	if err != nil {
+		t.Fatalf("create NAT VM: %v", err)
+	}
+	if vm.NetworkMode != model.NetworkModeNAT || !strings.HasPrefix(vm.IPv4, "10.10.0.") {
+		t.Fatalf("NAT VM got %s address %q", vm.NetworkMode, vm.IPv4)
+	}
+	public, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "public", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("create public VM: %v", err)
+	}
+	if !strings.HasPrefix(public.IPv4, "198.51.100.") {
+		t.Fatalf("public VM got %q", public.IPv4)
+	}
+	if rules := hv.NAT(); fmt.Sprint(rules.Masquerade) != "[10.10.0.0/24]" || len(rules.Forwards) != 0 {
+		t.Fatalf("unexpected rules after create %+v", rules)
+	}
+
+	info, err := n.GetNAT(ctx, owner, vm.ID)
+	if err != nil {
+		t.Fatalf("get NAT: %v", err)
+	}
+	if info.PublicIP != "203.0.113.10" || info.PortStart != 20000 || info.PortEnd != 20004 {
+		t.Fatalf("unexpected NAT info %+v", info)
+	}
+
+	ssh, err := n.AddForward(ctx, owner, vm.ID, PortForwardRequest{Protocol: "tcp", PrivatePort: 22})
+	if err != nil {
+		t.Fatalf("add forward: %v", err)
+	}
+	if ssh.PublicPort != 20000 {
+		t.Fatalf("first free port is %d, want 20000", ssh.PublicPort)
+	}
+	if _, err := n.AddForward(ctx, owner, vm.ID, PortForwardRequest{Protocol: "tcp", PublicPort: 20000, PrivatePort: 80}); !errors.Is(err, ErrPortInUse) {
+		t.Fatalf("taken port = %v, want ErrPortInUse", err)
+	}
+	if _, err := n.AddForward(ctx, owner, vm.ID, PortForwardRequest{Protocol: "udp", PublicPort: 20000, PrivatePort: 53}); err != nil {
+		t.Fatalf("same port over udp: %v", err)
+	}
+	if _, err := n.AddForward(ctx, owner, vm.ID, PortForwardRequest{Protocol: "tcp", PublicPort: 20005, PrivatePort: 80}); !errors.Is(err, ErrPortOutOfRange) {
+		t.Fatalf("port of another VM = %v, want ErrPortOutOfRange", err)
+	}
+	if _, err := n.AddForward(ctx, owner, public.ID, PortForwardRequest{Protocol: "tcp", PrivatePort: 22}); !errors.Is(err, ErrNotNATVM) {
+		t.Fatalf("forward to public VM = %v, want ErrNotNATVM", err)
+	}
+	addr, _, _ := strings.Cut(vm.IPv4, "/")
+	if rules := hv.NAT(); rules.PublicIP != "203.0.113.10" || len(rules.Forwards) != 2 || rules.Forwards[0].PrivateIP != addr {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+
+	n.syncAll(ctx, t.Errorf)
+
+	// A forward the node rejects is not kept.
+	hv.Inject(hypervisor.MethodApplyNAT, hypervisor.Fault{Err: errInjected, Times: 1})
+	if _, err := n.AddForward(ctx, owner, vm.ID, PortForwardRequest{Protocol: "tcp", PrivatePort: 80}); !errors.Is(err, errInjected) {
+		t.Fatalf("add with failing node = %v, want errInjected", err)
+	}
+	if info, _ := n.GetNAT(ctx, owner, vm.ID); len(info.Forwards) != 2 {
+		t.Fatalf("%d forwards kept, want 2", len(info.Forwards))
+	}
+
+	// Two ranges of five fit; the third NAT VM fails and gives its address
+	// and ports back.
+	if _, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "nat2", CPU: 1, MemoryMB: 512, DiskGB: 10, NetworkMode: model.NetworkModeNAT}); err != nil {
+		t.Fatalf("create second NAT VM: %v", err)
+	}
+	if _, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "nat3", CPU: 1, MemoryMB: 512, DiskGB: 10, NetworkMode: model.NetworkModeNAT}); !errors.Is(err, ErrPortRangeExhausted) {
+		t.Fatalf("third NAT VM = %v, want ErrPortRangeExhausted", err)
+	}
+	var ranges int64
+	s.db.Model(&model.NATPortRange{}).Count(&ranges)
+	if ranges != 2 {
+		t.Fatalf("%d port ranges, want 2", ranges)
+	}
+
+	if err := n.DeleteForward(ctx, owner, vm.ID, ssh.ID); err != nil {
+		t.Fatalf("delete forward: %v", err)
+	}
+	if err := n.DeleteForward(ctx, owner, vm.ID, ssh.ID); !errors.Is(err, ErrForwardNotFound) {
+		t.Fatalf("delete again = %v, want ErrForwardNotFound", err)
+	}
+
+	// A node that cannot drop the deleted VM's forwards is retried.
+	hv.Inject(hypervisor.MethodApplyNAT, hypervisor.Fault{Err: errInjected, Times: 1})
+	if err := s.DeleteVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("delete VM: %v", err)
+	}
+	if rules := hv.NAT(); len(rules.Forwards) == 0 {
+		t.Fatal("forwards dropped despite the failed push")
+	}
+	makeDue(s.db)
+	if err := s.outbox.dispatchDue(ctx, discardf); err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	if rules := hv.NAT(); len(rules.Forwards) != 0 {
+		t.Fatalf("forwards left after delete %+v", rules.Forwards)
+	}
+	s.db.Model(&model.NATPortRange{}).Count(&ranges)
+	if ranges != 1 {
+		t.Fatalf("%d port ranges after delete, want 1", ranges)
+	}
+}
+
+func TestNATUnavailable(t *testing.T) {
+	s, _, _ := newTestIPAM(t, 0)
+	req := VMCreateRequest{Name: "nat", CPU: 1, MemoryMB: 512, DiskGB: 10, NetworkMode: model.NetworkModeNAT}
+	if _, err := s.CreateVM(ctx, owner, req); !errors.Is(err, ErrNATUnavailable) {
+		t.Fatalf("create without NAT service = %v, want ErrNATUnavailable", err)
+	}
+	s.WithNAT(NewNATService(s.db, s, NATOptions{PortStart: 20000, PortEnd: 20099, PortsPerVM: 10}))
+	// No NAT pool serves the VM.
+	if _, err := s.CreateVM(ctx, owner, req); !errors.Is(err, ErrNATUnavailable) {
+		t.Fatalf("create without NAT pool = %v, want ErrNATUnavailable", err)
+	}
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"StarstreamAstra/internal/model"
+)
+
+var ErrNodeNotFound = errors.New("node not found")
+
+type NodeService struct {
+	db *gorm.DB
+}
+
+func NewNodeService(db *gorm.DB) *NodeService {
+	return &NodeService{db: db}
+}
+
+type NodeRegisterRequest struct {
+	Name      string `json:"name" binding:"required"`
+	Hostname  string `json:"hostname" binding:"required"`
+	IP        string `json:"ip"`
+	AgentURL  string `json:"agent_url"`
+	Region    string `json:"region" binding:"max=64"`
+	CPUTotal  int    `json:"cpu_total" binding:"required"`
+	MemTotal  int    `json:"mem_total" binding:"required"`
+	DiskTotal int    `json:"disk_total" binding:"required"`
+}
+
+type NodeHeartbeatRequest struct {
+	NodeID          uint    `json:"node_id" binding:"required"`
+	CPUUsagePercent float64 `json:"cpu_usage_percent"`
+	MemUsageMB      int     `json:"mem_usage_mb"`
+	DiskUsageGB     int     `json:"disk_usage_gb"`
+}
+
+// Register creates the node or refreshes its identity and capacity if an
+// agent with the same name registered before. Allocation counters are kept.
+func (s *NodeService) Register(ctx context.Context, req NodeRegisterRequest) (*model.Node, error) {
+	now := time.Now()
+	node := &model.Node{
+		Name:            req.Name,
+		Hostname:        req.Hostname,
+		IP:              req.IP,
+		AgentURL:        req.AgentURL,
+		Region:          req.Region,
+		CPUTotal:        req.CPUTotal,
+		MemTotal:        req.MemTotal,
+		DiskTotal:       req.DiskTotal,
+		Status:          model.NodeStatusOnline,
+		LastHeartbeatAt: &now,
+	}
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"hostname", "ip", "agent_url", "region", "cpu_total", "mem_total", "disk_total",
+			"status", "last_heartbeat_at", "updated_at",
+		}),
+	}).Create(node).Error
+	if err != nil {
+		return nil, err
+	}
+	return s.GetNodeByName(ctx, req.Name)
+}
+
+func (s *NodeService) Heartbeat(ctx context.Context, req NodeHeartbeatRequest) error {
+	res := s.db.WithContext(ctx).Model(&model.Node{}).Where("id = ?", req.NodeID).Updates(map[string]interface{}{
+		"cpu_usage_percent": req.CPUUsagePercent,
+		"mem_usage_mb":      req.MemUsageMB,
+		"disk_usage_gb":     req.DiskUsageGB,
+		"status":            model.NodeStatusOnline,
+		"last_heartbeat_at": time.Now(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNodeNotFound
+	}
+	return nil
+}
+
+type NodeOvercommitRequest struct {
+	CPUOvercommit float64 `json:"cpu_overcommit" binding:"required,gt=0"`
+	MemOvercommit float64 `json:"mem_overcommit" binding:"required,gt=0"`
+}
+
+// SetOvercommit changes how far allocations on the node may exceed its
+// physical CPU and memory. Lowering a ratio below current usage does not
+// evict anything; the node just stops taking new allocations.
+func (s *NodeService) SetOvercommit(ctx context.Context, id uint, req NodeOvercommitRequest) (*model.Node, error) {
+	res := s.db.WithContext(ctx).Model(&model.Node{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"cpu_overcommit": req.CPUOvercommit,
+		"mem_overcommit": req.MemOvercommit,
+	})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrNodeNotFound
+	}
+	return s.GetNode(ctx, id)
+}
+
+func (s *NodeService) ListNodes(ctx context.Context) ([]*model.Node, error) {
+	var nodes []*model.Node
+	if err := s.db.WithContext(ctx).Order("id").Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (s *NodeService) GetNode(ctx context.Context, id uint) (*model.Node, error) {
+	return s.findNode(s.db.WithContext(ctx).Where("id = ?", id))
+}
+
+func (s *NodeService) GetNodeByName(ctx context.Context, name string) (*model.Node, error) {
+	return s.findNode(s.db.WithContext(ctx).Where("name = ?", name))
+}
+
+func (s *NodeService) findNode(q *gorm.DB) (*model.Node, error) {
+	var node model.Node
+	if err := q.First(&node).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNodeNotFound
+		}
+		return nil, err
+	}
+	return &node, nil
+}
+
+// MarkOffline flags online nodes whose last heartbeat is older than
+// timeout and returns how many were changed.
+func (s *NodeService) MarkOffline(ctx context.Context, timeout time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-timeout)
+	res := s.db.WithContext(ctx).Model(&model.Node{}).
+		Where("status = ?", model.NodeStatusOnline).
+		Where("last_heartbeat_at IS NULL OR last_heartbeat_at < ?", cutoff).
+		Update("status", model.NodeStatusOffline)
+	return res.RowsAffected, res.Error
+}
+
+// RunHealthMonitor periodically marks nodes with missed heartbeats offline
+// until ctx is cancelled.
+func (s *NodeService) RunHealthMonitor(ctx context.Context, timeout time.Duration, logf func(string, ...interface{})) {
+	interval := timeout / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.MarkOffline(ctx, timeout)
+			if err != nil {
+				logf("Node health check failed: %v", err)
+			} else if n > 0 {
+				logf("Marked %d node(s) offline after missed heartbeats", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"StarstreamAstra/internal/model"
+)
+
+func registerTestNode(t *testing.T, s *NodeService, name string) *model.Node {
+	t.Helper()
+	node, err := s.Register(ctx, NodeRegisterRequest{
+		Name: name, Hostname: name + ".local", IP: "10.0.0.1",
+		CPUTotal: 16, MemTotal: 65536, DiskTotal: 1000,
+	})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	return node
+}
+
+func TestNodeServiceRegisterUpserts(t *testing.T) {
+	s := NewNodeService(newTestDB(t))
+
+	first := registerTestNode(t, s, "node-a")
+	if first.ID == 0 || first.Status != model.NodeStatusOnline || first.LastHeartbeatAt == nil {
+		t.Fatalf("unexpected node %+v", first)
+	}
+
+	again, err := s.Register(ctx, NodeRegisterRequest{
+		Name: "node-a", Hostname: "node-a.new", IP: "10.0.0.2",
+		CPUTotal: 32, MemTotal: 65536, DiskTotal: 1000,
+	})
+	if err != nil {
+		t.Fatalf("re-register: %v", err)
+	}
+	if again.ID != first.ID || again.CPUTotal != 32 || again.IP != "10.0.0.2" {
+		t.Fatalf("re-register did not update in place: %+v", again)
+	}
+
+	nodes, err := s.ListNodes(ctx)
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("list = %v, %v", nodes, err)
+	}
+}
+
+func TestNodeServiceHeartbeat(t *testing.T) {
+	s := NewNodeService(newTestDB(t))
+	node := registerTestNode(t, s, "node-a")
+
+	err := s.Heartbeat(ctx, NodeHeartbeatRequest{NodeID: node.ID, CPUUsagePercent: 42.5, MemUsageMB: 1024, DiskUsageGB: 10})
+	if err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	got, err := s.GetNode(ctx, node.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.CPUUsagePercent != 42.5 || got.MemUsageMB != 1024 || got.DiskUsageGB != 10 {
+		t.Fatalf("usage not recorded: %+v", got)
+	}
+
+	if err := s.Heartbeat(ctx, NodeHeartbeatRequest{NodeID: 999}); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("heartbeat for unknown node = %v, want ErrNodeNotFound", err)
+	}
+	if _, err := s.GetNode(ctx, 999); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("get unknown node = %v, want ErrNodeNotFound", err)
+	}
+}
+
+func TestNodeServiceMarkOffline(t *testing.T) {
+	db := newTestDB(t)
+	s := NewNodeService(db)
+	stale := registerTestNode(t, s, "stale")
+	fresh := registerTestNode(t, s, "fresh")
+
+	old := time.Now().Add(-time.Hour)
+	if err := db.Model(&model.Node{}).Where("id = ?", stale.ID).Update("last_heartbeat_at", old).Error; err != nil {
+		t.Fatalf("backdate: %v", err)
+	}
+
+	n, err := s.MarkOffline(ctx, time.Minute)
+	if err != nil || n != 1 {
+		t.Fatalf("mark offline = %d, %v; want 1", n, err)
+	}
+	if got, _ := s.GetNode(ctx, stale.ID); got.Status != model.NodeStatusOffline {
+		t.Fatalf("stale node status = %s", got.Status)
+	}
+	if got, _ := s.GetNode(ctx, fresh.ID); got.Status != model.NodeStatusOnline {
+		t.Fatalf("fresh node status = %s", got.Status)
+	}
+
+	if err := s.Heartbeat(ctx, NodeHeartbeatRequest{NodeID: stale.ID}); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	if got, _ := s.GetNode(ctx, stale.ID); got.Status != model.NodeStatusOnline {
+		t.Fatalf("heartbeat did not bring node back online: %s", got.Status)
+	}
+}
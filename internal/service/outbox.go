@@ -0,0 +1,196 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/model"
+)
+
+const (
+	// maxOutboxAttempts bounds how often an event is retried before it is
+	// marked failed and left for an operator.
+	maxOutboxAttempts = 10
+	// outboxLease is how long a dispatch owns an event; an event whose
+	// dispatcher died becomes due again afterwards.
+	outboxLease = 5 * time.Minute
+)
+
+// OutboxHandler performs one outbox event. Database changes must go through
+// tx, which also removes the event, so they apply exactly once. Calls to a
+// hypervisor may be repeated and must be idempotent.
+type OutboxHandler func(ctx context.Context, tx *gorm.DB, payload json.RawMessage) error
+
+// Outbox stores side effects that must eventually happen and dispatches
+// them with retries and backoff.
+type Outbox struct {
+	db           *gorm.DB
+	pollInterval time.Duration
+	startedAt    time.Time
+
+	mu       sync.RWMutex
+	handlers map[string]OutboxHandler
+	wake     chan struct{}
+}
+
+func NewOutbox(db *gorm.DB) *Outbox {
+	return &Outbox{
+		db:           db,
+		pollInterval: 5 * time.Second,
+		startedAt:    time.Now(),
+		handlers:     make(map[string]OutboxHandler),
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Handle registers the handler for events of kind.
+func (o *Outbox) Handle(kind string, h OutboxHandler) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.handlers[kind] = h
+}
+
+func (o *Outbox) handler(kind string) OutboxHandler {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.handlers[kind]
+}
+
+func newOutboxEvent(sagaID, kind, status string, payload interface{}) (*model.OutboxEvent, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &model.OutboxEvent{
+		SagaID:      sagaID,
+		Kind:        kind,
+		Status:      status,
+		Payload:     raw,
+		AvailableAt: time.Now(),
+	}, nil
+}
+
+// Run releases compensations held by sagas of a previous master process and
+// then dispatches due events until ctx is cancelled.
+func (o *Outbox) Run(ctx context.Context, logf func(string, ...interface{})) {
+	if count, err := o.releaseAbandoned(ctx); err != nil {
+		logf("Releasing abandoned saga compensations failed: %v", err)
+	} else if count > 0 {
+		logf("Compensating %d step(s) of sagas interrupted by a restart", count)
+	}
+
+	ticker := time.NewTicker(o.pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := o.dispatchDue(ctx, logf); err != nil && ctx.Err() == nil {
+			logf("Dispatching outbox failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// releaseAbandoned turns events held before this process started into
+// pending ones. Their sagas died with the previous master and never
+// committed, so their steps have to be undone.
+func (o *Outbox) releaseAbandoned(ctx context.Context) (int64, error) {
+	res := o.db.WithContext(ctx).Model(&model.OutboxEvent{}).
+		Where("status = ? AND created_at < ?", model.OutboxStatusHeld, o.startedAt).
+		Updates(map[string]interface{}{"status": model.OutboxStatusPending, "available_at": time.Now()})
+	return res.RowsAffected, res.Error
+}
+
+func (o *Outbox) dispatchDue(ctx context.Context, logf func(string, ...interface{})) error {
+	for {
+		var events []*model.OutboxEvent
+		err := o.db.WithContext(ctx).
+			Where("status = ? AND available_at <= ?", model.OutboxStatusPending, time.Now()).
+			Order("id").Limit(20).Find(&events).Error
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		for _, ev := range events {
+			if err := o.dispatch(ctx, ev); err != nil && ctx.Err() == nil {
+				logf("Outbox event %d (%s) failed: %v", ev.ID, ev.Kind, err)
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// errOutboxBusy means another dispatch owns the event.
+var errOutboxBusy = errors.New("outbox event is being dispatched")
+
+// dispatch runs ev once. The claim moves the event's available_at past the
+// lease, so a concurrent dispatch leaves it alone; a failure then schedules
+// the retry with exponential backoff.
+func (o *Outbox) dispatch(ctx context.Context, ev *model.OutboxEvent) error {
+	now := time.Now()
+	res := o.db.WithContext(ctx).Model(&model.OutboxEvent{}).
+		Where("id = ? AND status = ? AND available_at <= ?", ev.ID, model.OutboxStatusPending, now).
+		Updates(map[string]interface{}{
+			"attempts":     gorm.Expr("attempts + 1"),
+			"available_at": now.Add(outboxLease),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errOutboxBusy
+	}
+	ev.Attempts++
+
+	h := o.handler(ev.Kind)
+	err := fmt.Errorf("no handler for outbox event %q", ev.Kind)
+	if h != nil {
+		err = o.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := h(ctx, tx, ev.Payload); err != nil {
+				return err
+			}
+			return tx.Delete(&model.OutboxEvent{}, ev.ID).Error
+		})
+	}
+	if err == nil {
+		return nil
+	}
+
+	updates := map[string]interface{}{
+		"error":        err.Error(),
+		"available_at": time.Now().Add(outboxBackoff(ev.Attempts)),
+	}
+	if ev.Attempts >= maxOutboxAttempts {
+		updates["status"] = model.OutboxStatusFailed
+	}
+	_ = o.db.WithContext(context.WithoutCancel(ctx)).Model(&model.OutboxEvent{}).Where("id = ?", ev.ID).Updates(updates).Error
+	return err
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	d := time.Second << uint(attempts)
+	if attempts > 8 || d > outboxLease {
+		return outboxLease
+	}
+	return d
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+// DefaultPlan is the plan of VMs created without one, unless the operator
+// picks another with WithDefaultPlan.
+const DefaultPlan = "default"
+
+var (
+	ErrUnknownPlan   = errors.New("unknown plan")
+	ErrPlanAdminOnly = errors.New("only admins can choose a VM's plan")
+)
+
+// Plan holds the limits that come with a VM's plan. VMs start out with
+// the plan's port speed; zero leaves a direction unlimited. TrafficGB is
+// the monthly transfer quota, zero for none.
+type Plan struct {
+	MaxSnapshots int
+	InboundMbps  int
+	OutboundMbps int
+	TrafficGB    int
+}
+
+func defaultPlans() map[string]Plan {
+	return map[string]Plan{DefaultPlan: {MaxSnapshots: 3}}
+}
+
+// WithPlans replaces the plans VMs can be created with. The default plan
+// keeps its built-in limits unless plans overrides it.
+func (s *VMService) WithPlans(plans map[string]Plan) *VMService {
+	s.plans = defaultPlans()
+	for name, plan := range plans {
+		s.plans[name] = plan
+	}
+	return s
+}
+
+// WithDefaultPlan gives VMs created without a plan the plan called name,
+// which must be one of the plans, so that they get its port speed and
+// quotas instead of the unlimited built-in default.
+func (s *VMService) WithDefaultPlan(name string) *VMService {
+	s.defaultPlan = name
+	return s
+}
+
+// plan returns the plan called name; an empty name is the default plan.
+func (s *VMService) plan(name string) (string, Plan, error) {
+	if name == "" {
+		name = s.defaultPlan
+	}
+	if name == "" {
+		name = DefaultPlan
+	}
+	plan, ok := s.plans[name]
+	if !ok {
+		return "", Plan{}, fmt.Errorf("%w: %s", ErrUnknownPlan, name)
+	}
+	return name, plan, nil
+}
+
+// PlanRequest assigns a VM a plan, such as after its owner paid for an
+// upgrade.
+type PlanRequest struct {
+	Plan string `json:"plan" binding:"required,max=32"`
+}
+
+// SetPlan moves a VM to another plan and the guest to the plan's port
+// speed. Plans are sold, so only admins can assign them.
+func (s *VMService) SetPlan(ctx context.Context, p Principal, id uint, req PlanRequest) (*model.VM, error) {
+	if !p.Admin {
+		return nil, ErrPlanAdminOnly
+	}
+	name, plan, err := s.plan(req.Plan)
+	if err != nil {
+		return nil, err
+	}
+	vm, hv, err := s.vmAndHypervisor(ctx, p, id)
+	if err != nil {
+		return nil, err
+	}
+	vm.Plan, vm.InboundMbps, vm.OutboundMbps = name, plan.InboundMbps, plan.OutboundMbps
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		columns := map[string]interface{}{"plan": vm.Plan, "inbound_mbps": vm.InboundMbps, "outbound_mbps": vm.OutboundMbps}
+		if err := tx.Model(vm).Updates(columns).Error; err != nil {
+			return err
+		}
+		// Without a driver that reshapes in place, or a guest to reshape,
+		// the new speed applies when the guest is next created.
+		bs, ok := hv.(hypervisor.BandwidthSupport)
+		if !ok || vm.Status == model.VMStatusCreating || vm.Status == model.VMStatusDeleting {
+			return nil
+		}
+		bw, err := s.bandwidth(tx, vm)
+		if err != nil {
+			return err
+		}
+		return bs.SetBandwidth(ctx, vm.HypervisorID, bw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
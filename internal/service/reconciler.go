@@ -0,0 +1,309 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+// Kinds of discrepancy the reconciler reports.
+const (
+	DiscrepancyDrift       = "drift"
+	DiscrepancyMissing     = "missing"
+	DiscrepancyOrphan      = "orphan"
+	DiscrepancyStuck       = "stuck"
+	DiscrepancyUnreachable = "unreachable"
+)
+
+// Discrepancy is one difference between the database and a hypervisor.
+// Fixed says whether the reconciler corrected the database; orphans and
+// unreachable hypervisors are only reported.
+type Discrepancy struct {
+	Kind         string `json:"kind"`
+	VMID         *uint  `json:"vm_id,omitempty"`
+	NodeID       *uint  `json:"node_id,omitempty"`
+	HypervisorID string `json:"hypervisor_id,omitempty"`
+	Expected     string `json:"expected,omitempty"`
+	Actual       string `json:"actual,omitempty"`
+	Detail       string `json:"detail,omitempty"`
+	Fixed        bool   `json:"fixed"`
+}
+
+type ReconcileReport struct {
+	StartedAt     time.Time      `json:"started_at"`
+	FinishedAt    time.Time      `json:"finished_at"`
+	Hypervisors   int            `json:"hypervisors"`
+	VMsChecked    int            `json:"vms_checked"`
+	Discrepancies []*Discrepancy `json:"discrepancies"`
+}
+
+// Reconciler compares model.VM rows with what each hypervisor actually runs
+// and pulls the database back in line with reality.
+type Reconciler struct {
+	vms        *VMService
+	staleAfter time.Duration
+
+	run  sync.Mutex
+	mu   sync.RWMutex
+	last *ReconcileReport
+}
+
+// NewReconciler builds a reconciler over the hypervisors vms drives. VMs
+// held in a transitional state for longer than staleAfter are considered
+// abandoned by a crashed operation.
+func NewReconciler(vms *VMService, staleAfter time.Duration) *Reconciler {
+	return &Reconciler{vms: vms, staleAfter: staleAfter}
+}
+
+// LastReport returns the most recent report, or nil before the first pass.
+func (r *Reconciler) LastReport() *ReconcileReport {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.last
+}
+
+// Run reconciles every interval until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration, logf func(string, ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.Reconcile(ctx, logf); err != nil && ctx.Err() == nil {
+				logf("Reconciliation failed: %v", err)
+			}
+		}
+	}
+}
+
+// Reconcile performs one pass and logs each discrepancy through logf.
+func (r *Reconciler) Reconcile(ctx context.Context, logf func(string, ...interface{})) (*ReconcileReport, error) {
+	r.run.Lock()
+	defer r.run.Unlock()
+
+	report := &ReconcileReport{StartedAt: time.Now(), Discrepancies: []*Discrepancy{}}
+	targets, err := r.targets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// A guest only counts as an orphan if no row anywhere claims it: VMs
+	// created before scheduling have no node but live on one.
+	var ids []string
+	if err := r.vms.db.WithContext(ctx).Model(&model.VM{}).Pluck("hypervisor_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		known[id] = true
+	}
+	for _, t := range targets {
+		if err := r.reconcileTarget(ctx, t, known, report); err != nil {
+			return nil, err
+		}
+	}
+	report.FinishedAt = time.Now()
+
+	for _, d := range report.Discrepancies {
+		logf("Reconcile: %s", d)
+	}
+	r.mu.Lock()
+	r.last = report
+	r.mu.Unlock()
+	return report, nil
+}
+
+func (d *Discrepancy) String() string {
+	s := d.Kind
+	if d.VMID != nil {
+		s += fmt.Sprintf(" vm=%d", *d.VMID)
+	}
+	if d.NodeID != nil {
+		s += fmt.Sprintf(" node=%d", *d.NodeID)
+	}
+	if d.HypervisorID != "" {
+		s += " guest=" + d.HypervisorID
+	}
+	if d.Expected != "" || d.Actual != "" {
+		s += fmt.Sprintf(" db=%s actual=%s", d.Expected, d.Actual)
+	}
+	if d.Detail != "" {
+		s += " (" + d.Detail + ")"
+	}
+	if d.Fixed {
+		s += " [fixed]"
+	}
+	return s
+}
+
+// reconcileTarget is one hypervisor and the VM rows that belong to it.
+type reconcileTarget struct {
+	nodeID *uint
+	hv     hypervisor.Hypervisor
+}
+
+// targets lists the default hypervisor plus one per online node. Offline
+// nodes are skipped; their VMs cannot be observed.
+func (r *Reconciler) targets(ctx context.Context) ([]reconcileTarget, error) {
+	var targets []reconcileTarget
+	if r.vms.hypervisor != nil {
+		targets = append(targets, reconcileTarget{hv: r.vms.hypervisor})
+	}
+	if r.vms.nodes == nil {
+		return targets, nil
+	}
+	var nodes []*model.Node
+	if err := r.vms.db.WithContext(ctx).Where("status = ?", model.NodeStatusOnline).Order("id").Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		id := n.ID
+		targets = append(targets, reconcileTarget{nodeID: &id, hv: r.vms.nodes.ForNode(n)})
+	}
+	return targets, nil
+}
+
+func (r *Reconciler) reconcileTarget(ctx context.Context, t reconcileTarget, known map[string]bool, report *ReconcileReport) error {
+	// Rows are read before guests are listed, so an operation that
+	// finishes in between makes the conditional status update miss instead
+	// of reverting it.
+	q := r.vms.db.WithContext(ctx)
+	if t.nodeID == nil {
+		q = q.Where("node_id IS NULL")
+	} else {
+		q = q.Where("node_id = ?", *t.nodeID)
+	}
+	var rows []*model.VM
+	if err := q.Find(&rows).Error; err != nil {
+		return err
+	}
+	guests, err := t.hv.ListVMs(ctx)
+	if err != nil {
+		report.Discrepancies = append(report.Discrepancies, &Discrepancy{
+			Kind: DiscrepancyUnreachable, NodeID: t.nodeID, Detail: err.Error(),
+		})
+		return nil
+	}
+	report.Hypervisors++
+	report.VMsChecked += len(rows)
+
+	actual := make(map[string]*hypervisor.VMInfo, len(guests))
+	for _, g := range guests {
+		actual[g.ID] = g
+	}
+	for _, vm := range rows {
+		d, err := r.reconcileVM(ctx, vm, actual[vm.HypervisorID])
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			d.NodeID = t.nodeID
+			report.Discrepancies = append(report.Discrepancies, d)
+		}
+	}
+	for _, g := range guests {
+		if !known[g.ID] && !hasRow(rows, g.ID) {
+			report.Discrepancies = append(report.Discrepancies, &Discrepancy{
+				Kind: DiscrepancyOrphan, NodeID: t.nodeID, HypervisorID: g.ID, Actual: g.Status,
+				Detail: "guest " + g.Name + " has no VM record",
+			})
+		}
+	}
+	return nil
+}
+
+// reconcileVM compares one row with its guest, which is nil when the
+// hypervisor does not know it.
+func (r *Reconciler) reconcileVM(ctx context.Context, vm *model.VM, guest *hypervisor.VMInfo) (*Discrepancy, error) {
+	id := vm.ID
+	d := &Discrepancy{VMID: &id, HypervisorID: vm.HypervisorID, Expected: vm.Status}
+
+	if isTransitional(vm.Status) {
+		if time.Since(vm.UpdatedAt) < r.staleAfter {
+			return nil, nil
+		}
+		// A queued or running task still owns the state, however long it
+		// takes to get to it.
+		var tasks int64
+		err := r.vms.db.WithContext(ctx).Model(&model.Task{}).
+			Where("vm_id = ? AND status IN ?", vm.ID, []string{model.TaskStatusPending, model.TaskStatusRunning}).
+			Count(&tasks).Error
+		if err != nil || tasks > 0 {
+			return nil, err
+		}
+		// The operation that owned this state is gone. Settle on what the
+		// hypervisor reports, or error if the guest never appeared.
+		d.Kind = DiscrepancyStuck
+		to := model.VMStatusError
+		if guest != nil {
+			if s, ok := guestStatus(guest); ok {
+				to = s
+			}
+			d.Actual = guest.Status
+		}
+		fixed, err := r.vms.reconcileStatus(ctx, vm, to, "abandoned in "+vm.Status)
+		d.Fixed = fixed
+		return d, err
+	}
+
+	if guest == nil {
+		if vm.Status == model.VMStatusError {
+			return nil, nil
+		}
+		d.Kind = DiscrepancyMissing
+		fixed, err := r.vms.reconcileStatus(ctx, vm, model.VMStatusError, "guest missing on hypervisor")
+		d.Fixed = fixed
+		return d, err
+	}
+
+	actual, ok := guestStatus(guest)
+	if !ok || actual == vm.Status {
+		return nil, nil
+	}
+	// The guest of a suspended VM is simply shut off.
+	if vm.Status == model.VMStatusSuspended && actual == model.VMStatusStopped {
+		return nil, nil
+	}
+	d.Kind = DiscrepancyDrift
+	d.Actual = guest.Status
+	fixed, err := r.vms.reconcileStatus(ctx, vm, actual, "status drift")
+	d.Fixed = fixed
+	return d, err
+}
+
+func hasRow(rows []*model.VM, hypervisorID string) bool {
+	for _, vm := range rows {
+		if vm.HypervisorID == hypervisorID {
+			return true
+		}
+	}
+	return false
+}
+
+func isTransitional(status string) bool {
+	switch status {
+	case model.VMStatusCreating, model.VMStatusStarting, model.VMStatusStopping,
+		model.VMStatusResizing, model.VMStatusReinstalling, model.VMStatusReverting,
+		model.VMStatusBackingUp, model.VMStatusRestoring, model.VMStatusDeleting:
+		return true
+	}
+	return false
+}
+
+// guestStatus maps a hypervisor status onto the VM lifecycle. A paused
+// guest has no VM status; VMStatusSuspended is a hold placed by the
+// platform, not something the hypervisor reports.
+func guestStatus(g *hypervisor.VMInfo) (string, bool) {
+	switch g.Status {
+	case "running":
+		return model.VMStatusRunning, true
+	case "stopped":
+		return model.VMStatusStopped, true
+	}
+	return "", false
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func discardf(string, ...interface{}) {}
+
+func findDiscrepancy(report *ReconcileReport, kind string) *Discrepancy {
+	for _, d := range report.Discrepancies {
+		if d.Kind == kind {
+			return d
+		}
+	}
+	return nil
+}
+
+func TestReconcilerFixesDrift(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	if err := hv.StartVM(ctx, vm.HypervisorID); err != nil {
+		t.Fatalf("start guest: %v", err)
+	}
+
+	r := NewReconciler(s, time.Minute)
+	report, err := r.Reconcile(ctx, discardf)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	d := findDiscrepancy(report, DiscrepancyDrift)
+	if d == nil || !d.Fixed || d.Expected != model.VMStatusStopped || d.Actual != "running" {
+		t.Fatalf("expected fixed drift, got %+v", report.Discrepancies)
+	}
+	assertStatus(t, s, hv, vm, model.VMStatusRunning)
+
+	history, _ := s.History(ctx, owner, vm.ID)
+	if last := history[len(history)-1]; last.Action != actionReconcile || last.ToStatus != model.VMStatusRunning {
+		t.Fatalf("unexpected last transition %+v", last)
+	}
+	if r.LastReport() != report {
+		t.Fatal("last report not kept")
+	}
+
+	if report, _ := r.Reconcile(ctx, discardf); len(report.Discrepancies) != 0 {
+		t.Fatalf("second pass found %+v", report.Discrepancies)
+	}
+}
+
+func TestReconcilerMissingAndOrphan(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	if err := hv.DeleteVM(ctx, vm.HypervisorID); err != nil {
+		t.Fatalf("delete guest: %v", err)
+	}
+	orphan, err := hv.CreateVM(ctx, hypervisor.VMConfig{Name: "stray", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("create guest: %v", err)
+	}
+
+	report, err := NewReconciler(s, time.Minute).Reconcile(ctx, discardf)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if d := findDiscrepancy(report, DiscrepancyMissing); d == nil || !d.Fixed || *d.VMID != vm.ID {
+		t.Fatalf("expected fixed missing guest, got %+v", report.Discrepancies)
+	}
+	if got, _ := s.GetVMByID(ctx, owner, vm.ID); got.Status != model.VMStatusError {
+		t.Fatalf("status = %q, want error", got.Status)
+	}
+	if d := findDiscrepancy(report, DiscrepancyOrphan); d == nil || d.Fixed || d.HypervisorID != orphan.ID {
+		t.Fatalf("expected unfixed orphan, got %+v", report.Discrepancies)
+	}
+	if _, ok := hv.VM(orphan.ID); !ok {
+		t.Fatal("orphan guest was removed")
+	}
+}
+
+func TestReconcilerSettlesStaleTransitions(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	vm := createTestVM(t, s)
+	if err := hv.StartVM(ctx, vm.HypervisorID); err != nil {
+		t.Fatalf("start guest: %v", err)
+	}
+	db.Model(&model.VM{}).Where("id = ?", vm.ID).Update("status", model.VMStatusStarting)
+
+	r := NewReconciler(s, time.Hour)
+	report, _ := r.Reconcile(ctx, discardf)
+	if len(report.Discrepancies) != 0 {
+		t.Fatalf("fresh transition should be left alone, got %+v", report.Discrepancies)
+	}
+
+	db.Model(&model.VM{}).Where("id = ?", vm.ID).UpdateColumn("updated_at", time.Now().Add(-2*time.Hour))
+	// A task still waiting for a worker keeps the VM in its state.
+	task := &model.Task{Type: TaskVMResize, Status: model.TaskStatusPending, UserID: owner.UserID, VMID: &vm.ID, Payload: []byte("{}")}
+	if err := db.Create(task).Error; err != nil {
+		t.Fatalf("create task: %v", err)
+	}
+	report, _ = r.Reconcile(ctx, discardf)
+	if len(report.Discrepancies) != 0 {
+		t.Fatalf("VM with a pending task should be left alone, got %+v", report.Discrepancies)
+	}
+
+	db.Model(task).Update("status", model.TaskStatusFailed)
+	report, _ = r.Reconcile(ctx, discardf)
+	if d := findDiscrepancy(report, DiscrepancyStuck); d == nil || !d.Fixed {
+		t.Fatalf("expected settled stuck vm, got %+v", report.Discrepancies)
+	}
+	assertStatus(t, s, hv, vm, model.VMStatusRunning)
+}
+
+func TestReconcilerSkipsUnreachableNodes(t *testing.T) {
+	s, hv, node := newScheduledVMService(t, 4, 4096, 100)
+	vm := createTestVM(t, s)
+	hv.Inject(hypervisor.MethodListVMs, hypervisor.Fault{Err: errInjected})
+
+	report, err := NewReconciler(s, time.Minute).Reconcile(ctx, discardf)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	d := findDiscrepancy(report, DiscrepancyUnreachable)
+	if d == nil || d.NodeID == nil || *d.NodeID != node.ID || report.Hypervisors != 0 {
+		t.Fatalf("expected unreachable node, got %+v", report.Discrepancies)
+	}
+	if got, _ := s.GetVMByID(ctx, owner, vm.ID); got.Status != model.VMStatusStopped {
+		t.Fatalf("vm on unreachable node changed to %q", got.Status)
+	}
+}
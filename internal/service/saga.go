@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/model"
+)
+
+// saga coordinates an operation that changes both a hypervisor and the
+// database. After each step with an effect outside the final transaction
+// it holds the compensation for that step in the outbox. The final
+// transaction discards the held compensations together with its own
+// changes, so the operation either commits as a whole or its steps are
+// undone: by abort when a later step fails, or by the outbox after a
+// restart if the master died in the middle. Only a crash between a step
+// and its hold escapes this; the reconciler reports what it leaves behind.
+type saga struct {
+	id     string
+	outbox *Outbox
+}
+
+func (s *VMService) newSaga() *saga {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &saga{id: hex.EncodeToString(b), outbox: s.outbox}
+}
+
+// hold records how to undo a step that has just succeeded. It ignores
+// cancellation of ctx: once the step happened, its undo must be recorded.
+func (sg *saga) hold(ctx context.Context, kind string, payload interface{}) error {
+	ev, err := newOutboxEvent(sg.id, kind, model.OutboxStatusHeld, payload)
+	if err != nil {
+		return err
+	}
+	return sg.outbox.db.WithContext(context.WithoutCancel(ctx)).Create(ev).Error
+}
+
+// commit discards the held compensations. It belongs in the transaction
+// that makes the operation's outcome durable.
+func (sg *saga) commit(tx *gorm.DB) error {
+	return tx.Where("saga_id = ? AND status = ?", sg.id, model.OutboxStatusHeld).Delete(&model.OutboxEvent{}).Error
+}
+
+// abort releases the held compensations and runs them, newest first.
+// Compensations that fail stay in the outbox and are retried from there.
+func (sg *saga) abort(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	db := sg.outbox.db.WithContext(ctx)
+	var events []*model.OutboxEvent
+	if err := db.Where("saga_id = ? AND status = ?", sg.id, model.OutboxStatusHeld).Order("id DESC").Find(&events).Error; err != nil || len(events) == 0 {
+		return
+	}
+	err := db.Model(&model.OutboxEvent{}).
+		Where("saga_id = ? AND status = ?", sg.id, model.OutboxStatusHeld).
+		Updates(map[string]interface{}{"status": model.OutboxStatusPending, "available_at": time.Now()}).Error
+	if err != nil {
+		return
+	}
+	for _, ev := range events {
+		if err := sg.outbox.dispatch(ctx, ev); err != nil {
+			sg.outbox.notify()
+		}
+	}
+}
+
+// forward hands the remaining step of a saga past its point of no return to
+// the outbox, which retries it until it succeeds. The held compensations
+// are discarded in the same transaction, since the steps before are now
+// kept rather than undone.
+func (sg *saga) forward(ctx context.Context, kind string, payload interface{}) error {
+	ctx = context.WithoutCancel(ctx)
+	ev, err := newOutboxEvent(sg.id, kind, model.OutboxStatusPending, payload)
+	if err != nil {
+		return err
+	}
+	err = sg.outbox.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := sg.commit(tx); err != nil {
+			return err
+		}
+		return tx.Create(ev).Error
+	})
+	if err != nil {
+		return err
+	}
+	if err := sg.outbox.dispatch(ctx, ev); err != nil {
+		sg.outbox.notify()
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+// failVMWrites makes updates and deletes of VM rows fail while *fail is set,
+// standing in for a database that breaks after the hypervisor call.
+func failVMWrites(t *testing.T, db *gorm.DB, fail *bool) {
+	t.Helper()
+	inject := func(tx *gorm.DB) {
+		if *fail && tx.Statement.Table == "vms" {
+			_ = tx.AddError(errInjected)
+		}
+	}
+	if err := db.Callback().Update().Before("gorm:update").Register("test:fail_vm_update", inject); err != nil {
+		t.Fatalf("register callback: %v", err)
+	}
+	if err := db.Callback().Delete().Before("gorm:delete").Register("test:fail_vm_delete", inject); err != nil {
+		t.Fatalf("register callback: %v", err)
+	}
+}
+
+func outboxEvents(t *testing.T, db *gorm.DB) []*model.OutboxEvent {
+	t.Helper()
+	var events []*model.OutboxEvent
+	if err := db.Order("id").Find(&events).Error; err != nil {
+		t.Fatalf("list outbox: %v", err)
+	}
+	return events
+}
+
+// makeDue lets pending events run now instead of after their backoff.
+func makeDue(db *gorm.DB) {
+	db.Model(&model.OutboxEvent{}).Where("1 = 1").Update("available_at", time.Now().Add(-time.Second))
+}
+
+func TestCreateSagaCompensatesFailedCommit(t *testing.T) {
+	s, hv, node := newScheduledVMService(t, 4, 4096, 100)
+	fail := true
+	failVMWrites(t, s.db, &fail)
+
+	_, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 2, MemoryMB: 1024, DiskGB: 10})
+	if !errors.Is(err, errInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	if hv.Count() != 0 {
+		t.Fatalf("guest leaked: %d guests", hv.Count())
+	}
+	if n := reloadNode(t, s.db, node.ID); n.CPUUsed != 0 || n.MenUsed != 0 || n.DiskUsed != 0 {
+		t.Fatalf("reservation leaked: %+v", n)
+	}
+	if events := outboxEvents(t, s.db); len(events) != 0 {
+		t.Fatalf("outbox not drained: %+v", events)
+	}
+}
+
+func TestCreateSagaRetriesFailedCompensation(t *testing.T) {
+	s, hv, node := newScheduledVMService(t, 4, 4096, 100)
+	fail := true
+	failVMWrites(t, s.db, &fail)
+	hv.Inject(hypervisor.MethodDeleteVM, hypervisor.Fault{Err: errInjected, Times: 1})
+
+	if _, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 2, MemoryMB: 1024, DiskGB: 10}); err == nil {
+		t.Fatal("expected create to fail")
+	}
+	if hv.Count() != 1 {
+		t.Fatalf("expected the guest to survive the failed compensation, got %d guests", hv.Count())
+	}
+	if n := reloadNode(t, s.db, node.ID); n.CPUUsed != 0 {
+		t.Fatalf("reservation not released: %+v", n)
+	}
+	events := outboxEvents(t, s.db)
+	if len(events) != 1 || events[0].Kind != outboxDeleteGuest || events[0].Status != model.OutboxStatusPending {
+		t.Fatalf("expected pending guest deletion, got %+v", events)
+	}
+
+	makeDue(s.db)
+	if err := s.outbox.dispatchDue(ctx, discardf); err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	if hv.Count() != 0 || len(outboxEvents(t, s.db)) != 0 {
+		t.Fatalf("retry did not delete the guest: %d guests", hv.Count())
+	}
+}
+
+func TestOutboxCompensatesAbandonedSaga(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	info, err := hv.CreateVM(ctx, hypervisor.VMConfig{Name: "half-made", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("create guest: %v", err)
+	}
+	// A saga of a master that died after creating the guest.
+	if err := s.newSaga().hold(ctx, outboxDeleteGuest, deleteGuestPayload{HypervisorID: info.ID}); err != nil {
+		t.Fatalf("hold: %v", err)
+	}
+	s.db.Model(&model.OutboxEvent{}).Where("1 = 1").UpdateColumn("created_at", time.Now().Add(-time.Hour))
+	// One held by a saga still running in this process.
+	if err := s.newSaga().hold(ctx, outboxDeleteGuest, deleteGuestPayload{HypervisorID: "live"}); err != nil {
+		t.Fatalf("hold: %v", err)
+	}
+
+	if n, err := s.outbox.releaseAbandoned(ctx); err != nil || n != 1 {
+		t.Fatalf("release = %d, %v; want 1", n, err)
+	}
+	if err := s.outbox.dispatchDue(ctx, discardf); err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	if hv.Count() != 0 {
+		t.Fatal("abandoned guest not deleted")
+	}
+	if events := outboxEvents(t, s.db); len(events) != 1 || events[0].Status != model.OutboxStatusHeld {
+		t.Fatalf("live saga's compensation touched: %+v", events)
+	}
+}
+
+func TestDeleteSagaRetriesPurge(t *testing.T) {
+	s, hv, node := newScheduledVMService(t, 4, 4096, 100)
+	vm := createTestVM(t, s)
+	fail := true
+	failVMWrites(t, s.db, &fail)
+	// Only the purge should fail, not the move to deleting.
+	_ = s.db.Callback().Update().Remove("test:fail_vm_update")
+	if err := s.DeleteVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, ok := hv.VM(vm.HypervisorID); ok {
+		t.Fatal("guest not deleted")
+	}
+	got, _ := s.GetVMByID(ctx, owner, vm.ID)
+	if got == nil || got.Status != model.VMStatusDeleting {
+		t.Fatalf("expected row left in deleting, got %+v", got)
+	}
+
+	fail = false
+	makeDue(s.db)
+	if err := s.outbox.dispatchDue(ctx, discardf); err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	if got, _ := s.GetVMByID(ctx, owner, vm.ID); got != nil {
+		t.Fatalf("row not purged: %+v", got)
+	}
+	if n := reloadNode(t, s.db, node.ID); n.CPUUsed != 0 {
+		t.Fatalf("allocation not released: %+v", n)
+	}
+}
+
+func TestDeletePurgeIsAtomic(t *testing.T) {
+	s, _, node := newScheduledVMService(t, 4, 4096, 100)
+	vm := createTestVM(t, s)
+	// The purge fails after the row is gone but before the node's
+	// allocation is handed back.
+	fail := true
+	err := s.db.Callback().Delete().Before("gorm:delete").Register("test:fail_groups", func(tx *gorm.DB) {
+		if fail && tx.Statement.Table == "vm_security_groups" {
+			_ = tx.AddError(errInjected)
+		}
+	})
+	if err != nil {
+		t.Fatalf("register callback: %v", err)
+	}
+	if err := s.DeleteVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	got, _ := s.GetVMByID(ctx, owner, vm.ID)
+	if got == nil || got.Status != model.VMStatusDeleting {
+		t.Fatalf("expected row left in deleting, got %+v", got)
+	}
+
+	fail = false
+	makeDue(s.db)
+	if err := s.outbox.dispatchDue(ctx, discardf); err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	if n := reloadNode(t, s.db, node.ID); n.CPUUsed != 0 {
+		t.Fatalf("allocation not released: %+v", n)
+	}
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/model"
+)
+
+const (
+	PolicySpread  = "spread"
+	PolicyBinPack = "binpack"
+)
+
+var ErrNoCapacity = errors.New("insufficient node capacity")
+
+// Scheduler places VMs on nodes and reserves their capacity there.
+type Scheduler struct {
+	db     *gorm.DB
+	policy string
+}
+
+func NewScheduler(db *gorm.DB, policy string) (*Scheduler, error) {
+	switch policy {
+	case "":
+		policy = PolicySpread
+	case PolicySpread, PolicyBinPack:
+	default:
+		return nil, fmt.Errorf("unknown scheduler policy %q", policy)
+	}
+	return &Scheduler{db: db, policy: policy}, nil
+}
+
+// Reserve picks a node for res according to the policy and claims the
+// capacity on it. The claim is a conditional update, so two concurrent
+// reservations can never overbook a node; losing a race just moves on to
+// the next candidate.
+func (s *Scheduler) Reserve(ctx context.Context, res Resources) (*model.Node, error) {
+	var nodes []*model.Node
+	err := s.db.WithContext(ctx).
+		Where("status = ?", model.NodeStatusOnline).
+		Where("cpu_used + ? <= cpu_total * cpu_overcommit AND men_used + ? <= mem_total * mem_overcommit AND disk_used + ? <= disk_total",
+			res.CPU, res.MemoryMB, res.DiskGB).
+		Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+	s.rank(nodes, res)
+
+	// Only claim on nodes that are still online at update time. A node
+	// that went offline since it was listed is not found and skipped.
+	online := s.db.WithContext(ctx).Where("status = ?", model.NodeStatusOnline).Session(&gorm.Session{})
+	for _, node := range nodes {
+		err := adjustNode(online, node.ID, res)
+		if errors.Is(err, ErrNoCapacity) || errors.Is(err, ErrNodeNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		node.CPUUsed += res.CPU
+		node.MenUsed += res.MemoryMB
+		node.DiskUsed += res.DiskGB
+		return node, nil
+	}
+	return nil, ErrNoCapacity
+}
+
+// rank orders candidates best-first. Both policies score a node by the
+// average fraction of its (overcommitted) CPU, memory and disk left free
+// after placing res; spread takes the highest score, binpack the lowest.
+func (s *Scheduler) rank(nodes []*model.Node, res Resources) {
+	score := func(n *model.Node) float64 {
+		return (freeFraction(n.CPUCapacity(), n.CPUUsed+res.CPU) +
+			freeFraction(n.MemCapacity(), n.MenUsed+res.MemoryMB) +
+			freeFraction(n.DiskTotal, n.DiskUsed+res.DiskGB)) / 3
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		si, sj := score(nodes[i]), score(nodes[j])
+		if si == sj {
+			return nodes[i].ID < nodes[j].ID
+		}
+		if s.policy == PolicyBinPack {
+			return si < sj
+		}
+		return si > sj
+	})
+}
+
+func freeFraction(total, used int) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(total-used) / float64(total)
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func createTestNode(t *testing.T, db *gorm.DB, name string, cpu, memMB, diskGB int) *model.Node {
+	t.Helper()
+	node := &model.Node{
+		Name: name, Hostname: name, CPUTotal: cpu, MemTotal: memMB, DiskTotal: diskGB,
+		Status: model.NodeStatusOnline,
+	}
+	if err := db.Create(node).Error; err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	return node
+}
+
+func reloadNode(t *testing.T, db *gorm.DB, id uint) *model.Node {
+	t.Helper()
+	var node model.Node
+	if err := db.First(&node, id).Error; err != nil {
+		t.Fatalf("reload node: %v", err)
+	}
+	return &node
+}
+
+func TestSchedulerPolicies(t *testing.T) {
+	res := Resources{CPU: 2, MemoryMB: 2048, DiskGB: 20}
+	for _, tc := range []struct {
+		policy string
+		want   string
+	}{
+		{PolicySpread, "big"},
+		{PolicyBinPack, "small"},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			db := newTestDB(t)
+			createTestNode(t, db, "small", 4, 4096, 100)
+			createTestNode(t, db, "big", 32, 65536, 1000)
+
+			sched, err := NewScheduler(db, tc.policy)
+			if err != nil {
+				t.Fatalf("new scheduler: %v", err)
+			}
+			node, err := sched.Reserve(ctx, res)
+			if err != nil {
+				t.Fatalf("reserve: %v", err)
+			}
+			if node.Name != tc.want {
+				t.Fatalf("placed on %s, want %s", node.Name, tc.want)
+			}
+			got := reloadNode(t, db, node.ID)
+			if got.CPUUsed != 2 || got.MenUsed != 2048 || got.DiskUsed != 20 {
+				t.Fatalf("reservation not recorded: %+v", got)
+			}
+		})
+	}
+}
+
+func TestSchedulerSkipsFullAndOfflineNodes(t *testing.T) {
+	db := newTestDB(t)
+	full := createTestNode(t, db, "full", 2, 2048, 100)
+	offline := createTestNode(t, db, "offline", 64, 65536, 1000)
+	db.Model(full).Update("cpu_used", 2)
+	db.Model(offline).Update("status", model.NodeStatusOffline)
+
+	sched, _ := NewScheduler(db, "")
+	if _, err := sched.Reserve(ctx, Resources{CPU: 1, MemoryMB: 512, DiskGB: 10}); !errors.Is(err, ErrNoCapacity) {
+		t.Fatalf("reserve = %v, want ErrNoCapacity", err)
+	}
+}
+
+func TestSchedulerSkipsNodeGoingOffline(t *testing.T) {
+	db := newTestDB(t)
+	big := createTestNode(t, db, "big", 32, 65536, 1000)
+	small := createTestNode(t, db, "small", 4, 4096, 100)
+	sched, _ := NewScheduler(db, PolicySpread)
+
+	// The best candidate goes offline between listing and claiming.
+	var once sync.Once
+	err := db.Callback().Update().Before("gorm:update").Register("test:offline", func(tx *gorm.DB) {
+		once.Do(func() {
+			tx.Session(&gorm.Session{NewDB: true, SkipHooks: true}).Exec("UPDATE nodes SET status = ? WHERE id = ?", model.NodeStatusOffline, big.ID)
+		})
+	})
+	if err != nil {
+		t.Fatalf("register callback: %v", err)
+	}
+	node, err := sched.Reserve(ctx, Resources{CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	if node.ID != small.ID {
+		t.Fatalf("placed on %s, want small", node.Name)
+	}
+	if got := reloadNode(t, db, big.ID); got.CPUUsed != 0 {
+		t.Fatalf("offline node claimed: %+v", got)
+	}
+}
+
+func TestSchedulerReserveIsAtomic(t *testing.T) {
+	db := newTestDB(t)
+	node := createTestNode(t, db, "n1", 5, 5120, 50)
+	sched, _ := NewScheduler(db, PolicyBinPack)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	placed := 0
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := sched.Reserve(ctx, Resources{CPU: 1, MemoryMB: 1024, DiskGB: 10}); err == nil {
+				mu.Lock()
+				placed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if placed != 5 {
+		t.Fatalf("placed %d VMs, want 5", placed)
+	}
+	if got := reloadNode(t, db, node.ID); got.CPUUsed != 5 {
+		t.Fatalf("cpu_used = %d, want 5", got.CPUUsed)
+	}
+}
+
+func TestNewSchedulerRejectsUnknownPolicy(t *testing.T) {
+	if _, err := NewScheduler(newTestDB(t), "random"); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
+
+type fakeNodeHypervisors map[uint]*hypervisor.FakeHypervisor
+
+func (f fakeNodeHypervisors) ForNode(node *model.Node) hypervisor.Hypervisor {
+	return f[node.ID]
+}
+
+func TestVMServiceSchedulesOnNodes(t *testing.T) {
+	db := newTestDB(t)
+	n1 := createTestNode(t, db, "n1", 8, 8192, 100)
+	n2 := createTestNode(t, db, "n2", 8, 8192, 100)
+	nodes := fakeNodeHypervisors{n1.ID: hypervisor.NewFakeHypervisor(), n2.ID: hypervisor.NewFakeHypervisor()}
+	sched, _ := NewScheduler(db, PolicySpread)
+	s := NewVMService(db, hypervisor.NewFakeHypervisor()).WithScheduler(sched, nodes)
+
+	first := createTestVM(t, s)
+	second := createTestVM(t, s)
+	if first.NodeID == nil || second.NodeID == nil || *first.NodeID == *second.NodeID {
+		t.Fatalf("spread policy placed both VMs on the same node: %v %v", first.NodeID, second.NodeID)
+	}
+	if _, ok := nodes[*first.NodeID].VM(first.HypervisorID); !ok {
+		t.Fatal("guest not created on the scheduled node")
+	}
+
+	if err := s.StartVM(ctx, owner, first.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if info, _ := nodes[*first.NodeID].VM(first.HypervisorID); info.Status != "running" {
+		t.Fatalf("start was not routed to the VM's node: %+v", info)
+	}
+
+	if err := s.DeleteVM(ctx, owner, first.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got := reloadNode(t, db, *first.NodeID); got.CPUUsed != 0 || got.MenUsed != 0 || got.DiskUsed != 0 {
+		t.Fatalf("capacity not released on delete: %+v", got)
+	}
+}
+
+func TestVMServiceReleasesOnCreateFailure(t *testing.T) {
+	db := newTestDB(t)
+	n1 := createTestNode(t, db, "n1", 8, 8192, 100)
+	hv := hypervisor.NewFakeHypervisor()
+	hv.Inject(hypervisor.MethodCreateVM, hypervisor.Fault{Err: errInjected})
+	sched, _ := NewScheduler(db, PolicySpread)
+	s := NewVMService(db, nil).WithScheduler(sched, fakeNodeHypervisors{n1.ID: hv})
+
+	if _, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 2, MemoryMB: 2048, DiskGB: 20}); !errors.Is(err, errInjected) {
+		t.Fatalf("create = %v, want injected error", err)
+	}
+	if got := reloadNode(t, db, n1.ID); got.CPUUsed != 0 {
+		t.Fatalf("reservation leaked: %+v", got)
+	}
+}
@@ -0,0 +1,497 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"StarstreamAstra/internal/firewall"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+var (
+	ErrSecurityGroupNotFound = errors.New("security group not found")
+	ErrSecurityGroupExists   = errors.New("a security group with this name already exists")
+	ErrSecurityGroupInUse    = errors.New("security group is attached to VMs")
+	ErrInvalidRule           = errors.New("invalid security group rule")
+	ErrNoGuestAddress        = errors.New("VM has no address to filter")
+)
+
+// SecurityGroupService manages security groups and the VMs they are
+// attached to. Like port forwards, the rules of a node's VMs are pushed to
+// the node as one ruleset whenever they change there, and Run pushes every
+// node's ruleset again periodically.
+type SecurityGroupService struct {
+	db  *gorm.DB
+	vms *VMService
+}
+
+func NewSecurityGroupService(db *gorm.DB, vms *VMService) *SecurityGroupService {
+	return &SecurityGroupService{db: db, vms: vms}
+}
+
+// WithSecurityGroups has deleted VMs dropped from their node's firewall.
+func (s *VMService) WithSecurityGroups(g *SecurityGroupService) *VMService {
+	s.groups = g
+	s.outbox.Handle(outboxApplyFirewall, g.applyEvent)
+	return s
+}
+
+type SecurityGroupRuleRequest struct {
+	Direction   string `json:"direction" binding:"required,oneof=ingress egress"`
+	Protocol    string `json:"protocol" binding:"required,oneof=tcp udp icmp any"`
+	PortFrom    int    `json:"port_from" binding:"min=0,max=65535"`
+	PortTo      int    `json:"port_to" binding:"min=0,max=65535"`
+	CIDR        string `json:"cidr" binding:"required"`
+	Description string `json:"description" binding:"max=255"`
+}
+
+// SecurityGroupRequest creates a group or replaces one with all its rules.
+type SecurityGroupRequest struct {
+	Name        string                     `json:"name" binding:"required,max=64"`
+	Description string                     `json:"description" binding:"max=255"`
+	Rules       []SecurityGroupRuleRequest `json:"rules" binding:"max=100,dive"`
+}
+
+// SecurityGroupDetail is a group with its rules and the VMs it is attached
+// to.
+type SecurityGroupDetail struct {
+	*model.SecurityGroup
+	Rules []*model.SecurityGroupRule `json:"rules"`
+	VMIDs []uint                     `json:"vm_ids"`
+}
+
+func (s *SecurityGroupService) CreateGroup(ctx context.Context, p Principal, req SecurityGroupRequest) (*SecurityGroupDetail, error) {
+	rules, err := groupRules(req.Rules)
+	if err != nil {
+		return nil, err
+	}
+	group := &model.SecurityGroup{UserID: p.UserID, Name: req.Name, Description: req.Description}
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := checkGroupName(tx, p.UserID, req.Name, 0); err != nil {
+			return err
+		}
+		if err := tx.Create(group).Error; err != nil {
+			return err
+		}
+		return createRules(tx, group.ID, rules)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SecurityGroupDetail{SecurityGroup: group, Rules: rules, VMIDs: []uint{}}, nil
+}
+
+func (s *SecurityGroupService) ListGroups(ctx context.Context, p Principal) ([]*SecurityGroupDetail, error) {
+	var groups []*model.SecurityGroup
+	if err := p.scope(s.db.WithContext(ctx)).Order("id").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	return s.details(s.db.WithContext(ctx), groups)
+}
+
+func (s *SecurityGroupService) GetGroup(ctx context.Context, p Principal, id uint) (*SecurityGroupDetail, error) {
+	group, err := s.group(s.db.WithContext(ctx), p, id)
+	if err != nil {
+		return nil, err
+	}
+	details, err := s.details(s.db.WithContext(ctx), []*model.SecurityGroup{group})
+	if err != nil {
+		return nil, err
+	}
+	return details[0], nil
+}
+
+// UpdateGroup replaces a group's name, description and rules, and applies
+// the new rules to the nodes of the VMs it is attached to. If any node
+// fails the change is rolled back and the nodes are put back.
+func (s *SecurityGroupService) UpdateGroup(ctx context.Context, p Principal, id uint, req SecurityGroupRequest) (*SecurityGroupDetail, error) {
+	rules, err := groupRules(req.Rules)
+	if err != nil {
+		return nil, err
+	}
+	var nodeIDs []*uint
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		group, err := s.group(tx, p, id)
+		if err != nil {
+			return err
+		}
+		if err := checkGroupName(tx, group.UserID, req.Name, group.ID); err != nil {
+			return err
+		}
+		if err := tx.Model(group).Updates(map[string]interface{}{"name": req.Name, "description": req.Description}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", group.ID).Delete(&model.SecurityGroupRule{}).Error; err != nil {
+			return err
+		}
+		if err := createRules(tx, group.ID, rules); err != nil {
+			return err
+		}
+		if nodeIDs, err = groupNodes(tx, group.ID); err != nil {
+			return err
+		}
+		for _, nodeID := range nodeIDs {
+			if err := s.apply(ctx, tx, nodeID); err != nil {
+				return fmt.Errorf("node %s: %w", nodeName(nodeID), err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Nodes updated before the failing one still have the new rules;
+		// the outbox puts the old ones back.
+		for _, nodeID := range nodeIDs {
+			_ = s.vms.newSaga().forward(ctx, outboxApplyFirewall, applyRulesPayload{NodeID: nodeID})
+		}
+		return nil, err
+	}
+	return s.GetGroup(ctx, p, id)
+}
+
+// DeleteGroup removes a group that is attached to no VM.
+func (s *SecurityGroupService) DeleteGroup(ctx context.Context, p Principal, id uint) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		group, err := s.group(tx, p, id)
+		if err != nil {
+			return err
+		}
+		var n int64
+		if err := tx.Model(&model.VMSecurityGroup{}).Where("group_id = ?", group.ID).Count(&n).Error; err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrSecurityGroupInUse
+		}
+		if err := tx.Where("group_id = ?", group.ID).Delete(&model.SecurityGroupRule{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(group).Error
+	})
+}
+
+// VMGroups returns the groups attached to a VM.
+func (s *SecurityGroupService) VMGroups(ctx context.Context, p Principal, vmID uint) ([]*SecurityGroupDetail, error) {
+	vm, err := s.vms.ownedVM(ctx, p, vmID)
+	if err != nil {
+		return nil, err
+	}
+	db := s.db.WithContext(ctx)
+	var groups []*model.SecurityGroup
+	err = db.Where("id IN (?)", db.Model(&model.VMSecurityGroup{}).Select("group_id").Where("vm_id = ?", vm.ID)).
+		Order("id").Find(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+	return s.details(db, groups)
+}
+
+// AttachGroup attaches one of the VM owner's groups to the VM and applies
+// it on the VM's node. Attaching a group twice is not an error.
+func (s *SecurityGroupService) AttachGroup(ctx context.Context, p Principal, vmID, groupID uint) error {
+	vm, err := s.vms.ownedVM(ctx, p, vmID)
+	if err != nil {
+		return err
+	}
+	if len(guestAddresses(vm)) == 0 {
+		return ErrNoGuestAddress
+	}
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Locking the group holds off an update of its rules, which would
+		// miss this VM's node if it read the group's nodes first.
+		group, err := s.group(tx.Clauses(clause.Locking{Strength: "UPDATE"}), p, groupID)
+		if err != nil {
+			return err
+		}
+		if group.UserID != vm.UserID {
+			return ErrSecurityGroupNotFound
+		}
+		var n int64
+		if err := tx.Model(&model.VMSecurityGroup{}).Where("vm_id = ? AND group_id = ?", vm.ID, group.ID).Count(&n).Error; err != nil {
+			return err
+		}
+		if n > 0 {
+			return nil
+		}
+		if err := tx.Create(&model.VMSecurityGroup{VMID: vm.ID, GroupID: group.ID}).Error; err != nil {
+			return err
+		}
+		return s.apply(ctx, tx, vm.NodeID)
+	})
+}
+
+// DetachGroup detaches a group from a VM. A VM left without groups is no
+// longer filtered.
+func (s *SecurityGroupService) DetachGroup(ctx context.Context, p Principal, vmID, groupID uint) error {
+	vm, err := s.vms.ownedVM(ctx, p, vmID)
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("vm_id = ? AND group_id = ?", vm.ID, groupID).Delete(&model.VMSecurityGroup{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrSecurityGroupNotFound
+		}
+		return s.apply(ctx, tx, vm.NodeID)
+	})
+}
+
+// Run pushes the rules of every node with filtered VMs every interval
+// until ctx is cancelled.
+func (s *SecurityGroupService) Run(ctx context.Context, interval time.Duration, logf func(string, ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.syncAll(ctx, logf)
+		}
+	}
+}
+
+func (s *SecurityGroupService) syncAll(ctx context.Context, logf func(string, ...interface{})) {
+	db := s.db.WithContext(ctx)
+	nodeIDs, err := vmNodes(db.Where("id IN (?)", db.Model(&model.VMSecurityGroup{}).Select("vm_id")))
+	if err != nil {
+		logf("Firewall sync: list nodes: %v", err)
+		return
+	}
+	for _, nodeID := range nodeIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return s.apply(ctx, tx, nodeID)
+		})
+		if err != nil {
+			logf("Firewall sync: node %s: %v", nodeName(nodeID), err)
+		}
+	}
+}
+
+// applyEvent pushes a node's firewall ruleset for the outbox. A node that
+// has been removed since has no rules left to update.
+func (s *SecurityGroupService) applyEvent(ctx context.Context, tx *gorm.DB, raw json.RawMessage) error {
+	var p applyRulesPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	if err := s.apply(ctx, tx, p.NodeID); err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (s *SecurityGroupService) group(db *gorm.DB, p Principal, id uint) (*model.SecurityGroup, error) {
+	var group model.SecurityGroup
+	if err := p.scope(db).First(&group, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSecurityGroupNotFound
+		}
+		return nil, err
+	}
+	return &group, nil
+}
+
+// details loads the rules and VMs of groups.
+func (s *SecurityGroupService) details(db *gorm.DB, groups []*model.SecurityGroup) ([]*SecurityGroupDetail, error) {
+	out := make([]*SecurityGroupDetail, 0, len(groups))
+	if len(groups) == 0 {
+		return out, nil
+	}
+	byID := make(map[uint]*SecurityGroupDetail, len(groups))
+	ids := make([]uint, 0, len(groups))
+	for _, g := range groups {
+		d := &SecurityGroupDetail{SecurityGroup: g, Rules: []*model.SecurityGroupRule{}, VMIDs: []uint{}}
+		byID[g.ID] = d
+		ids = append(ids, g.ID)
+		out = append(out, d)
+	}
+	var rules []*model.SecurityGroupRule
+	if err := db.Where("group_id IN ?", ids).Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		byID[r.GroupID].Rules = append(byID[r.GroupID].Rules, r)
+	}
+	var links []*model.VMSecurityGroup
+	if err := db.Where("group_id IN ?", ids).Order("vm_id").Find(&links).Error; err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		byID[l.GroupID].VMIDs = append(byID[l.GroupID].VMIDs, l.VMID)
+	}
+	return out, nil
+}
+
+// apply pushes the firewall ruleset of the node nodeID, as seen by the
+// transaction tx, to the node. It holds the node's firewall lock until tx
+// ends.
+func (s *SecurityGroupService) apply(ctx context.Context, tx *gorm.DB, nodeID *uint) error {
+	if err := lockRuleset(tx, firewallRulesetLock, nodeID); err != nil {
+		return err
+	}
+	hv, err := s.vms.nodeHypervisor(tx, nodeID)
+	if err != nil {
+		return err
+	}
+	fs, ok := hv.(hypervisor.FirewallSupport)
+	if !ok {
+		return hypervisor.ErrFirewallUnsupported
+	}
+	rules, err := s.ruleset(tx, nodeID)
+	if err != nil {
+		return err
+	}
+	return fs.ApplyFirewall(ctx, rules)
+}
+
+// ruleset compiles the groups of the VMs on a node into the node's
+// firewall ruleset. Rules two groups of a VM share are rendered once.
+func (s *SecurityGroupService) ruleset(db *gorm.DB, nodeID *uint) (firewall.Ruleset, error) {
+	var vms []*model.VM
+	err := onNode(db, nodeID).Where("id IN (?)", db.Model(&model.VMSecurityGroup{}).Select("vm_id")).
+		Order("id").Find(&vms).Error
+	if err != nil {
+		return firewall.Ruleset{}, err
+	}
+	rules := firewall.Ruleset{Guests: []firewall.Guest{}}
+	if len(vms) == 0 {
+		return rules, nil
+	}
+	vmIDs := make([]uint, 0, len(vms))
+	for _, vm := range vms {
+		vmIDs = append(vmIDs, vm.ID)
+	}
+	var links []*model.VMSecurityGroup
+	if err := db.Where("vm_id IN ?", vmIDs).Find(&links).Error; err != nil {
+		return firewall.Ruleset{}, err
+	}
+	groupsOf := make(map[uint][]uint)
+	groupIDs := make([]uint, 0, len(links))
+	for _, l := range links {
+		groupsOf[l.VMID] = append(groupsOf[l.VMID], l.GroupID)
+		groupIDs = append(groupIDs, l.GroupID)
+	}
+	var groupRules []*model.SecurityGroupRule
+	if err := db.Where("group_id IN ?", groupIDs).Order("id").Find(&groupRules).Error; err != nil {
+		return firewall.Ruleset{}, err
+	}
+	rulesOf := make(map[uint][]*model.SecurityGroupRule)
+	for _, r := range groupRules {
+		rulesOf[r.GroupID] = append(rulesOf[r.GroupID], r)
+	}
+
+	for _, vm := range vms {
+		guest := firewall.Guest{VMID: vm.ID, Addresses: guestAddresses(vm), Ingress: []firewall.Rule{}}
+		if len(guest.Addresses) == 0 {
+			// Nothing to match the VM's traffic by.
+			continue
+		}
+		seen := make(map[model.SecurityGroupRule]bool)
+		for _, groupID := range groupsOf[vm.ID] {
+			for _, r := range rulesOf[groupID] {
+				key := model.SecurityGroupRule{Direction: r.Direction, Protocol: r.Protocol, PortFrom: r.PortFrom, PortTo: r.PortTo, CIDR: r.CIDR}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				rule := firewall.Rule{Protocol: r.Protocol, PortFrom: r.PortFrom, PortTo: r.PortTo, CIDR: r.CIDR}
+				if r.Direction == firewall.Egress {
+					guest.Egress = append(guest.Egress, rule)
+				} else {
+					guest.Ingress = append(guest.Ingress, rule)
+				}
+			}
+		}
+		rules.Guests = append(rules.Guests, guest)
+	}
+	return rules, nil
+}
+
+// guestAddresses returns what a VM's traffic is matched by: its IPv4
+// address and its whole IPv6 prefix.
+func guestAddresses(vm *model.VM) []string {
+	var out []string
+	if addr, _, _ := strings.Cut(vm.IPv4, "/"); addr != "" {
+		out = append(out, addr)
+	}
+	if p, err := netip.ParsePrefix(vm.IPv6); err == nil {
+		out = append(out, p.Masked().String())
+	}
+	return out
+}
+
+// groupNodes returns the nodes of the VMs a group is attached to, in the
+// order their locks are taken.
+func groupNodes(db *gorm.DB, groupID uint) ([]*uint, error) {
+	return vmNodes(db.Where("id IN (?)", db.Model(&model.VMSecurityGroup{}).Select("vm_id").Where("group_id = ?", groupID)).Order("node_id"))
+}
+
+func checkGroupName(tx *gorm.DB, userID uint, name string, except uint) error {
+	var n int64
+	if err := tx.Model(&model.SecurityGroup{}).Where("user_id = ? AND name = ? AND id <> ?", userID, name, except).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrSecurityGroupExists
+	}
+	return nil
+}
+
+// groupRules checks and normalises requested rules: a single port may be
+// given as PortFrom alone and a CIDR as a bare address.
+func groupRules(reqs []SecurityGroupRuleRequest) ([]*model.SecurityGroupRule, error) {
+	rules := make([]*model.SecurityGroupRule, 0, len(reqs))
+	for _, req := range reqs {
+		r := &model.SecurityGroupRule{
+			Direction:   req.Direction,
+			Protocol:    req.Protocol,
+			PortFrom:    req.PortFrom,
+			PortTo:      req.PortTo,
+			CIDR:        strings.TrimSpace(req.CIDR),
+			Description: req.Description,
+		}
+		if r.PortTo == 0 {
+			r.PortTo = r.PortFrom
+		}
+		if !strings.Contains(r.CIDR, "/") {
+			if addr, err := netip.ParseAddr(r.CIDR); err == nil {
+				r.CIDR = netip.PrefixFrom(addr, addr.BitLen()).String()
+			}
+		}
+		if p, err := netip.ParsePrefix(r.CIDR); err == nil {
+			r.CIDR = p.Masked().String()
+		}
+		if r.Direction != firewall.Ingress && r.Direction != firewall.Egress {
+			return nil, fmt.Errorf("%w: unknown direction %q", ErrInvalidRule, r.Direction)
+		}
+		fr := firewall.Rule{Protocol: r.Protocol, PortFrom: r.PortFrom, PortTo: r.PortTo, CIDR: r.CIDR}
+		if err := fr.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func createRules(tx *gorm.DB, groupID uint, rules []*model.SecurityGroupRule) error {
+	for _, r := range rules {
+		r.ID = 0
+		r.GroupID = groupID
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return tx.Create(&rules).Error
+}
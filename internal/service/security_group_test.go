@@ -0,0 +1,147 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"StarstreamAstra/internal/firewall"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestSecurityGroups(t *testing.T) {
+	s, ipam, hv := newTestIPAM(t, 0)
+	g := NewSecurityGroupService(s.db, s)
+	s.WithSecurityGroups(g)
+	if _, err := ipam.CreatePool(ctx, IPPoolRequest{Name: "v4", CIDR: "198.51.100.0/24"}); err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+	if _, err := ipam.CreatePool(ctx, IPPoolRequest{Name: "v6", CIDR: "2001:db8:1::/56"}); err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+	vm := createTestVM(t, s)
+
+	if _, err := g.CreateGroup(ctx, owner, SecurityGroupRequest{Name: "bad", Rules: []SecurityGroupRuleRequest{
+		{Direction: "ingress", Protocol: "tcp", PortFrom: 443, PortTo: 80, CIDR: "0.0.0.0/0"},
+	}}); !errors.Is(err, ErrInvalidRule) {
+		t.Fatalf("reversed ports = %v, want ErrInvalidRule", err)
+	}
+	web, err := g.CreateGroup(ctx, owner, SecurityGroupRequest{Name: "web", Rules: []SecurityGroupRuleRequest{
+		{Direction: "ingress", Protocol: "tcp", PortFrom: 443, CIDR: "0.0.0.0/0"},
+		{Direction: "ingress", Protocol: "tcp", PortFrom: 22, CIDR: "203.0.113.7"},
+	}})
+	if err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	if r := web.Rules[1]; r.PortTo != 22 || r.CIDR != "203.0.113.7/32" {
+		t.Fatalf("rule not normalised: %+v", r)
+	}
+	ssh, err := g.CreateGroup(ctx, owner, SecurityGroupRequest{Name: "ssh", Rules: []SecurityGroupRuleRequest{
+		{Direction: "ingress", Protocol: "tcp", PortFrom: 22, CIDR: "203.0.113.7/32"},
+		{Direction: "egress", Protocol: "udp", PortFrom: 53, CIDR: "198.51.100.53/32"},
+	}})
+	if err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	if _, err := g.CreateGroup(ctx, owner, SecurityGroupRequest{Name: "web"}); !errors.Is(err, ErrSecurityGroupExists) {
+		t.Fatalf("duplicate name = %v, want ErrSecurityGroupExists", err)
+	}
+	if err := g.AttachGroup(ctx, Principal{UserID: 2}, vm.ID, web.ID); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("attach to another user's VM = %v, want ErrVMNotFound", err)
+	}
+
+	for _, id := range []uint{web.ID, ssh.ID, web.ID} {
+		if err := g.AttachGroup(ctx, owner, vm.ID, id); err != nil {
+			t.Fatalf("attach %d: %v", id, err)
+		}
+	}
+	// The SSH rule both groups have is rendered once.
+	want := firewall.Ruleset{Guests: []firewall.Guest{{
+		VMID:      vm.ID,
+		Addresses: []string{"198.51.100.1", "2001:db8:1::/64"},
+		Ingress: []firewall.Rule{
+			{Protocol: "tcp", PortFrom: 443, PortTo: 443, CIDR: "0.0.0.0/0"},
+			{Protocol: "tcp", PortFrom: 22, PortTo: 22, CIDR: "203.0.113.7/32"},
+		},
+		Egress: []firewall.Rule{{Protocol: "udp", PortFrom: 53, PortTo: 53, CIDR: "198.51.100.53/32"}},
+	}}}
+	if got := hv.Firewall(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("node got %+v\nwant %+v", got, want)
+	}
+
+	// A rule change the node rejects is rolled back.
+	hv.Inject(hypervisor.MethodApplyFirewall, hypervisor.Fault{Err: errInjected, Times: 1})
+	if _, err := g.UpdateGroup(ctx, owner, web.ID, SecurityGroupRequest{Name: "web"}); !errors.Is(err, errInjected) {
+		t.Fatalf("update with failing node = %v, want errInjected", err)
+	}
+	if detail, _ := g.GetGroup(ctx, owner, web.ID); len(detail.Rules) != 2 || fmt.Sprint(detail.VMIDs) != fmt.Sprint([]uint{vm.ID}) {
+		t.Fatalf("group after failed update %+v", detail)
+	}
+	if _, err := g.UpdateGroup(ctx, owner, web.ID, SecurityGroupRequest{Name: "web", Rules: []SecurityGroupRuleRequest{
+		{Direction: "ingress", Protocol: "icmp", CIDR: "::/0"},
+	}}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if got := hv.Firewall().Guests[0].Ingress; fmt.Sprint(got) != "[{icmp 0 0 ::/0} {tcp 22 22 203.0.113.7/32}]" {
+		t.Fatalf("ingress after update %v", got)
+	}
+
+	// The periodic sync covers VMs on the default hypervisor, which have no
+	// node ID.
+	applied := hv.Calls(hypervisor.MethodApplyFirewall)
+	g.syncAll(ctx, t.Errorf)
+	if hv.Calls(hypervisor.MethodApplyFirewall) != applied+1 {
+		t.Fatal("sync did not apply any rules")
+	}
+
+	if err := g.DeleteGroup(ctx, owner, ssh.ID); !errors.Is(err, ErrSecurityGroupInUse) {
+		t.Fatalf("delete attached group = %v, want ErrSecurityGroupInUse", err)
+	}
+	if err := g.DetachGroup(ctx, owner, vm.ID, ssh.ID); err != nil {
+		t.Fatalf("detach: %v", err)
+	}
+	if groups, _ := g.VMGroups(ctx, owner, vm.ID); len(groups) != 1 || groups[0].ID != web.ID {
+		t.Fatalf("groups after detach %+v", groups)
+	}
+	if err := g.DeleteGroup(ctx, owner, ssh.ID); err != nil {
+		t.Fatalf("delete group: %v", err)
+	}
+
+	// A node that cannot drop the deleted VM's chains is retried.
+	hv.Inject(hypervisor.MethodApplyFirewall, hypervisor.Fault{Err: errInjected, Times: 1})
+	if err := s.DeleteVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("delete VM: %v", err)
+	}
+	if got := hv.Firewall(); len(got.Guests) == 0 {
+		t.Fatal("guests dropped despite the failed push")
+	}
+	makeDue(s.db)
+	if err := s.outbox.dispatchDue(ctx, discardf); err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	if got := hv.Firewall(); len(got.Guests) != 0 {
+		t.Fatalf("guests left after delete %+v", got.Guests)
+	}
+	var links int64
+	s.db.Model(&model.VMSecurityGroup{}).Count(&links)
+	if links != 0 {
+		t.Fatalf("%d attachments left after delete", links)
+	}
+}
+
+func TestSecurityGroupNeedsAddress(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	g := NewSecurityGroupService(db, s)
+	vm := createTestVM(t, s)
+	group, err := g.CreateGroup(ctx, owner, SecurityGroupRequest{Name: "any"})
+	if err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	if err := g.AttachGroup(ctx, owner, vm.ID, group.ID); !errors.Is(err, ErrNoGuestAddress) {
+		t.Fatalf("attach to VM without addresses = %v, want ErrNoGuestAddress", err)
+	}
+	if got := hv.Firewall(); got.Guests != nil {
+		t.Fatalf("node got rules %+v", got)
+	}
+}
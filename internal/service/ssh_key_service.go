@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/model"
+)
+
+var (
+	ErrInvalidSSHKey  = errors.New("invalid SSH public key")
+	ErrSSHKeyNotFound = errors.New("SSH key not found")
+	ErrSSHKeyExists   = errors.New("this SSH key is already on file")
+)
+
+// minRSAKeyBits is the smallest RSA modulus accepted for new keys.
+const minRSAKeyBits = 2048
+
+// SSHKeyService manages the public keys users keep on file. Keys are
+// private to their owner, admins included.
+type SSHKeyService struct {
+	db *gorm.DB
+}
+
+func NewSSHKeyService(db *gorm.DB) *SSHKeyService {
+	return &SSHKeyService{db: db}
+}
+
+type SSHKeyCreateRequest struct {
+	Name      string `json:"name" binding:"required,max=64"`
+	PublicKey string `json:"public_key" binding:"required"`
+}
+
+type SSHKeyUpdateRequest struct {
+	Name string `json:"name" binding:"required,max=64"`
+}
+
+func (s *SSHKeyService) CreateKey(ctx context.Context, p Principal, req SSHKeyCreateRequest) (*model.SSHKey, error) {
+	pub, comment, err := parseSSHKey(req.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key := &model.SSHKey{
+		UserID:      p.UserID,
+		Name:        req.Name,
+		Type:        pub.Type(),
+		PublicKey:   authorizedKey(pub, comment),
+		Fingerprint: ssh.FingerprintSHA256(pub),
+	}
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var n int64
+		if err := tx.Model(&model.SSHKey{}).Where("user_id = ? AND fingerprint = ?", key.UserID, key.Fingerprint).Count(&n).Error; err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrSSHKeyExists
+		}
+		return tx.Create(key).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *SSHKeyService) ListKeys(ctx context.Context, p Principal) ([]*model.SSHKey, error) {
+	var keys []*model.SSHKey
+	if err := s.db.WithContext(ctx).Where("user_id = ?", p.UserID).Order("id").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *SSHKeyService) GetKey(ctx context.Context, p Principal, id uint) (*model.SSHKey, error) {
+	var key model.SSHKey
+	if err := s.db.WithContext(ctx).Where("user_id = ?", p.UserID).First(&key, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSSHKeyNotFound
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+// UpdateKey renames a key. The key material itself is immutable; upload a
+// new key and delete the old one to rotate.
+func (s *SSHKeyService) UpdateKey(ctx context.Context, p Principal, id uint, req SSHKeyUpdateRequest) (*model.SSHKey, error) {
+	res := s.db.WithContext(ctx).Model(&model.SSHKey{}).
+		Where("id = ? AND user_id = ?", id, p.UserID).
+		Update("name", req.Name)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrSSHKeyNotFound
+	}
+	return s.GetKey(ctx, p, id)
+}
+
+// DeleteKey removes a key from the user's account. Guests it was installed
+// in keep it.
+func (s *SSHKeyService) DeleteKey(ctx context.Context, p Principal, id uint) error {
+	res := s.db.WithContext(ctx).Where("user_id = ?", p.UserID).Delete(&model.SSHKey{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrSSHKeyNotFound
+	}
+	return nil
+}
+
+// AuthorizedKeys returns the authorized_keys lines of the user's keys ids,
+// in the order given. Every ID must name one of the user's keys.
+func (s *SSHKeyService) AuthorizedKeys(ctx context.Context, p Principal, ids []uint) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var keys []*model.SSHKey
+	if err := s.db.WithContext(ctx).Where("user_id = ? AND id IN ?", p.UserID, ids).Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]string, len(keys))
+	for _, k := range keys {
+		byID[k.ID] = k.PublicKey
+	}
+	lines := make([]string, 0, len(ids))
+	for _, id := range ids {
+		line, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %d", ErrSSHKeyNotFound, id)
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// parseSSHKey accepts a single authorized_keys style line holding an
+// ed25519, ECDSA or RSA key of at least minRSAKeyBits.
+func parseSSHKey(line string) (ssh.PublicKey, string, error) {
+	line = strings.TrimSpace(line)
+	if strings.ContainsAny(line, "\r\n") {
+		return nil, "", fmt.Errorf("%w: expected a single key", ErrInvalidSSHKey)
+	}
+	pub, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidSSHKey, err)
+	}
+	if len(options) > 0 {
+		return nil, "", fmt.Errorf("%w: key options are not allowed", ErrInvalidSSHKey)
+	}
+	switch pub.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+	case ssh.KeyAlgoRSA:
+		crypto, ok := pub.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, "", fmt.Errorf("%w: unreadable RSA key", ErrInvalidSSHKey)
+		}
+		rsaKey, ok := crypto.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok || rsaKey.N.BitLen() < minRSAKeyBits {
+			return nil, "", fmt.Errorf("%w: RSA keys need at least %d bits", ErrInvalidSSHKey, minRSAKeyBits)
+		}
+	default:
+		return nil, "", fmt.Errorf("%w: unsupported key type %s", ErrInvalidSSHKey, pub.Type())
+	}
+	return pub, comment, nil
+}
+
+// authorizedKey formats pub as an authorized_keys line.
+func authorizedKey(pub ssh.PublicKey, comment string) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
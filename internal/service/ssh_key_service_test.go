@@ -0,0 +1,109 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	testRSAKey   = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDZld4p9tGIA/jHXxaZAPvSZ5V4InXDJZylzfsKwosKWUD7wzd7wNE0CfrYWEDjKEbIRbcLozKmW9opy8b4d5kh7jCTS6dp83ptbuoCGmggvM0X5O1/OuxQvbkTvD+JJ5kspZkWFUkx08Qu9+ZjMxEdmfX3xiBPgj9EAMRFo8M9Nwbxkide5jc8zm2tMkauXbmbty/sjeWl88H9ekaeLVUNClDC4MD0hb1JFONNNPMbrEfQJVTH390p9OS7dmvY0G9ZptOewzxt/C2TRUKeuOrXHpCZtacFuV/w5NNSATX57iB+Is39HvLrUJR3hI1yPESojz3H22JCjCzDQJs1gZdj bob@ci"
+	testECDSAKey = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBLx0c0oM/TT9nkbTxlYbX2tTJJJa7uzeeqeJEZQ4trOBdI6ttnBVvSO0eX6FcqEywZBvh5TpuwZ2rP6eH1+d0ac="
+	weakRSAKey   = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQCpYUyrNxnURbGfWMwq9HmJ9Q0GfZHm9OHYhAo2/RhjI8ofj88AOAeY476SnkyIVXapZO3t3hueN/6WNZGxnfasDCmwA2Ms2KR4RvxXRrMe5SGpfXdiwy/eIOHPhpFVwdjKCxIbMA2FxcqXEjLNeIbemIw6w2p0mIfR3EFB6CWI9Q== root@vm"
+)
+
+func TestSSHKeyServiceFingerprints(t *testing.T) {
+	s := NewSSHKeyService(newTestDB(t))
+	// Fingerprints as printed by ssh-keygen -l.
+	for key, want := range map[string]string{
+		testSSHKey:   "SHA256:oySiTAZ+RkQo44fxlHHycI9YFYwpyPOgObXL+8L4Xno",
+		testRSAKey:   "SHA256:dAUPjJYrsE4xW8r/SQI/GxZqVTXLo/ffAKvI8W2IV4I",
+		testECDSAKey: "SHA256:O3iwBqWMSF79ucRQYRqdEJfp8jEM1NIYnbQUaeQ4egw",
+	} {
+		got, err := s.CreateKey(ctx, owner, SSHKeyCreateRequest{Name: "k", PublicKey: "  " + key + "\n"})
+		if err != nil {
+			t.Fatalf("create %s: %v", key[:12], err)
+		}
+		if got.Fingerprint != want || got.PublicKey != key {
+			t.Errorf("key %s stored as %+v, want fingerprint %s", key[:12], got, want)
+		}
+	}
+
+	for _, bad := range []string{
+		weakRSAKey,
+		"from=\"10.0.0.1\" " + testSSHKey,
+		testSSHKey + "\n" + testRSAKey,
+		"not a key",
+	} {
+		if _, err := s.CreateKey(ctx, owner, SSHKeyCreateRequest{Name: "bad", PublicKey: bad}); !errors.Is(err, ErrInvalidSSHKey) {
+			t.Errorf("expected ErrInvalidSSHKey for %.20q, got %v", bad, err)
+		}
+	}
+}
+
+func TestSSHKeyServiceOwnership(t *testing.T) {
+	s := NewSSHKeyService(newTestDB(t))
+	other := Principal{UserID: 2}
+	admin := Principal{UserID: 99, Admin: true}
+	key, err := s.CreateKey(ctx, owner, SSHKeyCreateRequest{Name: "laptop", PublicKey: testSSHKey})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := s.CreateKey(ctx, owner, SSHKeyCreateRequest{Name: "again", PublicKey: testSSHKey}); !errors.Is(err, ErrSSHKeyExists) {
+		t.Fatalf("expected ErrSSHKeyExists, got %v", err)
+	}
+	if _, err := s.CreateKey(ctx, other, SSHKeyCreateRequest{Name: "shared", PublicKey: testSSHKey}); err != nil {
+		t.Fatalf("another user should be able to store the same key: %v", err)
+	}
+
+	if _, err := s.GetKey(ctx, other, key.ID); !errors.Is(err, ErrSSHKeyNotFound) {
+		t.Fatalf("expected other user's lookup to fail, got %v", err)
+	}
+	if _, err := s.GetKey(ctx, admin, key.ID); !errors.Is(err, ErrSSHKeyNotFound) {
+		t.Fatalf("keys are private to their owner, got %v", err)
+	}
+	if err := s.DeleteKey(ctx, other, key.ID); !errors.Is(err, ErrSSHKeyNotFound) {
+		t.Fatalf("expected other user's delete to fail, got %v", err)
+	}
+
+	renamed, err := s.UpdateKey(ctx, owner, key.ID, SSHKeyUpdateRequest{Name: "work"})
+	if err != nil || renamed.Name != "work" {
+		t.Fatalf("rename: %+v, %v", renamed, err)
+	}
+	if keys, _ := s.ListKeys(ctx, owner); len(keys) != 1 {
+		t.Fatalf("owner has %d keys, want 1", len(keys))
+	}
+	if err := s.DeleteKey(ctx, owner, key.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+}
+
+func TestVMServiceCreateWithStoredKeys(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	keys := NewSSHKeyService(db)
+	other := Principal{UserID: 2}
+	stored, err := keys.CreateKey(ctx, owner, SSHKeyCreateRequest{Name: "ci", PublicKey: testRSAKey})
+	if err != nil {
+		t.Fatalf("create key: %v", err)
+	}
+	foreign, err := keys.CreateKey(ctx, other, SSHKeyCreateRequest{Name: "theirs", PublicKey: testECDSAKey})
+	if err != nil {
+		t.Fatalf("create key: %v", err)
+	}
+
+	vm, err := s.CreateVM(ctx, owner, VMCreateRequest{
+		Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10,
+		GuestSetup: GuestSetup{SSHKeyIDs: []uint{stored.ID}, SSHKeys: []string{testSSHKey, testRSAKey}},
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	ci, _ := hv.Seed(vm.HypervisorID)
+	if len(ci.SSHKeys) != 2 || ci.SSHKeys[0] != testRSAKey || ci.SSHKeys[1] != testSSHKey {
+		t.Fatalf("unexpected keys %q", ci.SSHKeys)
+	}
+
+	_, err = s.CreateVM(ctx, owner, VMCreateRequest{Name: "db", CPU: 1, MemoryMB: 512, DiskGB: 10, GuestSetup: GuestSetup{SSHKeyIDs: []uint{foreign.ID}}})
+	if !errors.Is(err, ErrSSHKeyNotFound) {
+		t.Fatalf("expected another user's key to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/model"
+)
+
+var ErrTaskNotFound = errors.New("task not found")
+
+// maxTaskAttempts bounds how often a task interrupted by a master shutdown
+// is picked up again before it is failed.
+const maxTaskAttempts = 3
+
+// TaskHandler executes one task. It reports progress in percent through
+// progress and returns a value that is stored as the task's JSON result; if
+// that value is a *model.VM the task is linked to it. Handlers may be re-run
+// after a master restart and must tolerate that.
+type TaskHandler func(ctx context.Context, task *model.Task, progress func(int)) (interface{}, error)
+
+// TaskService persists long-running operations and runs them on a pool of
+// workers, so HTTP requests only have to enqueue them.
+type TaskService struct {
+	db           *gorm.DB
+	pollInterval time.Duration
+
+	mu       sync.RWMutex
+	handlers map[string]TaskHandler
+	wake     chan struct{}
+}
+
+func NewTaskService(db *gorm.DB) *TaskService {
+	return &TaskService{
+		db:           db,
+		pollInterval: 2 * time.Second,
+		handlers:     make(map[string]TaskHandler),
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Handle registers the handler for tasks of taskType.
+func (s *TaskService) Handle(taskType string, h TaskHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[taskType] = h
+}
+
+func (s *TaskService) handler(taskType string) TaskHandler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.handlers[taskType]
+}
+
+// Enqueue stores a pending task owned by p and wakes a worker.
+func (s *TaskService) Enqueue(ctx context.Context, p Principal, taskType string, vmID *uint, payload interface{}) (*model.Task, error) {
+	task, err := s.enqueue(s.db.WithContext(ctx), p, taskType, vmID, payload)
+	if err != nil {
+		return nil, err
+	}
+	s.notify()
+	return task, nil
+}
+
+// enqueue is Enqueue within a caller's transaction, such as the one that
+// records the task's VM. The caller calls notify once it commits.
+func (s *TaskService) enqueue(tx *gorm.DB, p Principal, taskType string, vmID *uint, payload interface{}) (*model.Task, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	task := &model.Task{
+		Type:    taskType,
+		Status:  model.TaskStatusPending,
+		UserID:  p.UserID,
+		VMID:    vmID,
+		Payload: raw,
+	}
+	if err := tx.Create(task).Error; err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// notify wakes a worker for a newly queued task.
+func (s *TaskService) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *TaskService) GetTask(ctx context.Context, p Principal, id uint) (*model.Task, error) {
+	var task model.Task
+	if err := p.scope(s.db.WithContext(ctx)).First(&task, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTaskNotFound
+		}
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (s *TaskService) ListTasks(ctx context.Context, p Principal) ([]*model.Task, error) {
+	var tasks []*model.Task
+	if err := p.scope(s.db.WithContext(ctx)).Order("id DESC").Limit(100).Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// RunWorkers requeues tasks left running by a previous master process and
+// then executes pending tasks on n workers until ctx is cancelled. Only one
+// master may run workers against a database.
+func (s *TaskService) RunWorkers(ctx context.Context, n int, logf func(string, ...interface{})) {
+	if n <= 0 {
+		n = 1
+	}
+	if count, err := s.requeueInterrupted(ctx); err != nil {
+		logf("Requeueing interrupted tasks failed: %v", err)
+	} else if count > 0 {
+		logf("Requeued %d task(s) interrupted by a restart", count)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx, logf)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *TaskService) work(ctx context.Context, logf func(string, ...interface{})) {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			task, err := s.claim(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					logf("Claiming task failed: %v", err)
+				}
+				break
+			}
+			if task == nil {
+				break
+			}
+			s.execute(ctx, task, logf)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim moves the oldest pending task to running. The conditional update
+// keeps two workers from picking up the same task.
+func (s *TaskService) claim(ctx context.Context) (*model.Task, error) {
+	for {
+		var task model.Task
+		err := s.db.WithContext(ctx).
+			Where("status = ?", model.TaskStatusPending).
+			Order("id").
+			First(&task).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		res := s.db.WithContext(ctx).Model(&model.Task{}).
+			Where("id = ? AND status = ?", task.ID, model.TaskStatusPending).
+			Updates(map[string]interface{}{
+				"status":     model.TaskStatusRunning,
+				"attempts":   gorm.Expr("attempts + 1"),
+				"started_at": now,
+			})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			task.Status = model.TaskStatusRunning
+			task.Attempts++
+			task.StartedAt = &now
+			return &task, nil
+		}
+	}
+}
+
+func (s *TaskService) execute(ctx context.Context, task *model.Task, logf func(string, ...interface{})) {
+	h := s.handler(task.Type)
+	if h == nil {
+		s.finish(task, nil, fmt.Errorf("no handler for task type %q", task.Type))
+		return
+	}
+	progress := func(pct int) {
+		_ = s.db.Model(&model.Task{}).Where("id = ?", task.ID).Update("progress", pct).Error
+	}
+
+	result, err := h(ctx, task, progress)
+	if err != nil && ctx.Err() != nil {
+		// The master is shutting down; leave the task for the next one.
+		if rerr := s.db.Model(&model.Task{}).Where("id = ?", task.ID).
+			Update("status", model.TaskStatusPending).Error; rerr != nil {
+			logf("Requeueing task %d failed: %v", task.ID, rerr)
+		}
+		return
+	}
+	if err != nil {
+		logf("Task %d (%s) failed: %v", task.ID, task.Type, err)
+	}
+	s.finish(task, result, err)
+}
+
+// finish records the outcome. It deliberately ignores the worker's context
+// so results are written even while shutting down.
+func (s *TaskService) finish(task *model.Task, result interface{}, taskErr error) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"status":      model.TaskStatusSucceeded,
+		"progress":    100,
+		"finished_at": now,
+	}
+	if taskErr != nil {
+		updates["status"] = model.TaskStatusFailed
+		updates["error"] = taskErr.Error()
+	} else if result != nil {
+		raw, err := json.Marshal(result)
+		if err != nil {
+			updates["status"] = model.TaskStatusFailed
+			updates["error"] = fmt.Sprintf("encode result: %v", err)
+		} else {
+			updates["result"] = raw
+		}
+	}
+	if vm, ok := result.(*model.VM); ok && vm != nil {
+		updates["vm_id"] = vm.ID
+	}
+	_ = s.db.Model(&model.Task{}).Where("id = ?", task.ID).Updates(updates).Error
+}
+
+// requeueInterrupted returns running tasks to the queue, failing those that
+// have already used up their attempts.
+func (s *TaskService) requeueInterrupted(ctx context.Context) (int64, error) {
+	db := s.db.WithContext(ctx)
+	err := db.Model(&model.Task{}).
+		Where("status = ? AND attempts >= ?", model.TaskStatusRunning, maxTaskAttempts).
+		Updates(map[string]interface{}{
+			"status":      model.TaskStatusFailed,
+			"error":       "interrupted too many times",
+			"finished_at": time.Now(),
+		}).Error
+	if err != nil {
+		return 0, err
+	}
+	res := db.Model(&model.Task{}).
+		Where("status = ?", model.TaskStatusRunning).
+		Update("status", model.TaskStatusPending)
+	return res.RowsAffected, res.Error
+}
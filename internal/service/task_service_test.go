@@ -0,0 +1,218 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func startTestWorkers(t *testing.T, tasks *TaskService) {
+	t.Helper()
+	wctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		tasks.RunWorkers(wctx, 2, t.Logf)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitTask(t *testing.T, tasks *TaskService, p Principal, id uint) *model.Task {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		task, err := tasks.GetTask(ctx, p, id)
+		if err != nil {
+			t.Fatalf("get task: %v", err)
+		}
+		if task.Status == model.TaskStatusSucceeded || task.Status == model.TaskStatusFailed {
+			return task
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("task %d did not finish", id)
+	return nil
+}
+
+func newTestTaskVMService(t *testing.T) (*VMService, *TaskService, *hypervisor.FakeHypervisor) {
+	t.Helper()
+	s, hv, db := newTestVMService(t)
+	tasks := NewTaskService(db)
+	s.RegisterTasks(tasks)
+	startTestWorkers(t, tasks)
+	return s, tasks, hv
+}
+
+func TestTaskVMCreateAndDelete(t *testing.T) {
+	s, tasks, hv := newTestTaskVMService(t)
+
+	task, err := s.CreateVMAsync(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("enqueue create: %v", err)
+	}
+	if task.Status != model.TaskStatusPending {
+		t.Fatalf("new task status = %s", task.Status)
+	}
+	done := waitTask(t, tasks, owner, task.ID)
+	if done.Status != model.TaskStatusSucceeded || done.Progress != 100 || done.VMID == nil || done.Attempts != 1 {
+		t.Fatalf("unexpected finished task %+v", done)
+	}
+	var vm model.VM
+	if err := json.Unmarshal(done.Result, &vm); err != nil || vm.ID != *done.VMID || vm.UserID != owner.UserID {
+		t.Fatalf("result = %s, %v", done.Result, err)
+	}
+
+	del, err := s.DeleteVMAsync(ctx, owner, vm.ID)
+	if err != nil {
+		t.Fatalf("enqueue delete: %v", err)
+	}
+	if done := waitTask(t, tasks, owner, del.ID); done.Status != model.TaskStatusSucceeded {
+		t.Fatalf("delete task %+v", done)
+	}
+	if hv.Count() != 0 {
+		t.Fatal("guest not deleted")
+	}
+}
+
+func TestTaskVMCreateCarriesCloudInit(t *testing.T) {
+	s, tasks, hv := newTestTaskVMService(t)
+
+	task, err := s.CreateVMAsync(ctx, owner, VMCreateRequest{
+		Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10, GuestSetup: GuestSetup{Hostname: "web.example.com", RootPassword: "correct horse"},
+	})
+	if err != nil {
+		t.Fatalf("enqueue create: %v", err)
+	}
+	if strings.Contains(string(task.Payload), "correct horse") {
+		t.Fatalf("task payload holds the plain password: %s", task.Payload)
+	}
+	done := waitTask(t, tasks, owner, task.ID)
+	if done.Status != model.TaskStatusSucceeded {
+		t.Fatalf("create task %+v", done)
+	}
+	var vm model.VM
+	if err := json.Unmarshal(done.Result, &vm); err != nil {
+		t.Fatal(err)
+	}
+	if ci, ok := hv.Seed(vm.HypervisorID); !ok || ci.Hostname != "web.example.com" || ci.PasswordHash == "" {
+		t.Fatalf("unexpected seed %+v", ci)
+	}
+}
+
+func TestTaskRecordsFailure(t *testing.T) {
+	s, tasks, hv := newTestTaskVMService(t)
+	hv.Inject(hypervisor.MethodCreateVM, hypervisor.Fault{Err: errInjected})
+
+	task, err := s.CreateVMAsync(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	done := waitTask(t, tasks, owner, task.ID)
+	if done.Status != model.TaskStatusFailed || done.Error != errInjected.Error() {
+		t.Fatalf("unexpected failed task %+v", done)
+	}
+}
+
+func TestTaskAsyncChecksOwnership(t *testing.T) {
+	s, tasks, _ := newTestTaskVMService(t)
+	vm := createTestVM(t, s)
+	other := Principal{UserID: 2}
+
+	if _, err := s.DeleteVMAsync(ctx, other, vm.ID); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("delete by other user = %v, want ErrVMNotFound", err)
+	}
+	task, err := s.ResizeVMAsync(ctx, owner, vm.ID, hypervisor.VMConfig{CPU: 4, MemoryMB: 2048, DiskGB: 20})
+	if err != nil {
+		t.Fatalf("enqueue resize: %v", err)
+	}
+	if _, err := tasks.GetTask(ctx, other, task.ID); !errors.Is(err, ErrTaskNotFound) {
+		t.Fatalf("other user sees task: %v", err)
+	}
+	if done := waitTask(t, tasks, owner, task.ID); done.Status != model.TaskStatusSucceeded {
+		t.Fatalf("resize task %+v", done)
+	}
+}
+
+func TestTaskRequeuedAfterRestart(t *testing.T) {
+	db := newTestDB(t)
+	tasks := NewTaskService(db)
+	ran := make(chan struct{}, 1)
+	tasks.Handle("test.noop", func(ctx context.Context, task *model.Task, progress func(int)) (interface{}, error) {
+		ran <- struct{}{}
+		return nil, nil
+	})
+
+	// Simulate tasks a crashed master left behind.
+	stuck := &model.Task{Type: "test.noop", Status: model.TaskStatusRunning, Payload: []byte("{}"), Attempts: 1}
+	exhausted := &model.Task{Type: "test.noop", Status: model.TaskStatusRunning, Payload: []byte("{}"), Attempts: maxTaskAttempts}
+	db.Create(stuck)
+	db.Create(exhausted)
+
+	startTestWorkers(t, tasks)
+	admin := Principal{Admin: true}
+	if done := waitTask(t, tasks, admin, stuck.ID); done.Status != model.TaskStatusSucceeded || done.Attempts != 2 {
+		t.Fatalf("interrupted task not rerun: %+v", done)
+	}
+	if done := waitTask(t, tasks, admin, exhausted.ID); done.Status != model.TaskStatusFailed {
+		t.Fatalf("exhausted task = %+v, want failed", done)
+	}
+	select {
+	case <-ran:
+	default:
+		t.Fatal("handler did not run")
+	}
+}
+
+func TestTaskVMCreateStoredWithVM(t *testing.T) {
+	s, _, db := newTestVMService(t)
+	tasks := NewTaskService(db)
+	s.RegisterTasks(tasks)
+
+	// A VM whose task cannot be stored is not kept either.
+	err := db.Callback().Create().Before("gorm:create").Register("test:fail-tasks", func(tx *gorm.DB) {
+		if tx.Statement.Table == "tasks" {
+			_ = tx.AddError(errInjected)
+		}
+	})
+	if err != nil {
+		t.Fatalf("register callback: %v", err)
+	}
+	if _, err := s.CreateVMAsync(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10}); !errors.Is(err, errInjected) {
+		t.Fatalf("create = %v, want injected error", err)
+	}
+	var n int64
+	db.Model(&model.VM{}).Count(&n)
+	if n != 0 {
+		t.Fatalf("%d VMs left without a task", n)
+	}
+}
+
+func TestTaskVMCreateOfFailedVM(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	tasks := NewTaskService(db)
+	s.RegisterTasks(tasks)
+	task, err := s.CreateVMAsync(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("enqueue create: %v", err)
+	}
+
+	// The reconciler gave up on the VM before the task ran.
+	db.Model(&model.VM{}).Where("id = ?", *task.VMID).Update("status", model.VMStatusError)
+	if _, err := s.runCreateTask(ctx, task, func(int) {}); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("create task = %v, want ErrInvalidTransition", err)
+	}
+	if hv.Calls(hypervisor.MethodCreateVM) != 0 {
+		t.Fatal("guest created for a failed VM")
+	}
+}
@@ -0,0 +1,423 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+var ErrUnknownTrafficPolicy = errors.New("unknown traffic policy")
+
+// Traffic quota policies. TrafficPolicyNone only meters usage.
+const (
+	TrafficPolicyNone     = "none"
+	TrafficPolicyThrottle = model.TrafficActionThrottle
+	TrafficPolicySuspend  = model.TrafficActionSuspend
+)
+
+// bytesPerGB: transfer is sold in decimal gigabytes.
+const bytesPerGB = 1000 * 1000 * 1000
+
+// A traffic report has a day of hourly usage unless asked for more, up to
+// a month.
+const (
+	defaultTrafficHours = 24
+	maxTrafficHours     = 31 * 24
+)
+
+// TrafficOptions sets what happens to VMs over their plan's monthly quota
+// and how long hourly usage is kept; zero keeps it for good.
+type TrafficOptions struct {
+	Policy          string
+	ThrottleMbps    int
+	HourlyRetention time.Duration
+}
+
+// TrafficService meters VM traffic. Run reads the interface counters of
+// every node, adds what moved since the last reading to hourly and monthly
+// buckets, and enforces quotas. Enforcement ends when the month does.
+type TrafficService struct {
+	db   *gorm.DB
+	vms  *VMService
+	opts TrafficOptions
+}
+
+func NewTrafficService(db *gorm.DB, vms *VMService, opts TrafficOptions) (*TrafficService, error) {
+	switch opts.Policy {
+	case "":
+		opts.Policy = TrafficPolicyNone
+	case TrafficPolicyNone, TrafficPolicySuspend:
+	case TrafficPolicyThrottle:
+		if opts.ThrottleMbps <= 0 {
+			return nil, fmt.Errorf("traffic policy %s needs a rate", opts.Policy)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTrafficPolicy, opts.Policy)
+	}
+	return &TrafficService{db: db, vms: vms, opts: opts}, nil
+}
+
+// WithTraffic keeps VMs throttled by t from getting their full port speed
+// back before the month ends.
+func (s *VMService) WithTraffic(t *TrafficService) *VMService {
+	s.traffic = t
+	return s
+}
+
+// TrafficReport is a VM's usage: this month's against its quota, the last
+// hours and the last twelve months. Action is what is being done about the
+// VM going over its quota, if anything.
+type TrafficReport struct {
+	Month      model.TrafficUsage    `json:"month"`
+	QuotaBytes int64                 `json:"quota_bytes"`
+	Action     string                `json:"action,omitempty"`
+	Hourly     []*model.TrafficUsage `json:"hourly"`
+	Monthly    []*model.TrafficUsage `json:"monthly"`
+}
+
+// GetTraffic reports the usage of a VM with the given number of hourly
+// buckets, capped at a month.
+func (t *TrafficService) GetTraffic(ctx context.Context, p Principal, vmID uint, hours int) (*TrafficReport, error) {
+	vm, err := t.vms.ownedVM(ctx, p, vmID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case hours <= 0:
+		hours = defaultTrafficHours
+	case hours > maxTrafficHours:
+		hours = maxTrafficHours
+	}
+	now := time.Now().UTC()
+	month := monthStart(now)
+	report := &TrafficReport{Month: model.TrafficUsage{VMID: vm.ID, Period: model.TrafficPeriodMonth, PeriodStart: month}}
+	if _, plan, err := t.vms.plan(vm.Plan); err == nil {
+		report.QuotaBytes = int64(plan.TrafficGB) * bytesPerGB
+	}
+	db := t.db.WithContext(ctx)
+	err = db.Where("vm_id = ? AND period = ? AND period_start = ?", vm.ID, model.TrafficPeriodMonth, month).Limit(1).Find(&report.Month).Error
+	if err != nil {
+		return nil, err
+	}
+	since := now.Truncate(time.Hour).Add(-time.Duration(hours-1) * time.Hour)
+	err = db.Where("vm_id = ? AND period = ? AND period_start >= ?", vm.ID, model.TrafficPeriodHour, since).
+		Order("period_start").Find(&report.Hourly).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Where("vm_id = ? AND period = ?", vm.ID, model.TrafficPeriodMonth).
+		Order("period_start DESC").Limit(12).Find(&report.Monthly).Error
+	if err != nil {
+		return nil, err
+	}
+	var enforced model.TrafficEnforcement
+	if err := db.Where("vm_id = ?", vm.ID).Limit(1).Find(&enforced).Error; err != nil {
+		return nil, err
+	}
+	report.Action = enforced.Action
+	return report, nil
+}
+
+// Run collects traffic every interval until ctx is cancelled.
+func (t *TrafficService) Run(ctx context.Context, interval time.Duration, logf func(string, ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.collect(ctx, time.Now(), logf)
+		}
+	}
+}
+
+// collect reads the counters of every node with VMs as of now, then
+// enforces quotas and drops hourly usage past its retention.
+func (t *TrafficService) collect(ctx context.Context, now time.Time, logf func(string, ...interface{})) {
+	now = now.UTC()
+	db := t.db.WithContext(ctx)
+	nodeIDs, err := vmNodes(db)
+	if err != nil {
+		logf("traffic: list nodes: %v", err)
+		return
+	}
+	for _, nodeID := range nodeIDs {
+		if err := t.collectNode(ctx, nodeID, now); err != nil && !errors.Is(err, hypervisor.ErrTrafficUnsupported) {
+			logf("traffic: node %s: %v", nodeName(nodeID), err)
+		}
+	}
+	t.enforce(ctx, now, logf)
+	if t.opts.HourlyRetention > 0 {
+		err := db.Where("period = ? AND period_start < ?", model.TrafficPeriodHour, now.Add(-t.opts.HourlyRetention)).
+			Delete(&model.TrafficUsage{}).Error
+		if err != nil {
+			logf("traffic: prune hourly usage: %v", err)
+		}
+	}
+}
+
+func (t *TrafficService) collectNode(ctx context.Context, nodeID *uint, now time.Time) error {
+	db := t.db.WithContext(ctx)
+	hv, err := t.vms.nodeHypervisor(db, nodeID)
+	if err != nil {
+		return err
+	}
+	ts, ok := hv.(hypervisor.TrafficSupport)
+	if !ok {
+		return hypervisor.ErrTrafficUnsupported
+	}
+	stats, err := ts.TrafficStats(ctx)
+	if err != nil {
+		return err
+	}
+	var vms []*model.VM
+	if err := onNode(db, nodeID).Find(&vms).Error; err != nil {
+		return err
+	}
+	byGuest := make(map[string]*model.VM, len(vms))
+	for _, vm := range vms {
+		byGuest[vm.HypervisorID] = vm
+	}
+	seen := make(map[uint]bool, len(stats))
+	for _, c := range stats {
+		vm, ok := byGuest[c.ID]
+		if !ok {
+			continue
+		}
+		seen[vm.ID] = true
+		if err := t.record(db, vm.ID, c, now); err != nil {
+			return err
+		}
+	}
+	// Guests that are not running report nothing, and their counters start
+	// from zero when they boot again; so does their next reading.
+	var stopped []uint
+	for _, vm := range vms {
+		if !seen[vm.ID] {
+			stopped = append(stopped, vm.ID)
+		}
+	}
+	if len(stopped) == 0 {
+		return nil
+	}
+	return db.Where("vm_id IN ?", stopped).Delete(&model.TrafficCounter{}).Error
+}
+
+// record stores the reading c of a VM and adds the traffic since the
+// previous one to the VM's current hour and month.
+func (t *TrafficService) record(db *gorm.DB, vmID uint, c hypervisor.TrafficCounters, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var last model.TrafficCounter
+		if err := tx.Where("vm_id = ?", vmID).Limit(1).Find(&last).Error; err != nil {
+			return err
+		}
+		rx, txd := counterDelta(c.RxBytes, last.RxBytes), counterDelta(c.TxBytes, last.TxBytes)
+		reading := &model.TrafficCounter{VMID: vmID, RxBytes: int64(c.RxBytes), TxBytes: int64(c.TxBytes)}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(reading).Error; err != nil {
+			return err
+		}
+		if rx == 0 && txd == 0 {
+			return nil
+		}
+		buckets := map[string]time.Time{
+			model.TrafficPeriodHour:  now.Truncate(time.Hour),
+			model.TrafficPeriodMonth: monthStart(now),
+		}
+		for period, start := range buckets {
+			usage := &model.TrafficUsage{VMID: vmID, Period: period, PeriodStart: start, RxBytes: rx, TxBytes: txd}
+			err := tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "vm_id"}, {Name: "period"}, {Name: "period_start"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{
+					"rx_bytes": gorm.Expr("traffic_usages.rx_bytes + ?", rx),
+					"tx_bytes": gorm.Expr("traffic_usages.tx_bytes + ?", txd),
+				}),
+			}).Create(usage).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// counterDelta is what a counter moved since it read last. A counter
+// below its last reading was reset, by a reboot of the guest or a new tap
+// device, and counts from zero again; what the guest moved between the
+// last reading and the reset is lost.
+func counterDelta(cur uint64, last int64) int64 {
+	if int64(cur) < last {
+		return int64(cur)
+	}
+	return int64(cur) - last
+}
+
+// enforce lifts what was done to VMs in earlier months, records the VMs
+// over their quota this month and applies the policy to them. Whatever
+// could not be applied, such as because a node was down, is retried on
+// the next pass.
+func (t *TrafficService) enforce(ctx context.Context, now time.Time, logf func(string, ...interface{})) {
+	db := t.db.WithContext(ctx)
+	month := monthStart(now)
+	var expired []*model.TrafficEnforcement
+	if err := db.Where("month < ?", month).Find(&expired).Error; err != nil {
+		logf("traffic: list enforcements: %v", err)
+		return
+	}
+	for _, e := range expired {
+		if err := t.lift(ctx, e); err != nil {
+			logf("traffic: lift %s of VM %d: %v", e.Action, e.VMID, err)
+		}
+	}
+	if t.opts.Policy == TrafficPolicyNone {
+		return
+	}
+	var usages []*model.TrafficUsage
+	if err := db.Where("period = ? AND period_start = ?", model.TrafficPeriodMonth, month).Find(&usages).Error; err != nil {
+		logf("traffic: list usage: %v", err)
+		return
+	}
+	for _, u := range usages {
+		if err := t.check(ctx, u); err != nil {
+			logf("traffic: quota of VM %d: %v", u.VMID, err)
+		}
+	}
+	var current []*model.TrafficEnforcement
+	if err := db.Where("month = ?", month).Find(&current).Error; err != nil {
+		logf("traffic: list enforcements: %v", err)
+		return
+	}
+	for _, e := range current {
+		if err := t.apply(ctx, e); err != nil {
+			logf("traffic: %s VM %d: %v", e.Action, e.VMID, err)
+		}
+	}
+}
+
+// check records an enforcement of the policy if the monthly usage u is
+// over its VM's quota and there is none yet.
+func (t *TrafficService) check(ctx context.Context, u *model.TrafficUsage) error {
+	db := t.db.WithContext(ctx)
+	var vm model.VM
+	if err := db.Where("id = ?", u.VMID).Limit(1).Find(&vm).Error; err != nil || vm.ID == 0 {
+		return err
+	}
+	_, plan, err := t.vms.plan(vm.Plan)
+	if err != nil || plan.TrafficGB == 0 || u.RxBytes+u.TxBytes < int64(plan.TrafficGB)*bytesPerGB {
+		return nil
+	}
+	e := &model.TrafficEnforcement{VMID: vm.ID, Month: u.PeriodStart, Action: t.opts.Policy}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(e).Error
+}
+
+// apply carries out an enforcement recorded by check; the row is committed
+// first so that a node that fails is retried rather than forgotten. A VM
+// that an admin started again after its suspension is left running.
+func (t *TrafficService) apply(ctx context.Context, e *model.TrafficEnforcement) error {
+	db := t.db.WithContext(ctx)
+	var vm model.VM
+	if err := db.Where("id = ?", e.VMID).Limit(1).Find(&vm).Error; err != nil || vm.ID == 0 {
+		return err
+	}
+	switch e.Action {
+	case model.TrafficActionThrottle:
+		if e.Applied {
+			return nil
+		}
+		hv, err := t.vms.nodeHypervisor(db, vm.NodeID)
+		if err != nil {
+			return err
+		}
+		bs, ok := hv.(hypervisor.BandwidthSupport)
+		if !ok {
+			return hypervisor.ErrBandwidthUnsupported
+		}
+		if err := bs.SetBandwidth(ctx, vm.HypervisorID, throttled(vmBandwidth(&vm), t.opts.ThrottleMbps)); err != nil {
+			return err
+		}
+	case model.TrafficActionSuspend:
+		switch {
+		case vm.Status == model.VMStatusSuspended:
+		case vm.Status == model.VMStatusRunning && e.Applied:
+			return nil
+		case vm.Status == model.VMStatusRunning, vm.Status == model.VMStatusStopped:
+			if err := t.vms.suspend(ctx, Principal{Admin: true}, &vm); err != nil {
+				return err
+			}
+		default:
+			// Busy; try again once its operation is over.
+			return nil
+		}
+	}
+	if e.Applied {
+		return nil
+	}
+	return db.Model(e).Update("applied", true).Error
+}
+
+// lift ends an enforcement. A throttled VM gets its port speed back and a
+// suspended one is left stopped for its owner to start. The row goes only
+// once that worked, so a failure is retried on the next pass.
+func (t *TrafficService) lift(ctx context.Context, e *model.TrafficEnforcement) error {
+	db := t.db.WithContext(ctx)
+	var vm model.VM
+	if err := db.Where("id = ?", e.VMID).Limit(1).Find(&vm).Error; err != nil {
+		return err
+	}
+	switch {
+	case vm.ID == 0:
+	case e.Action == model.TrafficActionThrottle:
+		hv, err := t.vms.nodeHypervisor(db, vm.NodeID)
+		if err != nil {
+			return err
+		}
+		if bs, ok := hv.(hypervisor.BandwidthSupport); ok {
+			if err := bs.SetBandwidth(ctx, vm.HypervisorID, vmBandwidth(&vm)); err != nil {
+				return err
+			}
+		}
+	case vm.Status == model.VMStatusSuspended:
+		if err := t.vms.unsuspend(ctx, Principal{Admin: true}, &vm); err != nil {
+			return err
+		}
+	}
+	return db.Where("vm_id = ?", e.VMID).Delete(&model.TrafficEnforcement{}).Error
+}
+
+// bandwidth is the limits vm's guest should have: its own, capped while
+// it is throttled for its traffic.
+func (s *VMService) bandwidth(db *gorm.DB, vm *model.VM) (hypervisor.Bandwidth, error) {
+	bw := vmBandwidth(vm)
+	if s.traffic == nil {
+		return bw, nil
+	}
+	var n int64
+	err := db.Model(&model.TrafficEnforcement{}).
+		Where("vm_id = ? AND action = ?", vm.ID, model.TrafficActionThrottle).Count(&n).Error
+	if err != nil || n == 0 {
+		return bw, err
+	}
+	return throttled(bw, s.traffic.opts.ThrottleMbps), nil
+}
+
+// throttled caps both directions of bw at mbps.
+func throttled(bw hypervisor.Bandwidth, mbps int) hypervisor.Bandwidth {
+	limit := func(v int) int {
+		if v == 0 || v > mbps {
+			return mbps
+		}
+		return v
+	}
+	return hypervisor.Bandwidth{InboundMbps: limit(bw.InboundMbps), OutboundMbps: limit(bw.OutboundMbps)}
+}
+
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestTrafficAccounting(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	s.WithPlans(map[string]Plan{"small": {TrafficGB: 1}})
+	traffic, err := NewTrafficService(db, s, TrafficOptions{Policy: TrafficPolicyNone, HourlyRetention: 48 * time.Hour})
+	if err != nil {
+		t.Fatalf("traffic service: %v", err)
+	}
+	s.WithTraffic(traffic)
+	vm, err := s.CreateVM(ctx, Principal{UserID: owner.UserID, Admin: true}, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10, Plan: "small"})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	now := time.Now()
+	hv.AddTraffic(vm.HypervisorID, 1000, 200)
+	traffic.collect(ctx, now, t.Logf)
+	hv.AddTraffic(vm.HypervisorID, 500, 100)
+	traffic.collect(ctx, now, t.Logf)
+
+	report, err := traffic.GetTraffic(ctx, owner, vm.ID, 0)
+	if err != nil {
+		t.Fatalf("get traffic: %v", err)
+	}
+	if report.Month.RxBytes != 1500 || report.Month.TxBytes != 300 || report.QuotaBytes != bytesPerGB {
+		t.Fatalf("unexpected month %+v of %d", report.Month, report.QuotaBytes)
+	}
+	if len(report.Hourly) != 1 || report.Hourly[0].RxBytes != 1500 || len(report.Monthly) != 1 {
+		t.Fatalf("unexpected buckets %+v %+v", report.Hourly, report.Monthly)
+	}
+
+	// A restarted guest counts from zero again.
+	if err := s.StopVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	traffic.collect(ctx, now, t.Logf)
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	hv.AddTraffic(vm.HypervisorID, 100, 0)
+	traffic.collect(ctx, now.Add(time.Hour), t.Logf)
+	report, err = traffic.GetTraffic(ctx, owner, vm.ID, 0)
+	if err != nil {
+		t.Fatalf("get traffic: %v", err)
+	}
+	if report.Month.RxBytes != 1600 || len(report.Hourly) > 2 {
+		t.Fatalf("unexpected month %+v after restart", report.Month)
+	}
+
+	// Without a policy a VM over its quota is only metered.
+	hv.AddTraffic(vm.HypervisorID, 2*bytesPerGB, 0)
+	traffic.collect(ctx, now.Add(time.Hour), t.Logf)
+	var n int64
+	db.Model(&model.TrafficEnforcement{}).Count(&n)
+	if n != 0 {
+		t.Fatalf("expected no enforcement, got %d", n)
+	}
+
+	// Hourly usage past its retention is dropped; monthly usage stays.
+	traffic.collect(ctx, now.Add(72*time.Hour), t.Logf)
+	db.Model(&model.TrafficUsage{}).Where("period = ?", model.TrafficPeriodHour).Count(&n)
+	if n != 0 {
+		t.Fatalf("expected hourly usage to be pruned, %d left", n)
+	}
+
+	if _, err := traffic.GetTraffic(ctx, Principal{UserID: 2}, vm.ID, 0); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("expected ErrVMNotFound for another user, got %v", err)
+	}
+}
+
+func TestTrafficQuotaThrottle(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	s.WithPlans(map[string]Plan{"small": {TrafficGB: 1, InboundMbps: 100}})
+	traffic, err := NewTrafficService(db, s, TrafficOptions{Policy: TrafficPolicyThrottle, ThrottleMbps: 10})
+	if err != nil {
+		t.Fatalf("traffic service: %v", err)
+	}
+	s.WithTraffic(traffic)
+	vm, err := s.CreateVM(ctx, Principal{UserID: owner.UserID, Admin: true}, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10, Plan: "small"})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	// A node that fails to throttle is retried on the next pass.
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	hv.AddTraffic(vm.HypervisorID, bytesPerGB, 0)
+	hv.Inject(hypervisor.MethodSetBandwidth, hypervisor.Fault{Err: errInjected, Times: 1})
+	traffic.collect(ctx, now, t.Logf)
+	var e model.TrafficEnforcement
+	if err := db.First(&e, "vm_id = ?", vm.ID).Error; err != nil || e.Applied || e.Action != model.TrafficActionThrottle {
+		t.Fatalf("expected a pending throttle, got %+v (%v)", e, err)
+	}
+	traffic.collect(ctx, now, t.Logf)
+	if got := hv.Bandwidth(vm.HypervisorID); got != (hypervisor.Bandwidth{InboundMbps: 10, OutboundMbps: 10}) {
+		t.Fatalf("guest not throttled: %+v", got)
+	}
+
+	// An upgrade while throttled is stored but the cap stays.
+	if _, err := s.SetBandwidth(ctx, owner, vm.ID, BandwidthRequest{InboundMbps: 1000, OutboundMbps: 5}); err != nil {
+		t.Fatalf("set bandwidth: %v", err)
+	}
+	if got := hv.Bandwidth(vm.HypervisorID); got != (hypervisor.Bandwidth{InboundMbps: 10, OutboundMbps: 5}) {
+		t.Fatalf("throttle lost on upgrade: %+v", got)
+	}
+
+	// The next month the VM gets its own limits back, also if the node
+	// only manages on the second try.
+	hv.Inject(hypervisor.MethodSetBandwidth, hypervisor.Fault{Err: errInjected, Times: 1})
+	traffic.collect(ctx, now.Add(24*time.Hour), t.Logf)
+	if got := hv.Bandwidth(vm.HypervisorID); got != (hypervisor.Bandwidth{InboundMbps: 10, OutboundMbps: 5}) {
+		t.Fatalf("throttle lifted despite the failure: %+v", got)
+	}
+	traffic.collect(ctx, now.Add(24*time.Hour), t.Logf)
+	if got := hv.Bandwidth(vm.HypervisorID); got != (hypervisor.Bandwidth{InboundMbps: 1000, OutboundMbps: 5}) {
+		t.Fatalf("throttle not lifted: %+v", got)
+	}
+	var n int64
+	db.Model(&model.TrafficEnforcement{}).Count(&n)
+	if n != 0 {
+		t.Fatalf("expected enforcement to be lifted, %d left", n)
+	}
+}
+
+func TestTrafficQuotaSuspend(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	// The quota of the operator's default plan covers VMs created without one.
+	s.WithPlans(map[string]Plan{"small": {TrafficGB: 1}}).WithDefaultPlan("small")
+	traffic, err := NewTrafficService(db, s, TrafficOptions{Policy: TrafficPolicySuspend})
+	if err != nil {
+		t.Fatalf("traffic service: %v", err)
+	}
+	s.WithTraffic(traffic)
+	vm, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	hv.AddTraffic(vm.HypervisorID, bytesPerGB/2, bytesPerGB/2)
+	traffic.collect(ctx, now, t.Logf)
+	assertStatus := func(want string) {
+		t.Helper()
+		var stored model.VM
+		if err := db.First(&stored, vm.ID).Error; err != nil || stored.Status != want {
+			t.Fatalf("expected %s VM, got %q (%v)", want, stored.Status, err)
+		}
+	}
+	assertStatus(model.VMStatusSuspended)
+	if info, _ := hv.VM(vm.HypervisorID); info.Status != "stopped" {
+		t.Fatalf("guest of suspended VM is %s", info.Status)
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); !errors.Is(err, ErrVMSuspended) {
+		t.Fatalf("expected ErrVMSuspended, got %v", err)
+	}
+	report, err := traffic.GetTraffic(ctx, owner, vm.ID, 0)
+	if err != nil || report.Action != model.TrafficActionSuspend {
+		t.Fatalf("report does not show the suspension: %+v (%v)", report, err)
+	}
+
+	// An admin may start it anyway; the next pass leaves it running.
+	if err := s.StartVM(ctx, Principal{Admin: true}, vm.ID); err != nil {
+		t.Fatalf("admin start: %v", err)
+	}
+	traffic.collect(ctx, now, t.Logf)
+	assertStatus(model.VMStatusRunning)
+	if err := s.StopVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	traffic.collect(ctx, now, t.Logf)
+	assertStatus(model.VMStatusSuspended)
+
+	// Suspension ends with the month, but the VM is left for its owner to start.
+	traffic.collect(ctx, now.Add(24*time.Hour), t.Logf)
+	assertStatus(model.VMStatusStopped)
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start after the month: %v", err)
+	}
+}
+
+func TestTrafficCounterReset(t *testing.T) {
+	if got := counterDelta(1500, 1000); got != 500 {
+		t.Fatalf("delta = %d, want 500", got)
+	}
+	// After a reset only what was counted since is added; the traffic
+	// between the last reading and the reset is not recovered.
+	if got := counterDelta(300, 1000); got != 300 {
+		t.Fatalf("delta after reset = %d, want 300", got)
+	}
+
+	s, _, db := newTestVMService(t)
+	traffic, err := NewTrafficService(db, s, TrafficOptions{})
+	if err != nil {
+		t.Fatalf("traffic service: %v", err)
+	}
+	vm := createTestVM(t, s)
+	now := time.Now()
+	// The guest's tap is recreated between two readings, so the second
+	// reads 300 where the counter stood at 1000.
+	for _, rx := range []uint64{1000, 300} {
+		if err := traffic.record(db, vm.ID, hypervisor.TrafficCounters{ID: vm.HypervisorID, RxBytes: rx}, now); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	report, err := traffic.GetTraffic(ctx, owner, vm.ID, 0)
+	if err != nil {
+		t.Fatalf("get traffic: %v", err)
+	}
+	if report.Month.RxBytes != 1300 {
+		t.Fatalf("month rx = %d, want 1300", report.Month.RxBytes)
+	}
+}
+
+func TestNewTrafficService(t *testing.T) {
+	s, _, db := newTestVMService(t)
+	if _, err := NewTrafficService(db, s, TrafficOptions{Policy: "delete"}); !errors.Is(err, ErrUnknownTrafficPolicy) {
+		t.Fatalf("expected ErrUnknownTrafficPolicy, got %v", err)
+	}
+	if _, err := NewTrafficService(db, s, TrafficOptions{Policy: TrafficPolicyThrottle}); err == nil {
+		t.Fatal("expected throttle without a rate to be rejected")
+	}
+}
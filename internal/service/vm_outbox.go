@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+// Outbox events of VM sagas.
+const (
+	outboxReleaseNode   = "node.release"
+	outboxDeleteGuest   = "guest.delete"
+	outboxPurgeVM       = "vm.purge"
+	outboxFinishResize  = "vm.finish-resize"
+	outboxReleaseIPs    = "ip.release"
+	outboxReleaseNAT    = "nat.release"
+	outboxApplyNAT      = "nat.apply"
+	outboxApplyFirewall = "firewall.apply"
+)
+
+type releaseNodePayload struct {
+	NodeID    uint      `json:"node_id"`
+	Resources Resources `json:"resources"`
+}
+
+type deleteGuestPayload struct {
+	NodeID       *uint  `json:"node_id"`
+	HypervisorID string `json:"hypervisor_id"`
+}
+
+type releaseIPsPayload struct {
+	VMID uint `json:"vm_id"`
+}
+
+type releaseNATPayload struct {
+	VMID uint `json:"vm_id"`
+}
+
+type purgeVMPayload struct {
+	VMID uint `json:"vm_id"`
+}
+
+type applyRulesPayload struct {
+	NodeID *uint `json:"node_id"`
+}
+
+type finishResizePayload struct {
+	Actor  Principal           `json:"actor"`
+	VMID   uint                `json:"vm_id"`
+	From   string              `json:"from"`
+	Config hypervisor.VMConfig `json:"config"`
+}
+
+func (s *VMService) registerOutbox() {
+	s.outbox.Handle(outboxReleaseNode, s.releaseNodeEvent)
+	s.outbox.Handle(outboxDeleteGuest, s.deleteGuestEvent)
+	s.outbox.Handle(outboxPurgeVM, s.purgeVMEvent)
+	s.outbox.Handle(outboxFinishResize, s.finishResizeEvent)
+	s.outbox.Handle(outboxReleaseIPs, s.releaseIPsEvent)
+	s.outbox.Handle(outboxReleaseNAT, s.releaseNATEvent)
+}
+
+// Outbox returns the outbox VM sagas use; the caller runs it.
+func (s *VMService) Outbox() *Outbox {
+	return s.outbox
+}
+
+func (s *VMService) releaseNodeEvent(ctx context.Context, tx *gorm.DB, raw json.RawMessage) error {
+	var p releaseNodePayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	if err := adjustNode(tx, p.NodeID, Resources{}.sub(p.Resources)); err != nil && !errors.Is(err, ErrNodeNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (s *VMService) deleteGuestEvent(ctx context.Context, tx *gorm.DB, raw json.RawMessage) error {
+	var p deleteGuestPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	hv, err := s.nodeHypervisor(tx, p.NodeID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := hv.DeleteVM(ctx, p.HypervisorID); err != nil && !errors.Is(err, hypervisor.ErrVMNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (s *VMService) releaseIPsEvent(ctx context.Context, tx *gorm.DB, raw json.RawMessage) error {
+	var p releaseIPsPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	return releaseLeases(tx, p.VMID)
+}
+
+func (s *VMService) releaseNATEvent(ctx context.Context, tx *gorm.DB, raw json.RawMessage) error {
+	var p releaseNATPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	return releasePorts(tx, p.VMID)
+}
+
+func (s *VMService) purgeVMEvent(ctx context.Context, tx *gorm.DB, raw json.RawMessage) error {
+	var p purgeVMPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	_, err := purgeVM(tx, s.newSaga().id, p.VMID)
+	return err
+}
+
+func (s *VMService) finishResizeEvent(ctx context.Context, tx *gorm.DB, raw json.RawMessage) error {
+	var p finishResizePayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	var vm model.VM
+	if err := tx.First(&vm, p.VMID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if vm.Status != model.VMStatusResizing {
+		return nil
+	}
+	return applyTransition(tx, p.Actor, &vm, p.From, actionResize, nil, resizeColumns(p.Config))
+}
+
+// purgeVM removes a VM whose guest is gone, quarantines its addresses,
+// frees its NAT ports, detaches its security groups and hands its
+// allocation back to its node. A VM no longer being deleted is left alone,
+// so a purge can be repeated. The pushes that drop the VM's rules from its
+// node are queued in tx under sagaID and returned, so the caller can run
+// them right away.
+func purgeVM(tx *gorm.DB, sagaID string, id uint) ([]*model.OutboxEvent, error) {
+	var vm model.VM
+	if err := tx.Where("status = ?", model.VMStatusDeleting).First(&vm, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := tx.Delete(&model.VM{}, id).Error; err != nil {
+		return nil, err
+	}
+	if err := deleteSnapshots(tx, id); err != nil {
+		return nil, err
+	}
+	if err := quarantineLeases(tx, id); err != nil {
+		return nil, err
+	}
+	if err := releasePorts(tx, id); err != nil {
+		return nil, err
+	}
+	groups := tx.Where("vm_id = ?", id).Delete(&model.VMSecurityGroup{})
+	if groups.Error != nil {
+		return nil, groups.Error
+	}
+	// Backups are kept so the VM can be restored into a new one.
+	if err := tx.Where("vm_id = ?", id).Delete(&model.BackupSchedule{}).Error; err != nil {
+		return nil, err
+	}
+	// Traffic usage is kept for billing.
+	if err := tx.Where("vm_id = ?", id).Delete(&model.TrafficCounter{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("vm_id = ?", id).Delete(&model.TrafficEnforcement{}).Error; err != nil {
+		return nil, err
+	}
+	if vm.NodeID != nil {
+		if err := adjustNode(tx, *vm.NodeID, Resources{}.sub(vmAllocation(&vm))); err != nil {
+			return nil, err
+		}
+	}
+
+	var kinds []string
+	if vm.NetworkMode == model.NetworkModeNAT {
+		kinds = append(kinds, outboxApplyNAT)
+	}
+	if groups.RowsAffected > 0 {
+		kinds = append(kinds, outboxApplyFirewall)
+	}
+	pushes := make([]*model.OutboxEvent, 0, len(kinds))
+	for _, kind := range kinds {
+		ev, err := newOutboxEvent(sagaID, kind, model.OutboxStatusPending, applyRulesPayload{NodeID: vm.NodeID})
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Create(ev).Error; err != nil {
+			return nil, err
+		}
+		pushes = append(pushes, ev)
+	}
+	return pushes, nil
+}
+
+func resizeColumns(cfg hypervisor.VMConfig) map[string]interface{} {
+	return map[string]interface{}{"cpu": cfg.CPU, "memory_mb": cfg.MemoryMB, "disk_gb": cfg.DiskGB}
+}
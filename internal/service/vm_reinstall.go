@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/cloudinit"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+// VMReinstallRequest picks the image a VM is rebuilt from and how the fresh
+// guest is set up.
+type VMReinstallRequest struct {
+	ImageID uint `json:"image_id" binding:"required"`
+	GuestSetup
+}
+
+// ReinstallVM wipes the VM's disk and rebuilds it from req.ImageID. The VM
+// keeps its ID, node, size and guest, so addresses and billing carry over.
+// A running VM is stopped first and started again on the new disk.
+func (s *VMService) ReinstallVM(ctx context.Context, p Principal, id uint, req VMReinstallRequest) error {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, id)
+	if err != nil {
+		return err
+	}
+	ci, err := s.prepareReinstall(ctx, p, vm, req)
+	if err != nil {
+		return err
+	}
+	return s.reinstall(ctx, p, vm, hv, req.ImageID, ci)
+}
+
+// prepareReinstall checks that vm can be reinstalled from the requested
+// image and builds the guest's cloud-init configuration.
+func (s *VMService) prepareReinstall(ctx context.Context, p Principal, vm *model.VM, req VMReinstallRequest) (*cloudinit.Config, error) {
+	if !canTransition(vm.Status, model.VMStatusReinstalling) {
+		return nil, &TransitionError{VMID: vm.ID, From: vm.Status, To: model.VMStatusReinstalling}
+	}
+	img, err := NewImageService(s.db).GetImage(ctx, req.ImageID, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImageFits(img, vm.MemoryMB, vm.DiskGB); err != nil {
+		return nil, err
+	}
+	return s.cloudInitFor(ctx, p, vm.Name, &img.ID, req.GuestSetup)
+}
+
+// reinstall runs a reinstall checked by prepareReinstall. A VM found in
+// reinstalling is a rerun after a restart and picks up where it left off.
+func (s *VMService) reinstall(ctx context.Context, p Principal, vm *model.VM, hv hypervisor.Hypervisor, imageID uint, ci *cloudinit.Config) error {
+	// The image may have been disabled since the request was accepted,
+	// which only keeps it from new requests.
+	img, err := NewImageService(s.db).GetImage(ctx, imageID, true)
+	if err != nil {
+		return err
+	}
+	// The new guest keeps the VM's addresses.
+	if s.ipam != nil {
+		leases, err := s.ipam.leases(ctx, vm.ID)
+		if err != nil {
+			return err
+		}
+		ci = withGuestNetwork(ci, leases)
+	}
+	bw, err := s.bandwidth(s.db.WithContext(ctx), vm)
+	if err != nil {
+		return err
+	}
+	from, restart := vm.Status, vm.Status == model.VMStatusRunning
+	if from == model.VMStatusReinstalling {
+		from = model.VMStatusError
+	} else if err := s.transition(ctx, p, vm, model.VMStatusReinstalling, actionReinstall, nil, nil); err != nil {
+		return err
+	}
+	if err := hv.StopVM(ctx, vm.HypervisorID); err != nil {
+		return s.settle(ctx, p, vm, actionReinstall, from, from, err)
+	}
+
+	cfg := hypervisor.VMConfig{
+		Name:      vm.Name,
+		CPU:       vm.CPU,
+		MemoryMB:  vm.MemoryMB,
+		DiskGB:    vm.DiskGB,
+		Image:     imageSpec(img),
+		CloudInit: ci,
+		Bandwidth: bw,
+	}
+	if err := hv.ReinstallVM(ctx, vm.HypervisorID, cfg); err != nil {
+		// The old disk may already be gone, so the VM cannot go back.
+		return s.settle(ctx, p, vm, actionReinstall, model.VMStatusStopped, model.VMStatusError, err)
+	}
+	// The snapshots went with the old disk.
+	extra := map[string]interface{}{"image_id": img.ID}
+	err = s.db.WithContext(context.WithoutCancel(ctx)).Transaction(func(tx *gorm.DB) error {
+		if err := applyTransition(tx, p, vm, model.VMStatusStopped, actionReinstall, nil, extra); err != nil {
+			return err
+		}
+		return deleteSnapshots(tx, vm.ID)
+	})
+	if err != nil {
+		return err
+	}
+	vm.Status = model.VMStatusStopped
+	vm.ImageID = &img.ID
+	if restart {
+		return s.StartVM(ctx, p, vm.ID)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestVMServiceReinstall(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	images := NewImageService(db)
+	debian := createTestImage(t, images, "debian-12")
+	ubuntu := createTestImage(t, images, "ubuntu-24.04")
+
+	vm, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 20, ImageID: &debian.ID})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	if _, err := s.CreateSnapshot(ctx, owner, vm.ID, SnapshotCreateRequest{Name: "old"}); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	req := VMReinstallRequest{ImageID: ubuntu.ID, GuestSetup: GuestSetup{Hostname: "fresh", RootPassword: "correct horse"}}
+	if err := s.ReinstallVM(ctx, owner, vm.ID, req); err != nil {
+		t.Fatalf("reinstall: %v", err)
+	}
+	got, _ := s.GetVMByID(ctx, owner, vm.ID)
+	if got.Status != model.VMStatusRunning || got.HypervisorID != vm.HypervisorID || got.ImageID == nil || *got.ImageID != ubuntu.ID {
+		t.Fatalf("unexpected VM after reinstall %+v", got)
+	}
+	if snaps, _ := s.ListSnapshots(ctx, owner, vm.ID); len(snaps) != 0 || hv.Snapshots(vm.HypervisorID) != 0 {
+		t.Fatalf("snapshots of the old disk survived the reinstall: %+v", snaps)
+	}
+	info, _ := hv.VM(vm.HypervisorID)
+	ci, _ := hv.Seed(vm.HypervisorID)
+	if info.Image != "ubuntu-24.04" || ci.Hostname != "fresh" || ci.PasswordHash == "" {
+		t.Fatalf("guest not rebuilt: %+v, seed %+v", info, ci)
+	}
+	history, _ := s.History(ctx, owner, vm.ID)
+	var actions []string
+	for _, h := range history[len(history)-4:] {
+		actions = append(actions, h.Action+":"+h.ToStatus)
+	}
+	want := []string{"reinstall:reinstalling", "reinstall:stopped", "start:starting", "start:running"}
+	for i := range want {
+		if actions[i] != want[i] {
+			t.Fatalf("history %v, want %v", actions, want)
+		}
+	}
+
+	small := createTestImage(t, images, "windows")
+	if err := images.db.Model(small).Update("min_disk_gb", 40).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReinstallVM(ctx, owner, vm.ID, VMReinstallRequest{ImageID: small.ID}); !errors.Is(err, ErrImageTooSmall) {
+		t.Fatalf("expected ErrImageTooSmall, got %v", err)
+	}
+}
+
+func TestVMServiceReinstallFailure(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	img := createTestImage(t, NewImageService(db), "debian-12")
+	vm := createTestVM(t, s)
+
+	hv.Inject(hypervisor.MethodReinstallVM, hypervisor.Fault{Err: errInjected, Times: 1})
+	if err := s.ReinstallVM(ctx, owner, vm.ID, VMReinstallRequest{ImageID: img.ID}); !errors.Is(err, errInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	got, _ := s.GetVMByID(ctx, owner, vm.ID)
+	if got.Status != model.VMStatusError || got.ImageID != nil {
+		t.Fatalf("failed reinstall should leave the VM in error, got %+v", got)
+	}
+
+	// A VM in error can be recovered by reinstalling it.
+	if err := s.ReinstallVM(ctx, owner, vm.ID, VMReinstallRequest{ImageID: img.ID}); err != nil {
+		t.Fatalf("reinstall from error: %v", err)
+	}
+	if got, _ := s.GetVMByID(ctx, owner, vm.ID); got.Status != model.VMStatusStopped {
+		t.Fatalf("status = %s, want stopped", got.Status)
+	}
+}
+
+func TestTaskVMReinstall(t *testing.T) {
+	s, tasks, hv := newTestTaskVMService(t)
+	img := createTestImage(t, NewImageService(s.db), "debian-12")
+	vm := createTestVM(t, s)
+
+	task, err := s.ReinstallVMAsync(ctx, owner, vm.ID, VMReinstallRequest{ImageID: img.ID, GuestSetup: GuestSetup{RootPassword: "correct horse"}})
+	if err != nil {
+		t.Fatalf("enqueue reinstall: %v", err)
+	}
+	done := waitTask(t, tasks, owner, task.ID)
+	if done.Status != model.TaskStatusSucceeded || done.Type != TaskVMReinstall {
+		t.Fatalf("reinstall task %+v", done)
+	}
+	var got model.VM
+	if err := json.Unmarshal(done.Result, &got); err != nil || got.ImageID == nil || *got.ImageID != img.ID {
+		t.Fatalf("result = %s, %v", done.Result, err)
+	}
+	if info, _ := hv.VM(vm.HypervisorID); info.Image != "debian-12" {
+		t.Fatalf("guest not rebuilt: %+v", info)
+	}
+
+	if _, err := s.ReinstallVMAsync(ctx, Principal{UserID: 2}, vm.ID, VMReinstallRequest{ImageID: img.ID}); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("expected ErrVMNotFound for another user, got %v", err)
+	}
+}
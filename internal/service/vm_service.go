@@ -1,21 +1,70 @@
 package service
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"time"
+	"fmt"
+	"strings"
 
-	"Zjmf-kvm/internal/hypervisor"
-	"Zjmf-kvm/internal/model"
+	"StarstreamAstra/internal/cloudinit"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
 	"gorm.io/gorm"
 )
 
+var ErrVMNotFound = errors.New("VM not found")
+
 type VMService struct {
 	db         *gorm.DB
 	hypervisor hypervisor.Hypervisor
+	scheduler  *Scheduler
+	nodes      NodeHypervisors
+	tasks      *TaskService
+	outbox     *Outbox
+	plans      map[string]Plan
+	ipam       *IPAMService
+	nat        *NATService
+	groups     *SecurityGroupService
+	traffic    *TrafficService
+
+	// defaultPlan names the plan of VMs created without one.
+	defaultPlan string
+}
+
+// NodeHypervisors returns the hypervisor that manages VMs on a node.
+type NodeHypervisors interface {
+	ForNode(node *model.Node) hypervisor.Hypervisor
 }
 
 func NewVMService(db *gorm.DB, hv hypervisor.Hypervisor) *VMService {
-	return &VMService{db: db, hypervisor: hv}
+	s := &VMService{db: db, hypervisor: hv, outbox: NewOutbox(db), plans: defaultPlans()}
+	s.registerOutbox()
+	return s
+}
+
+// WithScheduler makes CreateVM place new VMs on nodes chosen by sched and
+// drive them through nodes. VMs without a node keep using the default
+// hypervisor.
+func (s *VMService) WithScheduler(sched *Scheduler, nodes NodeHypervisors) *VMService {
+	s.scheduler = sched
+	s.nodes = nodes
+	return s
+}
+
+// Principal is the user a VM operation is performed for. Admins act on
+// every VM; other users only on the VMs they own.
+type Principal struct {
+	UserID uint
+	Admin  bool
+}
+
+func (p Principal) scope(db *gorm.DB) *gorm.DB {
+	if p.Admin {
+		return db
+	}
+	return db.Where("user_id = ?", p.UserID)
 }
 
 type VMCreateRequest struct {
@@ -24,45 +73,305 @@ type VMCreateRequest struct {
 	MemoryMB    int    `json:"memory_mb" binding:"required"`
 	DiskGB      int    `json:"disk_gb" binding:"required"`
 	Description string `json:"description"`
+	// ImageID picks the base image the disk is cloned from; without it the
+	// VM gets a blank disk.
+	ImageID *uint `json:"image_id"`
+	// Plan sets the VM's limits, such as how many snapshots it may keep;
+	// it defaults to DefaultPlan. Only admins may pick one.
+	Plan string `json:"plan" binding:"omitempty,max=32"`
+	// NetworkMode "nat" gives the VM a private address and a range of
+	// ports on its node's public address instead of a public address.
+	NetworkMode string `json:"network_mode" binding:"omitempty,oneof=public nat"`
+	GuestSetup
 }
 
-func (s *VMService) CreateVM(req VMCreateRequest) (*model.VM, error) {
-	cfg := hypervisor.VMConfig{
-		Name: req.Name, CPU: req.CPU, MemoryMB: req.MemoryMB, DiskGB: req.DiskGB,
+// GuestSetup is handed to the guest through cloud-init on first boot. The
+// hostname defaults to the VM name. Keys come inline as SSHKeys or by ID
+// from the keys the user has on file.
+type GuestSetup struct {
+	Hostname     string   `json:"hostname" binding:"omitempty,hostname_rfc1123,max=253"`
+	RootPassword string   `json:"root_password" binding:"omitempty,min=8,max=128"`
+	SSHKeys      []string `json:"ssh_keys" binding:"omitempty,max=32"`
+	SSHKeyIDs    []uint   `json:"ssh_key_ids" binding:"omitempty,max=32"`
+}
+
+func (g GuestSetup) isZero() bool {
+	return g.Hostname == "" && g.RootPassword == "" && len(g.SSHKeys) == 0 && len(g.SSHKeyIDs) == 0
+}
+
+func (s *VMService) CreateVM(ctx context.Context, p Principal, req VMCreateRequest) (*model.VM, error) {
+	ci, err := s.cloudInitFor(ctx, p, req.Name, req.ImageID, req.GuestSetup)
+	if err != nil {
+		return nil, err
 	}
-	info, err := s.hypervisor.CreateVM(cfg)
+	vm, err := s.insertVM(ctx, p, req, nil)
 	if err != nil {
 		return nil, err
 	}
+	if err := s.provision(ctx, p, vm, ci); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
 
+// insertVM records a new VM in the creating state. Its HypervisorID is a
+// unique placeholder until provision learns the real one. then, if set,
+// runs in the same transaction, so that the task building the VM is stored
+// with it or not at all.
+func (s *VMService) insertVM(ctx context.Context, p Principal, req VMCreateRequest, then func(tx *gorm.DB, vm *model.VM) error) (*model.VM, error) {
+	if req.Plan != "" && !p.Admin {
+		return nil, ErrPlanAdminOnly
+	}
+	plan, limits, err := s.plan(req.Plan)
+	if err != nil {
+		return nil, err
+	}
+	mode := req.NetworkMode
+	if mode == "" {
+		mode = model.NetworkModePublic
+	}
+	if mode == model.NetworkModeNAT && (s.nat == nil || s.ipam == nil) {
+		return nil, ErrNATUnavailable
+	}
+	if req.ImageID != nil {
+		img, err := NewImageService(s.db).GetImage(ctx, *req.ImageID, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkImageFits(img, req.MemoryMB, req.DiskGB); err != nil {
+			return nil, err
+		}
+	}
 	vm := &model.VM{
-		Name:         info.Name,
-		CPU:          info.CPU,
-		MemoryMB:     info.MemoryMB,
-		DiskGB:       info.DiskGB,
-		Status:       info.Status,
+		Name:         req.Name,
+		CPU:          req.CPU,
+		MemoryMB:     req.MemoryMB,
+		DiskGB:       req.DiskGB,
+		Status:       model.VMStatusCreating,
 		Description:  req.Description,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
-		HypervisorID: info.ID,
+		HypervisorID: pendingHypervisorID(),
+		UserID:       p.UserID,
+		ImageID:      req.ImageID,
+		Plan:         plan,
+		NetworkMode:  mode,
+		InboundMbps:  limits.InboundMbps,
+		OutboundMbps: limits.OutboundMbps,
 	}
-	if err := s.db.Create(vm).Error; err != nil {
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(vm).Error; err != nil {
+			return err
+		}
+		err := tx.Create(&model.VMTransition{
+			VMID: vm.ID, ToStatus: model.VMStatusCreating, Action: actionCreate, ActorID: p.UserID,
+		}).Error
+		if err != nil || then == nil {
+			return err
+		}
+		return then(tx, vm)
+	})
+	if err != nil {
 		return nil, err
 	}
 	return vm, nil
 }
 
-func (s *VMService) ListVMs() ([]*model.VM, error) {
+// provision places a creating VM, builds the guest and moves the VM to
+// stopped. ci, when set, is attached as the guest's cloud-init seed. It
+// runs as a saga: if any step fails, the reservation and the guest made so
+// far are undone and the VM ends in error.
+func (s *VMService) provision(ctx context.Context, p Principal, vm *model.VM, ci *cloudinit.Config) error {
+	cfg := hypervisor.VMConfig{Name: vm.Name, CPU: vm.CPU, MemoryMB: vm.MemoryMB, DiskGB: vm.DiskGB, CloudInit: ci, Bandwidth: vmBandwidth(vm)}
+	sg := s.newSaga()
+	fail := func(err error) error {
+		sg.abort(ctx)
+		return s.settle(ctx, p, vm, actionCreate, model.VMStatusStopped, model.VMStatusError, err)
+	}
+
+	if vm.ImageID != nil {
+		// The image was checked when the VM was requested; it may have been
+		// disabled since, which only keeps it from new requests.
+		img, err := NewImageService(s.db).GetImage(ctx, *vm.ImageID, true)
+		if err != nil {
+			return fail(err)
+		}
+		cfg.Image = imageSpec(img)
+	}
+
+	hv := s.hypervisor
+	var node *model.Node
+	if s.scheduler != nil {
+		var err error
+		node, err = s.scheduler.Reserve(ctx, vmResources(cfg))
+		if err != nil {
+			return fail(err)
+		}
+		if err := sg.hold(ctx, outboxReleaseNode, releaseNodePayload{NodeID: node.ID, Resources: vmResources(cfg)}); err != nil {
+			s.release(ctx, node, vmResources(cfg))
+			return fail(err)
+		}
+		hv = s.nodes.ForNode(node)
+	}
+	natMode := vm.NetworkMode == model.NetworkModeNAT
+	var leases []ipLease
+	if s.ipam != nil {
+		var err error
+		leases, err = s.ipam.allocate(ctx, vm.ID, node, natMode)
+		if len(leases) > 0 {
+			if err := sg.hold(ctx, outboxReleaseIPs, releaseIPsPayload{VMID: vm.ID}); err != nil {
+				_ = releaseLeases(s.db.WithContext(context.WithoutCancel(ctx)), vm.ID)
+				return fail(err)
+			}
+		}
+		if err != nil {
+			return fail(err)
+		}
+		cfg.CloudInit = withGuestNetwork(ci, leases)
+	}
+	if natMode {
+		if _, ok := leaseColumns(leases)["ipv4"]; !ok || s.nat == nil {
+			return fail(fmt.Errorf("%w: no NAT address pool serves the node", ErrNATUnavailable))
+		}
+		var nodeID uint
+		if node != nil {
+			nodeID = node.ID
+		}
+		if _, err := s.nat.allocateRange(ctx, vm.ID, nodeID); err != nil {
+			return fail(err)
+		}
+		if err := sg.hold(ctx, outboxReleaseNAT, releaseNATPayload{VMID: vm.ID}); err != nil {
+			_ = releasePorts(s.db.WithContext(context.WithoutCancel(ctx)), vm.ID)
+			return fail(err)
+		}
+	}
+	info, err := hv.CreateVM(ctx, cfg)
+	if err != nil {
+		return fail(err)
+	}
+	guest := deleteGuestPayload{HypervisorID: info.ID}
+	extra := leaseColumns(leases)
+	extra["hypervisor_id"] = info.ID
+	if node != nil {
+		guest.NodeID = &node.ID
+		extra["node_id"] = node.ID
+	}
+	if err := sg.hold(ctx, outboxDeleteGuest, guest); err != nil {
+		_ = hv.DeleteVM(context.WithoutCancel(ctx), info.ID)
+		return fail(err)
+	}
+
+	err = s.db.WithContext(context.WithoutCancel(ctx)).Transaction(func(tx *gorm.DB) error {
+		if err := applyTransition(tx, p, vm, model.VMStatusStopped, actionCreate, nil, extra); err != nil {
+			return err
+		}
+		return sg.commit(tx)
+	})
+	if err != nil {
+		return fail(err)
+	}
+	vm.Status = model.VMStatusStopped
+	vm.HypervisorID = info.ID
+	if node != nil {
+		vm.NodeID = &node.ID
+	}
+	if v, ok := extra["ipv4"].(string); ok {
+		vm.IPv4 = v
+	}
+	if v, ok := extra["ipv6"].(string); ok {
+		vm.IPv6 = v
+	}
+	if natMode {
+		// Installs masquerading for the VM's network. The VM has no forwards
+		// yet, and the periodic sync retries if the node is unreachable.
+		_ = s.nat.apply(ctx, s.db.WithContext(ctx), vm.NodeID)
+	}
+	return nil
+}
+
+// pendingPrefix marks the HypervisorID of a VM whose guest is not built.
+const pendingPrefix = "pending-"
+
+func pendingHypervisorID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return pendingPrefix + hex.EncodeToString(b)
+}
+
+func isPendingHypervisorID(id string) bool {
+	return strings.HasPrefix(id, pendingPrefix)
+}
+
+// hypervisorFor returns the hypervisor that owns vm.
+func (s *VMService) hypervisorFor(ctx context.Context, vm *model.VM) (hypervisor.Hypervisor, error) {
+	hv, err := s.nodeHypervisor(s.db.WithContext(ctx), vm.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("load node %d for vm %d: %w", *vm.NodeID, vm.ID, err)
+	}
+	return hv, nil
+}
+
+// nodeHypervisor returns the hypervisor of the node nodeID, or the default
+// one for VMs without a node.
+func (s *VMService) nodeHypervisor(db *gorm.DB, nodeID *uint) (hypervisor.Hypervisor, error) {
+	if nodeID == nil || s.nodes == nil {
+		return s.hypervisor, nil
+	}
+	var node model.Node
+	if err := db.First(&node, *nodeID).Error; err != nil {
+		return nil, err
+	}
+	return s.nodes.ForNode(&node), nil
+}
+
+// onNode limits a VM query to the VMs on the node nodeID, or to those on
+// the default hypervisor.
+func onNode(db *gorm.DB, nodeID *uint) *gorm.DB {
+	if nodeID == nil {
+		return db.Where("node_id IS NULL")
+	}
+	return db.Where("node_id = ?", *nodeID)
+}
+
+// vmNodes returns the distinct nodes of the VMs query matches; nil stands
+// for the default hypervisor.
+func vmNodes(query *gorm.DB) ([]*uint, error) {
+	var rows []struct{ NodeID *uint }
+	if err := query.Model(&model.VM{}).Distinct("node_id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	nodeIDs := make([]*uint, 0, len(rows))
+	for _, row := range rows {
+		nodeIDs = append(nodeIDs, row.NodeID)
+	}
+	return nodeIDs, nil
+}
+
+// release hands a reservation back to its node. It runs on cleanup paths
+// where the caller already has an error to report, so a failure here is
+// dropped rather than masking it.
+func (s *VMService) release(ctx context.Context, node *model.Node, res Resources) {
+	if node == nil {
+		return
+	}
+	_ = adjustNode(s.db.WithContext(ctx), node.ID, Resources{}.sub(res))
+}
+
+func vmResources(cfg hypervisor.VMConfig) Resources {
+	return Resources{CPU: cfg.CPU, MemoryMB: cfg.MemoryMB, DiskGB: cfg.DiskGB}
+}
+
+func (s *VMService) ListVMs(ctx context.Context, p Principal) ([]*model.VM, error) {
 	var vms []*model.VM
-	if err := s.db.Find(&vms).Error; err != nil {
+	if err := p.scope(s.db.WithContext(ctx)).Find(&vms).Error; err != nil {
 		return nil, err
 	}
 	return vms, nil
 }
 
-func (s *VMService) GetVMByID(id uint) (*model.VM, error) {
+// GetVMByID returns nil without an error when the VM does not exist or is
+// not visible to p.
+func (s *VMService) GetVMByID(ctx context.Context, p Principal, id uint) (*model.VM, error) {
 	var vm model.VM
-	if err := s.db.First(&vm, id).Error; err != nil {
+	if err := p.scope(s.db.WithContext(ctx)).First(&vm, id).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, nil
 		}
@@ -71,54 +380,181 @@ func (s *VMService) GetVMByID(id uint) (*model.VM, error) {
 	return &vm, nil
 }
 
-func (s *VMService) UpdateVMStatus(id uint, status string) error {
-	return s.db.Model(&model.VM{}).Where("id = ?", id).Update("status", status).Error
+func (s *VMService) ownedVM(ctx context.Context, p Principal, id uint) (*model.VM, error) {
+	vm, err := s.GetVMByID(ctx, p, id)
+	if err != nil {
+		return nil, err
+	}
+	if vm == nil {
+		return nil, ErrVMNotFound
+	}
+	return vm, nil
 }
 
-func (s *VMService) StartVM(id uint) error {
-	vm, err := s.GetVMByID(id)
-	if err != nil || vm == nil {
+func (s *VMService) StartVM(ctx context.Context, p Principal, id uint) error {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, id)
+	if err != nil {
 		return err
 	}
-	if err := s.hypervisor.StartVM(vm.HypervisorID); err != nil {
+	if vm.Status == model.VMStatusSuspended && !p.Admin {
+		return ErrVMSuspended
+	}
+	from := vm.Status
+	if err := s.transition(ctx, p, vm, model.VMStatusStarting, actionStart, nil, nil); err != nil {
 		return err
 	}
-	return s.UpdateVMStatus(id, "running")
+	err = hv.StartVM(ctx, vm.HypervisorID)
+	return s.settle(ctx, p, vm, actionStart, model.VMStatusRunning, from, err)
 }
 
-func (s *VMService) StopVM(id uint) error {
-	vm, err := s.GetVMByID(id)
-	if err != nil || vm == nil {
+func (s *VMService) StopVM(ctx context.Context, p Principal, id uint) error {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, id)
+	if err != nil {
+		return err
+	}
+	from := vm.Status
+	if err := s.transition(ctx, p, vm, model.VMStatusStopping, actionStop, nil, nil); err != nil {
+		return err
+	}
+	err = hv.StopVM(ctx, vm.HypervisorID)
+	return s.settle(ctx, p, vm, actionStop, model.VMStatusStopped, from, err)
+}
+
+// ForceStopVM also works on a VM stuck in stopping after a graceful stop
+// timed out.
+func (s *VMService) ForceStopVM(ctx context.Context, p Principal, id uint) error {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, id)
+	if err != nil {
+		return err
+	}
+	from := vm.Status
+	failed := from
+	if from == model.VMStatusStopping {
+		failed = model.VMStatusError
+	} else if err := s.transition(ctx, p, vm, model.VMStatusStopping, actionForceStop, nil, nil); err != nil {
 		return err
 	}
-	if err := s.hypervisor.StopVM(vm.HypervisorID); err != nil {
+	err = hv.ForceStopVM(ctx, vm.HypervisorID)
+	return s.settle(ctx, p, vm, actionForceStop, model.VMStatusStopped, failed, err)
+}
+
+func (s *VMService) RebootVM(ctx context.Context, p Principal, id uint) error {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, id)
+	if err != nil {
 		return err
 	}
-	return s.UpdateVMStatus(id, "stopped")
+	if vm.Status != model.VMStatusRunning {
+		return hypervisor.ErrVMNotRunning
+	}
+	return hv.RebootVM(ctx, vm.HypervisorID)
 }
 
-func (s *VMService) DeleteVM(id uint) error {
-	vm, err := s.GetVMByID(id)
-	if err != nil || vm == nil {
+func (s *VMService) DeleteVM(ctx context.Context, p Principal, id uint) error {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, id)
+	if err != nil {
 		return err
 	}
-	if err := s.hypervisor.DeleteVM(vm.HypervisorID); err != nil {
+	from := vm.Status
+	if vm.Status != model.VMStatusDeleting {
+		if err := s.transition(ctx, p, vm, model.VMStatusDeleting, actionDelete, nil, nil); err != nil {
+			return err
+		}
+	}
+	// A guest that is already gone is treated as deleted so that a delete
+	// interrupted after the hypervisor call can be retried.
+	if err := hv.DeleteVM(ctx, vm.HypervisorID); err != nil && !errors.Is(err, hypervisor.ErrVMNotFound) {
+		if from == model.VMStatusDeleting {
+			from = model.VMStatusError
+		}
+		return s.settle(ctx, p, vm, actionDelete, from, from, err)
+	}
+	// The guest is gone, so the delete can only go forward. If the row
+	// cannot be removed now the outbox keeps trying.
+	sg := s.newSaga()
+	var pushes []*model.OutboxEvent
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) (err error) {
+		pushes, err = purgeVM(tx, sg.id, vm.ID)
 		return err
+	})
+	if err != nil {
+		if ferr := sg.forward(ctx, outboxPurgeVM, purgeVMPayload{VMID: vm.ID}); ferr != nil {
+			return err
+		}
+		return nil
+	}
+	// Drops the VM's rules from its node now if the node can be reached;
+	// otherwise the outbox retries.
+	for _, ev := range pushes {
+		if err := s.outbox.dispatch(ctx, ev); err != nil {
+			s.outbox.notify()
+		}
 	}
-	return s.db.Delete(&model.VM{}, id).Error
+	return nil
 }
 
-func (s *VMService) ResizeVM(id uint, cfg hypervisor.VMConfig) error {
-	vm, err := s.GetVMByID(id)
-	if err != nil || vm == nil {
+func (s *VMService) ResizeVM(ctx context.Context, p Principal, id uint, cfg hypervisor.VMConfig) error {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, id)
+	if err != nil {
+		return err
+	}
+	if err := checkResize(vm, hv, cfg); err != nil {
 		return err
 	}
-	if err := s.hypervisor.ResizeVM(vm.HypervisorID, cfg); err != nil {
+	if err := s.checkSnapshotResize(ctx, vm, cfg); err != nil {
 		return err
 	}
+	from := vm.Status
+
+	// Claim any growth on the node before touching the guest so concurrent
+	// resizes cannot overbook it; the saga hands it back if the resize fails.
+	sg := s.newSaga()
+	delta := vmResources(cfg).sub(vmAllocation(vm))
+	if vm.NodeID != nil && !delta.isZero() {
+		if err := adjustNode(s.db.WithContext(ctx), *vm.NodeID, delta); err != nil {
+			return err
+		}
+		if err := sg.hold(ctx, outboxReleaseNode, releaseNodePayload{NodeID: *vm.NodeID, Resources: delta}); err != nil {
+			_ = adjustNode(s.db.WithContext(context.WithoutCancel(ctx)), *vm.NodeID, Resources{}.sub(delta))
+			return err
+		}
+	}
+	if err := s.transition(ctx, p, vm, model.VMStatusResizing, actionResize, nil, nil); err != nil {
+		sg.abort(ctx)
+		return err
+	}
+	if err := hv.ResizeVM(ctx, vm.HypervisorID, cfg); err != nil {
+		sg.abort(ctx)
+		return s.settle(ctx, p, vm, actionResize, from, from, err)
+	}
+
+	// The guest has its new size and a resize cannot be undone in general,
+	// so from here the database is brought in line rather than rolled back.
+	err = s.db.WithContext(context.WithoutCancel(ctx)).Transaction(func(tx *gorm.DB) error {
+		if err := applyTransition(tx, p, vm, from, actionResize, nil, resizeColumns(cfg)); err != nil {
+			return err
+		}
+		return sg.commit(tx)
+	})
+	if err != nil {
+		if ferr := sg.forward(ctx, outboxFinishResize, finishResizePayload{Actor: p, VMID: vm.ID, From: from, Config: cfg}); ferr != nil {
+			return err
+		}
+	}
+	vm.Status = from
 	vm.CPU = cfg.CPU
 	vm.MemoryMB = cfg.MemoryMB
 	vm.DiskGB = cfg.DiskGB
-	vm.UpdatedAt = time.Now()
-	return s.db.Save(vm).Error
+	return nil
+}
+
+func (s *VMService) vmAndHypervisor(ctx context.Context, p Principal, id uint) (*model.VM, hypervisor.Hypervisor, error) {
+	vm, err := s.ownedVM(ctx, p, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	hv, err := s.hypervisorFor(ctx, vm)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vm, hv, nil
 }
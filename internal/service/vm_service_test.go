@@ -0,0 +1,299 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+var (
+	errInjected = errors.New("injected failure")
+	ctx         = context.Background()
+	owner       = Principal{UserID: 1}
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("sql db: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	if err := db.AutoMigrate(&model.Node{}, &model.VM{}, &model.VMTransition{}, &model.Task{}, &model.OutboxEvent{}, &model.Image{}, &model.SSHKey{}, &model.Snapshot{}, &model.Backup{}, &model.BackupSchedule{}, &model.ConsoleToken{}, &model.IPPool{}, &model.IPAddress{}, &model.NATPortRange{}, &model.PortForward{}, &model.SecurityGroup{}, &model.SecurityGroupRule{}, &model.VMSecurityGroup{}, &model.TrafficUsage{}, &model.TrafficCounter{}, &model.TrafficEnforcement{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func newTestVMService(t *testing.T) (*VMService, *hypervisor.FakeHypervisor, *gorm.DB) {
+	t.Helper()
+	db := newTestDB(t)
+	hv := hypervisor.NewFakeHypervisor()
+	return NewVMService(db, hv), hv, db
+}
+
+func createTestVM(t *testing.T, s *VMService) *model.VM {
+	t.Helper()
+	vm, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 2, MemoryMB: 2048, DiskGB: 20, Description: "test"})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	return vm
+}
+
+func TestVMServiceCreateVM(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+
+	vm := createTestVM(t, s)
+	if vm.ID == 0 || vm.Status != "stopped" || vm.CPU != 2 || vm.Description != "test" {
+		t.Fatalf("unexpected vm %+v", vm)
+	}
+	info, ok := hv.VM(vm.HypervisorID)
+	if !ok || info.Name != "web" {
+		t.Fatalf("guest not created on hypervisor: %+v", info)
+	}
+
+	vms, err := s.ListVMs(ctx, owner)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(vms) != 1 || vms[0].HypervisorID != vm.HypervisorID {
+		t.Fatalf("unexpected list %+v", vms)
+	}
+}
+
+func TestVMServiceCreateVMHypervisorError(t *testing.T) {
+	s, hv, db := newTestVMService(t)
+	hv.Inject(hypervisor.MethodCreateVM, hypervisor.Fault{Err: errInjected})
+
+	if _, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 512, DiskGB: 10}); !errors.Is(err, errInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	var vms []model.VM
+	db.Find(&vms)
+	if len(vms) != 1 || vms[0].Status != model.VMStatusError || hv.Count() != 0 {
+		t.Fatalf("expected one vm in error and no guests, got %+v and %d guests", vms, hv.Count())
+	}
+}
+
+func TestVMServiceStartStop(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	assertStatus(t, s, hv, vm, "running")
+
+	if err := s.StopVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	assertStatus(t, s, hv, vm, "stopped")
+}
+
+func TestVMServiceStartFailureKeepsStatus(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	hv.Inject(hypervisor.MethodStartVM, hypervisor.Fault{Err: errInjected, Times: 1})
+
+	if err := s.StartVM(ctx, owner, vm.ID); !errors.Is(err, errInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	assertStatus(t, s, hv, vm, "stopped")
+
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("retry start: %v", err)
+	}
+	assertStatus(t, s, hv, vm, "running")
+	if hv.Calls(hypervisor.MethodStartVM) != 2 {
+		t.Fatalf("expected 2 start calls, got %d", hv.Calls(hypervisor.MethodStartVM))
+	}
+}
+
+func TestVMServicePartialStopFailure(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	hv.Inject(hypervisor.MethodStopVM, hypervisor.Fault{Err: errInjected, Partial: true})
+
+	if err := s.StopVM(ctx, owner, vm.ID); !errors.Is(err, errInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	info, _ := hv.VM(vm.HypervisorID)
+	if info.Status != "stopped" {
+		t.Fatalf("partial fault should have stopped the guest, got %q", info.Status)
+	}
+	got, _ := s.GetVMByID(ctx, owner, vm.ID)
+	if got.Status != "running" {
+		t.Fatalf("db status should be unchanged on error, got %q", got.Status)
+	}
+}
+
+func TestVMServiceResizeVM(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+
+	cfg := hypervisor.VMConfig{CPU: 4, MemoryMB: 4096, DiskGB: 40}
+	if err := s.ResizeVM(ctx, owner, vm.ID, cfg); err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	got, _ := s.GetVMByID(ctx, owner, vm.ID)
+	if got.CPU != 4 || got.MemoryMB != 4096 || got.DiskGB != 40 {
+		t.Fatalf("unexpected vm after resize %+v", got)
+	}
+	info, _ := hv.VM(vm.HypervisorID)
+	if info.DiskGB != 40 {
+		t.Fatalf("unexpected guest after resize %+v", info)
+	}
+
+	if err := s.ResizeVM(ctx, owner, vm.ID, hypervisor.VMConfig{CPU: 4, MemoryMB: 4096, DiskGB: 10}); !errors.Is(err, hypervisor.ErrDiskShrink) {
+		t.Fatalf("expected ErrDiskShrink, got %v", err)
+	}
+}
+
+func TestVMServiceDeleteVM(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+
+	hv.Inject(hypervisor.MethodDeleteVM, hypervisor.Fault{Err: errInjected, Times: 1})
+	if err := s.DeleteVM(ctx, owner, vm.ID); !errors.Is(err, errInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	if got, _ := s.GetVMByID(ctx, owner, vm.ID); got == nil {
+		t.Fatal("vm row removed despite hypervisor failure")
+	}
+
+	if err := s.DeleteVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got, _ := s.GetVMByID(ctx, owner, vm.ID); got != nil {
+		t.Fatalf("vm row still present: %+v", got)
+	}
+	if _, ok := hv.VM(vm.HypervisorID); ok {
+		t.Fatal("guest still present on hypervisor")
+	}
+}
+
+func TestVMServiceHypervisorNotFound(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	if err := hv.DeleteVM(ctx, vm.HypervisorID); err != nil {
+		t.Fatalf("delete guest: %v", err)
+	}
+
+	if err := s.StartVM(ctx, owner, vm.ID); !errors.Is(err, hypervisor.ErrVMNotFound) {
+		t.Fatalf("expected ErrVMNotFound, got %v", err)
+	}
+}
+
+func TestVMServiceRebootAndForceStop(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+
+	if err := s.RebootVM(ctx, owner, vm.ID); !errors.Is(err, hypervisor.ErrVMNotRunning) {
+		t.Fatalf("expected ErrVMNotRunning, got %v", err)
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := s.RebootVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("reboot: %v", err)
+	}
+	if err := s.ForceStopVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("force stop: %v", err)
+	}
+	assertStatus(t, s, hv, vm, "stopped")
+}
+
+func TestVMServiceContextCancelled(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	hv.Inject(hypervisor.MethodStartVM, hypervisor.Fault{Latency: time.Minute})
+
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := s.StartVM(cctx, owner, vm.ID); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	assertStatus(t, s, hv, vm, "stopped")
+}
+
+func TestVMServiceLatency(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	hv.Inject(hypervisor.MethodStopVM, hypervisor.Fault{Latency: 50 * time.Millisecond})
+
+	start := time.Now()
+	if err := s.StopVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected injected latency, took %v", elapsed)
+	}
+}
+
+func assertStatus(t *testing.T, s *VMService, hv *hypervisor.FakeHypervisor, vm *model.VM, want string) {
+	t.Helper()
+	got, err := s.GetVMByID(ctx, owner, vm.ID)
+	if err != nil || got == nil {
+		t.Fatalf("get vm: %v", err)
+	}
+	if got.Status != want {
+		t.Fatalf("db status = %q, want %q", got.Status, want)
+	}
+	info, ok := hv.VM(vm.HypervisorID)
+	if !ok || info.Status != want {
+		t.Fatalf("hypervisor status = %q, want %q", info.Status, want)
+	}
+}
+
+func TestVMServiceOwnership(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	if vm.UserID != owner.UserID {
+		t.Fatalf("vm owner = %d, want %d", vm.UserID, owner.UserID)
+	}
+
+	other := Principal{UserID: 2}
+	if vms, _ := s.ListVMs(ctx, other); len(vms) != 0 {
+		t.Fatalf("other user sees %d VMs", len(vms))
+	}
+	if got, err := s.GetVMByID(ctx, other, vm.ID); err != nil || got != nil {
+		t.Fatalf("other user get = %v, %v; want nil", got, err)
+	}
+	if err := s.StartVM(ctx, other, vm.ID); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("other user start = %v, want ErrVMNotFound", err)
+	}
+	if err := s.DeleteVM(ctx, other, vm.ID); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("other user delete = %v, want ErrVMNotFound", err)
+	}
+	if _, ok := hv.VM(vm.HypervisorID); !ok {
+		t.Fatal("guest deleted by another user")
+	}
+
+	admin := Principal{UserID: 99, Admin: true}
+	if vms, _ := s.ListVMs(ctx, admin); len(vms) != 1 {
+		t.Fatalf("admin sees %d VMs, want 1", len(vms))
+	}
+	if err := s.StartVM(ctx, admin, vm.ID); err != nil {
+		t.Fatalf("admin start: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+var (
+	ErrSnapshotNotFound    = errors.New("snapshot not found")
+	ErrSnapshotLimit       = errors.New("snapshot limit of the VM's plan reached")
+	ErrSnapshotNotReady    = errors.New("snapshot is still being created")
+	ErrResizeWithSnapshots = errors.New("disk cannot grow while the VM has snapshots")
+)
+
+type SnapshotCreateRequest struct {
+	Name string `json:"name" binding:"required,max=64"`
+}
+
+// snapshotStates are the VM states in which snapshots can be taken and
+// deleted. Reverting has its own state in the VM lifecycle.
+var snapshotStates = []string{model.VMStatusStopped, model.VMStatusRunning}
+
+// CreateSnapshot takes a snapshot of the VM's disk, and of its memory if
+// it is running. The VM's plan caps how many snapshots it may keep.
+func (s *VMService) CreateSnapshot(ctx context.Context, p Principal, vmID uint, req SnapshotCreateRequest) (*model.Snapshot, error) {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, vmID)
+	if err != nil {
+		return nil, err
+	}
+	_, plan, err := s.plan(vm.Plan)
+	if err != nil {
+		return nil, err
+	}
+	snap := &model.Snapshot{VMID: vm.ID, Name: req.Name, Tag: snapshotTag(), Status: model.SnapshotStatusCreating}
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Touching the VM row serialises snapshot requests for the VM, so
+		// concurrent ones cannot both pass the limit.
+		res := tx.Model(&model.VM{}).
+			Where("id = ? AND status IN ?", vm.ID, snapshotStates).
+			Update("updated_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("%w: vm %d cannot be snapshotted while %s", ErrInvalidTransition, vm.ID, vm.Status)
+		}
+		var n int64
+		if err := tx.Model(&model.Snapshot{}).Where("vm_id = ?", vm.ID).Count(&n).Error; err != nil {
+			return err
+		}
+		if int(n) >= plan.MaxSnapshots {
+			return ErrSnapshotLimit
+		}
+		return tx.Create(snap).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	db := s.db.WithContext(context.WithoutCancel(ctx))
+	if err := hv.CreateSnapshot(ctx, vm.HypervisorID, snap.Tag); err != nil {
+		// The call may have got as far as the disk.
+		_ = hv.DeleteSnapshot(context.WithoutCancel(ctx), vm.HypervisorID, snap.Tag)
+		_ = db.Delete(snap).Error
+		return nil, err
+	}
+	res := db.Model(snap).Where("status = ?", model.SnapshotStatusCreating).Update("status", model.SnapshotStatusReady)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		// Deleted while it was being taken.
+		_ = hv.DeleteSnapshot(context.WithoutCancel(ctx), vm.HypervisorID, snap.Tag)
+		return nil, ErrSnapshotNotFound
+	}
+	snap.Status = model.SnapshotStatusReady
+	return snap, nil
+}
+
+func (s *VMService) ListSnapshots(ctx context.Context, p Principal, vmID uint) ([]*model.Snapshot, error) {
+	if _, err := s.ownedVM(ctx, p, vmID); err != nil {
+		return nil, err
+	}
+	var snaps []*model.Snapshot
+	if err := s.db.WithContext(ctx).Where("vm_id = ?", vmID).Order("id").Find(&snaps).Error; err != nil {
+		return nil, err
+	}
+	return snaps, nil
+}
+
+// DeleteSnapshot also clears snapshots stuck in creating, so a create cut
+// short by a restart does not count against the limit forever.
+func (s *VMService) DeleteSnapshot(ctx context.Context, p Principal, vmID, id uint) error {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, vmID)
+	if err != nil {
+		return err
+	}
+	snap, err := s.snapshot(ctx, vm.ID, id)
+	if err != nil {
+		return err
+	}
+	if !inStates(vm.Status, snapshotStates) {
+		return fmt.Errorf("%w: vm %d cannot delete snapshots while %s", ErrInvalidTransition, vm.ID, vm.Status)
+	}
+	if err := hv.DeleteSnapshot(ctx, vm.HypervisorID, snap.Tag); err != nil && !errors.Is(err, hypervisor.ErrSnapshotNotFound) {
+		return err
+	}
+	return s.db.WithContext(context.WithoutCancel(ctx)).Delete(snap).Error
+}
+
+// RevertSnapshot rolls a stopped VM's disk back to a snapshot. A VM in
+// error can be reverted too, which is often the way out of it. The VM is
+// left stopped.
+func (s *VMService) RevertSnapshot(ctx context.Context, p Principal, vmID, id uint) error {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, vmID)
+	if err != nil {
+		return err
+	}
+	snap, err := s.snapshot(ctx, vm.ID, id)
+	if err != nil {
+		return err
+	}
+	if snap.Status != model.SnapshotStatusReady {
+		return ErrSnapshotNotReady
+	}
+	from := vm.Status
+	if err := s.transition(ctx, p, vm, model.VMStatusReverting, actionRevert, nil, nil); err != nil {
+		return err
+	}
+	err = hv.RevertSnapshot(ctx, vm.HypervisorID, snap.Tag)
+	// Unless the hypervisor refused up front, the disk may be half reverted.
+	failed := model.VMStatusError
+	if errors.Is(err, hypervisor.ErrSnapshotNotFound) || errors.Is(err, hypervisor.ErrVMRunning) {
+		failed = from
+	}
+	return s.settle(ctx, p, vm, actionRevert, model.VMStatusStopped, failed, err)
+}
+
+func (s *VMService) snapshot(ctx context.Context, vmID, id uint) (*model.Snapshot, error) {
+	var snap model.Snapshot
+	if err := s.db.WithContext(ctx).Where("vm_id = ?", vmID).First(&snap, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSnapshotNotFound
+		}
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// checkSnapshotResize refuses to grow the disk of a VM with snapshots;
+// qcow2 images cannot be resized while they hold internal snapshots.
+func (s *VMService) checkSnapshotResize(ctx context.Context, vm *model.VM, cfg hypervisor.VMConfig) error {
+	if cfg.DiskGB <= vm.DiskGB {
+		return nil
+	}
+	var n int64
+	if err := s.db.WithContext(ctx).Model(&model.Snapshot{}).Where("vm_id = ?", vm.ID).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrResizeWithSnapshots
+	}
+	return nil
+}
+
+// deleteSnapshots drops the rows of snapshots that went with the VM's disk.
+func deleteSnapshots(tx *gorm.DB, vmID uint) error {
+	return tx.Where("vm_id = ?", vmID).Delete(&model.Snapshot{}).Error
+}
+
+func inStates(status string, states []string) bool {
+	for _, s := range states {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func snapshotTag() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "snap-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestVMServiceSnapshots(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	s.WithPlans(map[string]Plan{"small": {MaxSnapshots: 2}})
+	vm, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "web", CPU: 1, MemoryMB: 1024, DiskGB: 20})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if vm, err = s.SetPlan(ctx, Principal{Admin: true}, vm.ID, PlanRequest{Plan: "small"}); err != nil || vm.Plan != "small" {
+		t.Fatalf("set plan: %v", err)
+	}
+
+	first, err := s.CreateSnapshot(ctx, owner, vm.ID, SnapshotCreateRequest{Name: "before upgrade"})
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if first.Status != model.SnapshotStatusReady || first.Tag == "" {
+		t.Fatalf("unexpected snapshot %+v", first)
+	}
+	// Running VMs can be snapshotted too.
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if _, err := s.CreateSnapshot(ctx, owner, vm.ID, SnapshotCreateRequest{Name: "live"}); err != nil {
+		t.Fatalf("live snapshot: %v", err)
+	}
+	if _, err := s.CreateSnapshot(ctx, owner, vm.ID, SnapshotCreateRequest{Name: "third"}); !errors.Is(err, ErrSnapshotLimit) {
+		t.Fatalf("expected ErrSnapshotLimit, got %v", err)
+	}
+	if hv.Snapshots(vm.HypervisorID) != 2 {
+		t.Fatalf("guest has %d snapshots, want 2", hv.Snapshots(vm.HypervisorID))
+	}
+
+	// Reverting is only allowed once the VM is stopped.
+	if err := s.RevertSnapshot(ctx, owner, vm.ID, first.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("revert of running VM = %v, want ErrInvalidTransition", err)
+	}
+	if err := s.StopVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if err := s.RevertSnapshot(ctx, owner, vm.ID, first.ID); err != nil {
+		t.Fatalf("revert: %v", err)
+	}
+	assertStatus(t, s, hv, vm, model.VMStatusStopped)
+	history, _ := s.History(ctx, owner, vm.ID)
+	if h := history[len(history)-2]; h.Action != actionRevert || h.ToStatus != model.VMStatusReverting {
+		t.Fatalf("unexpected transition %+v", h)
+	}
+
+	if err := s.ResizeVM(ctx, owner, vm.ID, hypervisor.VMConfig{CPU: 1, MemoryMB: 1024, DiskGB: 30}); !errors.Is(err, ErrResizeWithSnapshots) {
+		t.Fatalf("expected ErrResizeWithSnapshots, got %v", err)
+	}
+
+	if err := s.DeleteSnapshot(ctx, owner, vm.ID, first.ID); err != nil {
+		t.Fatalf("delete snapshot: %v", err)
+	}
+	if err := s.DeleteSnapshot(ctx, owner, vm.ID, first.ID); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expected ErrSnapshotNotFound, got %v", err)
+	}
+	snaps, err := s.ListSnapshots(ctx, owner, vm.ID)
+	if err != nil || len(snaps) != 1 || snaps[0].Name != "live" {
+		t.Fatalf("unexpected snapshots %+v (%v)", snaps, err)
+	}
+
+	if err := s.DeleteVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("delete vm: %v", err)
+	}
+	var left int64
+	s.db.Model(&model.Snapshot{}).Count(&left)
+	if left != 0 {
+		t.Fatalf("%d snapshot rows left after deleting the VM", left)
+	}
+}
+
+func TestVMServiceSnapshotFailures(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+
+	admin := Principal{UserID: owner.UserID, Admin: true}
+	if _, err := s.CreateVM(ctx, admin, VMCreateRequest{Name: "db", CPU: 1, MemoryMB: 512, DiskGB: 10, Plan: "huge"}); !errors.Is(err, ErrUnknownPlan) {
+		t.Fatalf("expected ErrUnknownPlan, got %v", err)
+	}
+	// Users cannot buy themselves a bigger plan.
+	if _, err := s.CreateVM(ctx, owner, VMCreateRequest{Name: "db", CPU: 1, MemoryMB: 512, DiskGB: 10, Plan: DefaultPlan}); !errors.Is(err, ErrPlanAdminOnly) {
+		t.Fatalf("expected ErrPlanAdminOnly for a plan picked by a user, got %v", err)
+	}
+	if _, err := s.SetPlan(ctx, owner, vm.ID, PlanRequest{Plan: DefaultPlan}); !errors.Is(err, ErrPlanAdminOnly) {
+		t.Fatalf("expected ErrPlanAdminOnly for a plan change by a user, got %v", err)
+	}
+
+	hv.Inject(hypervisor.MethodCreateSnapshot, hypervisor.Fault{Err: errInjected, Times: 1})
+	if _, err := s.CreateSnapshot(ctx, owner, vm.ID, SnapshotCreateRequest{Name: "x"}); !errors.Is(err, errInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	if snaps, _ := s.ListSnapshots(ctx, owner, vm.ID); len(snaps) != 0 {
+		t.Fatalf("failed snapshot left a row: %+v", snaps)
+	}
+
+	snap, err := s.CreateSnapshot(ctx, owner, vm.ID, SnapshotCreateRequest{Name: "x"})
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	stranger := Principal{UserID: 2}
+	if _, err := s.ListSnapshots(ctx, stranger, vm.ID); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("expected ErrVMNotFound for another user, got %v", err)
+	}
+	if err := s.RevertSnapshot(ctx, stranger, vm.ID, snap.ID); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("expected ErrVMNotFound for another user, got %v", err)
+	}
+
+	// A failed revert may have left the disk half written.
+	hv.Inject(hypervisor.MethodRevertSnapshot, hypervisor.Fault{Err: errInjected, Times: 1})
+	if err := s.RevertSnapshot(ctx, owner, vm.ID, snap.ID); !errors.Is(err, errInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	if got, _ := s.GetVMByID(ctx, owner, vm.ID); got.Status != model.VMStatusError {
+		t.Fatalf("status = %s, want error", got.Status)
+	}
+	if err := s.RevertSnapshot(ctx, owner, vm.ID, snap.ID); err != nil {
+		t.Fatalf("revert from error: %v", err)
+	}
+	assertStatus(t, s, hv, vm, model.VMStatusStopped)
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+var (
+	ErrInvalidTransition  = errors.New("operation not allowed in the VM's current state")
+	ErrHotplugUnsupported = errors.New("changing CPU or memory of a running VM needs hotplug support")
+	ErrVMSuspended        = errors.New("VM is suspended")
+)
+
+// TransitionError reports an operation that the VM's current state does not
+// allow. It matches ErrInvalidTransition under errors.Is.
+type TransitionError struct {
+	VMID uint
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("vm %d cannot go from %s to %s", e.VMID, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+// vmTransitions lists, for each state, the states it may move to.
+// Transitional states fall back to where they came from or to error when
+// their operation fails. Suspended is a stopped VM the platform holds, such
+// as for going over a quota; only admins can start it.
+var vmTransitions = map[string][]string{
+	model.VMStatusCreating:     {model.VMStatusStopped, model.VMStatusError},
+	model.VMStatusStopped:      {model.VMStatusStarting, model.VMStatusResizing, model.VMStatusReinstalling, model.VMStatusReverting, model.VMStatusBackingUp, model.VMStatusRestoring, model.VMStatusDeleting, model.VMStatusSuspended},
+	model.VMStatusStarting:     {model.VMStatusRunning, model.VMStatusStopped, model.VMStatusStopping, model.VMStatusSuspended, model.VMStatusError},
+	model.VMStatusRunning:      {model.VMStatusStopping, model.VMStatusResizing, model.VMStatusReinstalling, model.VMStatusBackingUp, model.VMStatusDeleting, model.VMStatusError},
+	model.VMStatusStopping:     {model.VMStatusStopped, model.VMStatusRunning, model.VMStatusSuspended, model.VMStatusError},
+	model.VMStatusResizing:     {model.VMStatusStopped, model.VMStatusRunning, model.VMStatusError},
+	model.VMStatusReinstalling: {model.VMStatusStopped, model.VMStatusRunning, model.VMStatusError},
+	model.VMStatusReverting:    {model.VMStatusStopped, model.VMStatusError},
+	model.VMStatusBackingUp:    {model.VMStatusStopped, model.VMStatusRunning, model.VMStatusError},
+	model.VMStatusRestoring:    {model.VMStatusStopped, model.VMStatusError},
+	model.VMStatusDeleting:     {model.VMStatusStopped, model.VMStatusRunning, model.VMStatusSuspended, model.VMStatusError},
+	model.VMStatusError:        {model.VMStatusStarting, model.VMStatusStopping, model.VMStatusReinstalling, model.VMStatusReverting, model.VMStatusRestoring, model.VMStatusDeleting},
+	model.VMStatusSuspended:    {model.VMStatusStarting, model.VMStatusStopped, model.VMStatusDeleting, model.VMStatusError},
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range vmTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition actions recorded in the history.
+const (
+	actionCreate    = "create"
+	actionStart     = "start"
+	actionStop      = "stop"
+	actionForceStop = "force-stop"
+	actionResize    = "resize"
+	actionReinstall = "reinstall"
+	actionRevert    = "revert"
+	actionBackup    = "backup"
+	actionRestore   = "restore"
+	actionDelete    = "delete"
+	actionReconcile = "reconcile"
+	actionSuspend   = "suspend"
+	actionUnsuspend = "unsuspend"
+)
+
+// transition moves vm to status `to` and records it in the history. The
+// update is conditional on the status vm was loaded with, so of two
+// concurrent operations only one gets to start. extra holds further columns
+// to update in the same statement.
+func (s *VMService) transition(ctx context.Context, actor Principal, vm *model.VM, to, action string, cause error, extra map[string]interface{}) error {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return applyTransition(tx, actor, vm, to, action, cause, extra)
+	})
+	if err != nil {
+		return err
+	}
+	vm.Status = to
+	return nil
+}
+
+// applyTransition is transition within a caller's transaction. It leaves
+// vm untouched; the caller updates it once the transaction commits.
+func applyTransition(tx *gorm.DB, actor Principal, vm *model.VM, to, action string, cause error, extra map[string]interface{}) error {
+	from := vm.Status
+	if !canTransition(from, to) {
+		return &TransitionError{VMID: vm.ID, From: from, To: to}
+	}
+	updates := map[string]interface{}{"status": to, "updated_at": time.Now()}
+	for k, v := range extra {
+		updates[k] = v
+	}
+	record := &model.VMTransition{VMID: vm.ID, FromStatus: from, ToStatus: to, Action: action, ActorID: actor.UserID}
+	if cause != nil {
+		record.Error = cause.Error()
+	}
+	res := tx.Model(&model.VM{}).Where("id = ? AND status = ?", vm.ID, from).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &TransitionError{VMID: vm.ID, From: from, To: to}
+	}
+	return tx.Create(record).Error
+}
+
+// settle ends an operation started with transition: it moves vm to `ok`
+// when opErr is nil and to `failed` otherwise, and returns opErr. It runs
+// even if ctx was cancelled, so a VM is never left in a transitional state
+// because the caller gave up.
+func (s *VMService) settle(ctx context.Context, actor Principal, vm *model.VM, action, ok, failed string, opErr error) error {
+	to := ok
+	if opErr != nil {
+		to = failed
+	}
+	if err := s.transition(context.WithoutCancel(ctx), actor, vm, to, action, opErr, nil); err != nil && opErr == nil {
+		return err
+	}
+	return opErr
+}
+
+// reconcileStatus forces vm to status `to`, bypassing the transition table,
+// because the hypervisor has already put the guest there. It reports false
+// without error if an operation moved the VM on since it was loaded.
+func (s *VMService) reconcileStatus(ctx context.Context, vm *model.VM, to, reason string) (bool, error) {
+	from := vm.Status
+	record := &model.VMTransition{VMID: vm.ID, FromStatus: from, ToStatus: to, Action: actionReconcile, Error: reason}
+	updated := false
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&model.VM{}).
+			Where("id = ? AND status = ?", vm.ID, from).
+			Updates(map[string]interface{}{"status": to, "updated_at": time.Now()})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		updated = true
+		return tx.Create(record).Error
+	})
+	if err != nil || !updated {
+		return false, err
+	}
+	vm.Status = to
+	return true, nil
+}
+
+// suspend holds vm stopped, shutting its guest down first if it runs.
+func (s *VMService) suspend(ctx context.Context, actor Principal, vm *model.VM) error {
+	if vm.Status != model.VMStatusRunning {
+		return s.transition(ctx, actor, vm, model.VMStatusSuspended, actionSuspend, nil, nil)
+	}
+	hv, err := s.nodeHypervisor(s.db.WithContext(ctx), vm.NodeID)
+	if err != nil {
+		return err
+	}
+	if err := s.transition(ctx, actor, vm, model.VMStatusStopping, actionSuspend, nil, nil); err != nil {
+		return err
+	}
+	err = hv.StopVM(ctx, vm.HypervisorID)
+	return s.settle(ctx, actor, vm, actionSuspend, model.VMStatusSuspended, model.VMStatusRunning, err)
+}
+
+// unsuspend releases a suspended VM, leaving it stopped for its owner to
+// start.
+func (s *VMService) unsuspend(ctx context.Context, actor Principal, vm *model.VM) error {
+	return s.transition(ctx, actor, vm, model.VMStatusStopped, actionUnsuspend, nil, nil)
+}
+
+// checkResize rejects resizes the VM's state or hypervisor cannot honour.
+func checkResize(vm *model.VM, hv hypervisor.Hypervisor, cfg hypervisor.VMConfig) error {
+	if !canTransition(vm.Status, model.VMStatusResizing) {
+		return &TransitionError{VMID: vm.ID, From: vm.Status, To: model.VMStatusResizing}
+	}
+	if vm.Status != model.VMStatusRunning {
+		return nil
+	}
+	if cfg.CPU == vm.CPU && cfg.MemoryMB == vm.MemoryMB {
+		return nil
+	}
+	if hp, ok := hv.(hypervisor.HotplugSupport); ok && hp.SupportsHotplug() {
+		return nil
+	}
+	return ErrHotplugUnsupported
+}
+
+func (s *VMService) History(ctx context.Context, p Principal, id uint) ([]*model.VMTransition, error) {
+	if _, err := s.ownedVM(ctx, p, id); err != nil {
+		return nil, err
+	}
+	var history []*model.VMTransition
+	if err := s.db.WithContext(ctx).Where("vm_id = ?", id).Order("id").Find(&history).Error; err != nil {
+		return nil, err
+	}
+	return history, nil
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+func TestVMStateRejectsIllegalOperations(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+
+	if err := s.StopVM(ctx, owner, vm.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("stop of stopped VM = %v, want ErrInvalidTransition", err)
+	}
+	if err := s.RebootVM(ctx, owner, vm.ID); !errors.Is(err, hypervisor.ErrVMNotRunning) {
+		t.Fatalf("reboot of stopped VM = %v, want ErrVMNotRunning", err)
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("start of running VM = %v, want ErrInvalidTransition", err)
+	}
+	if hv.Calls(hypervisor.MethodStartVM) != 1 || hv.Calls(hypervisor.MethodStopVM) != 0 {
+		t.Fatal("rejected operations reached the hypervisor")
+	}
+}
+
+func TestVMStateResizeRunningNeedsHotplug(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	err := s.ResizeVM(ctx, owner, vm.ID, hypervisor.VMConfig{CPU: 4, MemoryMB: vm.MemoryMB, DiskGB: vm.DiskGB})
+	if !errors.Is(err, ErrHotplugUnsupported) {
+		t.Fatalf("cpu resize of running VM = %v, want ErrHotplugUnsupported", err)
+	}
+	// Growing the disk works online.
+	if err := s.ResizeVM(ctx, owner, vm.ID, hypervisor.VMConfig{CPU: vm.CPU, MemoryMB: vm.MemoryMB, DiskGB: 40}); err != nil {
+		t.Fatalf("online disk resize: %v", err)
+	}
+	assertStatus(t, s, hv, vm, model.VMStatusRunning)
+}
+
+func TestVMStateHistory(t *testing.T) {
+	s, _, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	admin := Principal{UserID: 7, Admin: true}
+	if err := s.StartVM(ctx, admin, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	history, err := s.History(ctx, owner, vm.ID)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	want := []struct {
+		from, to string
+		actor    uint
+	}{
+		{"", model.VMStatusCreating, owner.UserID},
+		{model.VMStatusCreating, model.VMStatusStopped, owner.UserID},
+		{model.VMStatusStopped, model.VMStatusStarting, admin.UserID},
+		{model.VMStatusStarting, model.VMStatusRunning, admin.UserID},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("got %d transitions, want %d", len(history), len(want))
+	}
+	for i, w := range want {
+		h := history[i]
+		if h.FromStatus != w.from || h.ToStatus != w.to || h.ActorID != w.actor {
+			t.Fatalf("transition %d = %+v, want %+v", i, h, w)
+		}
+	}
+
+	if _, err := s.History(ctx, Principal{UserID: 2}, vm.ID); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("history for other user = %v, want ErrVMNotFound", err)
+	}
+}
+
+func TestVMStateStaleTransitionLoses(t *testing.T) {
+	s, _, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+
+	// Another request already moved the VM on; the stale copy must lose.
+	stale := *vm
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := s.transition(ctx, owner, &stale, model.VMStatusStarting, actionStart, nil, nil); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("stale transition = %v, want ErrInvalidTransition", err)
+	}
+}
+
+func TestVMStateFailureRecordsError(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	hv.Inject(hypervisor.MethodStartVM, hypervisor.Fault{Err: errInjected})
+
+	if err := s.StartVM(ctx, owner, vm.ID); !errors.Is(err, errInjected) {
+		t.Fatalf("start = %v, want injected error", err)
+	}
+	history, _ := s.History(ctx, owner, vm.ID)
+	last := history[len(history)-1]
+	if last.FromStatus != model.VMStatusStarting || last.ToStatus != model.VMStatusStopped || last.Error != errInjected.Error() {
+		t.Fatalf("failed start recorded as %+v", last)
+	}
+}
+
+func TestVMStateSuspend(t *testing.T) {
+	s, hv, _ := newTestVMService(t)
+	vm := createTestVM(t, s)
+	admin := Principal{UserID: 7, Admin: true}
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	// A running VM is shut down first.
+	vm, _ = s.GetVMByID(ctx, owner, vm.ID)
+	if err := s.suspend(ctx, admin, vm); err != nil {
+		t.Fatalf("suspend: %v", err)
+	}
+	if got, _ := s.GetVMByID(ctx, owner, vm.ID); got.Status != model.VMStatusSuspended {
+		t.Fatalf("db status = %q, want suspended", got.Status)
+	}
+	if info, _ := hv.VM(vm.HypervisorID); info.Status != "stopped" {
+		t.Fatalf("guest of suspended VM is %s", info.Status)
+	}
+	if report, _ := NewReconciler(s, time.Minute).Reconcile(ctx, discardf); len(report.Discrepancies) != 0 {
+		t.Fatalf("suspended VM reported as %+v", report.Discrepancies[0])
+	}
+	if err := s.StartVM(ctx, owner, vm.ID); !errors.Is(err, ErrVMSuspended) {
+		t.Fatalf("owner start of suspended VM = %v, want ErrVMSuspended", err)
+	}
+	if err := s.StopVM(ctx, owner, vm.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("stop of suspended VM = %v, want ErrInvalidTransition", err)
+	}
+	if err := s.StartVM(ctx, admin, vm.ID); err != nil {
+		t.Fatalf("admin start of suspended VM: %v", err)
+	}
+	assertStatus(t, s, hv, vm, model.VMStatusRunning)
+
+	vm, _ = s.GetVMByID(ctx, owner, vm.ID)
+	if err := s.suspend(ctx, admin, vm); err != nil {
+		t.Fatalf("suspend: %v", err)
+	}
+	if err := s.unsuspend(ctx, admin, vm); err != nil {
+		t.Fatalf("unsuspend: %v", err)
+	}
+	assertStatus(t, s, hv, vm, model.VMStatusStopped)
+	if err := s.StartVM(ctx, owner, vm.ID); err != nil {
+		t.Fatalf("owner start after unsuspend: %v", err)
+	}
+}
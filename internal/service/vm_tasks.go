@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+
+	"gorm.io/gorm"
+
+	"StarstreamAstra/internal/cloudinit"
+	"StarstreamAstra/internal/hypervisor"
+	"StarstreamAstra/internal/model"
+)
+
+const (
+	TaskVMCreate    = "vm.create"
+	TaskVMResize    = "vm.resize"
+	TaskVMDelete    = "vm.delete"
+	TaskVMReinstall = "vm.reinstall"
+)
+
+// vmTaskPayload is what VM tasks persist: the acting principal, so the
+// worker applies the same ownership rules as the request did, plus the
+// operation's own arguments. The VM itself is the task's VMID.
+type vmTaskPayload struct {
+	Principal Principal            `json:"principal"`
+	Create    *VMCreateRequest     `json:"create,omitempty"`
+	Resize    *hypervisor.VMConfig `json:"resize,omitempty"`
+	ImageID   *uint                `json:"image_id,omitempty"`
+	CloudInit *cloudinit.Config    `json:"cloud_init,omitempty"`
+}
+
+// RegisterTasks installs the handlers for VM tasks on tasks and makes the
+// *Async methods available.
+func (s *VMService) RegisterTasks(tasks *TaskService) {
+	s.tasks = tasks
+	tasks.Handle(TaskVMCreate, s.runCreateTask)
+	tasks.Handle(TaskVMResize, s.runResizeTask)
+	tasks.Handle(TaskVMDelete, s.runDeleteTask)
+	tasks.Handle(TaskVMReinstall, s.runReinstallTask)
+}
+
+// CreateVMAsync records the VM in the creating state right away, together
+// with the task that builds it, so it is listed meanwhile.
+func (s *VMService) CreateVMAsync(ctx context.Context, p Principal, req VMCreateRequest) (*model.Task, error) {
+	ci, err := s.cloudInitFor(ctx, p, req.Name, req.ImageID, req.GuestSetup)
+	if err != nil {
+		return nil, err
+	}
+	var task *model.Task
+	_, err = s.insertVM(ctx, p, req, func(tx *gorm.DB, vm *model.VM) (err error) {
+		task, err = s.tasks.enqueue(tx, p, TaskVMCreate, &vm.ID, vmTaskPayload{Principal: p, CloudInit: ci})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.tasks.notify()
+	return task, nil
+}
+
+// ResizeVMAsync and DeleteVMAsync check ownership and state up front so
+// that requests which cannot succeed are refused instead of queued.
+func (s *VMService) ResizeVMAsync(ctx context.Context, p Principal, id uint, cfg hypervisor.VMConfig) (*model.Task, error) {
+	vm, hv, err := s.vmAndHypervisor(ctx, p, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResize(vm, hv, cfg); err != nil {
+		return nil, err
+	}
+	if err := s.checkSnapshotResize(ctx, vm, cfg); err != nil {
+		return nil, err
+	}
+	return s.tasks.Enqueue(ctx, p, TaskVMResize, &id, vmTaskPayload{Principal: p, Resize: &cfg})
+}
+
+func (s *VMService) DeleteVMAsync(ctx context.Context, p Principal, id uint) (*model.Task, error) {
+	vm, err := s.ownedVM(ctx, p, id)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Status != model.VMStatusDeleting && !canTransition(vm.Status, model.VMStatusDeleting) {
+		return nil, &TransitionError{VMID: vm.ID, From: vm.Status, To: model.VMStatusDeleting}
+	}
+	return s.tasks.Enqueue(ctx, p, TaskVMDelete, &id, vmTaskPayload{Principal: p})
+}
+
+// ReinstallVMAsync checks the request up front like ResizeVMAsync. The
+// password is hashed before the task is stored.
+func (s *VMService) ReinstallVMAsync(ctx context.Context, p Principal, id uint, req VMReinstallRequest) (*model.Task, error) {
+	vm, err := s.ownedVM(ctx, p, id)
+	if err != nil {
+		return nil, err
+	}
+	ci, err := s.prepareReinstall(ctx, p, vm, req)
+	if err != nil {
+		return nil, err
+	}
+	return s.tasks.Enqueue(ctx, p, TaskVMReinstall, &id, vmTaskPayload{Principal: p, ImageID: &req.ImageID, CloudInit: ci})
+}
+
+func decodeVMTask(task *model.Task) (vmTaskPayload, error) {
+	var payload vmTaskPayload
+	err := json.Unmarshal(task.Payload, &payload)
+	return payload, err
+}
+
+func (s *VMService) runCreateTask(ctx context.Context, task *model.Task, progress func(int)) (interface{}, error) {
+	payload, err := decodeVMTask(task)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := s.ownedVM(ctx, payload.Principal, *task.VMID)
+	if err != nil {
+		return nil, err
+	}
+	progress(10)
+	if vm.Status == model.VMStatusCreating {
+		if err := s.provision(ctx, payload.Principal, vm, payload.CloudInit); err != nil {
+			return nil, err
+		}
+		return vm, nil
+	}
+	// A rerun after a restart finds the VM already built. A VM that never
+	// got a guest, such as one the reconciler gave up on, was not created.
+	if vm.Status == model.VMStatusError || vm.Status == model.VMStatusDeleting || isPendingHypervisorID(vm.HypervisorID) {
+		return nil, &TransitionError{VMID: vm.ID, From: vm.Status, To: model.VMStatusStopped}
+	}
+	return vm, nil
+}
+
+func (s *VMService) runResizeTask(ctx context.Context, task *model.Task, progress func(int)) (interface{}, error) {
+	payload, err := decodeVMTask(task)
+	if err != nil {
+		return nil, err
+	}
+	progress(10)
+	if err := s.ResizeVM(ctx, payload.Principal, *task.VMID, *payload.Resize); err != nil {
+		return nil, err
+	}
+	return s.ownedVM(ctx, payload.Principal, *task.VMID)
+}
+
+func (s *VMService) runDeleteTask(ctx context.Context, task *model.Task, progress func(int)) (interface{}, error) {
+	payload, err := decodeVMTask(task)
+	if err != nil {
+		return nil, err
+	}
+	progress(10)
+	return nil, s.DeleteVM(ctx, payload.Principal, *task.VMID)
+}
+
+func (s *VMService) runReinstallTask(ctx context.Context, task *model.Task, progress func(int)) (interface{}, error) {
+	payload, err := decodeVMTask(task)
+	if err != nil {
+		return nil, err
+	}
+	vm, hv, err := s.vmAndHypervisor(ctx, payload.Principal, *task.VMID)
+	if err != nil {
+		return nil, err
+	}
+	progress(10)
+	if err := s.reinstall(ctx, payload.Principal, vm, hv, *payload.ImageID, payload.CloudInit); err != nil {
+		return nil, err
+	}
+	return s.ownedVM(ctx, payload.Principal, *task.VMID)
+}